@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"go-proxy/internal/logger"
+)
+
+// benchSize is the payload of benchmark requests, as with -size
+const benchSize = 1024
+
+var (
+	benchOnce sync.Once
+	benchOpts options
+	benchErr  error
+)
+
+// startBench starts the in-process proxy and echo origin the benchmarks
+// share
+func startBench(b *testing.B) options {
+	benchOnce.Do(func() {
+		logger.SetLevel(logger.LevelError)
+		benchOpts.size = benchSize
+		if benchOpts.origin, benchErr = startEchoOrigin(); benchErr != nil {
+			return
+		}
+		benchOpts.proxyHTTP, benchOpts.proxyHTTPS, benchErr = startProxy()
+	})
+	if benchErr != nil {
+		b.Fatalf("Failed to start the proxy: %v", benchErr)
+	}
+	return benchOpts
+}
+
+// benchmark runs the workers newWorker creates in parallel, one request
+// per iteration
+func benchmark(b *testing.B, newWorker func(options) worker) {
+	opts := startBench(b)
+	b.ReportAllocs()
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := newWorker(opts)
+		for pb.Next() {
+			if _, err := w.do(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkHTTP(b *testing.B) {
+	benchmark(b, newHTTPWorker)
+}
+
+func BenchmarkConnect(b *testing.B) {
+	benchmark(b, newConnectWorker)
+}
@@ -0,0 +1,200 @@
+// Command loadgen drives HTTP and CONNECT traffic through the proxy and
+// reports throughput, latency and allocations. Without -proxy it starts the
+// proxy handlers and an echo origin in-process, so results are comparable
+// between commits without Redis or network access. The same traffic runs
+// as Go benchmarks with go test -bench . ./cmd/loadgen.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/proxy"
+)
+
+type options struct {
+	proxyHTTP   string // host:port of the plain HTTP proxy listener
+	proxyHTTPS  string // host:port of the CONNECT listener
+	origin      string // host:port of the echo origin
+	mode        string
+	concurrency int
+	duration    time.Duration
+	requests    int
+	size        int
+}
+
+// result collects per-request measurements from all workers
+type result struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+	errors    atomic.Int64
+	bytes     atomic.Int64
+}
+
+func (r *result) record(d time.Duration, bytes int) {
+	r.bytes.Add(int64(bytes))
+	r.mutex.Lock()
+	r.latencies = append(r.latencies, d)
+	r.mutex.Unlock()
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.proxyHTTP, "proxy", "", "HTTP proxy address to test (default: start the proxy in-process)")
+	flag.StringVar(&opts.proxyHTTPS, "proxy-connect", "", "CONNECT proxy address (default: same as -proxy)")
+	flag.StringVar(&opts.origin, "origin", "", "Echo origin address (default: start one in-process)")
+	flag.StringVar(&opts.mode, "mode", "http", "Traffic to generate: http, connect or both")
+	flag.IntVar(&opts.concurrency, "c", 32, "Concurrent workers")
+	flag.DurationVar(&opts.duration, "d", 10*time.Second, "Test duration (ignored when -n is set)")
+	flag.IntVar(&opts.requests, "n", 0, "Total requests per mode (0 runs for -d)")
+	flag.IntVar(&opts.size, "size", 1024, "Response body / tunnel payload size in bytes")
+	flag.Parse()
+
+	// Keep the proxy's own logging out of the measurements
+	logger.SetLevel(logger.LevelError)
+
+	if opts.origin == "" {
+		addr, err := startEchoOrigin()
+		if err != nil {
+			log.Fatalf("Failed to start echo origin: %v", err)
+		}
+		opts.origin = addr
+	}
+	if opts.proxyHTTP == "" {
+		httpAddr, connectAddr, err := startProxy()
+		if err != nil {
+			log.Fatalf("Failed to start in-process proxy: %v", err)
+		}
+		opts.proxyHTTP, opts.proxyHTTPS = httpAddr, connectAddr
+	}
+	if opts.proxyHTTPS == "" {
+		opts.proxyHTTPS = opts.proxyHTTP
+	}
+
+	var modes []string
+	switch opts.mode {
+	case "http", "connect":
+		modes = []string{opts.mode}
+	case "both":
+		modes = []string{"http", "connect"}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mode %q\n", opts.mode)
+		os.Exit(2)
+	}
+
+	for _, mode := range modes {
+		run(mode, opts)
+	}
+}
+
+// startProxy serves the proxy handlers on ephemeral ports the same way
+// cmd/proxy wires them
+func startProxy() (string, string, error) {
+	cfg, err := config.Load([]string{"-geo-enabled=false"})
+	if err != nil {
+		return "", "", err
+	}
+	server := proxy.NewServer(cfg, proxy.Deps{Log: logger.Discard()})
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", err
+	}
+	connectListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", err
+	}
+
+	go http.Serve(httpListener, http.HandlerFunc(server.HandleHTTP))
+	go http.Serve(connectListener, server)
+	return httpListener.Addr().String(), connectListener.Addr().String(), nil
+}
+
+// run executes one mode and prints its report
+func run(mode string, opts options) {
+	res := &result{}
+	var issued atomic.Int64
+	deadline := time.Now().Add(opts.duration)
+
+	next := func() bool {
+		if opts.requests > 0 {
+			return issued.Add(1) <= int64(opts.requests)
+		}
+		return time.Now().Before(deadline)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var w worker
+			if mode == "http" {
+				w = newHTTPWorker(opts)
+			} else {
+				w = newConnectWorker(opts)
+			}
+			for next() {
+				begin := time.Now()
+				n, err := w.do()
+				if err != nil {
+					res.errors.Add(1)
+					continue
+				}
+				res.record(time.Since(begin), n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	report(mode, opts, res, elapsed, &before, &after)
+}
+
+func report(mode string, opts options, res *result, elapsed time.Duration, before, after *runtime.MemStats) {
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	count := len(res.latencies)
+
+	target := opts.proxyHTTP
+	if mode == "connect" {
+		target = opts.proxyHTTPS
+	}
+	fmt.Printf("\n=== %s via %s (%d workers, %d byte payload) ===\n", mode, target, opts.concurrency, opts.size)
+	fmt.Printf("Requests:    %d ok, %d errors in %v\n", count, res.errors.Load(), elapsed.Round(time.Millisecond))
+	if count == 0 {
+		return
+	}
+	fmt.Printf("Throughput:  %.0f req/s, %.2f MB/s\n",
+		float64(count)/elapsed.Seconds(),
+		float64(res.bytes.Load())/elapsed.Seconds()/(1<<20))
+	fmt.Printf("Latency:     p50 %v  p90 %v  p99 %v  max %v\n",
+		percentile(res.latencies, 0.50), percentile(res.latencies, 0.90),
+		percentile(res.latencies, 0.99), percentile(res.latencies, 1))
+
+	// Includes the load generator itself; compare runs, not absolutes
+	fmt.Printf("Allocations: %.1f allocs/req, %.0f B/req (process wide)\n",
+		float64(after.Mallocs-before.Mallocs)/float64(count),
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(count))
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx].Round(time.Microsecond)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// worker issues one request per call and returns the bytes received
+type worker interface {
+	do() (int, error)
+}
+
+// httpWorker sends plain GETs through the proxy over a keep-alive client
+type httpWorker struct {
+	client *http.Client
+	url    string
+}
+
+func newHTTPWorker(opts options) worker {
+	proxyURL := &url.URL{Scheme: "http", Host: opts.proxyHTTP}
+	return &httpWorker{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyURL(proxyURL),
+				MaxIdleConnsPerHost: 1,
+			},
+			Timeout: 30 * time.Second,
+		},
+		url: fmt.Sprintf("http://%s/?size=%d", opts.origin, opts.size),
+	}
+}
+
+func (w *httpWorker) do() (int, error) {
+	resp, err := w.client.Get(w.url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return int(n), err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return int(n), fmt.Errorf("status %s", resp.Status)
+	}
+	return int(n), nil
+}
+
+// connectWorker opens a new CONNECT tunnel per request, which is what
+// browsers do for every HTTPS origin, and echoes a payload through it
+type connectWorker struct {
+	proxy   string
+	origin  string
+	payload []byte
+	buf     []byte
+}
+
+func newConnectWorker(opts options) worker {
+	return &connectWorker{
+		proxy:   opts.proxyHTTPS,
+		origin:  opts.origin,
+		payload: bytes.Repeat([]byte("x"), opts.size),
+		buf:     make([]byte, opts.size),
+	}
+}
+
+func (w *connectWorker) do() (int, error) {
+	conn, err := net.DialTimeout("tcp", w.proxy, 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", w.origin, w.origin)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("CONNECT status %s", resp.Status)
+	}
+
+	// The echo origin answers raw bytes on tunnelled connections
+	if _, err := conn.Write(w.payload); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(reader, w.buf)
+	return n, err
+}
+
+// startEchoOrigin serves sized HTTP responses and echoes raw TCP streams
+// that don't start with an HTTP request line
+func startEchoOrigin() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	httpConns := make(chan net.Conn)
+	go http.Serve(&chanListener{conns: httpConns, addr: listener.Addr()}, http.HandlerFunc(serveSized))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				peeked := &peekConn{Conn: conn, reader: bufio.NewReader(conn)}
+				first, err := peeked.reader.Peek(1)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if first[0] == 'x' {
+					io.Copy(conn, peeked.reader)
+					conn.Close()
+					return
+				}
+				httpConns <- peeked
+			}()
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// serveSized answers with a body of ?size= bytes
+func serveSized(w http.ResponseWriter, r *http.Request) {
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Write(bytes.Repeat([]byte("x"), size))
+}
+
+// peekConn is a net.Conn whose first bytes were already buffered
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// chanListener hands pre-accepted connections to http.Serve
+type chanListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *chanListener) Close() error {
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,67 @@
+// Command migrate upgrades the stats records in Redis to the schema the
+// current proxy expects. Migrations are applied in place and in order, and
+// the applied version is stored in Redis, so it is safe to rerun. Use
+// -dry-run first to see how many keys each migration would change.
+//
+//	migrate -redis-addr localhost:6379 -dry-run
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"go-proxy/internal/storage"
+)
+
+func main() {
+	var redisOpts storage.RedisOptions
+	redisOpts.RegisterFlags(flag.CommandLine)
+	dryRun := flag.Bool("dry-run", false, "Report what would change without writing")
+	flag.Parse()
+
+	store, err := storage.NewRedisStore(redisOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+	latest := storage.Migrations[len(storage.Migrations)-1].Version
+	fmt.Printf("Schema version %d, latest %d\n", version, latest)
+	if version >= latest {
+		fmt.Println("Nothing to do")
+		return
+	}
+	for _, m := range storage.Migrations {
+		if m.Version > version {
+			fmt.Printf("  %d: %s\n", m.Version, m.Description)
+		}
+	}
+
+	verb := "upgraded"
+	if *dryRun {
+		verb = "to upgrade"
+	}
+	last := 0
+	results, err := store.Migrate(*dryRun, func(p storage.MigrationProgress) {
+		if last != 0 && p.Version != last {
+			fmt.Println()
+		}
+		last = p.Version
+		fmt.Printf("\rMigration %d: %d keys scanned, %d %s", p.Version, p.Scanned, p.Upgraded, verb)
+	})
+	fmt.Println()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: %d migration(s) checked, nothing written\n", len(results))
+		return
+	}
+	fmt.Printf("Done: schema is at version %d\n", latest)
+}
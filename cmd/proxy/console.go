@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// quiet suppresses console status output when set (-quiet)
+var quiet atomic.Bool
+
+// console prints a status message to stdout unless running quiet
+func console(format string, args ...interface{}) {
+	if quiet.Load() {
+		return
+	}
+	fmt.Printf(format, args...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/systemd"
+	"go-proxy/internal/upgrade"
+)
+
+// upgradeReadyTimeout bounds how long we wait for a new binary to come up
+const upgradeReadyTimeout = 30 * time.Second
+
+// Listener names, used for systemd FileDescriptorName= and upgrades
+const (
+	listenerHTTP  = "http"
+	listenerHTTPS = "https"
+	listenerTLS   = "tls"
+	listenerSOCKS = "socks"
+)
+
+// startUpgrade launches the (possibly replaced) executable with our
+// listeners. Once it returns nil the new process is serving and this one
+// should drain and exit.
+func startUpgrade(listeners map[string]net.Listener) error {
+	console("🔁 Upgrade requested, starting new process...\n")
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ordered := make([]net.Listener, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, listeners[name])
+	}
+
+	process, err := upgrade.Spawn(names, ordered, upgradeReadyTimeout)
+	if err != nil {
+		return err
+	}
+
+	logger.Log("Upgrade: new process %d is serving, draining this one", process.Pid)
+	console("✅ New process %d is serving\n", process.Pid)
+
+	// Under systemd the new process becomes the service's main process
+	systemd.Notify(fmt.Sprintf("MAINPID=%d", process.Pid))
+	return nil
+}
+
+// openListeners returns the proxy listeners keyed by name ("http",
+// "https" and, when enabled, "tls" and "socks"). Sockets handed over by a previous
+// process during an upgrade take priority, then sockets passed by systemd
+// socket activation, matched by FileDescriptorName= or else by order;
+// anything not passed in is bound from the configured ports.
+func openListeners(cfg *config.Config) (map[string]net.Listener, error) {
+	addrs := map[string]string{
+		listenerHTTP:  cfg.HTTPAddr(),
+		listenerHTTPS: cfg.HTTPSAddr(),
+	}
+	order := []string{listenerHTTP, listenerHTTPS}
+	if cfg.TLSPort != 0 {
+		addrs[listenerTLS] = cfg.TLSAddr()
+		order = append(order, listenerTLS)
+	}
+	if cfg.SOCKSPort != 0 {
+		addrs[listenerSOCKS] = cfg.SOCKSAddr()
+		order = append(order, listenerSOCKS)
+	}
+
+	passed, err := upgrade.Inherited()
+	if err != nil {
+		return nil, err
+	}
+	if len(passed) > 0 {
+		logger.Log("Using %d listener(s) inherited from previous process", len(passed))
+	} else {
+		var activatedOrder []string
+		passed, activatedOrder, err = systemd.Listeners()
+		if err != nil {
+			return nil, err
+		}
+		if len(passed) > 0 {
+			logger.Log("Using %d socket-activated listener(s) from systemd", len(passed))
+		}
+		// Unnamed sockets are assigned in the order they were passed
+		if passed[listenerHTTP] == nil && passed[listenerHTTPS] == nil {
+			byOrder := make(map[string]net.Listener)
+			for i, name := range activatedOrder {
+				if i < len(order) {
+					byOrder[order[i]] = passed[name]
+				}
+			}
+			passed = byOrder
+		}
+	}
+
+	listeners := make(map[string]net.Listener)
+	for _, name := range order {
+		if l := passed[name]; l != nil {
+			listeners[name] = l
+			continue
+		}
+		l, err := net.Listen("tcp", addrs[name])
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addrs[name], err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// protectListeners wraps the proxy listeners with the abuse protections:
+// the file descriptor reserve, connection limits and bans, the minimum
+// transfer rate and, on the plain HTTP ports, strict parsing. The listeners
+// passed in are left as they are for handing over on upgrades. With
+// -proxy-protocol the client addresses load balancers pass on are read
+// first, so the protections apply to them.
+func protectListeners(cfg *config.Config, s *proxy.Server, listeners map[string]net.Listener) map[string]net.Listener {
+	protected := make(map[string]net.Listener, len(listeners))
+	for name, l := range listeners {
+		if cfg.ProxyProtocol != "" {
+			l = s.ProxyProtoListener(l)
+		}
+		l = s.FDListener(l, name == listenerHTTP || name == listenerHTTPS)
+		l = s.LimitListener(l)
+		if name != listenerSOCKS {
+			l = s.RateListener(l)
+		}
+		if cfg.StrictParsing && (name == listenerHTTP || name == listenerHTTPS) {
+			l = s.StrictListener(l)
+		}
+		protected[name] = l
+	}
+	return protected
+}
@@ -1,84 +1,226 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
+	"go-proxy/internal/adblock"
 	"go-proxy/internal/api"
+	"go-proxy/internal/auth"
 	"go-proxy/internal/config"
 	"go-proxy/internal/geo"
+	"go-proxy/internal/ha"
 	"go-proxy/internal/logger"
+	"go-proxy/internal/privdrop"
 	"go-proxy/internal/proxy"
+	"go-proxy/internal/report"
 	"go-proxy/internal/storage"
+	"go-proxy/internal/systemd"
+	"go-proxy/internal/upgrade"
 )
 
 func main() {
 	cfg := config.ParseFlags()
+	quiet.Store(cfg.Quiet)
 
 	// Print startup banner and configuration
-	fmt.Printf("\n=== Proxy Server Configuration ===\n")
-	fmt.Printf("🌐 HTTP Proxy: http://localhost:%d\n", cfg.HTTPPort)
-	fmt.Printf("🔒 HTTPS Proxy: https://localhost:%d\n", cfg.HTTPSPort)
-	fmt.Printf("📝 Log File: %s\n", cfg.LogFile)
-	fmt.Printf("📊 Redis Address: %s\n", cfg.RedisAddr)
-	fmt.Printf("🚫 Blacklist File: %s\n", cfg.BlockFile)
-	fmt.Printf("🌍 Geolocation Enabled: %t\n", cfg.GeoEnabled)
+	console("\n=== Proxy Server Configuration ===\n")
+	console("🌐 HTTP Proxy: http://localhost:%d\n", cfg.HTTPPort)
+	console("🔒 HTTPS Proxy: https://localhost:%d\n", cfg.HTTPSPort)
+	console("📝 Log File: %s (level %s)\n", cfg.LogFile, cfg.LogLevel)
+	switch cfg.Storage {
+	case "redis":
+		console("📊 Redis Address: %s\n", cfg.RedisAddr)
+	case "bolt":
+		console("📊 Stats Database: %s\n", cfg.StoragePath)
+	default:
+		console("📊 Stats Storage: %s\n", cfg.Storage)
+	}
+	console("🚫 Blacklist File: %s\n", cfg.BlockFile)
+	console("🌍 Geolocation Enabled: %t\n", cfg.GeoEnabled)
 	if cfg.GeoEnabled {
-		fmt.Printf("🧠 Geolocation Cache Size: %d entries\n", cfg.GeoCacheSize)
+		console("🧠 Geolocation Cache Size: %d entries\n", cfg.GeoCacheSize)
 	}
-	fmt.Printf("===============================\n\n")
+	applyRuntimeTuning(cfg)
+	console("===============================\n\n")
 
 	// Initialize logger
 	if err := logger.Init(cfg.LogFile); err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("✅ Logger initialized\n")
+	logLevel, _ := logger.ParseLevel(cfg.LogLevel) // validated by config.Load
+	logger.SetLevel(logLevel)
+	console("✅ Logger initialized\n")
 
-	// Initialize Redis
-	if err := storage.InitRedis(cfg.RedisAddr, cfg.RedisPassword); err != nil {
-		log.Fatal(err)
+	// Initialize stats storage
+	var store storage.StatsStore
+	var boltStore *storage.BoltStore
+	switch cfg.Storage {
+	case "memory":
+		store = storage.NewMemoryStore()
+		console("⚠️ Using in-memory stats storage; stats are lost on restart\n")
+	case "bolt":
+		var err error
+		boltStore, err = storage.NewBoltStore(cfg.StoragePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = boltStore
+		console("✅ Stats database opened\n")
+	case "none":
+		store = storage.NoStore{}
+		console("⚠️ Stats storage disabled; stats endpoints answer 503\n")
+	default:
+		if cfg.StorageLazy {
+			store = storage.NewLazyStore(cfg.Storage, func() (storage.StatsStore, error) {
+				return openNetworkStore(cfg)
+			})
+			console("⏳ Connecting to %s in the background; stats endpoints answer 503 until then\n", cfg.Storage)
+			break
+		}
+		var err error
+		store, err = openNetworkStore(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.Storage == "postgres" {
+			console("✅ Postgres connection established\n")
+		} else {
+			console("✅ Redis connection established\n")
+		}
+	}
+	// Network backends can go away at runtime; keep their writes off the
+	// request path while they do
+	if (cfg.Storage == "redis" || cfg.Storage == "postgres") && cfg.StatsBufferSize > 0 {
+		buffered, err := storage.NewBufferedStore(store, cfg.StatsBufferSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = buffered
 	}
-	fmt.Printf("✅ Redis connection established\n")
+	deps := proxy.Deps{Store: store, Log: logger.Default()}
+
+	// Initialize geolocation system if enabled (its cache is persisted
+	// next to the stats)
+	if cfg.GeoEnabled && (cfg.Storage == "memory" || cfg.Storage == "postgres" || cfg.Storage == "none") {
+		console("ℹ️ Geolocation tracking needs redis or bolt storage; disabled\n")
+	} else if cfg.GeoEnabled {
+		if err := initGeo(cfg, boltStore); err != nil {
+			log.Printf("⚠️ Warning: Geolocation system initialization failed: %v\n", err)
+		} else {
+			geo.SetTTL(cfg.GeoTTL, cfg.GeoRefreshBefore)
+			console("✅ Geolocation system initialized\n")
+			deps.Geo = geo.Default()
+			storage.SetHostCountry(geo.Default().CachedCountry)
+		}
+	} else {
+		console("ℹ️ Geolocation tracking disabled\n")
+	}
+	if cfg.GeoAllowCountries != "" && deps.Geo == nil {
+		// Geo-fencing fails closed
+		console("⚠️ Geolocation is unavailable; -geo-allow-countries blocks every destination\n")
+	}
+
+	// Significant events go to a Redis stream for external consumers
+	var eventLog *storage.RedisEventLog
+	if cfg.EventStreamMaxLen > 0 {
+		var err error
+		eventLog, err = storage.NewRedisEventLog(cfg.Redis(), cfg.EventStreamMaxLen)
+		if err != nil {
+			log.Printf("⚠️ Warning: Event stream disabled: %v\n", err)
+		} else {
+			deps.Events = append(deps.Events, eventLog)
+			console("✅ Event stream enabled\n")
+		}
+	}
+
+	sharedState := openSharedState(cfg, &deps)
+	securityLogs := openSecurityLogs(cfg, &deps)
 
 	// Initialize proxy server
-	proxyServer := proxy.NewServer(cfg)
+	proxyServer := proxy.NewServer(cfg, deps)
+
+	// Proxy authentication
+	authChain, err := auth.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up proxy authentication: %v", err)
+	}
+	if len(authChain) > 0 {
+		proxyServer.SetAuth(authChain)
+		console("✅ Proxy authentication enabled\n")
+	}
+
+	var filters *adblock.Engine
+	if sources := cfg.AdblockSources(); len(sources) > 0 {
+		filters = adblock.New(sources, cfg.AdblockRefresh)
+		proxyServer.SetFilters(filters)
+		console("✅ %d filter list(s) loaded\n", len(sources))
+	}
 
 	// Initialize API handlers
-	apiHandler := api.NewHandler()
+	apiHandler := api.NewHandler(store, deps.Log)
+	apiHandler.SetInternalStats(proxyServer.InternalStats)
 
-	// Create HTTP server mux
-	httpMux := http.NewServeMux()
+	// Config reload via SIGHUP and the admin API
+	configReloader := newReloader(cfg, proxyServer)
+	configReloader.watchSIGHUP()
+	adminHandler := api.NewAdminHandler(configReloader.Reload)
+	haMonitor := ha.New(cfg.HA(), deps.Log)
 
-	// Register API routes
-	httpMux.HandleFunc("/api/stats/daily", apiHandler.HandleDailyStats)
-	httpMux.HandleFunc("/api/stats/hourly", apiHandler.HandleHourlyStats)
-	httpMux.HandleFunc("/api/metrics", apiHandler.HandleMetrics)
+	// Scheduled usage reports
+	reporter := report.New(cfg.Report(), store, deps.Log)
+	if reporter.Enabled() {
+		console("✅ %s reports enabled\n", cfg.ReportSchedule)
+	}
 
-	// Initialize geolocation system if enabled
-	if cfg.GeoEnabled {
-		if err := geo.Initialize(cfg.RedisAddr, cfg.GeoCacheSize); err != nil {
-			log.Printf("⚠️ Warning: Geolocation system initialization failed: %v\n", err)
-		} else {
-			fmt.Printf("✅ Geolocation system initialized\n")
+	// Create HTTP server mux
+	httpMux := http.NewServeMux()
 
-			// Add geolocation API endpoint
-			geo.AddAPIHandler(httpMux)
-		}
-	} else {
-		fmt.Printf("ℹ️ Geolocation tracking disabled\n")
+	// Register API routes and the proxy handler
+	routes := apiRoutes{
+		api:      apiHandler,
+		admin:    adminHandler,
+		guard:    api.NewAdminGuard(cfg.AdminToken, cfg.OIDCIssuer != ""),
+		proxy:    proxyServer,
+		health:   haMonitor,
+		filters:  filters,
+		eventLog: eventLog,
+		geo:      deps.Geo != nil,
+		log:      deps.Log,
 	}
+	routes.register(httpMux)
 
-	// Register proxy handler
-	httpMux.HandleFunc("/", proxyServer.HandleHTTP)
+	// SSO for the web API
+	var httpHandler http.Handler = httpMux
+	discoveryCtx, cancelDiscovery := context.WithTimeout(context.Background(), 30*time.Second)
+	webAuth, err := auth.NewWebAuth(discoveryCtx, cfg)
+	cancelDiscovery()
+	if err != nil {
+		log.Fatalf("Failed to set up SSO: %v", err)
+	}
+	if webAuth != nil {
+		webAuth.RegisterRoutes(httpMux)
+		httpHandler = webAuth.Protect(httpMux, []auth.PathRole{
+			{Prefix: "/api/admin/", Role: auth.RoleAdmin},
+			{Prefix: "/api/bans", Role: auth.RoleAdmin},
+			{Prefix: "/api/pauses", Role: auth.RoleAdmin},
+			{Prefix: "/api/", Role: auth.RoleViewer},
+		})
+		console("✅ SSO login enabled for the web API\n")
+	}
+	httpHandler = api.TenantScope(httpHandler, httpMux, proxyServer.Tenants)
 
 	// Start HTTP server
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.HTTPPort),
-		Handler: httpMux,
+		Handler: proxyServer.ProxyRequests(httpHandler),
 	}
 
 	// Start HTTPS server
@@ -86,49 +228,202 @@ func main() {
 		Addr:    fmt.Sprintf(":%d", cfg.HTTPSPort),
 		Handler: proxyServer, // This handles CONNECT requests for HTTPS
 	}
+	proxyServer.ConfigureServer(httpServer)
+	proxyServer.ConfigureServer(httpsServer)
+
+	// TLS proxy listener ("secure web proxy"), optionally with client certs
+	var tlsServer *http.Server
+	if cfg.TLSPort != 0 {
+		tlsConfig, err := proxy.NewTLSConfig(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsServer = &http.Server{
+			Addr:      cfg.TLSAddr(),
+			Handler:   http.HandlerFunc(proxyServer.ServeProxy),
+			TLSConfig: tlsConfig,
+		}
+		proxyServer.ConfigureServer(tlsServer)
+		httpMux.HandleFunc("/proxy.pac", proxyServer.HandlePAC)
+	}
+
+	// Bind listeners (or take them over from an upgrade or systemd)
+	listeners, err := openListeners(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Everything privileged is open now; confine the process if requested
+	if err := privdrop.Apply(privdrop.Options{
+		User:     cfg.RunAsUser,
+		Group:    cfg.RunAsGroup,
+		Chroot:   cfg.Chroot,
+		Upgraded: upgrade.Upgraded(),
+	}); err != nil {
+		log.Fatalf("Failed to drop privileges: %v", err)
+	}
+	if cfg.RunAsUser != "" || cfg.Chroot != "" {
+		console("🔐 Running as user %q (chroot %q)\n", cfg.RunAsUser, cfg.Chroot)
+	}
 
 	// Start both servers
-	fmt.Printf("\n🚀 Starting proxy servers...\n")
-	fmt.Printf("📡 HTTP proxy listening on http://localhost:%d\n", cfg.HTTPPort)
-	fmt.Printf("📡 HTTPS proxy listening on https://localhost:%d\n", cfg.HTTPSPort)
-	fmt.Printf("🌐 API endpoints available at http://localhost:%d/api/*\n", cfg.HTTPPort)
-	fmt.Printf("\n💡 Configure your browser/system proxy settings to:\n")
-	fmt.Printf("   HTTP Proxy:  localhost:%d\n", cfg.HTTPPort)
-	fmt.Printf("   HTTPS Proxy: localhost:%d\n", cfg.HTTPSPort)
-	fmt.Printf("\n📊 Statistics API endpoints:\n")
-	fmt.Printf("   Daily stats:  http://localhost:%d/api/stats/daily\n", cfg.HTTPPort)
-	fmt.Printf("   Hourly stats: http://localhost:%d/api/stats/hourly\n", cfg.HTTPPort)
-	fmt.Printf("   Metrics:      http://localhost:%d/api/metrics\n", cfg.HTTPPort)
-	fmt.Printf("   Geolocation:  http://localhost:%d/api/geo\n", cfg.HTTPPort)
-	fmt.Printf("\n✨ Proxy server is ready!\n")
-
-	// Set up graceful shutdown
+	console("\n🚀 Starting proxy servers...\n")
+	console("📡 HTTP proxy listening on http://localhost:%d\n", cfg.HTTPPort)
+	console("📡 HTTPS proxy listening on https://localhost:%d\n", cfg.HTTPSPort)
+	if tlsServer != nil {
+		console("🔐 TLS proxy listening on https://localhost:%d (client certs required: %t, HTTP/2: %t)\n",
+			cfg.TLSPort, cfg.TLSClientCA != "", cfg.TLSHTTP2)
+		console("   PAC file:    http://localhost:%d/proxy.pac\n", cfg.HTTPPort)
+	}
+	if cfg.SOCKSPort != 0 {
+		console("🧦 SOCKS5 proxy listening on localhost:%d (password auth: %t)\n", cfg.SOCKSPort, len(authChain) > 0)
+	}
+	if cfg.ConnectUDP {
+		console("📦 CONNECT-UDP (MASQUE) tunnels at http://localhost:%d/.well-known/masque/udp/{host}/{port}/\n", cfg.HTTPPort)
+	}
+	console("🌐 API endpoints available at http://localhost:%d/api/*\n", cfg.HTTPPort)
+	console("\n💡 Configure your browser/system proxy settings to:\n")
+	console("   HTTP Proxy:  localhost:%d\n", cfg.HTTPPort)
+	console("   HTTPS Proxy: localhost:%d\n", cfg.HTTPSPort)
+	routes.announce(cfg)
+	console("\n✨ Proxy server is ready!\n")
+
+	// Set up graceful shutdown and binary upgrades
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	notifySignals(sigChan)
+
+	// Strict parsing checks the head of the one request per connection
+	serving := protectListeners(cfg, proxyServer, listeners)
+	if cfg.StrictParsing {
+		httpServer.SetKeepAlivesEnabled(false)
+		httpsServer.SetKeepAlivesEnabled(false)
+	}
 
 	// Start HTTP server in a goroutine
 	go func() {
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := httpServer.Serve(serving[listenerHTTP]); err != nil && err != http.ErrServerClosed {
 			log.Printf("HTTP server error: %v\n", err)
 		}
 	}()
 
 	// Start HTTPS server in a goroutine
 	go func() {
-		if err := httpsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := httpsServer.Serve(serving[listenerHTTPS]); err != nil && err != http.ErrServerClosed {
 			log.Printf("HTTPS server error: %v\n", err)
 		}
 	}()
 
-	// Wait for shutdown signal
-	<-sigChan
-	fmt.Println("\n🛑 Shutting down servers...")
+	// Start TLS proxy server in a goroutine
+	if tlsServer != nil {
+		go func() {
+			if err := tlsServer.ServeTLS(serving[listenerTLS], "", ""); err != nil && err != http.ErrServerClosed {
+				log.Printf("TLS proxy server error: %v\n", err)
+			}
+		}()
+	}
+
+	// Start SOCKS5 server in a goroutine
+	if socksListener := serving[listenerSOCKS]; socksListener != nil {
+		go func() {
+			if err := proxyServer.ServeSOCKS(socksListener); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("SOCKS server error: %v\n", err)
+			}
+		}()
+	}
+
+	// Tell an upgrading parent and systemd (Type=notify) we are ready
+	if err := upgrade.Ready(); err != nil {
+		logger.Warn("Failed to signal upgrade readiness: %v", err)
+	}
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		logger.Warn("sd_notify failed: %v", err)
+	}
+	watchdog := systemd.StartWatchdog(nil)
+	haMonitor.Start()
+	reporter.Start()
+
+	// Wait for shutdown signal, handing over to a new binary on SIGUSR2
+	upgraded := false
+	for sig := range sigChan {
+		if !isUpgradeSignal(sig) {
+			break
+		}
+		if err := startUpgrade(listeners); err != nil {
+			log.Printf("⚠️ Upgrade failed, continuing to serve: %v\n", err)
+			continue
+		}
+		upgraded = true
+		break
+	}
+	console("\n🛑 Shutting down servers...\n")
+	systemd.Notify("STOPPING=1")
+	close(watchdog)
+	haMonitor.Stop()
+	reporter.Stop()
+
+	if upgraded {
+		// Stop accepting, then let established tunnels finish
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		httpServer.Shutdown(ctx)
+		httpsServer.Shutdown(ctx)
+		if tlsServer != nil {
+			tlsServer.Shutdown(ctx)
+		}
+		if socksListener := listeners[listenerSOCKS]; socksListener != nil {
+			socksListener.Close()
+		}
+		console("⏳ Waiting for %d open tunnel(s) to close...\n", proxyServer.ActiveTunnels())
+		if err := proxyServer.WaitForTunnels(ctx); err != nil {
+			logger.Warn("Drain timeout reached with %d tunnel(s) open", proxyServer.ActiveTunnels())
+		}
+		cancel()
+	}
 
 	// Clean up resources
-	if cfg.GeoEnabled {
+	if filters != nil {
+		filters.Close()
+	}
+	if deps.Geo != nil {
 		geo.Shutdown()
 	}
+	for _, securityLog := range securityLogs {
+		securityLog.Close()
+	}
+	for _, state := range sharedState {
+		state.Close()
+	}
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
 
 	// Exit
 	os.Exit(0)
 }
+
+// openNetworkStore connects to the redis or postgres stats backend
+func openNetworkStore(cfg *config.Config) (storage.StatsStore, error) {
+	if cfg.Storage == "postgres" {
+		pgStore, err := storage.NewPostgresStore(cfg.PostgresDSN)
+		if err != nil {
+			return nil, err
+		}
+		return pgStore, nil
+	}
+	redisStore, err := storage.NewRedisStore(cfg.Redis())
+	if err != nil {
+		return nil, err
+	}
+	return redisStore, nil
+}
+
+// initGeo sets up the geolocation cache on the same backend as the stats
+func initGeo(cfg *config.Config, boltStore *storage.BoltStore) error {
+	if boltStore == nil {
+		return geo.Initialize(cfg.Redis(), cfg.GeoCacheSize, cfg.GeoDebug)
+	}
+	store, err := geo.NewBoltPersistence(boltStore.DB())
+	if err != nil {
+		return err
+	}
+	return geo.InitializeWith(store, cfg.GeoCacheSize, cfg.GeoDebug)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/geo"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/systemd"
+)
+
+// reloader re-reads the configuration and applies the reloadable settings
+// to the running components. current is the config last applied, startup
+// the one the process started with, which settings needing a restart are
+// still running with.
+type reloader struct {
+	mu      sync.Mutex
+	startup *config.Config
+	current *config.Config
+	server  *proxy.Server
+}
+
+func newReloader(startup *config.Config, server *proxy.Server) *reloader {
+	return &reloader{startup: startup, current: startup, server: server}
+}
+
+// Reload loads the config from the original args, file and environment and
+// applies it. Settings that need a restart are reported but not applied.
+func (r *reloader) Reload() (*config.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	systemd.Notify("RELOADING=1")
+	defer systemd.Notify("READY=1")
+
+	next, err := config.Load(os.Args[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	result := r.current.CompareForReload(next)
+	result.RestartRequired = r.startup.CompareForReload(next).RestartRequired
+
+	if err := r.server.Reload(next); err != nil {
+		return nil, fmt.Errorf("failed to apply reloaded settings: %w", err)
+	}
+	if next.GeoEnabled {
+		geo.SetDebug(next.GeoDebug)
+		geo.SetTTL(next.GeoTTL, next.GeoRefreshBefore)
+	}
+	if level, err := logger.ParseLevel(next.LogLevel); err == nil {
+		logger.SetLevel(level)
+	}
+	quiet.Store(next.Quiet)
+	r.current = next
+
+	logger.Log("Config reloaded: changed=%v restart_required=%v", result.Changed, result.RestartRequired)
+	return result, nil
+}
+
+// watchSIGHUP reloads the configuration whenever the process receives SIGHUP.
+func (r *reloader) watchSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			result, err := r.Reload()
+			if err != nil {
+				console("⚠️ Config reload failed: %v\n", err)
+				continue
+			}
+			console("🔄 Config reloaded (restart required for: %v)\n", result.RestartRequired)
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+
+	"go-proxy/internal/adblock"
+	"go-proxy/internal/api"
+	"go-proxy/internal/config"
+	"go-proxy/internal/geo"
+	"go-proxy/internal/ha"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/storage"
+)
+
+// apiRoutes are the handlers the web API is served by
+type apiRoutes struct {
+	api      *api.Handler
+	admin    *api.AdminHandler
+	guard    *api.AdminGuard
+	proxy    *proxy.Server
+	health   *ha.Monitor
+	filters  *adblock.Engine        // nil without -adblock-lists
+	eventLog *storage.RedisEventLog // nil without -event-stream-maxlen
+	geo      bool                   // Geolocation is available
+	log      logger.Logger
+}
+
+// register adds the web API endpoints to mux, and the proxy handler for
+// every other path
+func (r apiRoutes) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/stats/daily", r.api.HandleDailyStats)
+	mux.HandleFunc("/api/stats/hourly", r.api.HandleHourlyStats)
+	mux.HandleFunc("/api/stats/users", r.api.HandleUserStats)
+	mux.HandleFunc("/api/stats/activity", r.api.HandleActivity)
+	mux.HandleFunc("/api/stats/geo", r.api.HandleGeoStats)
+	mux.HandleFunc("/api/metrics", r.api.HandleMetrics)
+	mux.HandleFunc("/api/reports/generate", r.api.HandleReport)
+	mux.HandleFunc("/api/stats/compression", r.proxy.HandleCompressionStats)
+	mux.HandleFunc("/api/stats/saver", r.proxy.HandleSaverStats)
+	mux.HandleFunc("/api/stats/privacy", r.proxy.HandlePrivacyStats)
+	mux.HandleFunc("/api/stats/upstreams", r.proxy.HandleUpstreamStats)
+	mux.HandleFunc("/api/stats/origins", r.proxy.HandleOriginStats)
+	mux.HandleFunc("/api/stats/prewarm", r.proxy.HandlePrewarmStats)
+	mux.HandleFunc("/api/stats/https-upgrade", r.proxy.HandleHTTPSUpgradeStats)
+	mux.HandleFunc("/api/stats/geofence", r.proxy.HandleGeoFenceStats)
+	mux.HandleFunc("/api/stats/protocols", r.proxy.HandleProtocolStats)
+	mux.HandleFunc("/api/stats/strict", r.proxy.HandleStrictStats)
+	mux.HandleFunc("/api/stats/slow-clients", r.proxy.HandleSlowClientStats)
+	mux.HandleFunc("/api/stats/new-domains", r.proxy.HandleNewDomains)
+	mux.HandleFunc("/api/stats/origin-limits", r.proxy.HandleOriginLimits)
+	mux.HandleFunc("/api/stats/origin-tls", r.proxy.HandleOriginTLS)
+	mux.HandleFunc("/api/stats/errors", r.proxy.HandleFailureStats)
+	mux.HandleFunc("/api/stats/projection", r.proxy.HandleProjection)
+	mux.HandleFunc("/api/stats/apps", r.proxy.HandleAppStats)
+	mux.HandleFunc("/api/requests", r.proxy.HandleRequests)
+	mux.HandleFunc("/api/bans", r.guard.Require(r.proxy.HandleBans))
+	mux.HandleFunc("/api/pauses", r.guard.Require(r.proxy.HandlePauses))
+	mux.HandleFunc("/api/services", r.proxy.HandleServicePolicies)
+	mux.HandleFunc("/api/quotas", r.proxy.HandleQuotas)
+	mux.HandleFunc("/api/devices", r.proxy.HandleDevices)
+	mux.HandleFunc("/api/certs", r.proxy.HandleCerts)
+	mux.HandleFunc("/api/events/blocked", r.proxy.HandleBlockedEvents)
+	mux.HandleFunc("/api/alerts", r.proxy.HandleAlerts)
+	mux.HandleFunc("/api/health", r.health.HandleHealth)
+	mux.HandleFunc("/api/health/origins", r.proxy.HandleOriginHealth)
+	mux.HandleFunc("/api/admin/reload", r.guard.Require(r.admin.HandleReload))
+	mux.HandleFunc("/api/admin/wol", r.guard.Require(r.admin.HandleWake))
+	mux.HandleFunc("/api/admin/loglevel", r.guard.Require(r.admin.HandleLogLevel))
+	mux.HandleFunc("/api/admin/export", r.api.HandleExport)
+	mux.HandleFunc("/api/admin/import", r.guard.Require(r.api.HandleImport))
+	mux.HandleFunc("/api/admin/maintenance", r.guard.Require(r.proxy.HandleMaintenance))
+	mux.HandleFunc("/api/admin/runtime", r.proxy.HandleRuntime)
+
+	if r.filters != nil {
+		mux.HandleFunc("/api/stats/adblock", r.filters.HandleStats)
+	}
+	if r.eventLog != nil {
+		mux.HandleFunc("/api/events", api.NewEventsHandler(r.eventLog, r.log).HandleEvents)
+	}
+
+	// Add geolocation API endpoint
+	if r.geo {
+		geo.AddAPIHandler(mux)
+	}
+
+	// Register proxy handler
+	mux.HandleFunc("/", r.proxy.HandleHTTP)
+}
+
+// announce lists the web API endpoints on the console
+func (r apiRoutes) announce(cfg *config.Config) {
+	console("\n📊 Statistics API endpoints:\n")
+	console("   Daily stats:  http://localhost:%d/api/stats/daily\n", cfg.HTTPPort)
+	console("   Hourly stats: http://localhost:%d/api/stats/hourly\n", cfg.HTTPPort)
+	console("   User stats:   http://localhost:%d/api/stats/users\n", cfg.HTTPPort)
+	console("   Activity:     http://localhost:%d/api/stats/activity?days=&idle=&user=\n", cfg.HTTPPort)
+	console("   Projection:   http://localhost:%d/api/stats/projection?limit=\n", cfg.HTTPPort)
+	console("   Geo stats:    http://localhost:%d/api/stats/geo?level=country|region|city\n", cfg.HTTPPort)
+	console("   Metrics:      http://localhost:%d/api/metrics\n", cfg.HTTPPort)
+	console("   Reports:      http://localhost:%d/api/reports/generate?period=day|week|month&format=html|pdf\n", cfg.HTTPPort)
+	console("   Geolocation:  http://localhost:%d/api/geo[/{host}]?country=&limit=&offset=\n", cfg.HTTPPort)
+	console("   Health:       http://localhost:%d/api/health (role %s)\n", cfg.HTTPPort, r.health.Role())
+	if cfg.ProbeOrigins > 0 {
+		console("   Origins:      http://localhost:%d/api/health/origins\n", cfg.HTTPPort)
+	}
+	console("   Origin TLS:   http://localhost:%d/api/stats/origin-tls\n", cfg.HTTPPort)
+	console("   Reload:       POST http://localhost:%d/api/admin/reload (or SIGHUP)\n", cfg.HTTPPort)
+	console("   Log level:    GET/PUT http://localhost:%d/api/admin/loglevel\n", cfg.HTTPPort)
+	console("   Export:       GET http://localhost:%d/api/admin/export?from_date=&to_date=\n", cfg.HTTPPort)
+	console("   Import:       POST http://localhost:%d/api/admin/import[?merge=true]\n", cfg.HTTPPort)
+	console("   Maintenance:  GET/PUT http://localhost:%d/api/admin/maintenance\n", cfg.HTTPPort)
+	console("   Wake-on-LAN:  POST http://localhost:%d/api/admin/wol?mac=&broadcast=\n", cfg.HTTPPort)
+	console("   Runtime:      http://localhost:%d/api/admin/runtime?limit=\n", cfg.HTTPPort)
+	console("   Pauses:       GET/POST/DELETE http://localhost:%d/api/pauses[?client=&minutes=]\n", cfg.HTTPPort)
+	if cfg.Quotas != "" {
+		console("   Quotas:       http://localhost:%d/api/quotas?client=\n", cfg.HTTPPort)
+	}
+	console("   Devices:      http://localhost:%d/api/devices?client=\n", cfg.HTTPPort)
+	if cfg.AppAgents != "" {
+		console("   Apps:         http://localhost:%d/api/stats/apps?client=\n", cfg.HTTPPort)
+	}
+	if cfg.CertWatch > 0 {
+		console("   Certificates: http://localhost:%d/api/certs?host=\n", cfg.HTTPPort)
+	}
+	console("   Bans:         GET/POST/DELETE http://localhost:%d/api/bans[?ip=&duration=]\n", cfg.HTTPPort)
+	console("   Alerts:       http://localhost:%d/api/alerts?since=&kind=\n", cfg.HTTPPort)
+	if r.eventLog != nil {
+		console("   Events:       http://localhost:%d/api/events?cursor=&wait=30s\n", cfg.HTTPPort)
+	}
+}
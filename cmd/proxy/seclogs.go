@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"go-proxy/internal/banlog"
+	"go-proxy/internal/config"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/siem"
+	"go-proxy/internal/webhook"
+)
+
+// openSecurityLogs adds the SIEM and fail2ban logs and the alert webhook
+// enabled in cfg to the event sinks of deps and returns them for closing
+// at shutdown
+func openSecurityLogs(cfg *config.Config, deps *proxy.Deps) []io.Closer {
+	var logs []io.Closer
+	if cfg.SIEMFormat != "off" {
+		siemLog, err := siem.Open(cfg.SIEMFormat, cfg.SIEMLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deps.Events = append(deps.Events, siemLog)
+		logs = append(logs, siemLog)
+	}
+	if cfg.BanLog != "" {
+		banLog, err := banlog.Open(cfg.BanLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deps.Events = append(deps.Events, banLog)
+		logs = append(logs, banLog)
+	}
+	if cfg.AlertWebhook != "" {
+		sender, err := webhook.Open(cfg.AlertWebhook)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deps.Events = append(deps.Events, sender)
+		logs = append(logs, sender)
+	}
+	return logs
+}
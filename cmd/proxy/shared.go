@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/geo"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/storage"
+)
+
+// openSharedState connects the state instances share through Redis: rule
+// changes and job leases with -cluster-sync, and the first-seen times of
+// destination domains with redis storage. It adds them to deps and
+// returns them for closing at shutdown.
+func openSharedState(cfg *config.Config, deps *proxy.Deps) []io.Closer {
+	var shared []io.Closer
+
+	// Rule changes are shared with instances using the same Redis
+	if cfg.ClusterSync {
+		clusterBus, err := storage.NewRedisBus(cfg.Redis())
+		if err != nil {
+			log.Printf("⚠️ Warning: Cluster sync disabled: %v\n", err)
+		} else {
+			deps.Cluster = clusterBus
+			shared = append(shared, clusterBus)
+			console("✅ Cluster sync enabled\n")
+		}
+	}
+
+	// Shared background jobs run on the one instance holding their lease
+	if cfg.ClusterSync {
+		leases, err := storage.NewRedisLeases(cfg.Redis())
+		if err != nil {
+			log.Printf("⚠️ Warning: Leader election disabled: %v\n", err)
+		} else {
+			geo.SetLeader(leases)
+			shared = append(shared, leases)
+		}
+	}
+
+	// Without Redis first sightings are kept in memory until restart
+	if cfg.Storage == "redis" {
+		domains, err := storage.NewRedisDomains(cfg.Redis())
+		if err != nil {
+			log.Printf("⚠️ Warning: Domain first sightings kept in memory: %v\n", err)
+		} else {
+			deps.Domains = domains
+			shared = append(shared, domains)
+		}
+	}
+	return shared
+}
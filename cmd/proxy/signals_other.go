@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals relays to c the signals that stop the proxy. There is no
+// SIGUSR2 here, so binary upgrades are not available.
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// isUpgradeSignal reports whether sig asks for a binary upgrade
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals relays to c the signals that stop the proxy, and SIGUSR2,
+// which hands the listeners over to a new binary first
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+}
+
+// isUpgradeSignal reports whether sig asks for a binary upgrade
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"go-proxy/internal/config"
+)
+
+// applyRuntimeTuning sets the Go runtime limits given in cfg
+func applyRuntimeTuning(cfg *config.Config) {
+	if cfg.GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(cfg.GOMAXPROCS)
+	}
+	if cfg.GCPercent != 0 {
+		debug.SetGCPercent(cfg.GCPercent)
+	}
+	if cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(cfg.MemoryLimit * 1024 * 1024)
+	}
+	console("⚙️  GOMAXPROCS: %d\n", runtime.GOMAXPROCS(0))
+}
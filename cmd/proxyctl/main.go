@@ -0,0 +1,49 @@
+// Command proxyctl is the operator tool for the proxy's stats data.
+//
+//	proxyctl export -from 2024-03-01 -to 2024-03-31 -out stats.json.gz
+//	proxyctl import -in stats.json.gz -merge
+//
+// Both work either against a running proxy's admin API (-url) or directly
+// against a storage backend (-storage and its connection flags), so stats
+// can be backed up, moved between backends or merged from several
+// instances.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: proxyctl <command> [flags]
+
+Commands:
+  export   Write stats for a date range to a gzipped JSON dump
+  import   Load a dump into a proxy or storage backend
+
+Run "proxyctl <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "proxyctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
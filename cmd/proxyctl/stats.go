@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go-proxy/internal/api"
+	"go-proxy/internal/storage"
+)
+
+// apiTimeout bounds export and import requests to a running proxy
+const apiTimeout = 5 * time.Minute
+
+// target is where stats are read from or written to: a running proxy's
+// API, or a storage backend opened directly
+type target struct {
+	url         string
+	token       string
+	storage     string
+	redis       storage.RedisOptions
+	storagePath string
+	postgresDSN string
+}
+
+func (t *target) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.url, "url", "", "Base URL of a running proxy's API (e.g. http://localhost:8080); overrides -storage")
+	fs.StringVar(&t.token, "token", "", "Admin token of the proxy API, for -url (default $PROXY_ADMIN_TOKEN)")
+	fs.StringVar(&t.storage, "storage", "redis", "Storage backend to use directly: redis, bolt or postgres")
+	t.redis.RegisterFlags(fs)
+	fs.StringVar(&t.storagePath, "storage-path", "proxy.db", "Database file for -storage=bolt (must not be open by a running proxy)")
+	fs.StringVar(&t.postgresDSN, "postgres-dsn", "", "PostgreSQL connection string for -storage=postgres")
+}
+
+// open connects to the configured storage backend
+func (t *target) open() (storage.StatsStore, func(), error) {
+	switch t.storage {
+	case "redis":
+		s, err := storage.NewRedisStore(t.redis)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	case "bolt":
+		s, err := storage.NewBoltStore(t.storagePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	case "postgres":
+		s, err := storage.NewPostgresStore(t.postgresDSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown -storage %q (want redis, bolt or postgres)", t.storage)
+	}
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	today := time.Now().Format("2006-01-02")
+	from := fs.String("from", today, "First day to export (YYYY-MM-DD)")
+	to := fs.String("to", today, "Last day to export (YYYY-MM-DD)")
+	out := fs.String("out", "stats.json.gz", "Output file, or - for stdout")
+	var t target
+	t.register(fs)
+	fs.Parse(args)
+
+	fromDate, err := time.Parse("2006-01-02", *from)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	toDate, err := time.Parse("2006-01-02", *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if t.url != "" {
+		query := url.Values{"from_date": {*from}, "to_date": {*to}}
+		resp, err := t.apiRequest(http.MethodGet, t.url+"/api/admin/export?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(w, resp.Body)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d bytes from %s\n", n, t.url)
+		return nil
+	}
+
+	store, closeStore, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	dump, err := storage.Export(store, fromDate, toDate)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteDump(w, dump); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d host and %d user records\n", len(dump.Hosts), len(dump.Users))
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "stats.json.gz", "Dump file to import, or - for stdin")
+	merge := fs.Bool("merge", false, "Add to existing records instead of replacing them (for combining instances)")
+	var t target
+	t.register(fs)
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if t.url != "" {
+		target := t.url + "/api/admin/import"
+		if *merge {
+			target += "?merge=true"
+		}
+		resp, err := t.apiRequest(http.MethodPost, target, r)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var result api.ImportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d records into %s\n", result.Imported, t.url)
+		return nil
+	}
+
+	dump, err := storage.ReadDump(r)
+	if err != nil {
+		return err
+	}
+	store, closeStore, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	imported, err := storage.Import(store, dump, *merge)
+	if err != nil {
+		return fmt.Errorf("stopped after %d records: %w", imported, err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d records\n", imported)
+	return nil
+}
+
+// apiRequest calls the proxy API with the admin token, if any, and fails
+// on non-2xx responses
+func (t *target) apiRequest(method, target string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	token := t.token
+	if token == "" {
+		token = os.Getenv("PROXY_ADMIN_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: apiTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var result api.ImportResponse
+		if json.Unmarshal(msg, &result) == nil && result.Error != "" {
+			msg = []byte(result.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,49 @@
+// Command redis2pg copies the stats kept in Redis into a PostgreSQL
+// database, for switching a deployment to -storage=postgres without losing
+// history. It can be rerun; periods already copied are overwritten.
+//
+//	redis2pg -redis-addr localhost:6379 -postgres-dsn postgres://proxy@db/proxy
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go-proxy/internal/storage"
+)
+
+func main() {
+	var redisOpts storage.RedisOptions
+	redisOpts.RegisterFlags(flag.CommandLine)
+	dsn := flag.String("postgres-dsn", "", "PostgreSQL connection string to copy stats into")
+	flag.Parse()
+
+	if *dsn == "" {
+		fmt.Fprintln(os.Stderr, "-postgres-dsn is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := storage.NewRedisStore(redisOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	dst, err := storage.NewPostgresStore(*dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dst.Close()
+
+	copied, err := src.CopyToPostgres(dst, func(n int) {
+		fmt.Printf("\rCopied %d records", n)
+	})
+	fmt.Println()
+	if err != nil {
+		log.Fatalf("Copy stopped after %d records: %v", copied, err)
+	}
+	fmt.Printf("Done: %d records copied to Postgres\n", copied)
+}
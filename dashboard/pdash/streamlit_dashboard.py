@@ -28,6 +28,58 @@ def fetch_data(from_date, to_date, host_filter=None):
         st.error(f"Error fetching data: {e}")
         return {"records": {}}
 
+# Function to fetch the alerts raised since a given time
+@st.cache_data(ttl=60)
+def fetch_alerts(since):
+    api_url = f"{API_BASE_URL}/api/alerts?since={int(since.timestamp())}&limit=200"
+    try:
+        response = requests.get(api_url)
+        response.raise_for_status()
+        return response.json()
+    except requests.exceptions.RequestException as e:
+        st.error(f"Error fetching alerts: {e}")
+        return []
+
+def fetch_projection():
+    api_url = f"{API_BASE_URL}/api/stats/projection"
+    try:
+        response = requests.get(api_url)
+        response.raise_for_status()
+        return response.json()
+    except requests.exceptions.RequestException as e:
+        st.error(f"Error fetching usage projection: {e}")
+        return None
+
+def fetch_activity():
+    api_url = f"{API_BASE_URL}/api/stats/activity"
+    try:
+        response = requests.get(api_url)
+        response.raise_for_status()
+        return response.json().get("clients", [])
+    except requests.exceptions.RequestException as e:
+        st.error(f"Error fetching client activity: {e}")
+        return []
+
+def fetch_quotas():
+    api_url = f"{API_BASE_URL}/api/quotas"
+    try:
+        response = requests.get(api_url)
+        response.raise_for_status()
+        return response.json()
+    except requests.exceptions.RequestException as e:
+        st.error(f"Error fetching quotas: {e}")
+        return []
+
+def fetch_apps():
+    api_url = f"{API_BASE_URL}/api/stats/apps"
+    try:
+        response = requests.get(api_url)
+        response.raise_for_status()
+        return response.json()
+    except requests.exceptions.RequestException as e:
+        st.error(f"Error fetching application stats: {e}")
+        return []
+
 # Set page configuration
 st.set_page_config(
     page_title="Network Stats Dashboard",
@@ -96,6 +148,76 @@ with st.sidebar:
 from_date = datetime.combine(from_date, datetime.min.time())
 to_date = datetime.combine(to_date, datetime.min.time())
 
+# Usage of the billing cycle projected to its end, against the ISP data cap
+projection = fetch_projection()
+if projection:
+    cycle_end = projection["cycle_end"][:10]
+    if projection.get("cap") and projection["used"] > projection["cap"]:
+        st.error(f"Data cap exceeded: {projection['used'] / 1e9:.1f} GB used of {projection['cap'] / 1e9:.1f} GB until {cycle_end}")
+    elif projection["over_cap"]:
+        st.warning(f"Projected to use {projection['projected'] / 1e9:.1f} GB by {cycle_end}, over the {projection['cap'] / 1e9:.1f} GB data cap")
+    st.subheader(f"Billing cycle until {cycle_end}", divider="gray")
+    cols = st.columns(4)
+    cols[0].metric("Used", f"{projection['used'] / 1e9:.1f} GB")
+    cols[1].metric("Daily rate", f"{projection['daily_rate'] / 1e9:.2f} GB")
+    cols[2].metric("Projected", f"{projection['projected'] / 1e9:.1f} GB")
+    cols[3].metric("Data cap", f"{projection['cap'] / 1e9:.0f} GB" if projection.get("cap") else "none")
+    if projection["clients"]:
+        clients_df = pd.DataFrame(projection["clients"])
+        for col in ["used", "daily_rate", "projected"]:
+            clients_df[col] = (clients_df[col] / 1e9).round(2)
+        clients_df = clients_df.rename(columns={"used": "used (GB)", "daily_rate": "GB/day", "projected": "projected (GB)"})
+        st.dataframe(clients_df, use_container_width=True, hide_index=True)
+
+# Alerts raised in the last 24 hours, newest first
+alerts = fetch_alerts(CURRENT_DATE - timedelta(days=1))
+st.subheader(f"Alerts (last 24 hours): {len(alerts)}", divider="gray")
+if alerts:
+    alerts_df = pd.DataFrame(alerts).iloc[::-1]
+    columns = [col for col in ["time", "kind", "client", "user", "host", "message"] if col in alerts_df.columns]
+    st.dataframe(alerts_df[columns], use_container_width=True, hide_index=True)
+
+# Data quotas this cycle, closest to their limit first
+quotas = fetch_quotas()
+if quotas:
+    st.subheader("Data quotas", divider="gray")
+    quotas_df = pd.DataFrame(quotas)
+    for col in ["limit", "used", "remaining"]:
+        quotas_df[col] = (quotas_df[col] / 1e9).round(2)
+    quotas_df["used %"] = (100 * quotas_df["used"] / quotas_df["limit"]).round(1)
+    quotas_df = quotas_df.rename(columns={"limit": "limit (GB)", "used": "used (GB)", "remaining": "remaining (GB)"})
+    columns = ["client", "rule", "cycle", "used (GB)", "remaining (GB)", "limit (GB)", "used %", "resets"]
+    st.dataframe(quotas_df[columns], use_container_width=True, hide_index=True)
+
+# Traffic by application, as tagged by LAN agents
+apps = fetch_apps()
+if apps:
+    st.subheader("Applications", divider="gray")
+    apps_df = pd.DataFrame(apps)
+    apps_df["MB"] = (apps_df["bytes"] / 1e6).round(1)
+    apps_df["clients"] = apps_df["clients"].apply(lambda shares: ", ".join(share["name"] for share in shares))
+    apps_df["top hosts"] = apps_df["top_hosts"].apply(lambda shares: ", ".join(share["name"] for share in shares[:3]))
+    app_cols = st.columns([1, 2])
+    app_cols[0].plotly_chart(px.pie(apps_df.head(10), values="bytes", names="app", hole=0.4),
+                             use_container_width=True)
+    app_cols[1].dataframe(apps_df[["app", "MB", "requests", "clients", "top hosts", "last_seen"]],
+                          use_container_width=True, hide_index=True)
+
+# When each client was last active and at which hours it usually is
+activity = fetch_activity()
+if activity:
+    st.subheader("Client activity (last 7 days)", divider="gray")
+    activity_df = pd.DataFrame(activity)
+    st.dataframe(activity_df[["user", "last_active", "idle_hours", "requests", "bytes"]],
+                 use_container_width=True, hide_index=True)
+    heatmap_user = st.selectbox("Weekly activity of", activity_df["user"].tolist(),
+                                index=len(activity_df) - 1)
+    heatmap = next(client["heatmap"] for client in activity if client["user"] == heatmap_user)
+    heatmap_df = pd.DataFrame(heatmap, index=["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"])
+    st.plotly_chart(px.imshow(heatmap_df, labels={"x": "Hour", "y": "Day", "color": "Requests"},
+                              color_continuous_scale="Blues", aspect="auto"),
+                    use_container_width=True)
+
 # Fetch data with visual update effect
 with st.spinner("Updating data..."):
     data = fetch_data(from_date, to_date, host_filter if host_filter else None)
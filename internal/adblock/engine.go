@@ -0,0 +1,310 @@
+package adblock
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-proxy/internal/logger"
+)
+
+// Fetching limits for subscribed lists
+const (
+	fetchTimeout = time.Minute
+	maxListSize  = 50 << 20
+)
+
+// ruleSet holds the rules of one list, indexed by anchored domain so a
+// request is only matched against the rules that can apply to its host
+type ruleSet struct {
+	byDomain map[string][]*rule
+	generic  []*rule
+}
+
+// list is one filter list subscription
+type list struct {
+	source  string
+	blocks  ruleSet
+	rules   int
+	hits    atomic.Int64
+	updated time.Time
+	err     string
+}
+
+// ListStats describes a filter list and how often it blocked
+type ListStats struct {
+	Source  string    `json:"source"`
+	Rules   int       `json:"rules"`
+	Hits    int64     `json:"hits"`
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"` // Last refresh failure
+}
+
+// Engine blocks requests matching any of its filter lists, unless an
+// exception (@@) rule of any list allows them
+type Engine struct {
+	sources []string
+	client  *http.Client
+
+	mutex      sync.RWMutex
+	lists      []*list
+	exceptions ruleSet
+
+	stop chan struct{}
+}
+
+// New loads the filter lists at sources (files or http(s) URLs) and
+// re-reads them every refresh (0 disables refreshing)
+func New(sources []string, refresh time.Duration) *Engine {
+	e := &Engine{
+		sources: sources,
+		client:  &http.Client{},
+		stop:    make(chan struct{}),
+	}
+	e.Refresh()
+	if refresh > 0 {
+		go e.refreshLoop(refresh)
+	}
+	return e
+}
+
+// Close stops refreshing
+func (e *Engine) Close() {
+	close(e.stop)
+}
+
+// Refresh re-reads every list. A list that fails to load keeps its
+// previous rules.
+func (e *Engine) Refresh() {
+	e.mutex.RLock()
+	previous := make(map[string]*list, len(e.lists))
+	for _, l := range e.lists {
+		previous[l.source] = l
+	}
+	e.mutex.RUnlock()
+
+	lists := make([]*list, 0, len(e.sources))
+	exceptions := ruleSet{byDomain: make(map[string][]*rule)}
+	for _, source := range e.sources {
+		l, excepted, err := e.load(source)
+		if err != nil {
+			logger.Warn("Failed to load filter list %s: %v", source, err)
+			l = &list{source: source, blocks: ruleSet{byDomain: make(map[string][]*rule)}}
+			if old, ok := previous[source]; ok {
+				l.blocks, l.rules, l.updated = old.blocks, old.rules, old.updated
+			}
+			l.err = err.Error()
+		} else {
+			exceptions.add(excepted...)
+		}
+		if old, ok := previous[source]; ok {
+			l.hits.Store(old.hits.Load())
+		}
+		lists = append(lists, l)
+	}
+
+	e.mutex.Lock()
+	e.lists = lists
+	e.exceptions = exceptions
+	e.mutex.Unlock()
+}
+
+func (e *Engine) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.Refresh()
+		}
+	}
+}
+
+// load reads and compiles one list, returning its exception rules apart
+func (e *Engine) load(source string) (*list, []*rule, error) {
+	body, err := e.open(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	l := &list{source: source, blocks: ruleSet{byDomain: make(map[string][]*rule)}, updated: time.Now()}
+	var exceptions []*rule
+	invalid := 0
+	scanner := bufio.NewScanner(io.LimitReader(body, maxListSize))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		r, err := parseRule(scanner.Text())
+		if err != nil {
+			invalid++
+			logger.Debug("Skipping filter in %s: %v", source, err)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if r.exception {
+			exceptions = append(exceptions, r)
+		} else {
+			l.blocks.add(r)
+			l.rules++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	logger.Info("Loaded filter list %s: %d blocking and %d exception rules (%d invalid)",
+		source, l.rules, len(exceptions), invalid)
+	return l, exceptions, nil
+}
+
+// open returns the contents of a local or subscribed list
+func (e *Engine) open(source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return cancelOnClose{resp.Body, cancel}, nil
+}
+
+// cancelOnClose releases the fetch context along with the body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// Match reports whether a request for url (from a page on referrer, empty
+// if unknown) is blocked, and by which list
+func (e *Engine) Match(url, host, referrer string) (string, bool) {
+	host = strings.ToLower(host)
+	referrer = strings.ToLower(referrer)
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, l := range e.lists {
+		if l.blocks.match(url, host, referrer, false) {
+			if e.exceptions.match(url, host, referrer, false) {
+				return "", false
+			}
+			l.hits.Add(1)
+			return l.source, true
+		}
+	}
+	return "", false
+}
+
+// MatchHost reports whether every request to host is blocked, which is all
+// that can be decided for a CONNECT tunnel: only "||domain^" rules apply
+func (e *Engine) MatchHost(host string) (string, bool) {
+	host = strings.ToLower(host)
+	url := "https://" + host + "/"
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, l := range e.lists {
+		if l.blocks.match(url, host, "", true) {
+			if e.exceptions.match(url, host, "", true) {
+				return "", false
+			}
+			l.hits.Add(1)
+			return l.source, true
+		}
+	}
+	return "", false
+}
+
+// Lists returns the state and hit counters of every list
+func (e *Engine) Lists() []ListStats {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	stats := make([]ListStats, 0, len(e.lists))
+	for _, l := range e.lists {
+		stats = append(stats, ListStats{
+			Source:  l.source,
+			Rules:   l.rules,
+			Hits:    l.hits.Load(),
+			Updated: l.updated,
+			Error:   l.err,
+		})
+	}
+	return stats
+}
+
+// HandleStats serves Lists as JSON
+func (e *Engine) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.Lists())
+}
+
+func (s *ruleSet) add(rules ...*rule) {
+	for _, r := range rules {
+		if r.anchor != "" {
+			s.byDomain[r.anchor] = append(s.byDomain[r.anchor], r)
+		} else {
+			s.generic = append(s.generic, r)
+		}
+	}
+}
+
+// match reports whether any rule applies; with hostOnly only rules that
+// cover whole hosts are considered
+func (s *ruleSet) match(url, host, referrer string, hostOnly bool) bool {
+	// Anchored rules can only match the host or one of its parents
+	for domain := host; domain != ""; {
+		for _, r := range s.byDomain[domain] {
+			if (!hostOnly || r.hostOnly) && r.matches(url, host, referrer) {
+				return true
+			}
+		}
+		idx := strings.IndexByte(domain, '.')
+		if idx == -1 {
+			break
+		}
+		domain = domain[idx+1:]
+	}
+	if hostOnly {
+		return false
+	}
+	for _, r := range s.generic {
+		if r.matches(url, host, referrer) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+// Package adblock matches requests against Adblock Plus filter lists.
+// Only network filters are supported; element hiding, snippets and
+// rewriting options are skipped.
+package adblock
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// thirdParty restricts a rule to first- or third-party requests
+type thirdParty int
+
+const (
+	anyParty thirdParty = iota
+	firstPartyOnly
+	thirdPartyOnly
+)
+
+// rule is one compiled network filter
+type rule struct {
+	text       string
+	re         *regexp.Regexp
+	exception  bool
+	party      thirdParty
+	domains    []string // Referring domains the rule is limited to
+	notDomains []string // Referring domains the rule doesn't apply to
+	anchor     string   // Domain of a "||domain^..." rule, for indexing
+	hostOnly   bool     // "||domain^" alone: applies to whole hosts (CONNECT)
+}
+
+// optionsPattern recognises the "$option,..." suffix of a filter; a "$"
+// followed by anything else is part of the pattern
+var optionsPattern = regexp.MustCompile(`^~?[a-z0-9-]+(=[^,]*)?(,~?[a-z0-9-]+(=[^,]*)?)*$`)
+
+// anchoredDomain matches the domain of a "||domain" pattern that ends at a
+// separator, so "||ads.example.com^" and "||ads.example.com/x" are indexed
+// but "||ads" is not
+var anchoredDomain = regexp.MustCompile(`^\|\|([a-z0-9][a-z0-9.-]*[a-z0-9])([\^/:]|$)`)
+
+// ignoredOptions are resource types and hints that can't be told apart at
+// the proxy; rules using them apply to every request
+var ignoredOptions = map[string]bool{
+	"script": true, "image": true, "stylesheet": true, "object": true,
+	"xmlhttprequest": true, "xhr": true, "subdocument": true, "ping": true,
+	"media": true, "font": true, "other": true, "websocket": true,
+	"webrtc": true, "beacon": true, "important": true, "all": true,
+}
+
+// parseRule compiles one line of a filter list. It returns nil for
+// comments, element hiding and filters using unsupported options.
+func parseRule(line string) (*rule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, nil
+	}
+	for _, marker := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(line, marker) {
+			return nil, nil
+		}
+	}
+
+	r := &rule{text: line}
+	pattern := line
+	if strings.HasPrefix(pattern, "@@") {
+		r.exception = true
+		pattern = pattern[2:]
+	}
+
+	matchCase := false
+	if idx := strings.LastIndex(pattern, "$"); idx != -1 && optionsPattern.MatchString(strings.ToLower(pattern[idx+1:])) {
+		for _, option := range strings.Split(pattern[idx+1:], ",") {
+			name, value, _ := strings.Cut(strings.ToLower(option), "=")
+			switch {
+			case name == "third-party" || name == "3p" || name == "~first-party" || name == "~1p":
+				r.party = thirdPartyOnly
+			case name == "~third-party" || name == "~3p" || name == "first-party" || name == "1p":
+				r.party = firstPartyOnly
+			case name == "match-case":
+				matchCase = true
+			case name == "domain":
+				for _, domain := range strings.Split(value, "|") {
+					if strings.HasPrefix(domain, "~") {
+						r.notDomains = append(r.notDomains, domain[1:])
+					} else if domain != "" {
+						r.domains = append(r.domains, domain)
+					}
+				}
+			case ignoredOptions[strings.TrimPrefix(name, "~")]:
+			default:
+				return nil, nil
+			}
+		}
+		pattern = pattern[:idx]
+	}
+	if pattern == "" {
+		return nil, nil
+	}
+
+	expr := ""
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr = pattern[1 : len(pattern)-1]
+	} else {
+		lower := strings.ToLower(pattern)
+		if m := anchoredDomain.FindStringSubmatch(lower); m != nil {
+			r.anchor = m[1]
+			r.hostOnly = (lower == "||"+m[1]+"^" || lower == "||"+m[1]) &&
+				r.party == anyParty && len(r.domains) == 0 && len(r.notDomains) == 0
+		}
+		expr = patternToRegexp(pattern)
+	}
+	if !matchCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", line, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// patternToRegexp translates the ABP wildcards: * (anything), ^ (a
+// separator or the end), | (anchor at the start or end) and || (anchor at
+// a domain boundary)
+func patternToRegexp(pattern string) string {
+	var b strings.Builder
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		b.WriteString(`^[a-z][a-z0-9+.-]*://([^/?#]*\.)?`)
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		b.WriteString("^")
+		pattern = pattern[1:]
+	}
+	endAnchor := strings.HasSuffix(pattern, "|")
+	pattern = strings.TrimSuffix(pattern, "|")
+
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^\w\-.%]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if endAnchor {
+		b.WriteString("$")
+	}
+	return b.String()
+}
+
+// matches reports whether r applies to a request for url from a page on
+// referrer (empty if unknown)
+func (r *rule) matches(url, host, referrer string) bool {
+	if r.party != anyParty && referrer != "" {
+		if ThirdParty(host, referrer) != (r.party == thirdPartyOnly) {
+			return false
+		}
+	}
+	if len(r.domains) > 0 && !domainIn(referrer, r.domains) {
+		return false
+	}
+	if domainIn(referrer, r.notDomains) {
+		return false
+	}
+	return r.re.MatchString(url)
+}
+
+// domainIn reports whether host is one of domains or a subdomain of one
+func domainIn(host string, domains []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ThirdParty reports whether a request to host made from a page on
+// referrer crosses sites
+func ThirdParty(host, referrer string) bool {
+	return baseDomain(strings.ToLower(host)) != baseDomain(strings.ToLower(referrer))
+}
+
+// baseDomain approximates the registrable domain of host by its last two
+// labels, which is what first/third-party decisions are made on
+func baseDomain(host string) string {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// Bounds of the days an activity heatmap covers; hourly user records are
+// only kept for 15 days
+const (
+	defaultActivityDays = 7
+	maxActivityDays     = 15
+	// lastActiveDays is how far back daily records are searched for the
+	// last activity of a client
+	lastActiveDays = 90
+)
+
+// HandleActivity reports for each client when it was last active and a
+// heatmap of its requests by weekday and hour over the last ?days= (default
+// 7, at most 15), idlest first. ?idle= (a duration such as 48h) keeps only
+// clients idle at least that long and ?user= a single client.
+func (h *Handler) HandleActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	days := defaultActivityDays
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxActivityDays {
+			sendJSONResponse(w, ActivityResponse{Error: "Invalid days. Use 1 to 15"}, http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	var idle time.Duration
+	if value := query.Get("idle"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			sendJSONResponse(w, ActivityResponse{Error: "Invalid idle duration"}, http.StatusBadRequest)
+			return
+		}
+		idle = d
+	}
+	only := query.Get("user")
+
+	now := time.Now()
+	today, _ := time.Parse("2006-01-02", now.Format("2006-01-02"))
+	clients := make(map[string]*ClientActivity)
+	client := func(user string) *ClientActivity {
+		activity, ok := clients[user]
+		if !ok {
+			activity = &ClientActivity{User: user}
+			clients[user] = activity
+		}
+		return activity
+	}
+
+	keys, records, err := h.store.GetUserStats(today.AddDate(0, 0, 1-lastActiveDays), today)
+	if err == nil {
+		keys, records = scopeUserRecords(r.Context(), keys, records)
+		for _, key := range keys {
+			record := records[key]
+			if only != "" && record.User != only {
+				continue
+			}
+			if activity := client(record.User); record.LastSeen.After(activity.LastActive) {
+				activity.LastActive = record.LastSeen
+			}
+		}
+		keys, records, err = h.store.GetUserHourlyStats(today.AddDate(0, 0, 1-days), today)
+	}
+	if err != nil {
+		h.log.Info("API Error: Failed to fetch user activity: %v", err)
+		sendJSONResponse(w, ActivityResponse{Error: "Failed to fetch data: " + err.Error()}, storeErrorStatus(w, err))
+		return
+	}
+	keys, records = scopeUserRecords(r.Context(), keys, records)
+	for _, key := range keys {
+		record := records[key]
+		date, hour, ok := storage.RecordHour(key)
+		if !ok || (only != "" && record.User != only) {
+			continue
+		}
+		activity := client(record.User)
+		activity.Requests += record.RequestCount
+		activity.Bytes += record.BytesTransferred
+		activity.Heatmap[date.Weekday()][hour] += record.RequestCount
+		if record.LastSeen.After(activity.LastActive) {
+			activity.LastActive = record.LastSeen
+		}
+	}
+
+	response := ActivityResponse{Days: days, Clients: []ClientActivity{}}
+	for _, activity := range clients {
+		if !activity.LastActive.IsZero() {
+			activity.IdleHours = math.Round(now.Sub(activity.LastActive).Hours()*10) / 10
+		}
+		if now.Sub(activity.LastActive) >= idle {
+			response.Clients = append(response.Clients, *activity)
+		}
+	}
+	sort.Slice(response.Clients, func(i, j int) bool {
+		if !response.Clients[i].LastActive.Equal(response.Clients[j].LastActive) {
+			return response.Clients[i].LastActive.Before(response.Clients[j].LastActive)
+		}
+		return response.Clients[i].User < response.Clients[j].User
+	})
+	sendJSONResponse(w, response, http.StatusOK)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/geo"
+	"go-proxy/internal/logger"
+)
+
+// ReloadFunc re-reads the configuration and applies it to the running proxy
+type ReloadFunc func() (*config.ReloadResult, error)
+
+// AdminHandler serves the /api/admin/* endpoints
+type AdminHandler struct {
+	reload ReloadFunc
+}
+
+// ReloadResponse represents the response of the reload endpoint
+type ReloadResponse struct {
+	*config.ReloadResult
+	Error string `json:"error,omitempty"`
+}
+
+// NewAdminHandler creates an admin handler that uses reload to apply config changes
+func NewAdminHandler(reload ReloadFunc) *AdminHandler {
+	return &AdminHandler{reload: reload}
+}
+
+// HandleReload re-reads the config file and applies reloadable settings
+func (h *AdminHandler) HandleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Log("Config reload requested from %s", r.RemoteAddr)
+
+	result, err := h.reload()
+	if err != nil {
+		logger.Log("API Error: Config reload failed: %v", err)
+		sendJSONResponse(w, ReloadResponse{
+			Error: "Reload failed: " + err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, ReloadResponse{ReloadResult: result}, http.StatusOK)
+}
+
+// LogLevelRequest represents the body of a PUT /api/admin/loglevel request
+type LogLevelRequest struct {
+	Level    string `json:"level"`
+	GeoDebug *bool  `json:"geo_debug,omitempty"` // Defaults to level == "debug"
+}
+
+// LogLevelResponse reports the active logging verbosity
+type LogLevelResponse struct {
+	Level    string `json:"level"`
+	GeoDebug bool   `json:"geo_debug"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HandleLogLevel reports (GET) or changes (PUT) the log level of the running instance
+func (h *AdminHandler) HandleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponse(w, LogLevelResponse{
+				Error: "Invalid request format",
+			}, http.StatusBadRequest)
+			return
+		}
+
+		level, err := logger.ParseLevel(req.Level)
+		if err != nil {
+			sendJSONResponse(w, LogLevelResponse{
+				Error: "Invalid level. Use debug, info, warn or error",
+			}, http.StatusBadRequest)
+			return
+		}
+
+		geoDebug := level == logger.LevelDebug
+		if req.GeoDebug != nil {
+			geoDebug = *req.GeoDebug
+		}
+
+		logger.SetLevel(level)
+		geo.SetDebug(geoDebug)
+		logger.Log("Log level set to %s (geo debug %t) by %s", level, geoDebug, r.RemoteAddr)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendJSONResponse(w, LogLevelResponse{
+		Level:    logger.GetLevel().String(),
+		GeoDebug: geo.DebugEnabled(),
+	}, http.StatusOK)
+}
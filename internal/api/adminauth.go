@@ -0,0 +1,43 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminGuard limits the requests that change the running proxy to admins:
+// with SSO the web API login checks the admin role, otherwise they must
+// carry the -admin-token (Authorization: Bearer <admin_token>)
+type AdminGuard struct {
+	token string
+	sso   bool
+}
+
+// NewAdminGuard creates a guard checking token, or deferring to SSO if sso
+// is set. Without either, changes through the API are refused.
+func NewAdminGuard(token string, sso bool) *AdminGuard {
+	return &AdminGuard{token: token, sso: sso}
+}
+
+// Require wraps handler so that requests other than GET and HEAD need admin
+// rights
+func (g *AdminGuard) Require(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if g.sso || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		if g.token == "" {
+			http.Error(w, "Admin API disabled: set -admin-token or SSO", http.StatusForbidden)
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
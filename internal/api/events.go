@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/storage"
+)
+
+// maxEventWait bounds how long a consumer may wait for new events
+const maxEventWait = time.Minute
+
+// EventReader reads the event stream from a cursor
+type EventReader interface {
+	Read(ctx context.Context, cursor string, limit int64, wait time.Duration) ([]storage.Event, error)
+}
+
+// EventsHandler serves /api/events from the event stream
+type EventsHandler struct {
+	events EventReader
+	log    logger.Logger
+}
+
+// EventsResponse is a page of events and the cursor of the next page
+type EventsResponse struct {
+	Events []storage.Event `json:"events"`
+	Cursor string          `json:"cursor"` // Pass as ?cursor= to read on
+	Error  string          `json:"error,omitempty"`
+}
+
+// NewEventsHandler creates the events API. A nil log uses the process-wide
+// log.
+func NewEventsHandler(events EventReader, log logger.Logger) *EventsHandler {
+	if log == nil {
+		log = logger.Default()
+	}
+	return &EventsHandler{events: events, log: log}
+}
+
+// HandleEvents returns up to ?limit= (default 100, max 1000) events after
+// ?cursor=, oldest first, optionally only those of ?type=. ?wait= (e.g.
+// 30s) holds the request until an event arrives, for long polling.
+func (h *EventsHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	cursor := query.Get("cursor")
+	limit := int64(100)
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 || n > 1000 {
+			sendJSONResponse(w, EventsResponse{Error: "Invalid limit (want 1-1000)"}, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var wait time.Duration
+	if value := query.Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			sendJSONResponse(w, EventsResponse{Error: "Invalid wait duration"}, http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxEventWait)
+	}
+
+	events, err := h.events.Read(r.Context(), cursor, limit, wait)
+	if err != nil {
+		h.log.Info("API Error: Failed to read events: %v", err)
+		sendJSONResponse(w, EventsResponse{Error: "Failed to read events: " + err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	response := EventsResponse{Events: []storage.Event{}, Cursor: cursor}
+	kind := query.Get("type")
+	for _, event := range events {
+		// The cursor moves past filtered out events too
+		response.Cursor = event.ID
+		if kind == "" || event.Type == kind {
+			response.Events = append(response.Events, event)
+		}
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
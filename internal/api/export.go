@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// maxImportSize bounds the body of an import request
+const maxImportSize = 256 << 20
+
+// ImportResponse reports the outcome of an import request
+type ImportResponse struct {
+	Imported int    `json:"imported"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HandleExport streams the stats between from_date and to_date (inclusive,
+// YYYY-MM-DD; both default to today) as a gzipped JSON dump
+func (h *Handler) HandleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	today := time.Now().Format("2006-01-02")
+	fromStr, toStr := r.URL.Query().Get("from_date"), r.URL.Query().Get("to_date")
+	if fromStr == "" {
+		fromStr = today
+	}
+	if toStr == "" {
+		toStr = today
+	}
+	fromDate, err := time.Parse("2006-01-02", fromStr)
+	if err != nil {
+		http.Error(w, "Invalid from_date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	toDate, err := time.Parse("2006-01-02", toStr)
+	if err != nil {
+		http.Error(w, "Invalid to_date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	dump, err := storage.Export(h.store, fromDate, toDate)
+	if err != nil {
+		h.log.Error("API Error: Export failed: %v", err)
+		http.Error(w, "Export failed", storeErrorStatus(w, err))
+		return
+	}
+
+	h.log.Info("Exporting %d host and %d user records (%s to %s) to %s",
+		len(dump.Hosts), len(dump.Users), fromStr, toStr, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="stats-%s-%s.json.gz"`, fromStr, toStr))
+	if err := storage.WriteDump(w, dump); err != nil {
+		h.log.Warn("Export to %s interrupted: %v", r.RemoteAddr, err)
+	}
+}
+
+// HandleImport loads a dump produced by HandleExport (or proxyctl export).
+// With ?merge=true records are added to existing ones, e.g. to combine
+// several instances; otherwise they replace them.
+func (h *Handler) HandleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dump, err := storage.ReadDump(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		sendJSONResponse(w, ImportResponse{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	merge := r.URL.Query().Get("merge") == "true"
+	imported, err := storage.Import(h.store, dump, merge)
+	if err != nil {
+		status := storeErrorStatus(w, err)
+		if errors.Is(err, storage.ErrImportUnsupported) {
+			status = http.StatusNotImplemented
+		}
+		h.log.Error("API Error: Import failed after %d records: %v", imported, err)
+		sendJSONResponse(w, ImportResponse{Imported: imported, Error: err.Error()}, status)
+		return
+	}
+
+	h.log.Info("Imported %d records from %s (merge=%t)", imported, r.RemoteAddr, merge)
+	sendJSONResponse(w, ImportResponse{Imported: imported}, http.StatusOK)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"go-proxy/internal/geo"
+)
+
+// HandleGeoStats sums host stats by destination country, region or city
+// (?level=, default country) over ?from_date= to ?to_date=, which default
+// to the last seven days
+func (h *Handler) HandleGeoStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	level := query.Get("level")
+	if level == "" {
+		level = "country"
+	}
+	if level != "country" && level != "region" && level != "city" {
+		sendJSONResponse(w, GeoStatsResponse{
+			Error: "Invalid level. Use 'country', 'region' or 'city'",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	fromDate, toDate := today.AddDate(0, 0, -6), today
+	for name, target := range map[string]*time.Time{"from_date": &fromDate, "to_date": &toDate} {
+		if value := query.Get(name); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				sendJSONResponse(w, GeoStatsResponse{
+					Error: "Invalid " + name + " format. Use YYYY-MM-DD",
+				}, http.StatusBadRequest)
+				return
+			}
+			*target = date
+		}
+	}
+
+	cache := geo.Default()
+	if cache == nil {
+		sendJSONResponse(w, GeoStatsResponse{Error: "Geolocation is disabled"}, http.StatusServiceUnavailable)
+		return
+	}
+	locations, err := cache.Records()
+	if err != nil {
+		h.log.Info("API Error: Failed to fetch geolocation records: %v", err)
+		sendJSONResponse(w, GeoStatsResponse{
+			Error: "Failed to fetch geolocation records: " + err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	// Add one day to toDate to include the entire last day
+	_, records, err := h.store.GetDailyStats(fromDate, toDate.Add(24*time.Hour), "", "day")
+	if err != nil {
+		h.log.Info("API Error: Failed to fetch daily stats: %v", err)
+		sendJSONResponse(w, GeoStatsResponse{
+			Error: "Failed to fetch data: " + err.Error(),
+		}, storeErrorStatus(w, err))
+		return
+	}
+
+	response := GeoStatsResponse{Level: level, Buckets: []GeoStatsBucket{}}
+	buckets := make(map[GeoStatsBucket]*GeoStatsBucket)
+	hosts := make(map[*GeoStatsBucket]map[string]bool)
+	for _, record := range records {
+		bucket := &response.Unlocated
+		if location, ok := locations[record.Host]; ok {
+			key := GeoStatsBucket{CountryCode: location.CountryCode, Country: location.CountryName}
+			if level != "country" {
+				key.Region = location.Region
+			}
+			if level == "city" {
+				key.City = location.City
+			}
+			if bucket, ok = buckets[key]; !ok {
+				bucket = &key
+				buckets[key] = bucket
+			}
+		}
+		if hosts[bucket] == nil {
+			hosts[bucket] = make(map[string]bool)
+		}
+		hosts[bucket][record.Host] = true
+		bucket.Requests += record.Connections
+		bucket.Blocked += record.BlockedAttempts
+		bucket.Bytes += record.BytesTransferred
+	}
+	for bucket, names := range hosts {
+		bucket.Hosts = len(names)
+	}
+
+	for _, bucket := range buckets {
+		response.Buckets = append(response.Buckets, *bucket)
+	}
+	sort.Slice(response.Buckets, func(i, j int) bool {
+		a, b := response.Buckets[i], response.Buckets[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Country+a.Region+a.City < b.Country+b.Region+b.City
+	})
+	sendJSONResponse(w, response, http.StatusOK)
+}
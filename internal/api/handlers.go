@@ -2,24 +2,41 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"go-proxy/internal/geo"
 	"go-proxy/internal/logger"
 	"go-proxy/internal/metrics"
 	"go-proxy/internal/storage"
 )
 
-type Handler struct{}
+// Handler serves the stats API from a StatsStore
+type Handler struct {
+	store    storage.StatsStore
+	log      logger.Logger
+	internal func() metrics.InternalStats // nil leaves them out of /api/metrics
+}
+
+// NewHandler creates the stats API. A nil log uses the process-wide log.
+func NewHandler(store storage.StatsStore, log logger.Logger) *Handler {
+	if log == nil {
+		log = logger.Default()
+	}
+	return &Handler{store: store, log: log}
+}
 
-func NewHandler() *Handler {
-	return &Handler{}
+// SetInternalStats makes /api/metrics include the proxy's own counters as
+// returned by fn
+func (h *Handler) SetInternalStats(fn func() metrics.InternalStats) {
+	h.internal = fn
 }
 
 // HandleDailyStats handles requests for daily or hourly statistics based on a date range
 func (h *Handler) HandleDailyStats(w http.ResponseWriter, r *http.Request) {
-	logger.Log("Handling stats request from %s", r.RemoteAddr)
+	h.log.Info("Handling stats request from %s", r.RemoteAddr)
 
 	var fromDate, toDate time.Time
 	var err error
@@ -31,7 +48,7 @@ func (h *Handler) HandleDailyStats(w http.ResponseWriter, r *http.Request) {
 		fromStr := r.URL.Query().Get("from_date")
 		toStr := r.URL.Query().Get("to_date")
 		hostFilterStr = r.URL.Query().Get("host_filter")
-		
+
 		// Get granularity if provided
 		if g := r.URL.Query().Get("granularity"); g != "" {
 			granularity = g
@@ -86,7 +103,7 @@ func (h *Handler) HandleDailyStats(w http.ResponseWriter, r *http.Request) {
 		}
 
 		hostFilterStr = req.HostFilter
-		
+
 		// Use granularity if provided
 		if req.Granularity != "" {
 			granularity = req.Granularity
@@ -108,16 +125,17 @@ func (h *Handler) HandleDailyStats(w http.ResponseWriter, r *http.Request) {
 	// Add one day to toDate to include the entire last day
 	toDate = toDate.Add(24 * time.Hour)
 
-	keys, records, err := storage.GetDailyStats(fromDate, toDate, hostFilterStr, granularity)
+	keys, records, err := h.store.GetDailyStats(fromDate, toDate, hostFilterStr, granularity)
 	if err != nil {
-		logger.Log("API Error: Failed to fetch %s stats: %v", granularity, err)
+		h.log.Info("API Error: Failed to fetch %s stats: %v", granularity, err)
 		sendJSONResponse(w, StatsResponse{
 			Error: "Failed to fetch data: " + err.Error(),
-		}, http.StatusInternalServerError)
+		}, storeErrorStatus(w, err))
 		return
 	}
+	keys, records = scopeHostRecords(r.Context(), keys, records)
 
-	logger.Log("%s stats query: %v to %v, found %d records",
+	h.log.Info("%s stats query: %v to %v, found %d records",
 		granularity, fromDate.Format("2006-01-02"), toDate.Format("2006-01-02"), len(keys))
 
 	sendJSONResponse(w, StatsResponse{
@@ -128,7 +146,7 @@ func (h *Handler) HandleDailyStats(w http.ResponseWriter, r *http.Request) {
 
 // HandleHourlyStats handles requests for hourly statistics
 func (h *Handler) HandleHourlyStats(w http.ResponseWriter, r *http.Request) {
-	logger.Log("Handling hourly stats request from %s", r.RemoteAddr)
+	h.log.Info("Handling hourly stats request from %s", r.RemoteAddr)
 
 	var date time.Time
 	var fromHour, toHour int
@@ -197,16 +215,17 @@ func (h *Handler) HandleHourlyStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	keys, records, err := storage.GetHourlyStats(date, fromHour, toHour)
+	keys, records, err := h.store.GetHourlyStats(date, fromHour, toHour)
 	if err != nil {
-		logger.Log("API Error: Failed to fetch hourly stats: %v", err)
+		h.log.Info("API Error: Failed to fetch hourly stats: %v", err)
 		sendJSONResponse(w, StatsResponse{
 			Error: "Failed to fetch data: " + err.Error(),
-		}, http.StatusInternalServerError)
+		}, storeErrorStatus(w, err))
 		return
 	}
+	keys, records = scopeHostRecords(r.Context(), keys, records)
 
-	logger.Log("Hourly stats query: %v (%02d:00-%02d:00), found %d records",
+	h.log.Info("Hourly stats query: %v (%02d:00-%02d:00), found %d records",
 		date.Format("2006-01-02"), fromHour, toHour, len(keys))
 
 	sendJSONResponse(w, StatsResponse{
@@ -221,16 +240,22 @@ func (h *Handler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
 	hourAgo := now.Add(-1 * time.Hour)
 
 	// Get data by hour granularity
-	_, records, err := storage.GetDailyStats(hourAgo, now, "", "hour")
+	_, records, err := h.store.GetDailyStats(hourAgo, now, "", "hour")
 	if err != nil {
-		http.Error(w, "Failed to fetch metrics", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch metrics", storeErrorStatus(w, err))
 		return
 	}
 
-	metrics := metrics.TransformHostStats(records)
+	points := metrics.TransformHostStats(records)
+	if cache := geo.Default(); cache != nil {
+		points = append(points, metrics.TransformGeoStats(cache.Stats(), now)...)
+	}
+	if h.internal != nil {
+		points = append(points, metrics.TransformInternalStats(h.internal(), now)...)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	json.NewEncoder(w).Encode(points)
 }
 
 func sendJSONResponse(w http.ResponseWriter, response interface{}, statusCode int) {
@@ -243,3 +268,13 @@ func sendJSONResponse(w http.ResponseWriter, response interface{}, statusCode in
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(response)
 }
+
+// storeErrorStatus returns the status for a failed store query: 503 with a
+// Retry-After while there is no backend to ask, 500 otherwise
+func storeErrorStatus(w http.ResponseWriter, err error) int {
+	if errors.Is(err, storage.ErrUnavailable) {
+		w.Header().Set("Retry-After", "5")
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-proxy/internal/report"
+)
+
+// reportPeriods maps the period parameter of a report request to the
+// report's name and length in days
+var reportPeriods = map[string]struct {
+	name string
+	days int
+}{
+	"day":   {"daily", 1},
+	"week":  {"weekly", 7},
+	"month": {"monthly", 30},
+}
+
+// HandleReport generates a report of the ?period= (day, week or month;
+// default week) ending with ?to_date= (YYYY-MM-DD, default today) as a
+// self-contained ?format=html (default) or pdf document with ?top= rows
+// (default 20) per table
+func (h *Handler) HandleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	periodName := query.Get("period")
+	if periodName == "" {
+		periodName = "week"
+	}
+	period, ok := reportPeriods[periodName]
+	if !ok {
+		http.Error(w, "Invalid period. Use day, week or month", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "html"
+	}
+	if format != "html" && format != "pdf" {
+		http.Error(w, "Invalid format. Use html or pdf", http.StatusBadRequest)
+		return
+	}
+	toStr := query.Get("to_date")
+	if toStr == "" {
+		toStr = time.Now().Format("2006-01-02")
+	}
+	toDate, err := time.Parse("2006-01-02", toStr)
+	if err != nil {
+		http.Error(w, "Invalid to_date format. Use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	top := 20
+	if value := query.Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	fromDate := toDate.AddDate(0, 0, 1-period.days)
+	rep, err := report.Build(h.store, period.name, fromDate, toDate, top)
+	if err != nil {
+		h.log.Error("API Error: Report failed: %v", err)
+		http.Error(w, "Report failed", storeErrorStatus(w, err))
+		return
+	}
+
+	var body []byte
+	contentType := "text/html; charset=utf-8"
+	if format == "pdf" {
+		body, err = rep.PDF()
+		contentType = "application/pdf"
+	} else {
+		body, err = rep.HTML()
+	}
+	if err != nil {
+		h.log.Error("API Error: Rendering report failed: %v", err)
+		http.Error(w, "Report failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.log.Info("Generated %s %s report (%s to %s) for %s",
+		period.name, format, fromDate.Format("2006-01-02"), toStr, r.RemoteAddr)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`inline; filename="report-%s-%s.%s"`, period.name, fromDate.Format("2006-01-02"), format))
+	w.Write(body)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go-proxy/internal/stats"
+	"go-proxy/internal/tenant"
+)
+
+// tenantPaths are the endpoints a tenant API token may use
+var tenantPaths = map[string]bool{
+	"/api/stats/daily":  true,
+	"/api/stats/hourly": true,
+	"/api/stats/users":  true,
+}
+
+// TenantScope lets tenants read their own stats with their API token
+// (Authorization: Bearer <api_token>). Such requests go straight to mux,
+// limited to tenantPaths and to the tenant's records; all other requests
+// are served by next.
+func TenantScope(next, mux http.Handler, tenants func() *tenant.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		registry := tenants()
+		if !ok || registry == nil || r.URL.IsAbs() || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := registry.ByToken(token)
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !tenantPaths[r.URL.Path] {
+			http.Error(w, "Not available to tenant tokens", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(tenant.WithTenant(r.Context(), t)))
+	})
+}
+
+// scopeHostRecords keeps the host records of the tenant ctx is scoped to,
+// with their hosts outside the tenant namespace. Unscoped requests see all
+// records.
+func scopeHostRecords(ctx context.Context, keys []string, records map[string]stats.HostStats) ([]string, map[string]stats.HostStats) {
+	t := tenant.FromContext(ctx)
+	if t == nil {
+		return keys, records
+	}
+	scoped := make(map[string]stats.HostStats)
+	var scopedKeys []string
+	for _, key := range keys {
+		record, ok := records[key]
+		if name, host := tenant.Unscope(record.Host); ok && name == t.Name {
+			record.Host = host
+			scoped[key] = record
+			scopedKeys = append(scopedKeys, key)
+		}
+	}
+	return scopedKeys, scoped
+}
+
+// scopeUserRecords is scopeHostRecords for user records
+func scopeUserRecords(ctx context.Context, keys []string, records map[string]stats.UserStats) ([]string, map[string]stats.UserStats) {
+	t := tenant.FromContext(ctx)
+	if t == nil {
+		return keys, records
+	}
+	scoped := make(map[string]stats.UserStats)
+	var scopedKeys []string
+	for _, key := range keys {
+		record, ok := records[key]
+		if name, user := tenant.Unscope(record.User); ok && name == t.Name {
+			record.User = user
+			scoped[key] = record
+			scopedKeys = append(scopedKeys, key)
+		}
+	}
+	return scopedKeys, scoped
+}
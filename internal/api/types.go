@@ -1,13 +1,17 @@
 package api
 
-import "go-proxy/internal/stats"
+import (
+	"time"
+
+	"go-proxy/internal/stats"
+)
 
 // DailyStatsRequest represents the request structure for daily statistics
 type DailyStatsRequest struct {
-	FromDate    string `json:"from_date"`    // Format: "2024-03-22"
-	ToDate      string `json:"to_date"`      // Format: "2024-03-24"
-	HostFilter  string `json:"host_filter"`  // Format: "example.com"
-	Granularity string `json:"granularity"`  // "day" or "hour"
+	FromDate    string `json:"from_date"`   // Format: "2024-03-22"
+	ToDate      string `json:"to_date"`     // Format: "2024-03-24"
+	HostFilter  string `json:"host_filter"` // Format: "example.com"
+	Granularity string `json:"granularity"` // "day" or "hour"
 }
 
 // HourlyStatsRequest represents the request structure for hourly statistics
@@ -23,3 +27,49 @@ type StatsResponse struct {
 	Records map[string]stats.HostStats `json:"records"`
 	Error   string                     `json:"error,omitempty"`
 }
+
+// UserStatsResponse represents the response structure for per-user statistics
+type UserStatsResponse struct {
+	Keys    []string                   `json:"keys"`
+	Records map[string]stats.UserStats `json:"records"`
+	Error   string                     `json:"error,omitempty"`
+}
+
+// GeoStatsBucket sums the traffic of the hosts in one country, region or
+// city
+type GeoStatsBucket struct {
+	CountryCode string `json:"country_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Region      string `json:"region,omitempty"` // Set for level region and city
+	City        string `json:"city,omitempty"`   // Set for level city
+	Hosts       int    `json:"hosts"`
+	Requests    int64  `json:"requests"`
+	Blocked     int64  `json:"blocked"`
+	Bytes       uint64 `json:"bytes"`
+}
+
+// GeoStatsResponse represents the response of the geo stats endpoint
+type GeoStatsResponse struct {
+	Level     string           `json:"level"`
+	Buckets   []GeoStatsBucket `json:"buckets"`   // Busiest first
+	Unlocated GeoStatsBucket   `json:"unlocated"` // Hosts without a geolocation record
+	Error     string           `json:"error,omitempty"`
+}
+
+// ClientActivity is when a client was last active and at which hours of
+// the week it usually is
+type ClientActivity struct {
+	User       string       `json:"user"`
+	LastActive time.Time    `json:"last_active"`
+	IdleHours  float64      `json:"idle_hours"` // Since LastActive
+	Requests   int64        `json:"requests"`   // Over the heatmap's days
+	Bytes      uint64       `json:"bytes"`      // Over the heatmap's days
+	Heatmap    [7][24]int64 `json:"heatmap"`    // Requests by weekday (Sunday first) and hour
+}
+
+// ActivityResponse represents the response of the client activity endpoint
+type ActivityResponse struct {
+	Days    int              `json:"days"` // Days the heatmaps cover
+	Clients []ClientActivity `json:"clients"`
+	Error   string           `json:"error,omitempty"`
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// HandleUserStats handles requests for daily per-user statistics
+func (h *Handler) HandleUserStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fromDate, err := time.Parse("2006-01-02", r.URL.Query().Get("from_date"))
+	if err != nil {
+		sendJSONResponse(w, UserStatsResponse{
+			Error: "Invalid from_date format. Use YYYY-MM-DD",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	toDate, err := time.Parse("2006-01-02", r.URL.Query().Get("to_date"))
+	if err != nil {
+		sendJSONResponse(w, UserStatsResponse{
+			Error: "Invalid to_date format. Use YYYY-MM-DD",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	keys, records, err := h.store.GetUserStats(fromDate, toDate)
+	if err != nil {
+		h.log.Info("API Error: Failed to fetch user stats: %v", err)
+		sendJSONResponse(w, UserStatsResponse{
+			Error: "Failed to fetch data: " + err.Error(),
+		}, storeErrorStatus(w, err))
+		return
+	}
+	keys, records = scopeUserRecords(r.Context(), keys, records)
+
+	sendJSONResponse(w, UserStatsResponse{
+		Keys:    keys,
+		Records: records,
+	}, http.StatusOK)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+
+	"go-proxy/internal/logger"
+)
+
+// defaultWakeAddr is where magic packets go unless ?broadcast= says
+// otherwise: the local broadcast address, on the discard port
+const defaultWakeAddr = "255.255.255.255:9"
+
+// WakeResponse represents the response of the Wake-on-LAN endpoint
+type WakeResponse struct {
+	MAC       string `json:"mac,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HandleWake sends a Wake-on-LAN magic packet for ?mac= to the ?broadcast=
+// address (IP or IP:port, default 255.255.255.255:9)
+func (h *AdminHandler) HandleWake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil || len(mac) != 6 {
+		sendJSONResponse(w, WakeResponse{Error: "Invalid mac, want e.g. 00:11:22:33:44:55"}, http.StatusBadRequest)
+		return
+	}
+	broadcast := query.Get("broadcast")
+	if broadcast == "" {
+		broadcast = defaultWakeAddr
+	} else if ip := net.ParseIP(broadcast); ip != nil {
+		broadcast = net.JoinHostPort(ip.String(), "9")
+	}
+	// Only addresses, so the request can't be pointed at names to resolve
+	host, _, err := net.SplitHostPort(broadcast)
+	if err != nil || net.ParseIP(host) == nil {
+		sendJSONResponse(w, WakeResponse{Error: "Invalid broadcast address"}, http.StatusBadRequest)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", broadcast)
+	if err != nil {
+		sendJSONResponse(w, WakeResponse{Error: "Invalid broadcast address"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := sendMagicPacket(mac, addr); err != nil {
+		logger.Log("API Error: Wake-on-LAN for %s failed: %v", mac, err)
+		sendJSONResponse(w, WakeResponse{Error: "Sending magic packet failed: " + err.Error()}, http.StatusBadGateway)
+		return
+	}
+	logger.Log("Sent Wake-on-LAN packet for %s to %s (requested from %s)", mac, addr, r.RemoteAddr)
+	sendJSONResponse(w, WakeResponse{MAC: mac.String(), Broadcast: addr.String()}, http.StatusOK)
+}
+
+// sendMagicPacket sends the Wake-on-LAN packet of mac, six 0xff bytes
+// followed by the address sixteen times, to addr
+func sendMagicPacket(mac net.HardwareAddr, addr *net.UDPAddr) error {
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
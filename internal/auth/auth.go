@@ -0,0 +1,134 @@
+// Package auth implements proxy authentication via the
+// Proxy-Authorization / Proxy-Authenticate headers.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go-proxy/internal/config"
+)
+
+// ErrInvalidCredentials is returned when credentials were supplied but
+// could not be verified
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrNoCredentials is returned when the request carries no credentials
+// for any configured scheme
+var ErrNoCredentials = errors.New("no proxy credentials")
+
+// Identity is an authenticated proxy user
+type Identity struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+	Method string   `json:"method"` // Scheme that authenticated the user
+}
+
+// Authenticator verifies credentials for one authentication scheme
+type Authenticator interface {
+	// Scheme is the scheme name offered in Proxy-Authenticate, e.g. "Basic"
+	Scheme() string
+	// Challenge is the full Proxy-Authenticate value sent to clients
+	Challenge() string
+	// Authenticate verifies credentials, the Proxy-Authorization value
+	// after the scheme name
+	Authenticate(r *http.Request, credentials string) (*Identity, error)
+}
+
+// Chain offers several authenticators and uses whichever matches the
+// scheme the client picked
+type Chain []Authenticator
+
+// Authenticate verifies the Proxy-Authorization header of r
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return nil, ErrNoCredentials
+	}
+
+	scheme, credentials, _ := strings.Cut(header, " ")
+	for _, a := range c {
+		if strings.EqualFold(a.Scheme(), scheme) {
+			identity, err := a.Authenticate(r, strings.TrimSpace(credentials))
+			if err != nil {
+				return nil, err
+			}
+			identity.Method = a.Scheme()
+			return identity, nil
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// Challenge writes a 407 response offering every configured scheme
+func (c Chain) Challenge(w http.ResponseWriter) {
+	for _, a := range c {
+		w.Header().Add("Proxy-Authenticate", a.Challenge())
+	}
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+// New builds the authenticators enabled in cfg. An empty chain means proxy
+// authentication is disabled.
+func New(cfg *config.Config) (Chain, error) {
+	var chain Chain
+
+	if cfg.NegotiateKeytab != "" {
+		negotiate, err := NewNegotiate(cfg.NegotiateKeytab, cfg.NegotiateSPN)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, negotiate)
+	}
+
+	if cfg.LDAPURL != "" {
+		ldapAuth, err := NewLDAP(LDAPOptions{
+			URL:          cfg.LDAPURL,
+			BindDN:       cfg.LDAPBindDN,
+			BindPassword: cfg.LDAPBindPassword,
+			BaseDN:       cfg.LDAPBaseDN,
+			UserFilter:   cfg.LDAPUserFilter,
+			GroupAttr:    cfg.LDAPGroupAttr,
+			Realm:        cfg.AuthRealm,
+			CacheTTL:     cfg.LDAPCacheTTL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, ldapAuth)
+	}
+
+	return chain, nil
+}
+
+// NewWebAuth sets up SSO for the web API from cfg. It returns nil when OIDC
+// is not configured.
+func NewWebAuth(ctx context.Context, cfg *config.Config) (*OIDC, error) {
+	if cfg.OIDCIssuer == "" {
+		return nil, nil
+	}
+	return NewOIDC(ctx, OIDCOptions{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		GroupsClaim:  cfg.OIDCGroupsClaim,
+		AdminGroups:  splitList(cfg.OIDCAdminGroups),
+		ViewerGroups: splitList(cfg.OIDCViewerGroups),
+		SessionKey:   []byte(cfg.OIDCSessionKey),
+		SessionTTL:   cfg.OIDCSessionTTL,
+	})
+}
+
+// splitList parses a comma separated setting
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout bounds dialing and each LDAP operation
+const ldapTimeout = 10 * time.Second
+
+// ldapCacheSize caps the number of remembered credentials
+const ldapCacheSize = 10000
+
+// LDAPOptions configures the LDAP / Active Directory backend
+type LDAPOptions struct {
+	URL          string        // ldap:// or ldaps:// server URL
+	BindDN       string        // Service account used to look up users
+	BindPassword string        // Password of the service account
+	BaseDN       string        // Subtree searched for users
+	UserFilter   string        // Search filter, %s is replaced by the username
+	GroupAttr    string        // Attribute listing the user's groups
+	Realm        string        // Realm shown in the Basic challenge
+	CacheTTL     time.Duration // How long verified credentials are remembered
+}
+
+// LDAP verifies Basic credentials against an LDAP directory and resolves
+// the user's group memberships
+type LDAP struct {
+	opts LDAPOptions
+
+	cacheMutex sync.Mutex
+	cache      map[[sha256.Size]byte]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	identity Identity
+	expires  time.Time
+}
+
+// NewLDAP creates an LDAP backed Basic authenticator
+func NewLDAP(opts LDAPOptions) (*LDAP, error) {
+	if opts.BaseDN == "" {
+		return nil, fmt.Errorf("LDAP authentication requires a base DN")
+	}
+	if opts.UserFilter == "" {
+		opts.UserFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+	}
+	if !strings.Contains(opts.UserFilter, "%s") {
+		return nil, fmt.Errorf("LDAP user filter %q must contain %%s", opts.UserFilter)
+	}
+	if opts.GroupAttr == "" {
+		opts.GroupAttr = "memberOf"
+	}
+	if opts.Realm == "" {
+		opts.Realm = "go-proxy"
+	}
+	return &LDAP{
+		opts:  opts,
+		cache: make(map[[sha256.Size]byte]ldapCacheEntry),
+	}, nil
+}
+
+// Scheme implements Authenticator
+func (l *LDAP) Scheme() string {
+	return "Basic"
+}
+
+// Challenge implements Authenticator
+func (l *LDAP) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", l.opts.Realm)
+}
+
+// Authenticate implements Authenticator
+func (l *LDAP) Authenticate(r *http.Request, credentials string) (*Identity, error) {
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed Basic credentials", ErrInvalidCredentials)
+	}
+	username, password, ok := strings.Cut(string(raw), ":")
+	if !ok || username == "" || password == "" {
+		return nil, fmt.Errorf("%w: empty username or password", ErrInvalidCredentials)
+	}
+
+	// Browsers send Basic credentials with every request, so remember
+	// successful binds instead of hitting the directory each time
+	key := sha256.Sum256(raw)
+	if identity, ok := l.cached(key); ok {
+		return identity, nil
+	}
+
+	identity, err := l.verify(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.opts.CacheTTL > 0 {
+		l.remember(key, identity)
+	}
+	return identity, nil
+}
+
+// cached returns a copy of a still valid cache entry
+func (l *LDAP) cached(key [sha256.Size]byte) (*Identity, bool) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+
+	entry, ok := l.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(l.cache, key)
+		return nil, false
+	}
+	identity := entry.identity
+	return &identity, true
+}
+
+// remember caches a verified identity, dropping expired entries when the
+// cache is full
+func (l *LDAP) remember(key [sha256.Size]byte, identity *Identity) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+
+	now := time.Now()
+	if len(l.cache) >= ldapCacheSize {
+		for k, entry := range l.cache {
+			if now.After(entry.expires) {
+				delete(l.cache, k)
+			}
+		}
+		if len(l.cache) >= ldapCacheSize {
+			l.cache = make(map[[sha256.Size]byte]ldapCacheEntry)
+		}
+	}
+	l.cache[key] = ldapCacheEntry{identity: *identity, expires: now.Add(l.opts.CacheTTL)}
+}
+
+// verify looks the user up with the service account and then binds as the
+// user to check the password
+func (l *LDAP) verify(username, password string) (*Identity, error) {
+	conn, err := ldap.DialURL(l.opts.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if l.opts.BindDN != "" {
+		if err := conn.Bind(l.opts.BindDN, l.opts.BindPassword); err != nil {
+			return nil, fmt.Errorf("LDAP service account bind failed: %w", err)
+		}
+	}
+
+	filter := fmt.Sprintf(l.opts.UserFilter, ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.opts.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false,
+		filter, []string{"dn", l.opts.GroupAttr}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP user search failed: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("%w: user %q not found", ErrInvalidCredentials, username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("%w: wrong password for %q", ErrInvalidCredentials, username)
+		}
+		return nil, fmt.Errorf("LDAP user bind failed: %w", err)
+	}
+
+	return &Identity{
+		User:   username,
+		Groups: groupNames(entry.GetAttributeValues(l.opts.GroupAttr)),
+	}, nil
+}
+
+// groupNames reduces group DNs to their common names, which is how groups
+// are referred to in configuration
+func groupNames(values []string) []string {
+	groups := make([]string, 0, len(values))
+	for _, value := range values {
+		dn, err := ldap.ParseDN(value)
+		if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+			groups = append(groups, value)
+			continue
+		}
+		groups = append(groups, dn.RDNs[0].Attributes[0].Value)
+	}
+	return groups
+}
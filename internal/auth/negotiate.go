@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// ctxCredentials is the context key gokrb5 stores the verified
+// credentials under (unexported in the spnego package)
+const ctxCredentials = "github.com/jcmturner/gokrb5/v8/ctxCredentials"
+
+// ntlmPrefix starts every base64 NTLMSSP message ("NTLMSSP\0")
+const ntlmPrefix = "TlRMTVNTUA"
+
+// Negotiate authenticates domain users with SPNEGO/Kerberos tickets, so
+// browsers on domain-joined machines log in transparently
+type Negotiate struct {
+	keytab *keytab.Keytab
+	spn    string // Service principal, e.g. HTTP/proxy.corp.example.com
+}
+
+// NewNegotiate loads the service keytab for SPNEGO authentication. When spn
+// is empty the principal is taken from the ticket.
+func NewNegotiate(keytabPath, spn string) (*Negotiate, error) {
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keytab %s: %w", keytabPath, err)
+	}
+	return &Negotiate{keytab: kt, spn: spn}, nil
+}
+
+// Scheme implements Authenticator
+func (n *Negotiate) Scheme() string {
+	return "Negotiate"
+}
+
+// Challenge implements Authenticator
+func (n *Negotiate) Challenge() string {
+	return "Negotiate"
+}
+
+// Authenticate implements Authenticator
+func (n *Negotiate) Authenticate(r *http.Request, token string) (*Identity, error) {
+	if strings.HasPrefix(token, ntlmPrefix) {
+		// Windows falls back to NTLM when it cannot get a Kerberos ticket
+		return nil, fmt.Errorf("%w: NTLM is not supported, check the proxy SPN and client Kerberos setup", ErrInvalidCredentials)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed Negotiate token", ErrInvalidCredentials)
+	}
+
+	var st spnego.SPNEGOToken
+	if err := st.Unmarshal(raw); err != nil {
+		// Some clients send a raw KRB5 token instead of wrapping it
+		var k5t spnego.KRB5Token
+		if k5t.Unmarshal(raw) != nil {
+			return nil, fmt.Errorf("%w: unreadable Negotiate token", ErrInvalidCredentials)
+		}
+		st.Init = true
+		st.NegTokenInit = spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{k5t.OID},
+			MechTokenBytes: raw,
+		}
+	}
+
+	settings := []func(*service.Settings){service.DecodePAC(false)}
+	if addr, err := types.GetHostAddress(r.RemoteAddr); err == nil {
+		settings = append(settings, service.ClientAddress(addr))
+	}
+	if n.spn != "" {
+		settings = append(settings, service.KeytabPrincipal(n.spn))
+	}
+
+	svc := spnego.SPNEGOService(n.keytab, settings...)
+	ok, ctx, status := svc.AcceptSecContext(&st)
+	if !ok || status.Code != gssapi.StatusComplete {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, status.Message)
+	}
+
+	creds, _ := ctx.Value(ctxCredentials).(*credentials.Credentials)
+	if creds == nil {
+		return nil, fmt.Errorf("%w: no Kerberos credentials in context", ErrInvalidCredentials)
+	}
+
+	return &Identity{
+		User:   creds.UserName() + "@" + creds.Domain(),
+		Groups: creds.AuthzAttributes(),
+	}, nil
+}
@@ -0,0 +1,362 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"go-proxy/internal/logger"
+)
+
+const (
+	sessionCookie = "proxy_session"
+	stateCookie   = "proxy_oidc_state"
+	stateTTL      = 10 * time.Minute
+)
+
+// Role is the level of access an SSO user has to the web API
+type Role int
+
+const (
+	RoleNone   Role = iota
+	RoleViewer      // Stats, metrics and geo data
+	RoleAdmin       // Everything, including /api/admin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// PathRole requires Role for every request path starting with Prefix
+type PathRole struct {
+	Prefix string
+	Role   Role
+}
+
+// OIDCOptions configures OpenID Connect login
+type OIDCOptions struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string        // Must point at the /auth/callback route
+	GroupsClaim  string        // ID token claim holding the user's groups
+	AdminGroups  []string      // Groups granted RoleAdmin
+	ViewerGroups []string      // Groups granted RoleViewer
+	SessionKey   []byte        // HMAC key for session cookies (random if empty)
+	SessionTTL   time.Duration // Lifetime of a login session
+}
+
+// OIDC protects the web API with an OpenID Connect authorization code flow.
+// Sessions are kept in signed cookies, so nothing is stored server side.
+type OIDC struct {
+	opts     OIDCOptions
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+}
+
+// session is the payload of the signed session cookie
+type session struct {
+	User    string `json:"u"`
+	Role    Role   `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+// NewOIDC discovers the issuer's endpoints and prepares the login flow
+func NewOIDC(ctx context.Context, opts OIDCOptions) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, opts.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery for %s failed: %w", opts.Issuer, err)
+	}
+
+	if opts.GroupsClaim == "" {
+		opts.GroupsClaim = "groups"
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = 8 * time.Hour
+	}
+	if len(opts.SessionKey) == 0 {
+		// Sessions won't survive a restart, which is acceptable for an
+		// admin UI; configure a key to keep them
+		opts.SessionKey = make([]byte, 32)
+		if _, err := rand.Read(opts.SessionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &OIDC{
+		opts:     opts,
+		verifier: provider.Verifier(&oidc.Config{ClientID: opts.ClientID}),
+		oauth: oauth2.Config{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			RedirectURL:  opts.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		},
+	}, nil
+}
+
+// RegisterRoutes adds the login, callback and logout handlers to mux
+func (o *OIDC) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/login", o.HandleLogin)
+	mux.HandleFunc("/auth/callback", o.HandleCallback)
+	mux.HandleFunc("/auth/logout", o.HandleLogout)
+}
+
+// Protect requires an SSO session (or a bearer ID token) with a sufficient
+// role for paths matching rules. The first matching rule applies; other
+// paths, including proxied traffic, pass through untouched.
+func (o *OIDC) Protect(next http.Handler, rules []PathRole) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests naming an origin are proxy traffic, not API calls. This
+		// must match what ProxyRequests hands to the proxy: an absolute URI
+		// without a host, such as x:/api/admin/reload, reaches the web API.
+		if r.Method == http.MethodConnect || r.URL.Host != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required := RoleNone
+		for _, rule := range rules {
+			if strings.HasPrefix(r.URL.Path, rule.Prefix) {
+				required = rule.Role
+				break
+			}
+		}
+		if required == RoleNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, role, ok := o.identify(r)
+		if !ok {
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/auth/login?return="+r.URL.RequestURI(), http.StatusFound)
+				return
+			}
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if role < required {
+			logger.Warn("SSO user %s (%s) denied access to %s", user, role, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identify resolves the caller from the session cookie or a bearer token
+func (o *OIDC) identify(r *http.Request) (string, Role, bool) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token, err := o.verifier.Verify(r.Context(), strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			logger.Debug("Rejected bearer token: %v", err)
+			return "", RoleNone, false
+		}
+		user, role, err := o.claims(token)
+		return user, role, err == nil
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", RoleNone, false
+	}
+	s, err := o.decodeSession(cookie.Value)
+	if err != nil {
+		return "", RoleNone, false
+	}
+	return s.User, s.Role, true
+}
+
+// HandleLogin starts the authorization code flow
+func (o *OIDC) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomToken(), randomToken()
+	returnTo := r.URL.Query().Get("return")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/api/metrics"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state + "|" + nonce + "|" + returnTo,
+		Path:     "/auth/",
+		MaxAge:   int(stateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, o.oauth.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// HandleCallback completes the login and issues the session cookie
+func (o *OIDC) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "Login expired, please retry", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(cookie.Value, "|", 3)
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[0]), []byte(r.URL.Query().Get("state"))) {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	nonce, returnTo := parts[1], parts[2]
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/", MaxAge: -1})
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		http.Error(w, "Login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := o.oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		logger.Warn("OIDC code exchange failed: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Login failed: no ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := o.verifier.Verify(r.Context(), rawID)
+	if err != nil || idToken.Nonce != nonce {
+		logger.Warn("OIDC ID token rejected: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, role, err := o.claims(idToken)
+	if err != nil {
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	if role == RoleNone {
+		logger.Warn("SSO user %s is not in any proxy admin or viewer group", user)
+		http.Error(w, "Your account has no access to this proxy", http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    o.encodeSession(session{User: user, Role: role, Expires: time.Now().Add(o.opts.SessionTTL).Unix()}),
+		Path:     "/",
+		MaxAge:   int(o.opts.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	logger.Info("SSO login: %s as %s", user, role)
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// HandleLogout clears the session cookie
+func (o *OIDC) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	w.Write([]byte("Logged out\n"))
+}
+
+// claims extracts the user name and role from an ID token
+func (o *OIDC) claims(token *oidc.IDToken) (string, Role, error) {
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return "", RoleNone, err
+	}
+
+	user := token.Subject
+	for _, key := range []string{"preferred_username", "email"} {
+		if v, ok := claims[key].(string); ok && v != "" {
+			user = v
+			break
+		}
+	}
+
+	var groups []string
+	switch v := claims[o.opts.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	role := RoleNone
+	for _, g := range groups {
+		if contains(o.opts.AdminGroups, g) {
+			return user, RoleAdmin, nil
+		}
+		if contains(o.opts.ViewerGroups, g) {
+			role = RoleViewer
+		}
+	}
+	return user, role, nil
+}
+
+func (o *OIDC) encodeSession(s session) string {
+	payload, _ := json.Marshal(s)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + o.sign(encoded)
+}
+
+func (o *OIDC) decodeSession(value string) (*session, error) {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(o.sign(encoded))) {
+		return nil, errors.New("invalid session signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > s.Expires {
+		return nil, errors.New("session expired")
+	}
+	return &s, nil
+}
+
+func (o *OIDC) sign(data string) string {
+	mac := hmac.New(sha256.New, o.opts.SessionKey)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
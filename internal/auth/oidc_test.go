@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtect(t *testing.T) {
+	o := &OIDC{opts: OIDCOptions{SessionKey: []byte("test key")}}
+	admin := o.encodeSession(session{User: "alice", Role: RoleAdmin, Expires: time.Now().Add(time.Hour).Unix()})
+	viewer := o.encodeSession(session{User: "bob", Role: RoleViewer, Expires: time.Now().Add(time.Hour).Unix()})
+	rules := []PathRole{{Prefix: "/api/admin", Role: RoleAdmin}, {Prefix: "/api/", Role: RoleViewer}}
+
+	tests := []struct {
+		name    string
+		request string // Request line
+		session string
+		want    int // http.StatusOK if the request passes through
+	}{
+		{"admin without session", "POST /api/admin/reload", "", http.StatusUnauthorized},
+		{"admin as viewer", "POST /api/admin/reload", viewer, http.StatusForbidden},
+		{"admin as admin", "POST /api/admin/reload", admin, http.StatusOK},
+		{"stats as viewer", "GET /api/stats", viewer, http.StatusOK},
+		{"unprotected path", "GET /healthz", "", http.StatusOK},
+		// Absolute URIs without a host are served by the web API, so they
+		// must not skip SSO
+		{"absolute URI without host", "POST x:/api/admin/reload", "", http.StatusUnauthorized},
+		{"absolute URI with empty authority", "POST http:///api/admin/reload", "", http.StatusUnauthorized},
+		{"proxy request", "GET http://example.com/api/admin/reload", "", http.StatusOK},
+		{"CONNECT", "CONNECT example.com:443", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		raw := test.request + " HTTP/1.1\r\nHost: proxy.example\r\n"
+		if test.session != "" {
+			raw += "Cookie: " + sessionCookie + "=" + test.session + "\r\n"
+		}
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw + "\r\n")))
+		if err != nil {
+			t.Fatalf("%s: parsing request: %v", test.name, err)
+		}
+		passed := false
+		handler := o.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { passed = true }), rules)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if got := rec.Code; got != test.want || passed != (test.want == http.StatusOK) {
+			t.Errorf("%s: status %d (passed %v), want %d", test.name, got, passed, test.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package banlog writes authentication failures and abuse of the proxy
+// in a syslog-like format fail2ban can parse, one line per event:
+//
+//	2006-01-02 15:04:05 go-proxy[1234]: auth failure from 192.0.2.1 user="bob": invalid credentials
+//	2006-01-02 15:04:05 go-proxy[1234]: abuse from 192.0.2.1: connection flood
+//
+// deploy/fail2ban has a matching filter and an action banning through
+// the proxy's /api/bans.
+package banlog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-proxy/internal/storage"
+)
+
+// prefixes are the line prefixes of the event types written; other types
+// are not written
+var prefixes = map[string]string{
+	"auth":  "auth failure",
+	"abuse": "abuse",
+}
+
+// Writer appends ban log lines to a file or stdout
+type Writer struct {
+	mutex sync.Mutex
+	out   io.Writer
+	tag   string
+}
+
+// Open returns a Writer appending to path, or writing to stdout if path
+// is "-"
+func Open(path string) (*Writer, error) {
+	w := &Writer{out: os.Stdout, tag: "go-proxy[" + strconv.Itoa(os.Getpid()) + "]"}
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ban log: %v", err)
+		}
+		w.out = file
+	}
+	return w, nil
+}
+
+// Append writes event if it is an authentication failure or abuse
+func (w *Writer) Append(event storage.Event) error {
+	prefix, ok := prefixes[event.Type]
+	if !ok {
+		return nil
+	}
+	ip := event.Client
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	// Times are local, as fail2ban reads them
+	line := event.Time.Format("2006-01-02 15:04:05") + " " + w.tag + ": " + prefix + " from " + ip
+	if event.User != "" {
+		line += " user=" + strconv.Quote(event.User)
+	}
+	if event.Detail != "" {
+		line += ": " + sanitize.Replace(event.Detail)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := io.WriteString(w.out, line+"\n")
+	return err
+}
+
+// Close closes the log file
+func (w *Writer) Close() error {
+	if closer, ok := w.out.(io.Closer); ok && w.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// sanitize keeps details, which may quote client input, on one line
+var sanitize = strings.NewReplacer("\n", " ", "\r", " ")
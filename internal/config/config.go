@@ -1,43 +1,407 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-proxy/internal/secrets"
 )
 
+// EnvPrefix is prepended to the upper-cased flag name to form the
+// environment variable for a setting (http-port -> PROXY_HTTP_PORT).
+const EnvPrefix = "PROXY_"
+
+// secretSettings lists the flags whose values may be references to external
+// secrets (file:, vault:, awssm:) and are resolved after loading.
+var secretSettings = []string{
+	"redis-password",
+	"auth-ldap-bind-password",
+	"oidc-client-secret",
+	"oidc-session-key",
+	"admin-token",
+	"postgres-dsn",
+	"report-smtp-password",
+}
+
 type Config struct {
-	HTTPPort      int
-	HTTPSPort     int
-	LogFile       string
-	BlockFile     string
-	RedisAddr     string
-	RedisPassword string
-	GeoEnabled    bool // Whether geolocation is enabled
-	GeoCacheSize  int  // Size of in-memory geolocation cache
-	GeoDebug      bool // Whether to enable verbose geolocation logging
+	ConfigFile         string // Optional JSON file with flag-name keys
+	HTTPPort           int
+	HTTPSPort          int
+	LogFile            string
+	LogLevel           string // debug, info, warn or error
+	Quiet              bool   // Suppress console output other than fatal errors
+	BlockFile          string
+	RedisAddr          string
+	RedisUsername      string // ACL user (managed Redis offerings)
+	RedisPassword      string
+	RedisPasswordFile  string        // File holding the Redis password (Docker secrets)
+	RedisDB            int           // Redis database index
+	RedisPrefix        string        // Namespace prepended to every Redis key
+	RedisTLS           bool          // Connect to Redis over TLS
+	RedisTLSCA         string        // CA bundle for the Redis server certificate
+	RedisTLSCert       string        // Client certificate for Redis mutual TLS
+	RedisTLSKey        string        // Client key for Redis mutual TLS
+	GeoEnabled         bool          // Whether geolocation is enabled
+	GeoCacheSize       int           // Size of in-memory geolocation cache
+	GeoDebug           bool          // Whether to enable verbose geolocation logging
+	GeoTTL             time.Duration // How long geolocation records are kept
+	GeoRefreshBefore   time.Duration // How long before expiry records of active hosts are refreshed
+	GeoAllowCountries  string        // Comma separated country codes destinations must be in
+	DrainTimeout       time.Duration // How long an upgraded-away process waits for tunnels to close
+	TunnelMaxLifetime  time.Duration // Tunnels open longer are reported as leaked (0 disables)
+	GOMAXPROCS         int           // OS threads running Go code at once (0 uses the Go default)
+	GCPercent          int           // Garbage collector target percentage (0 uses GOGC or 100)
+	MemoryLimit        int64         // Soft memory limit in megabytes (0 disables)
+	RunAsUser          string        // Drop privileges to this user after binding
+	RunAsGroup         string        // Drop privileges to this group after binding
+	Chroot             string        // Chroot into this directory after startup
+	OutboundInterfaces string        // Comma separated interfaces outbound dials must use
+	OutboundMark       uint          // SO_MARK firewall mark of outbound sockets (0 disables)
+	OutboundDevice     string        // Device outbound sockets are bound to with SO_BINDTODEVICE
+	EgressRules        string        // File choosing the outbound interface or source IP per destination
+	OriginConnLimit    int           // Concurrent connections to one origin host (0 disables)
+	OriginLimits       string        // File of per-host overrides of OriginConnLimit
+	OriginCA           string        // CA bundle origin certificates may be signed by besides the system roots
+	OriginPins         string        // File of public keys origins' certificates are pinned to
+	OriginTLSMin       string        // Lowest TLS version accepted from origins: 1.0, 1.1, 1.2 or 1.3
+	CertWatch          time.Duration // How often certificates of HTTPS hosts are re-checked (0 disables)
+	CertWatchState     string        // File the certificates seen are kept in across restarts
+	PauseSchedule      string        // File of times clients' internet access is paused
+	Calendars          string        // Comma separated name=iCal file or URL calendars schedules can refer to
+	CalendarRefresh    time.Duration // How often Calendars are re-read
+	ServicePolicies    string        // File applying built-in service policies per client
+	Quotas             string        // File of per-client data quotas and when they reset
+	QuotaState         string        // File quota usage is kept in across restarts
+	DeviceRules        string        // File of rules blocking requests by User-Agent
+	AppAgents          string        // Comma separated IPs and CIDRs of agents trusted to tag requests with their application
+	NewDomainAge       int           // Days a domain counts as newly registered (0 disables lookups)
+	NewDomainPolicy    string        // warn or block newly registered domains
+	RDAPURL            string        // RDAP service domain names are appended to
+	ExfilThreshold     int64         // MB a client may upload to one host per ExfilWindow (0 disables)
+	ExfilWindow        time.Duration // Period uploads are counted over for ExfilThreshold
+	AlertWebhook       string        // URL alerts are posted to as JSON
+	DataCap            int64         // GB the ISP allows per billing cycle (0 disables warnings)
+	DataCapDay         int           // Day of the month the billing cycle starts
+	AlertRules         string        // File of rules raising alerts on bursts of events
+	SampleRate         int           // Record 1 in this many allowed requests in stats
+	SampleHosts        string        // Comma separated host=rate sampling rates overriding SampleRate
+	WireGuard          string        // Comma separated name=config user-space WireGuard tunnels
+	Upstreams          string        // Comma separated upstream proxy URLs requests are sent through
+	UpstreamStrategy   string        // round-robin, sticky or random
+	UpstreamProxyProto string        // PROXY protocol version (v1 or v2) tunnels to upstreams start with; "" sends none
+	UpstreamHealth     time.Duration // How often upstream proxies are health checked
+	OriginBalance      string        // first, round-robin or lowest-latency
+	HappyEyeballsDelay time.Duration // Head start of each origin address before the next is dialed
+	Prewarm            int           // Number of top origins kept connected (0 disables)
+	PrewarmHours       string        // Local hours pre-warming runs, e.g. 8-18
+	ProbeOrigins       int           // Number of top origins probed (0 disables)
+	ProbeInterval      time.Duration // Time between probes of each origin
+	ProbeMethod        string        // tcp or head
+	ProbeAlertAfter    int           // Failed probes in a row that raise an alert
+	ReportSchedule     string        // off, daily or weekly usage reports
+	ReportDir          string        // Directory HTML reports are written to
+	ReportSMTP         string        // host:port of the mail server reports are sent through
+	ReportSMTPUser     string        // SMTP AUTH username
+	ReportSMTPPassword string
+	ReportFrom         string        // Sender of report emails
+	ReportTo           string        // Comma separated report recipients
+	ReportTop          int           // Rows per report table
+	FlushInterval      time.Duration // How often buffered HTTP responses are flushed to the client
+	Compress           bool          // Compress uncompressed origin responses for clients that accept it
+	CompressMinSize    int           // Smallest response body worth compressing
+	CompressExclude    string        // Comma separated hosts whose responses are never compressed
+	SaverClients       string        // Comma separated IPs, CIDRs and users whose images are downgraded
+	SaverQuality       int           // JPEG quality of downgraded images
+	SaverMaxDimension  int           // Largest width or height of downgraded images
+	SaverMinSize       int           // Smallest image worth downgrading
+	Warn               string        // Comma separated ways clients are warned of pauses and quotas: banner, interstitial
+	WarnBefore         time.Duration // How long before a scheduled pause clients are warned
+	WarnQuota          int           // Percent of a data quota used from which clients are warned
+	WarnInterval       time.Duration // How often the warning interstitial is shown again
+	WarnRewritePages   bool          // Let the warning banner modify plain HTTP pages
+	AdblockLists       string        // Comma separated Adblock Plus filter list files or URLs
+	AdblockRefresh     time.Duration // How often filter lists are re-read
+	Privacy            bool          // Strip tracking parameters and third-party cookies
+	PrivacyParams      string        // Comma separated query parameters privacy mode strips
+	ErrorPages         string        // Directory of <status>.html error page templates
+	HTTPSUpgrade       string        // off, warn or redirect plain HTTP requests for HTTPS-only hosts
+	HSTSPreload        string        // File of domains only served over HTTPS
+	RequestIDHeader    string        // Header carrying the request ID to origins and clients
+	AccessLog          bool          // Log every proxied request
+	EventStreamMaxLen  int64         // Events kept in the Redis event stream (0 disables it)
+	SIEMFormat         string        // off, cef or leef security event output
+	SIEMLog            string        // File the security events are appended to ("" or - for stdout)
+	BanLog             string        // fail2ban log of auth failures and abuse ("" disables, - for stdout)
+	Maintenance        bool          // Start in maintenance mode
+	MaintenanceAllow   string        // Comma separated IPs and CIDRs served during maintenance
+	MaintenanceMessage string        // Shown on the maintenance page
+	ClusterSync        bool          // Share blacklist changes and elect who runs shared jobs over Redis
+	HAPrimary          string        // Health endpoint of the primary this instance stands by for
+	HAInterval         time.Duration // Time between health checks of the primary
+	HAFailures         int           // Failed health checks before the standby takes over
+	HANotify           string        // Hook run with active or standby on failover and failback
+	Tenants            string        // JSON file of tenants with their own blacklists, stats and API token
+	TLSPort            int           // TLS proxy listener port (0 disables it)
+	TLSHTTP2           bool          // Offer HTTP/2 on the TLS proxy listener
+	DenyProtocols      string        // Comma separated tunnel protocols to refuse
+	TunnelAccounting   string        // copy or kernel counting of tunnel bytes
+	TunnelIOURing      bool          // Copy tunnel data through io_uring (experimental)
+	ConnectUDP         bool          // Accept CONNECT-UDP (MASQUE) tunnels over HTTP/1.1
+	StrictParsing      bool          // Reject requests with request smuggling vectors
+	ProxyProtocol      string        // Comma separated IPs and CIDRs of load balancers sending PROXY protocol headers
+	TrustedProxies     string        // Comma separated IPs and CIDRs of downstream proxies whose X-Forwarded-For is honoured
+	ReadHeaderTimeout  time.Duration // Time clients have to send a request head (0 disables)
+	IdleTimeout        time.Duration // Time idle keep-alive connections are kept open
+	MinTransferRate    int64         // Bytes/s clients must read and send bodies at (0 disables)
+	MinRateWindow      time.Duration // Period -min-transfer-rate is measured over
+	ConnLimit          int           // New client connections per ConnLimitWindow (0 disables)
+	IPConnLimit        int           // New connections per client IP per ConnLimitWindow (0 disables)
+	ConnLimitWindow    time.Duration // Period connection limits are counted over
+	IPBanTime          time.Duration // How long IPs over IPConnLimit are refused
+	FDReserve          int           // File descriptors kept free below RLIMIT_NOFILE (0 disables)
+	SOCKSPort          int           // SOCKS5 listener port (0 disables it)
+	TLSCert            string        // Certificate for the TLS proxy listener
+	TLSKey             string        // Private key for the TLS proxy listener
+	TLSClientCA        string        // CA bundle required to verify client certificates
+	TLSUserMap         string        // File mapping client certificate subjects to users
+	NegotiateKeytab    string        // Keytab enabling Kerberos (SPNEGO) proxy authentication
+	NegotiateSPN       string        // Service principal to accept tickets for
+	AuthRealm          string        // Realm shown in Basic authentication prompts
+	LDAPURL            string        // LDAP server verifying Basic proxy credentials
+	LDAPBindDN         string        // Service account used for user lookups
+	LDAPBindPassword   string
+	LDAPBaseDN         string        // Subtree searched for users
+	LDAPUserFilter     string        // User search filter (%s is the username)
+	LDAPGroupAttr      string        // Attribute holding group memberships
+	LDAPCacheTTL       time.Duration // How long verified credentials are cached
+	OIDCIssuer         string        // OpenID Connect issuer protecting the web API
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCRedirectURL    string        // Public URL of /auth/callback
+	OIDCGroupsClaim    string        // ID token claim listing the user's groups
+	OIDCAdminGroups    string        // Comma separated groups granted admin access
+	OIDCViewerGroups   string        // Comma separated groups granted read-only access
+	OIDCSessionKey     string        // Key signing session cookies
+	OIDCSessionTTL     time.Duration // Lifetime of an SSO session
+	AdminToken         string        // Bearer token of admin API changes without SSO
+	DecisionCacheTTL   time.Duration // How long blacklist matches are cached (0 disables)
+	DecisionCacheSize  int           // Maximum number of cached blacklist matches
+	Storage            string        // Stats backend: redis, bolt, postgres, memory or none
+	StorageLazy        bool          // Connect to redis/postgres in the background
+	StoragePath        string        // Database file for the bolt backend
+	PostgresDSN        string        // Connection string for the postgres backend
+	StatsBufferSize    int           // Stats records held in memory while the backend is down
+
+	values map[string]string // Effective value of every setting, by flag name
 }
 
+// ParseFlags builds the configuration from the command line, the optional
+// config file and PROXY_* environment variables. It exits on error.
 func ParseFlags() *Config {
+	cfg, err := Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// Load parses args and applies the config file and environment on top of the
+// defaults. Precedence is env > flag > file > default.
+func Load(args []string) (*Config, error) {
 	cfg := &Config{}
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
 
-	flag.IntVar(&cfg.HTTPPort, "http-port", 3000, "HTTP proxy port")
-	flag.IntVar(&cfg.HTTPSPort, "https-port", 3443, "HTTPS proxy port")
-	flag.StringVar(&cfg.LogFile, "log-file", "proxy.log", "Log file path")
-	flag.StringVar(&cfg.BlockFile, "blacklist", "", "File containing blacklisted domain patterns")
-	flag.StringVar(&cfg.RedisAddr, "redis-addr", "localhost:6379", "Redis address")
-	flag.StringVar(&cfg.RedisPassword, "redis-password", "xK9mP2vL5nQ8", "Redis password")
-	flag.BoolVar(&cfg.GeoEnabled, "geo-enabled", true, "Enable geolocation tracking")
-	flag.IntVar(&cfg.GeoCacheSize, "geo-cache-size", 10000, "Size of in-memory geolocation cache")
-	flag.BoolVar(&cfg.GeoDebug, "geo-debug", false, "Enable verbose geolocation logging")
-
-	flag.Parse()
-	return cfg
+	fs.StringVar(&cfg.ConfigFile, "config", "", "JSON config file (keys are flag names)")
+	cfg.registerListenerFlags(fs)
+	cfg.registerProcessFlags(fs)
+	cfg.registerStorageFlags(fs)
+	cfg.registerOutboundFlags(fs)
+	cfg.registerPolicyFlags(fs)
+	cfg.registerHTTPFlags(fs)
+	cfg.registerMonitoringFlags(fs)
+	cfg.registerAuthFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// The config file location itself may come from the environment
+	if v, ok := os.LookupEnv(envName("config")); ok {
+		cfg.ConfigFile = v
+	}
+
+	sources := make(map[string]settingSource)
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = sourceFlag
+	})
+
+	if cfg.ConfigFile != "" {
+		if err := applyFile(fs, cfg.ConfigFile, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(fs, sources); err != nil {
+		return nil, err
+	}
+
+	// -redis-password-file only replaces a password set with lower
+	// precedence, and never one set in the same place
+	if cfg.RedisPasswordFile != "" {
+		fileSource, passwordSource := sources["redis-password-file"], sources["redis-password"]
+		if fileSource == passwordSource {
+			return nil, fmt.Errorf("-redis-password and -redis-password-file are both given by the %s; give only one", fileSource)
+		}
+		if fileSource > passwordSource {
+			password, err := secrets.ReadFile(cfg.RedisPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RedisPassword = password
+		}
+	}
+
+	if err := resolveSecrets(fs); err != nil {
+		return nil, err
+	}
+
+	for _, validate := range []func() error{
+		cfg.validateListeners, cfg.validateProcess, cfg.validateStorage, cfg.validateOutbound,
+		cfg.validatePolicy, cfg.validateHTTP, cfg.validateMonitoring, cfg.validateAuth,
+	} {
+		if err := validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.values = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		cfg.values[f.Name] = f.Value.String()
+	})
+
+	return cfg, nil
+}
+
+// settingSource is where a setting was last set, in increasing order of
+// precedence
+type settingSource int
+
+const (
+	sourceDefault settingSource = iota
+	sourceFile
+	sourceFlag
+	sourceEnv
+)
+
+func (s settingSource) String() string {
+	switch s {
+	case sourceFile:
+		return "config file"
+	case sourceFlag:
+		return "command line"
+	case sourceEnv:
+		return "environment"
+	default:
+		return "defaults"
+	}
 }
 
-func (c *Config) HTTPAddr() string {
-	return fmt.Sprintf(":%d", c.HTTPPort)
+// applyFile sets every flag present in the JSON file that was not given
+// explicitly on the command line, recording them in sources.
+func applyFile(fs *flag.FlagSet, path string, sources map[string]settingSource) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for name, value := range values {
+		if name == "config" || sources[name] == sourceFlag {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		text := fmt.Sprint(value)
+		if number, ok := value.(float64); ok {
+			// JSON numbers decode as float64, which Sprint would turn
+			// into 1e+06 for large integers
+			text = strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		if err := fs.Set(name, text); err != nil {
+			return fmt.Errorf("config file %s: invalid value for %s: %w", path, name, err)
+		}
+		sources[name] = sourceFile
+	}
+	return nil
+}
+
+// applyEnv overrides flags with PROXY_* environment variables. A
+// PROXY_*_FILE variable names a file whose content is used as the value,
+// which keeps secrets out of both the environment and process args. The
+// flags set are recorded in sources.
+func applyEnv(fs *flag.FlagSet, sources map[string]settingSource) error {
+	var firstErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || firstErr != nil {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		// When a -<flag>-file flag exists, PROXY_*_FILE is its value instead
+		if path, fileOK := os.LookupEnv(name + "_FILE"); fileOK && !ok && fs.Lookup(f.Name+"-file") == nil {
+			content, err := secrets.ReadFile(path)
+			if err != nil {
+				firstErr = fmt.Errorf("%s_FILE: %w", name, err)
+				return
+			}
+			v, ok = content, true
+		}
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			firstErr = fmt.Errorf("invalid value for %s: %w", name, err)
+			return
+		}
+		sources[f.Name] = sourceEnv
+	})
+	return firstErr
+}
+
+// resolveSecrets replaces secret references with the values they point to.
+func resolveSecrets(fs *flag.FlagSet) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	for _, name := range secretSettings {
+		f := fs.Lookup(name)
+		if f == nil || !secrets.IsReference(f.Value.String()) {
+			continue
+		}
+		value, err := secrets.Resolve(ctx, f.Value.String())
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *Config) HTTPSAddr() string {
-	return fmt.Sprintf(":%d", c.HTTPSPort)
+// envName maps a flag name to its environment variable name.
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
 }
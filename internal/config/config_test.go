@@ -0,0 +1,81 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedisPasswordFilePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(settings string) string {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(settings), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		config  string // Config file content, if any
+		env     map[string]string
+		want    string // Effective password; "" if an error is expected
+		wantErr string
+	}{
+		{name: "file flag alone", args: []string{"-redis-password-file", passwordFile}, want: "from-file"},
+		{name: "file in env beats password flag",
+			args: []string{"-redis-password", "from-flag"},
+			env:  map[string]string{"PROXY_REDIS_PASSWORD_FILE": passwordFile}, want: "from-file"},
+		{name: "password in env beats file flag",
+			args: []string{"-redis-password-file", passwordFile},
+			env:  map[string]string{"PROXY_REDIS_PASSWORD": "from-env"}, want: "from-env"},
+		{name: "password flag beats file in config",
+			args:   []string{"-redis-password", "from-flag"},
+			config: `{"redis-password-file": "` + passwordFile + `"}`, want: "from-flag"},
+		{name: "file flag beats password in config",
+			args:   []string{"-redis-password-file", passwordFile},
+			config: `{"redis-password": "from-config"}`, want: "from-file"},
+		{name: "both flags",
+			args:    []string{"-redis-password", "from-flag", "-redis-password-file", passwordFile},
+			wantErr: "both given by the command line"},
+		{name: "both in env",
+			env:     map[string]string{"PROXY_REDIS_PASSWORD": "from-env", "PROXY_REDIS_PASSWORD_FILE": passwordFile},
+			wantErr: "both given by the environment"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"PROXY_CONFIG", "PROXY_REDIS_PASSWORD", "PROXY_REDIS_PASSWORD_FILE"} {
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args := test.args
+			if test.config != "" {
+				args = append([]string{"-config", writeConfig(test.config)}, args...)
+			}
+
+			cfg, err := Load(args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Load error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.RedisPassword != test.want {
+				t.Errorf("password %q, want %q", cfg.RedisPassword, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// registerAuthFlags registers proxy authentication and web API SSO
+func (c *Config) registerAuthFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.NegotiateKeytab, "auth-negotiate-keytab", "", "Keytab file; when set clients must authenticate with Kerberos (Proxy-Authorization: Negotiate)")
+	fs.StringVar(&c.NegotiateSPN, "auth-negotiate-spn", "", "Service principal to accept tickets for, e.g. HTTP/proxy.corp.example.com (default: any in the keytab)")
+	fs.StringVar(&c.AuthRealm, "auth-realm", "go-proxy", "Realm shown in Basic proxy authentication prompts")
+	fs.StringVar(&c.LDAPURL, "auth-ldap-url", "", "LDAP/AD server (ldap:// or ldaps://); when set clients can authenticate with Basic credentials")
+	fs.StringVar(&c.LDAPBindDN, "auth-ldap-bind-dn", "", "DN of the service account used to look up users")
+	fs.StringVar(&c.LDAPBindPassword, "auth-ldap-bind-password", "", "Service account password (or file:, vault:, awssm: reference)")
+	fs.StringVar(&c.LDAPBaseDN, "auth-ldap-base-dn", "", "Base DN searched for users, e.g. DC=corp,DC=example,DC=com")
+	fs.StringVar(&c.LDAPUserFilter, "auth-ldap-user-filter", "(&(objectClass=user)(sAMAccountName=%s))", "LDAP filter locating a user; %s is replaced by the username")
+	fs.StringVar(&c.LDAPGroupAttr, "auth-ldap-group-attr", "memberOf", "User attribute listing group memberships")
+	fs.DurationVar(&c.LDAPCacheTTL, "auth-ldap-cache-ttl", 5*time.Minute, "How long successful LDAP logins are cached (0 disables)")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL; when set the web API requires SSO login")
+	fs.StringVar(&c.OIDCClientID, "oidc-client-id", "", "OIDC client ID")
+	fs.StringVar(&c.OIDCClientSecret, "oidc-client-secret", "", "OIDC client secret (or file:, vault:, awssm: reference)")
+	fs.StringVar(&c.OIDCRedirectURL, "oidc-redirect-url", "", "Public callback URL registered with the provider, e.g. https://proxy.example.com:3000/auth/callback")
+	fs.StringVar(&c.OIDCGroupsClaim, "oidc-groups-claim", "groups", "ID token claim holding group memberships")
+	fs.StringVar(&c.OIDCAdminGroups, "oidc-admin-groups", "", "Comma separated groups allowed to use the admin API")
+	fs.StringVar(&c.OIDCViewerGroups, "oidc-viewer-groups", "", "Comma separated groups allowed to read stats")
+	fs.StringVar(&c.OIDCSessionKey, "oidc-session-key", "", "Key signing session cookies (or file:, vault:, awssm: reference; default: random per process)")
+	fs.DurationVar(&c.OIDCSessionTTL, "oidc-session-ttl", 8*time.Hour, "Lifetime of an SSO session")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "Bearer token required to change settings through the admin API without SSO (or file:, vault:, awssm: reference)")
+}
+
+// validateAuth checks the authentication settings once every source is applied
+func (c *Config) validateAuth() error {
+	if c.OIDCIssuer != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		return fmt.Errorf("-oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+	}
+	return nil
+}
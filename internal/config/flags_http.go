@@ -0,0 +1,29 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// registerHTTPFlags registers how plain HTTP responses are passed on
+func (c *Config) registerHTTPFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.FlushInterval, "flush-interval", 100*time.Millisecond, "How often HTTP response bodies are flushed to the client (0 flushes only at the end); event streams and chunked responses are always flushed immediately")
+	fs.BoolVar(&c.Compress, "compress", false, "Compress text-like HTTP responses with brotli or gzip when the origin didn't and the client accepts it")
+	fs.IntVar(&c.CompressMinSize, "compress-min-size", 1024, "Smallest response body, in bytes, that -compress compresses")
+	fs.StringVar(&c.CompressExclude, "compress-exclude", "", "Comma separated hosts (and their subdomains) whose responses -compress leaves alone")
+	fs.StringVar(&c.SaverClients, "saver-clients", "", "Comma separated client IPs, CIDRs and users whose large JPEG/PNG images are downgraded to save bandwidth")
+	fs.IntVar(&c.SaverQuality, "saver-quality", 50, "JPEG quality (1-100) of images downgraded for -saver-clients")
+	fs.IntVar(&c.SaverMaxDimension, "saver-max-dimension", 1280, "Largest width or height, in pixels, of images downgraded for -saver-clients (0 keeps the size)")
+	fs.IntVar(&c.SaverMinSize, "saver-min-size", 32*1024, "Smallest image, in bytes, downgraded for -saver-clients")
+	fs.StringVar(&c.ErrorPages, "error-pages", "", "Directory of html/template error pages named by status (403.html, 502.html, 504.html); clients accepting JSON get JSON errors")
+	fs.StringVar(&c.RequestIDHeader, "request-id-header", "X-Proxy-Request-Id", "Header carrying each request's unique ID to origins and back to clients (empty keeps the ID in logs and error pages only)")
+}
+
+// validateHTTP checks the response settings once every source is applied
+func (c *Config) validateHTTP() error {
+	if c.SaverQuality < 1 || c.SaverQuality > 100 {
+		return fmt.Errorf("-saver-quality must be between 1 and 100")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// registerListenerFlags registers the proxy ports and how connections to
+// them are accepted and limited
+func (c *Config) registerListenerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.HTTPPort, "http-port", 3000, "HTTP proxy port")
+	fs.IntVar(&c.HTTPSPort, "https-port", 3443, "HTTPS proxy port")
+	fs.IntVar(&c.TLSPort, "tls-port", 0, "TLS proxy listener port (0 disables)")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time clients have to send a complete request head before the connection is closed (0 disables)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "Time an idle keep-alive client connection is kept open")
+	fs.Int64Var(&c.MinTransferRate, "min-transfer-rate", 0, "Bytes per second clients must at least read responses and send request bodies at, measured over -min-rate-window; slower connections are closed (0 disables)")
+	fs.DurationVar(&c.MinRateWindow, "min-rate-window", 30*time.Second, "Period -min-transfer-rate is measured over")
+	fs.IntVar(&c.ConnLimit, "conn-limit", 0, "New client connections accepted per -conn-limit-window on all proxy ports together; further ones are closed (0 disables)")
+	fs.IntVar(&c.IPConnLimit, "ip-conn-limit", 0, "New connections a client IP may open per -conn-limit-window before it is banned for -ip-ban-time (0 disables)")
+	fs.DurationVar(&c.ConnLimitWindow, "conn-limit-window", 10*time.Second, "Period -conn-limit and -ip-conn-limit are counted over")
+	fs.DurationVar(&c.IPBanTime, "ip-ban-time", 5*time.Minute, "How long client IPs over -ip-conn-limit are refused")
+	fs.IntVar(&c.FDReserve, "fd-reserve", 128, "File descriptors kept free below the open files limit (ulimit -n) for origin connections, logs and Redis; new client connections are refused, with a 503 on the HTTP ports, once fewer are left (0 disables)")
+	fs.BoolVar(&c.StrictParsing, "strict-parsing", false, "Reject requests on the HTTP and HTTPS proxy ports with bare LF line endings, duplicate Content-Length, Content-Length with Transfer-Encoding or folded headers; disables keep-alive on them")
+	fs.StringVar(&c.ProxyProtocol, "proxy-protocol", "", "Comma separated IPs and CIDRs of L4 load balancers whose connections start with a HAProxy PROXY protocol header (v1 or v2); the client address it carries is used for stats, rules and connection limits. Connections from these addresses without a valid header are closed; others are served as they are")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "", "Comma separated IPs and CIDRs of downstream proxies chained in front of this one; their requests are attributed to the client in X-Forwarded-For (the rightmost address that is not a trusted proxy), or else X-Real-IP, for stats, rules and logs. The headers of other clients are ignored")
+	fs.BoolVar(&c.TLSHTTP2, "tls-h2", false, "Offer HTTP/2 on the TLS proxy listener, so clients can multiplex CONNECT tunnels over one connection")
+	fs.IntVar(&c.SOCKSPort, "socks-port", 0, "SOCKS5 listener port (0 disables); with proxy authentication clients log in with username/password (RFC 1929) checked like Basic credentials")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "Certificate file for the TLS proxy listener")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "Private key file for the TLS proxy listener")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA bundle; when set clients must present a certificate signed by it")
+	fs.StringVar(&c.TLSUserMap, "tls-user-map", "", "File of '<subject> <user>' lines mapping client certificates to users (default: CN)")
+}
+
+// validateListeners checks the listener settings once every source is applied
+func (c *Config) validateListeners() error {
+	if c.TLSPort != 0 && (c.TLSCert == "" || c.TLSKey == "") {
+		return fmt.Errorf("-tls-port requires -tls-cert and -tls-key")
+	}
+
+	if c.MinTransferRate > 0 && c.MinRateWindow < time.Second {
+		return fmt.Errorf("-min-rate-window must be at least 1s")
+	}
+
+	if c.ConnLimitWindow <= 0 {
+		return fmt.Errorf("-conn-limit-window must be positive")
+	}
+	return nil
+}
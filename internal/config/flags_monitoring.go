@@ -0,0 +1,68 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// registerMonitoringFlags registers logs, alerts and usage reports
+func (c *Config) registerMonitoringFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&c.ExfilThreshold, "exfil-threshold", 0, "Raise an exfiltration alert when a client uploads more than this many megabytes to one external host within -exfil-window (0 disables)")
+	fs.DurationVar(&c.ExfilWindow, "exfil-window", time.Hour, "Period uploads are counted over for -exfil-threshold")
+	fs.Int64Var(&c.DataCap, "data-cap", 0, "ISP data cap in gigabytes per billing cycle; usage is projected to the end of the cycle every hour and an alert raised when the projection or the usage goes over it (see /api/stats/projection; 0 disables)")
+	fs.IntVar(&c.DataCapDay, "data-cap-day", 1, "Day of the month the ISP billing cycle of -data-cap starts; later than a month's last day starts it on that last day")
+	fs.StringVar(&c.AlertWebhook, "alert-webhook", "", "URL every alert (see /api/alerts) is posted to as JSON, with a Slack-compatible text field")
+	fs.StringVar(&c.AlertRules, "alert-rules", "", "File of '<name> <event type> <client|user|host> <count>/<window>' rules raising an alert when more than count events of the type share a client, user or host within window, e.g. 'blocked-burst block client 100/5m'")
+	fs.StringVar(&c.ReportSchedule, "report", "off", "Compile a usage report (top hosts, per-client usage, most blocked hosts, bandwidth totals) after every local day (daily) or Monday to Sunday week (weekly), or off; delivered to -report-dir and/or by mail through -report-smtp")
+	fs.StringVar(&c.ReportDir, "report-dir", "", "Directory reports are written to as report-<daily|weekly>-<first day>.html")
+	fs.StringVar(&c.ReportSMTP, "report-smtp", "", "Mail server (host:port) reports are sent through as HTML email; STARTTLS is used when offered")
+	fs.StringVar(&c.ReportSMTPUser, "report-smtp-user", "", "Username for SMTP authentication (default: none)")
+	fs.StringVar(&c.ReportSMTPPassword, "report-smtp-password", "", "Password for SMTP authentication (or file:, vault:, awssm: reference)")
+	fs.StringVar(&c.ReportFrom, "report-from", "", "Sender address of report emails")
+	fs.StringVar(&c.ReportTo, "report-to", "", "Comma separated recipients of report emails")
+	fs.IntVar(&c.ReportTop, "report-top", 20, "Rows in each table of a report")
+	fs.BoolVar(&c.AccessLog, "access-log", false, "Log every proxied request with its ID, client, user, status, size and duration")
+	fs.StringVar(&c.SIEMFormat, "siem-format", "off", "Write block, error, authentication failure and abuse events for SIEMs: off, cef (ArcSight) or leef (QRadar)")
+	fs.StringVar(&c.SIEMLog, "siem-log", "", "File -siem-format events are appended to (empty or - for stdout)")
+	fs.StringVar(&c.BanLog, "ban-log", "", "File authentication failures and abuse (connection floods, slow and malformed requests) are appended to for fail2ban (- for stdout)")
+}
+
+// validateMonitoring checks the monitoring settings once every source is applied
+func (c *Config) validateMonitoring() error {
+	switch c.ReportSchedule {
+	case "off":
+	case "daily", "weekly":
+		if c.ReportDir == "" && c.ReportSMTP == "" {
+			return fmt.Errorf("-report requires -report-dir or -report-smtp")
+		}
+		if c.ReportSMTP != "" && (c.ReportFrom == "" || c.ReportTo == "") {
+			return fmt.Errorf("-report-smtp requires -report-from and -report-to")
+		}
+		if c.ReportTop < 1 {
+			return fmt.Errorf("-report-top must be at least 1")
+		}
+		if c.Storage == "none" {
+			return fmt.Errorf("-report requires stats storage")
+		}
+	default:
+		return fmt.Errorf("unknown -report %q (want off, daily or weekly)", c.ReportSchedule)
+	}
+
+	if c.DataCap < 0 {
+		return fmt.Errorf("invalid -data-cap %d", c.DataCap)
+	}
+	if c.DataCapDay < 1 || c.DataCapDay > 31 {
+		return fmt.Errorf("invalid -data-cap-day %d, want 1 to 31", c.DataCapDay)
+	}
+	if c.ExfilThreshold > 0 && c.ExfilWindow <= 0 {
+		return fmt.Errorf("-exfil-threshold requires a positive -exfil-window")
+	}
+
+	switch c.SIEMFormat {
+	case "off", "cef", "leef":
+	default:
+		return fmt.Errorf("unknown -siem-format %q (want off, cef or leef)", c.SIEMFormat)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// registerOutboundFlags registers how origins are reached: interfaces,
+// upstream proxies, connection limits and origin TLS
+func (c *Config) registerOutboundFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.OutboundInterfaces, "outbound-interfaces", "", "Comma separated network interfaces outbound connections must use")
+	fs.UintVar(&c.OutboundMark, "outbound-mark", 0, "Firewall mark (SO_MARK) set on outbound sockets for policy routing, e.g. ip rule add fwmark 0x64 table 100; Linux only, needs CAP_NET_ADMIN (0 disables)")
+	fs.StringVar(&c.OutboundDevice, "outbound-device", "", "Network device outbound sockets are bound to with SO_BINDTODEVICE, e.g. a VRF or VPN interface; Linux only, may need CAP_NET_RAW")
+	fs.StringVar(&c.EgressRules, "egress-rules", "", "File of '<host glob|CIDR> <interface|source IP|tunnel> [clients]' rules choosing how connections leave")
+	fs.IntVar(&c.OriginConnLimit, "origin-conn-limit", 0, "Concurrent connections the proxy keeps open to any one origin host; further CONNECTs and requests get a 503 (0 disables). Tunnels through -upstreams count against their origin; plain requests through them are not capped")
+	fs.StringVar(&c.OriginLimits, "origin-limits", "", "File of '<host glob> <limit>' lines overriding -origin-conn-limit for matching hosts; the first match applies and 0 lifts the cap")
+	fs.StringVar(&c.OriginCA, "origin-ca", "", "PEM bundle of CAs trusted, besides the system roots, to sign the certificates of origins the proxy connects to over TLS itself (https:// URLs requested as plain proxy requests; CONNECT tunnels are end to end)")
+	fs.StringVar(&c.OriginPins, "origin-pins", "", "File of '<host|*.domain> sha256/<base64>...' lines pinning origins the proxy connects to over TLS to public keys (SHA-256 of a certificate's SubjectPublicKeyInfo) one certificate of their chain must have; failures are listed at /api/stats/origin-tls")
+	fs.DurationVar(&c.CertWatch, "cert-watch", 0, "How often the certificate of each host tunnelled to over TLS on port 443, and of origins the proxy connects to over TLS, is checked again; a cert-change alert is raised when its issuing CA changes, or its key does more than 30 days before the previous certificate expired (0 disables; see /api/certs)")
+	fs.StringVar(&c.CertWatchState, "cert-watch-state", "", "File the certificates -cert-watch has seen are kept in across restarts")
+	fs.StringVar(&c.OriginTLSMin, "origin-tls-min", "1.2", "Lowest TLS version, 1.0, 1.1, 1.2 or 1.3, accepted from origins the proxy connects to over TLS")
+	fs.StringVar(&c.WireGuard, "wireguard", "", "Comma separated name=file pairs of wg-quick style configs; each starts a user-space WireGuard tunnel -egress-rules can route through by name (needs a build with -tags wireguard)")
+	fs.StringVar(&c.Upstreams, "upstreams", "", "Comma separated upstream proxies (http://[user:pass@]host:port or https://...) to send requests through instead of connecting directly")
+	fs.StringVar(&c.UpstreamStrategy, "upstream-strategy", "round-robin", "How each request picks one of -upstreams: round-robin, sticky (same upstream per host) or random")
+	fs.StringVar(&c.UpstreamProxyProto, "upstream-proxy-protocol", "", "PROXY protocol header, v1 or v2, CONNECT and SOCKS tunnels through -upstreams start with to pass on the client address (empty sends none). Plain HTTP requests share pooled upstream connections and are not covered")
+	fs.DurationVar(&c.UpstreamHealth, "upstream-health-interval", 30*time.Second, "How often -upstreams are health checked; unhealthy ones are skipped until they recover (0 disables)")
+	fs.StringVar(&c.OriginBalance, "origin-balance", "first", "Order the addresses of a multi-address origin are tried in: first (resolver order), round-robin or lowest-latency; failing addresses are skipped for a while either way")
+	fs.DurationVar(&c.HappyEyeballsDelay, "happy-eyeballs-delay", 250*time.Millisecond, "How long a connection attempt to one origin address gets before the next (alternating IPv6 and IPv4) is started in parallel (0 dials one at a time)")
+	fs.IntVar(&c.Prewarm, "prewarm", 0, "Keep a TCP connection open to each of this many most visited HTTPS origins (by stats over the last week) so the next request skips connection setup (0 disables)")
+	fs.StringVar(&c.PrewarmHours, "prewarm-hours", "", "Local hours -prewarm runs in, e.g. 8-18 (default: all day)")
+	fs.IntVar(&c.ProbeOrigins, "probe-origins", 0, "Probe this many most visited HTTPS origins (by stats over the last week) every -probe-interval and report their availability and latency at /api/health/origins (0 disables)")
+	fs.DurationVar(&c.ProbeInterval, "probe-interval", time.Minute, "Time between probes of each -probe-origins origin")
+	fs.StringVar(&c.ProbeMethod, "probe-method", "tcp", "How origins are probed: tcp (connect to port 443) or head (HEAD / over HTTPS, failing on 5xx)")
+	fs.IntVar(&c.ProbeAlertAfter, "probe-alert-after", 3, "Failed probes in a row after which an origin-down alert is raised")
+	fs.StringVar(&c.DenyProtocols, "deny-protocols", "", "Comma separated application protocols refused inside CONNECT and SOCKS tunnels: tls, ssh, bittorrent, http or unknown")
+	fs.StringVar(&c.TunnelAccounting, "tunnel-accounting", "copy", "How CONNECT and SOCKS tunnel bytes are counted: copy (as the proxy relays them) or kernel (the bytes the origin socket acknowledged and received by its TCP_INFO counters, without retransmissions but including TLS to https upstreams; Linux 4.2+)")
+	fs.BoolVar(&c.TunnelIOURing, "tunnel-io-uring", false, "Copy CONNECT and SOCKS tunnel data with send and receive operations batched through one io_uring, to cut syscalls at very high tunnel counts (experimental; needs Linux 5.6+ and a build with -tags iouring)")
+	fs.BoolVar(&c.ConnectUDP, "connect-udp", false, "Accept CONNECT-UDP (RFC 9298, MASQUE) tunnels, upgraded from HTTP/1.1 requests for /.well-known/masque/udp/{host}/{port}/, relaying UDP to the origin directly even with -upstreams set (HTTP/3 clients are not supported)")
+}
+
+// validateOutbound checks the outbound settings once every source is applied
+func (c *Config) validateOutbound() error {
+	switch c.UpstreamStrategy {
+	case "round-robin", "sticky", "random":
+	default:
+		return fmt.Errorf("unknown -upstream-strategy %q (want round-robin, sticky or random)", c.UpstreamStrategy)
+	}
+
+	if c.CertWatch < 0 {
+		return fmt.Errorf("-cert-watch must not be negative")
+	}
+
+	switch c.OriginTLSMin {
+	case "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("unknown -origin-tls-min %q (want 1.0, 1.1, 1.2 or 1.3)", c.OriginTLSMin)
+	}
+
+	switch c.UpstreamProxyProto {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("unknown -upstream-proxy-protocol %q (want v1 or v2)", c.UpstreamProxyProto)
+	}
+
+	for _, proto := range strings.Split(c.DenyProtocols, ",") {
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "", "tls", "ssh", "bittorrent", "http", "unknown":
+		default:
+			return fmt.Errorf("unknown -deny-protocols entry %q (want tls, ssh, bittorrent, http or unknown)", proto)
+		}
+	}
+
+	if (c.OutboundMark != 0 || c.OutboundDevice != "") && runtime.GOOS != "linux" {
+		return fmt.Errorf("-outbound-mark and -outbound-device are not supported on %s", runtime.GOOS)
+	}
+
+	switch c.TunnelAccounting {
+	case "copy":
+	case "kernel":
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("-tunnel-accounting=kernel is not supported on %s", runtime.GOOS)
+		}
+	default:
+		return fmt.Errorf("unknown -tunnel-accounting %q (want copy or kernel)", c.TunnelAccounting)
+	}
+
+	if c.OriginConnLimit < 0 {
+		return fmt.Errorf("-origin-conn-limit must not be negative")
+	}
+
+	if c.ProbeOrigins > 0 {
+		if c.ProbeInterval <= 0 {
+			return fmt.Errorf("-probe-interval must be positive")
+		}
+		if c.ProbeAlertAfter < 1 {
+			return fmt.Errorf("-probe-alert-after must be at least 1")
+		}
+		if c.ProbeMethod != "tcp" && c.ProbeMethod != "head" {
+			return fmt.Errorf("unknown -probe-method %q (want tcp or head)", c.ProbeMethod)
+		}
+	}
+
+	switch c.OriginBalance {
+	case "first", "round-robin", "lowest-latency":
+	default:
+		return fmt.Errorf("unknown -origin-balance %q (want first, round-robin or lowest-latency)", c.OriginBalance)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// registerPolicyFlags registers the rules applied to requests:
+// blacklists, schedules, quotas and filters
+func (c *Config) registerPolicyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.BlockFile, "blacklist", "", "File containing blacklisted domain patterns")
+	fs.StringVar(&c.GeoAllowCountries, "geo-allow-countries", "", "Comma separated ISO country codes (e.g. DE,FR,NL); only destinations located in them are reachable and others, or those that cannot be located, are blocked")
+	fs.StringVar(&c.PauseSchedule, "pause-schedule", "", "File of '<clients> <days> <HH:MM>-<HH:MM>' lines pausing the clients' internet access on those days, in local time; a trailing [!]<calendar> limits a line to the days in one of -calendars, or with ! to the days not in it")
+	fs.StringVar(&c.Calendars, "calendars", "", "Comma separated name=source iCal calendars (files or http(s) URLs) -pause-schedule lines can refer to by name, e.g. school-holidays=https://example.com/holidays.ics")
+	fs.DurationVar(&c.CalendarRefresh, "calendar-refresh", 6*time.Hour, "How often -calendars are re-read; a calendar that fails to load keeps its previous events (0 disables)")
+	fs.StringVar(&c.ServicePolicies, "service-policies", "", "File of '<policies> [clients]' lines applying built-in policies such as youtube-strict, google-safesearch or block-tiktok; the first line matching a client applies (see /api/services)")
+	fs.StringVar(&c.Quotas, "quotas", "", "File of '<clients|*> <limit> <cycle>' lines giving each matching client a data allowance such as 20GB or 5GiB per cycle, where cycle is daily[@HH:MM], weekly[@<day>] or monthly[@<day of month>], e.g. monthly@15 for a billing cycle starting on the 15th; clients over their quota are blocked until it resets (see /api/quotas)")
+	fs.StringVar(&c.DeviceRules, "device-rules", "", "File of '<clients|*> <condition>...' lines blocking requests whose User-Agent meets every condition: browser=<name>[<version], os=<name>[<version], device=<desktop|mobile|tablet|tv|console|bot|other> or ua~<regexp>, e.g. '* os=windows<10' (see /api/devices)")
+	fs.StringVar(&c.AppAgents, "app-agents", "", "Comma separated IPs and CIDRs of LAN agents trusted to tag their requests with the process making them, in an X-Proxy-App header on HTTP and CONNECT requests or as a SOCKS username of [user;]app=<name>; traffic is then reported per application at /api/stats/apps")
+	fs.StringVar(&c.QuotaState, "quota-state", "", "File quota usage is saved to every minute and restored from at startup, so restarts do not reset -quotas (empty keeps usage in memory only)")
+	fs.IntVar(&c.NewDomainAge, "new-domain-age", 0, "Look up the registration date of each destination domain over RDAP and apply -new-domain-policy to domains registered less than this many days ago (0 disables)")
+	fs.StringVar(&c.NewDomainPolicy, "new-domain-policy", "warn", "What to do with domains younger than -new-domain-age: warn (log and emit an event) or block")
+	fs.StringVar(&c.RDAPURL, "rdap-url", "https://rdap.org/domain/", "RDAP service registration dates are looked up from; the domain is appended")
+	fs.StringVar(&c.Warn, "warn", "", "Comma separated ways clients about to be paused or near their -quotas are warned: banner inserts a notice at the top of HTML pages (needs -warn-rewrite-pages), interstitial shows a notice page before the page they asked for every -warn-interval. Only plain HTTP pages can be changed; HTTPS passes through CONNECT tunnels untouched")
+	fs.DurationVar(&c.WarnBefore, "warn-before", 15*time.Minute, "How long before a -pause-schedule pause starts -warn warns its clients (0 disables pause warnings)")
+	fs.IntVar(&c.WarnQuota, "warn-quota", 90, "Percent of a -quotas allowance used from which -warn warns the client")
+	fs.DurationVar(&c.WarnInterval, "warn-interval", 30*time.Minute, "How often a client with a pending warning sees the -warn interstitial again")
+	fs.BoolVar(&c.WarnRewritePages, "warn-rewrite-pages", false, "Allow -warn=banner to modify the HTML of the pages clients load. The proxy has no TLS interception (MITM) mode, so only plain HTTP pages are ever modified")
+	fs.StringVar(&c.AdblockLists, "adblock-lists", "", "Comma separated Adblock Plus filter lists (files or http(s) URLs) to block requests with; HTTPS is matched by host only")
+	fs.DurationVar(&c.AdblockRefresh, "adblock-refresh", 24*time.Hour, "How often -adblock-lists are re-read (0 disables)")
+	fs.BoolVar(&c.Privacy, "privacy", false, "Strip tracking query parameters and third-party cookies from plain HTTP requests")
+	fs.StringVar(&c.PrivacyParams, "privacy-params", "utm_*,fbclid,gclid,dclid,gbraid,wbraid,msclkid,mc_cid,mc_eid,yclid,igshid,_hsenc,_hsmi", "Comma separated query parameters -privacy strips; a trailing * matches any suffix")
+	fs.StringVar(&c.HTTPSUpgrade, "https-upgrade", "off", "Plain HTTP requests for hosts known to permanently redirect to HTTPS (or listed in -hsts-preload): off, warn (log them) or redirect (answer with a redirect to HTTPS without asking the origin)")
+	fs.StringVar(&c.HSTSPreload, "hsts-preload", "", "File of domains, one per line, served only over HTTPS (subdomains included) for -https-upgrade")
+	fs.DurationVar(&c.DecisionCacheTTL, "decision-cache-ttl", 30*time.Second, "How long blacklist matches per destination are cached (0 disables); blacklist changes clear the cache")
+	fs.IntVar(&c.DecisionCacheSize, "decision-cache-size", 50000, "Maximum number of cached blacklist matches")
+}
+
+// validatePolicy checks the policy settings once every source is applied
+func (c *Config) validatePolicy() error {
+	switch c.HTTPSUpgrade {
+	case "off", "warn", "redirect":
+	default:
+		return fmt.Errorf("unknown -https-upgrade %q (want off, warn or redirect)", c.HTTPSUpgrade)
+	}
+
+	if c.GeoAllowCountries != "" && !c.GeoEnabled {
+		return fmt.Errorf("-geo-allow-countries requires -geo-enabled")
+	}
+
+	switch c.NewDomainPolicy {
+	case "warn", "block":
+	default:
+		return fmt.Errorf("unknown -new-domain-policy %q (want warn or block)", c.NewDomainPolicy)
+	}
+
+	for _, item := range strings.Split(c.Calendars, ",") {
+		item = strings.TrimSpace(item)
+		name, source, ok := strings.Cut(item, "=")
+		if item != "" && (!ok || name == "" || source == "") {
+			return fmt.Errorf("invalid -calendars entry %q (want name=file or name=URL)", item)
+		}
+	}
+
+	banner := false
+	for _, mode := range strings.Split(c.Warn, ",") {
+		if mode = strings.TrimSpace(mode); mode != "" && mode != "banner" && mode != "interstitial" {
+			return fmt.Errorf("unknown -warn %q (want banner, interstitial or both)", mode)
+		}
+		banner = banner || mode == "banner"
+	}
+	if banner && !c.WarnRewritePages {
+		return fmt.Errorf("-warn=banner modifies the pages clients load; allow that with -warn-rewrite-pages")
+	}
+	if c.WarnQuota < 1 || c.WarnQuota > 100 {
+		return fmt.Errorf("invalid -warn-quota %d, want 1 to 100", c.WarnQuota)
+	}
+	if c.WarnInterval <= 0 {
+		return fmt.Errorf("-warn-interval must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"go-proxy/internal/logger"
+)
+
+// registerProcessFlags registers logging, privileges, runtime tuning,
+// maintenance mode and high availability
+func (c *Config) registerProcessFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.LogFile, "log-file", "proxy.log", "Log file path")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.BoolVar(&c.Quiet, "quiet", false, "Suppress the startup banner and console status messages")
+	fs.StringVar(&c.RunAsUser, "user", "", "Switch to this user after binding listeners")
+	fs.StringVar(&c.RunAsGroup, "group", "", "Switch to this group after binding listeners (default: the user's group)")
+	fs.StringVar(&c.Chroot, "chroot", "", "Chroot into this directory after startup (paths used by reloads become relative to it)")
+	fs.BoolVar(&c.Maintenance, "maintenance", false, "Start in maintenance mode, answering proxy clients not in -maintenance-allow with a 503 page; switched at runtime with /api/admin/maintenance")
+	fs.StringVar(&c.MaintenanceAllow, "maintenance-allow", "127.0.0.1,::1", "Comma separated IPs and CIDRs still served during maintenance")
+	fs.StringVar(&c.MaintenanceMessage, "maintenance-message", "", "Message shown on the maintenance page")
+	fs.BoolVar(&c.ClusterSync, "cluster-sync", false, "Broadcast blacklist changes made by a reload to every instance sharing the Redis server and prefix, and apply theirs; shared background jobs (geolocation refresh) run on one of them")
+	fs.StringVar(&c.HAPrimary, "ha-primary", "", "Run as standby for the primary whose health endpoint (http://primary:8080/api/health) this is, taking over when it fails")
+	fs.DurationVar(&c.HAInterval, "ha-interval", 2*time.Second, "Time between health checks of -ha-primary")
+	fs.IntVar(&c.HAFailures, "ha-failures", 3, "Consecutive failed health checks of -ha-primary before taking over")
+	fs.StringVar(&c.Tenants, "tenants", "", "JSON file of tenants ([{\"name\", \"users\", \"groups\", \"ports\", \"blacklist\", \"api_token\"}]) with their own blacklist and stats namespace; their api_token reads only their stats")
+	fs.StringVar(&c.HANotify, "ha-notify", "", "Program run with active on failover and standby on failback, e.g. to move a keepalived/VRRP address")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", 5*time.Minute, "Time an old process waits for open tunnels to close after an upgrade (SIGUSR2)")
+	fs.DurationVar(&c.TunnelMaxLifetime, "tunnel-max-lifetime", 24*time.Hour, "Tunnels open longer than this are logged and reported by /api/admin/runtime as leaked (0 disables)")
+	fs.IntVar(&c.GOMAXPROCS, "gomaxprocs", 0, "Maximum number of CPUs running Go code at once (0 uses GOMAXPROCS or all CPUs)")
+	fs.IntVar(&c.GCPercent, "gc-percent", 0, "Garbage collection target: heap growth, in percent, before a collection; lower trades CPU for memory (0 uses GOGC or 100, -1 disables collection)")
+	fs.Int64Var(&c.MemoryLimit, "memory-limit", 0, "Soft memory limit in megabytes the garbage collector works to stay under (0 disables)")
+}
+
+// validateProcess checks the process settings once every source is applied
+func (c *Config) validateProcess() error {
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+
+	if c.HAPrimary != "" && (c.HAInterval <= 0 || c.HAFailures < 1) {
+		return fmt.Errorf("-ha-primary requires a positive -ha-interval and -ha-failures")
+	}
+	return nil
+}
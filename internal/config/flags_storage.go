@@ -0,0 +1,61 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// registerStorageFlags registers where stats and geolocation records are
+// kept, and how many requests are recorded
+func (c *Config) registerStorageFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.RedisAddr, "redis-addr", "localhost:6379", "Redis address")
+	fs.StringVar(&c.RedisPassword, "redis-password", "", "Redis password (or file:, vault:, awssm: reference)")
+	fs.StringVar(&c.RedisPasswordFile, "redis-password-file", "", "File containing the Redis password")
+	fs.StringVar(&c.RedisUsername, "redis-username", "", "Redis ACL username (default user if empty)")
+	fs.IntVar(&c.RedisDB, "redis-db", 0, "Redis database index")
+	fs.StringVar(&c.RedisPrefix, "redis-prefix", "", "Prefix for every Redis key (stats and geo), e.g. \"proxy:\"; unprefixed keys are still read")
+	fs.BoolVar(&c.RedisTLS, "redis-tls", false, "Connect to Redis over TLS (implied by -redis-tls-ca and -redis-tls-cert)")
+	fs.StringVar(&c.RedisTLSCA, "redis-tls-ca", "", "CA bundle for verifying the Redis server (default: system roots)")
+	fs.StringVar(&c.RedisTLSCert, "redis-tls-cert", "", "Client certificate for Redis mutual TLS")
+	fs.StringVar(&c.RedisTLSKey, "redis-tls-key", "", "Client key for Redis mutual TLS")
+	fs.BoolVar(&c.GeoEnabled, "geo-enabled", true, "Enable geolocation tracking")
+	fs.IntVar(&c.GeoCacheSize, "geo-cache-size", 10000, "Size of in-memory geolocation cache")
+	fs.BoolVar(&c.GeoDebug, "geo-debug", false, "Enable verbose geolocation logging")
+	fs.DurationVar(&c.GeoTTL, "geo-ttl", 7*24*time.Hour, "How long geolocation records are kept before they are looked up again")
+	fs.DurationVar(&c.GeoRefreshBefore, "geo-refresh-before", 24*time.Hour, "Look up hosts still in use again this long before their geolocation record expires (0 lets records expire)")
+	fs.IntVar(&c.SampleRate, "sample-rate", 1, "Record 1 in this many allowed requests in stats and the event stream, counting each recorded one that many times; blocked requests and errors are always recorded")
+	fs.StringVar(&c.SampleHosts, "sample-hosts", "", "Comma separated <host glob>=<rate> pairs overriding -sample-rate for matching hosts, e.g. *.googlevideo.com=100; the first match applies")
+	fs.Int64Var(&c.EventStreamMaxLen, "event-stream-maxlen", 0, "Write connect, block and error events to a Redis stream keeping about this many, for consumers of /api/events (0 disables)")
+	fs.StringVar(&c.Storage, "storage", "redis", "Stats storage backend: redis, bolt (local file, no Redis needed), postgres, memory (lost on restart; for development) or none (stats disabled)")
+	fs.BoolVar(&c.StorageLazy, "storage-lazy", false, "Start without waiting for Redis or PostgreSQL: connect in the background and answer stats queries with 503 until connected")
+	fs.StringVar(&c.StoragePath, "storage-path", "proxy.db", "Database file for -storage=bolt")
+	fs.StringVar(&c.PostgresDSN, "postgres-dsn", "", "PostgreSQL connection string for -storage=postgres (or file:, vault:, awssm: reference)")
+	fs.IntVar(&c.StatsBufferSize, "stats-buffer-size", 100000, "Stats records buffered in memory while Redis or PostgreSQL is unreachable, replayed on reconnect (0 disables)")
+}
+
+// validateStorage checks the storage settings once every source is applied
+func (c *Config) validateStorage() error {
+	if (c.RedisTLSCert == "") != (c.RedisTLSKey == "") {
+		return fmt.Errorf("-redis-tls-cert and -redis-tls-key must be set together")
+	}
+
+	if c.GeoTTL <= 0 {
+		return fmt.Errorf("-geo-ttl must be positive")
+	}
+
+	if c.SampleRate < 1 {
+		return fmt.Errorf("-sample-rate must be at least 1")
+	}
+
+	switch c.Storage {
+	case "redis", "bolt", "memory", "none":
+	case "postgres":
+		if c.PostgresDSN == "" {
+			return fmt.Errorf("-storage=postgres requires -postgres-dsn")
+		}
+	default:
+		return fmt.Errorf("unknown -storage %q (want redis, bolt, postgres, memory or none)", c.Storage)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"go-proxy/internal/ha"
+	"go-proxy/internal/report"
+	"go-proxy/internal/storage"
+)
+
+func (c *Config) HTTPAddr() string {
+	return fmt.Sprintf(":%d", c.HTTPPort)
+}
+
+func (c *Config) HTTPSAddr() string {
+	return fmt.Sprintf(":%d", c.HTTPSPort)
+}
+
+func (c *Config) TLSAddr() string {
+	return fmt.Sprintf(":%d", c.TLSPort)
+}
+
+func (c *Config) SOCKSAddr() string {
+	return fmt.Sprintf(":%d", c.SOCKSPort)
+}
+
+// AdblockSources returns the filter lists of -adblock-lists
+func (c *Config) AdblockSources() []string {
+	var sources []string
+	for _, source := range strings.Split(c.AdblockLists, ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// Redis returns the connection options of the Redis used for stats and
+// geolocation
+func (c *Config) Redis() storage.RedisOptions {
+	return storage.RedisOptions{
+		Addr:     c.RedisAddr,
+		Username: c.RedisUsername,
+		Password: c.RedisPassword,
+		DB:       c.RedisDB,
+		Prefix:   c.RedisPrefix,
+		TLS:      c.RedisTLS,
+		CAFile:   c.RedisTLSCA,
+		CertFile: c.RedisTLSCert,
+		KeyFile:  c.RedisTLSKey,
+	}
+}
+
+// HA returns the standby options
+func (c *Config) HA() ha.Options {
+	return ha.Options{
+		PrimaryURL: c.HAPrimary,
+		Interval:   c.HAInterval,
+		Failures:   c.HAFailures,
+		Notify:     c.HANotify,
+	}
+}
+
+// Report returns the scheduled report options
+func (c *Config) Report() report.Options {
+	var to []string
+	for _, addr := range strings.Split(c.ReportTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	return report.Options{
+		Schedule:     c.ReportSchedule,
+		Dir:          c.ReportDir,
+		SMTPAddr:     c.ReportSMTP,
+		SMTPUser:     c.ReportSMTPUser,
+		SMTPPassword: c.ReportSMTPPassword,
+		From:         c.ReportFrom,
+		To:           to,
+		Top:          c.ReportTop,
+	}
+}
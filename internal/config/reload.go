@@ -0,0 +1,69 @@
+package config
+
+import "sort"
+
+// reloadable lists the settings that can be applied to a running instance
+// without a restart.
+var reloadable = map[string]bool{
+	"alert-rules":        true,
+	"blacklist":          true,
+	"device-rules":       true,
+	"egress-rules":       true,
+	"geo-debug":          true,
+	"geo-refresh-before": true,
+	"geo-ttl":            true,
+	"log-level":          true,
+	"maintenance-allow":  true,
+	"origin-limits":      true,
+	"origin-pins":        true,
+	"pause-schedule":     true,
+	"quiet":              true,
+	"quotas":             true,
+	"service-policies":   true,
+	"tenants":            true,
+	"tls-user-map":       true,
+}
+
+// ReloadResult reports the outcome of a configuration reload.
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Changed returns the names of settings whose values differ between c and
+// other, sorted by name.
+func (c *Config) Changed(other *Config) []string {
+	var names []string
+	for name, value := range other.values {
+		if c.values[name] != value {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CompareForReload classifies the settings that differ between the running
+// config c and next into those applied live and those needing a restart.
+func (c *Config) CompareForReload(next *Config) *ReloadResult {
+	result := &ReloadResult{
+		Changed:         []string{},
+		Applied:         []string{},
+		RestartRequired: []string{},
+	}
+	for _, name := range c.Changed(next) {
+		result.Changed = append(result.Changed, name)
+		if reloadable[name] {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	return result
+}
+
+// IsReloadable reports whether the named setting can be applied live.
+func IsReloadable(name string) bool {
+	return reloadable[name]
+}
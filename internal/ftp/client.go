@@ -0,0 +1,278 @@
+// Package ftp is a minimal passive-mode FTP client, enough to download
+// files and list directories for the proxy's FTP gateway.
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandTimeout bounds each command/reply exchange on the control
+// connection
+const commandTimeout = 30 * time.Second
+
+// DialFunc opens the control and data connections, so callers can apply
+// their own outbound restrictions
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Error is a negative reply from the server
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ftp: %d %s", e.Code, e.Msg)
+}
+
+// IsNotFound reports whether err says the file or directory does not exist
+// or is not accessible (550)
+func IsNotFound(err error) bool {
+	var ftpErr *Error
+	return errors.As(err, &ftpErr) && ftpErr.Code == 550
+}
+
+// IsLoginFailed reports whether err is a rejected login (530)
+func IsLoginFailed(err error) bool {
+	var ftpErr *Error
+	return errors.As(err, &ftpErr) && ftpErr.Code == 530
+}
+
+// Entry is one line of a directory listing
+type Entry struct {
+	Name string
+	Dir  bool
+	Line string // The line as the server sent it
+}
+
+// Conn is a logged-in control connection
+type Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+	host string // Data connections go to the control host, whatever PASV says
+	dial DialFunc
+}
+
+// Dial connects to the FTP server at addr and reads its greeting
+func Dial(ctx context.Context, addr string, dial DialFunc) (*Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, text: textproto.NewConn(conn), host: host, dial: dial}
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		c.conn.Close()
+		return nil, replyError(err)
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads a reply whose code starts with expect
+// (e.g. 2 for any 2xx)
+func (c *Conn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expect)
+	return code, msg, replyError(err)
+}
+
+// Login authenticates and switches to binary transfers
+func (c *Conn) Login(user, password string) error {
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+	case 331, 332:
+		if _, _, err := c.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	default:
+		return &Error{Code: code, Msg: "unexpected reply to USER"}
+	}
+	_, _, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// ChangeDir makes path the working directory; it fails if path is a file
+func (c *Conn) ChangeDir(path string) error {
+	_, _, err := c.cmd(2, "CWD %s", path)
+	return err
+}
+
+// Size returns the size of the file at path, or -1 if the server won't say
+func (c *Conn) Size(path string) int64 {
+	_, msg, err := c.cmd(2, "SIZE %s", path)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// Retrieve returns the content of the file at path. The reader must be
+// closed before the next command.
+func (c *Conn) Retrieve(ctx context.Context, path string) (io.ReadCloser, error) {
+	return c.transfer(ctx, "RETR %s", path)
+}
+
+// List returns the entries of the working directory
+func (c *Conn) List(ctx context.Context) ([]Entry, error) {
+	data, err := c.transfer(ctx, "LIST")
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	var entries []Entry
+	reader := textproto.NewReader(bufio.NewReader(data))
+	for {
+		line, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry, ok := parseListLine(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, data.Close()
+}
+
+// Close ends the session
+func (c *Conn) Close() error {
+	c.cmd(2, "QUIT")
+	return c.conn.Close()
+}
+
+// transfer opens a passive data connection and sends the command that
+// uses it
+func (c *Conn) transfer(ctx context.Context, format string, args ...interface{}) (io.ReadCloser, error) {
+	port, err := c.passivePort()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.dial(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		data.Close()
+		return nil, err
+	}
+	// The transfer may take long; the final reply is read on close
+	c.conn.SetDeadline(time.Time{})
+	return &dataReader{Conn: data, ctrl: c}, nil
+}
+
+// passivePort asks for a data port with EPSV, falling back to PASV for
+// servers that predate it
+func (c *Conn) passivePort() (int, error) {
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		// "Entering Extended Passive Mode (|||6446|)"
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start != -1 && end > start+4 {
+			if port, err := strconv.Atoi(msg[start+4 : end]); err == nil {
+				return port, nil
+			}
+		}
+	}
+
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	// "Entering Passive Mode (h1,h2,h3,h4,p1,p2)"; the address is ignored
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start == -1 || end < start {
+		return 0, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+	}
+	return p1<<8 | p2, nil
+}
+
+// dataReader is a data connection that reads the transfer's final reply
+// when closed
+type dataReader struct {
+	net.Conn
+	ctrl   *Conn
+	closed bool
+}
+
+func (d *dataReader) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	d.Conn.Close()
+	d.ctrl.conn.SetDeadline(time.Now().Add(commandTimeout))
+	_, _, err := d.ctrl.text.ReadResponse(2)
+	return replyError(err)
+}
+
+// replyError converts textproto reply errors to *Error
+func replyError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return &Error{Code: protoErr.Code, Msg: protoErr.Msg}
+	}
+	return err
+}
+
+// parseListLine parses a Unix style "ls -l" line, as sent by nearly all
+// servers, or failing that treats the whole line as a name
+func parseListLine(line string) (Entry, bool) {
+	if line == "" || strings.HasPrefix(line, "total ") {
+		return Entry{}, false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 9 || !strings.ContainsRune("-dl", rune(line[0])) {
+		return Entry{Name: strings.TrimSpace(line), Line: line}, true
+	}
+	// The name is whatever follows the eighth field, spaces included
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.IndexByte(rest, ' ')+1:]
+	}
+	name := strings.TrimLeft(rest, " ")
+	if line[0] == 'l' {
+		// Symlinks: "name -> target"
+		if idx := strings.Index(name, " -> "); idx != -1 {
+			name = name[:idx]
+		}
+	}
+	if name == "." || name == ".." {
+		return Entry{}, false
+	}
+	return Entry{Name: name, Dir: line[0] == 'd', Line: line}, true
+}
@@ -4,21 +4,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-
-	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // GeoAPIResponse represents the response format for the geo API endpoint
 type GeoAPIResponse struct {
 	Records map[string]*GeoData `json:"records"`
+	Total   int                 `json:"total"` // Records matching the filters, before paging
+	Offset  int                 `json:"offset"`
+	Limit   int                 `json:"limit,omitempty"` // 0 when unpaged
+}
+
+// HostGeoResponse is the location of a single host
+type HostGeoResponse struct {
+	Host string `json:"host"`
+	*GeoData
 }
 
 // AddAPIHandler adds a handler for geolocation data to the provided HTTP ServeMux
 func AddAPIHandler(mux *http.ServeMux) {
 	mux.HandleFunc("/api/geo", handleGeoAPI)
+	mux.HandleFunc("/api/geo/", handleHostGeoAPI)
 }
 
-// handleGeoAPI handles requests for geolocation data
+// handleGeoAPI handles requests for geolocation data. The records can be
+// narrowed with ?country= (code or name), ?city=, ?region= and ?host=
+// (substring), and paged by host with ?limit= and ?offset=.
 func handleGeoAPI(w http.ResponseWriter, r *http.Request) {
 	// Only support GET requests
 	if r.Method != http.MethodGet {
@@ -32,12 +45,27 @@ func handleGeoAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all geolocation data from Redis
+	query := r.URL.Query()
+	offset, limit := 0, 0
+	for name, target := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*target = n
+		}
+	}
+
+	// Get all geolocation data from the persistent cache
 	response, err := getAllGeoData()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get geolocation data: %v", err), http.StatusInternalServerError)
 		return
 	}
+	filterGeoData(response, query.Get("country"), query.Get("city"), query.Get("region"), query.Get("host"))
+	pageGeoData(response, offset, limit)
 
 	// Set headers and encode response
 	w.Header().Set("Content-Type", "application/json")
@@ -47,37 +75,79 @@ func handleGeoAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// getAllGeoData retrieves all geolocation data from Redis
-func getAllGeoData() (*GeoAPIResponse, error) {
-	conn := globalGeoCache.redisPool.Get()
-	defer conn.Close()
-
-	// Get all geo keys
-	keys, err := redis.Strings(conn.Do("KEYS", "geo:*"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to get geo keys: %w", err)
+// handleHostGeoAPI serves /api/geo/{host}, looking the host up on demand
+// if it has no record yet
+func handleHostGeoAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if globalGeoCache == nil {
+		http.Error(w, "Geolocation system not initialized", http.StatusInternalServerError)
+		return
 	}
 
-	records := make(map[string]*GeoData)
+	host := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/geo/"))
+	if host == "" || strings.Contains(host, "/") {
+		http.Error(w, "Invalid host", http.StatusBadRequest)
+		return
+	}
+	if isPrivateIP(host) {
+		http.Error(w, "Private addresses have no location", http.StatusNotFound)
+		return
+	}
 
-	// Get data for each key
-	for _, key := range keys {
-		host := key[4:] // Remove "geo:" prefix
+	data, err := globalGeoCache.Lookup(host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to locate %s: %v", host, err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HostGeoResponse{Host: host, GeoData: data})
+}
 
-		// Get data from Redis
-		data, err := redis.Bytes(conn.Do("GET", key))
-		if err != nil {
-			continue
-		}
+// getAllGeoData retrieves all persisted geolocation data
+func getAllGeoData() (*GeoAPIResponse, error) {
+	records, err := globalGeoCache.store.All()
+	if err != nil {
+		return nil, err
+	}
+	return &GeoAPIResponse{Records: records, Total: len(records)}, nil
+}
 
-		// Parse JSON data
-		var geoData GeoData
-		if err := json.Unmarshal(data, &geoData); err != nil {
-			continue
+// filterGeoData drops the records not matching every non-empty filter
+func filterGeoData(response *GeoAPIResponse, country, city, region, host string) {
+	for name, data := range response.Records {
+		if (country != "" && !strings.EqualFold(data.CountryCode, country) && !strings.EqualFold(data.CountryName, country)) ||
+			(city != "" && !strings.EqualFold(data.City, city)) ||
+			(region != "" && !strings.EqualFold(data.Region, region)) ||
+			(host != "" && !strings.Contains(name, strings.ToLower(host))) {
+			delete(response.Records, name)
 		}
+	}
+	response.Total = len(response.Records)
+}
 
-		records[host] = &geoData
+// pageGeoData keeps limit records from offset, in host order; a zero limit
+// keeps all from offset
+func pageGeoData(response *GeoAPIResponse, offset, limit int) {
+	response.Offset, response.Limit = offset, limit
+	if offset == 0 && limit == 0 {
+		return
+	}
+	hosts := make([]string, 0, len(response.Records))
+	for host := range response.Records {
+		hosts = append(hosts, host)
 	}
+	sort.Strings(hosts)
 
-	return &GeoAPIResponse{Records: records}, nil
+	end := len(hosts)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	page := make(map[string]*GeoData)
+	for i := offset; i < end; i++ {
+		page[hosts[i]] = response.Records[hosts[i]]
+	}
+	response.Records = page
 }
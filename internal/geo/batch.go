@@ -0,0 +1,144 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchWindow = 200 * time.Millisecond // How long lookups are collected before an API call
+	batchMax    = 50                     // Hosts per API call
+)
+
+// batchResult is the outcome of one host's lookup in a batch
+type batchResult struct {
+	data *GeoData
+	err  error
+}
+
+// batch collects the hosts to look up in the next GeoJS call. Concurrent
+// lookups of the same host share one slot.
+type batch struct {
+	mutex   sync.Mutex
+	pending map[string][]chan batchResult // Host -> lookups waiting for it
+	order   []string                      // Pending hosts in arrival order
+}
+
+// lookupGeoJS looks host up with the GeoJS API. Lookups arriving within
+// batchWindow of each other go out as one request, keeping busy networks
+// within the API rate limit.
+func (g *GeoCache) lookupGeoJS(host string) (*GeoData, error) {
+	result := make(chan batchResult, 1)
+
+	g.batch.mutex.Lock()
+	waiters, queued := g.batch.pending[host]
+	g.batch.pending[host] = append(waiters, result)
+	if !queued {
+		g.batch.order = append(g.batch.order, host)
+		if len(g.batch.order) == 1 {
+			time.AfterFunc(batchWindow, g.flushBatch)
+		}
+	}
+	g.batch.mutex.Unlock()
+
+	r := <-result
+	return r.data, r.err
+}
+
+// flushBatch looks up every pending host, batchMax per rate limited call
+func (g *GeoCache) flushBatch() {
+	g.batch.mutex.Lock()
+	hosts := g.batch.order
+	g.batch.order = nil
+	g.batch.mutex.Unlock()
+
+	for len(hosts) > 0 {
+		chunk := hosts
+		if len(chunk) > batchMax {
+			chunk = chunk[:batchMax]
+		}
+		hosts = hosts[len(chunk):]
+
+		<-g.rateLimiter.C
+		start := time.Now()
+		records, err := g.fetchBatch(chunk)
+		g.metrics.apiCalls.Add(1)
+		g.metrics.apiNanos.Add(int64(time.Since(start)))
+		if err != nil {
+			g.metrics.apiFailures.Add(1)
+		} else {
+			g.logInfo("Looked up %d hosts in one GeoJS request", len(chunk))
+		}
+
+		g.batch.mutex.Lock()
+		for _, host := range chunk {
+			result := batchResult{data: records[host], err: err}
+			if err == nil && result.data == nil {
+				result.err = fmt.Errorf("GeoJS returned no result for %s", host)
+			}
+			for _, waiter := range g.batch.pending[host] {
+				waiter <- result
+			}
+			delete(g.batch.pending, host)
+		}
+		g.batch.mutex.Unlock()
+	}
+}
+
+// fetchBatch performs one GeoJS API request for hosts
+func (g *GeoCache) fetchBatch(hosts []string) (map[string]*GeoData, error) {
+	resp, err := g.httpClient.Get("https://get.geojs.io/v1/ip/geo.json?ip=" + url.QueryEscape(strings.Join(hosts, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("GeoJS API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GeoJS API returned non-OK status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoJS response: %w", err)
+	}
+
+	// A single address may come back as an object rather than an array
+	var responses []GeoJSResponse
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '{' {
+		responses = make([]GeoJSResponse, 1)
+		err = json.Unmarshal(body, &responses[0])
+	} else {
+		err = json.Unmarshal(body, &responses)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GeoJS response: %w", err)
+	}
+
+	records := make(map[string]*GeoData, len(responses))
+	for i, geoJSResp := range responses {
+		host := geoJSResp.IP
+		if len(responses) == len(hosts) && host != hosts[i] {
+			// Results are in request order; the echoed address may be
+			// normalized differently
+			host = hosts[i]
+		}
+		records[host] = &GeoData{
+			CountryCode: geoJSResp.CountryCode,
+			CountryName: geoJSResp.CountryName,
+			City:        geoJSResp.City,
+			Latitude:    geoJSResp.Latitude,
+			Longitude:   geoJSResp.Longitude,
+			Region:      geoJSResp.Region,
+			TimeZone:    geoJSResp.TimeZone,
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,122 @@
+package geo
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// geoBucket holds geolocation records keyed by host
+var geoBucket = []byte("geo")
+
+// boltPersistence keeps records in a bbolt database shared with the stats
+// store
+type boltPersistence struct {
+	db *bolt.DB
+}
+
+// boltRecord wraps a record with its expiry, which bbolt has no notion of
+type boltRecord struct {
+	Expires int64    `json:"expires"` // Unix seconds
+	Data    *GeoData `json:"data"`
+}
+
+// NewBoltPersistence stores geolocation records in an open bbolt database.
+// The database is owned by the caller and is not closed by Close.
+func NewBoltPersistence(db *bolt.DB) (Persistence, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(geoBucket)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create geo bucket: %w", err)
+	}
+	return &boltPersistence{db: db}, nil
+}
+
+// Get implements Persistence
+func (p *boltPersistence) Get(host string) (*GeoData, error) {
+	var data *GeoData
+	err := p.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(geoBucket).Get([]byte(host))
+		if raw == nil {
+			return nil
+		}
+		var record boltRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal geo data: %w", err)
+		}
+		if record.Expires >= time.Now().Unix() {
+			data = record.Data
+		}
+		return nil
+	})
+	return data, err
+}
+
+// Save implements Persistence
+func (p *boltPersistence) Save(host string, data *GeoData, ttl time.Duration) error {
+	raw, err := json.Marshal(boltRecord{Expires: time.Now().Add(ttl).Unix(), Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal geo data: %w", err)
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(geoBucket).Put([]byte(host), raw)
+	})
+}
+
+// TTL implements Persistence
+func (p *boltPersistence) TTL(host string) (time.Duration, error) {
+	var ttl time.Duration
+	err := p.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(geoBucket).Get([]byte(host))
+		if raw == nil {
+			return nil
+		}
+		var record boltRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal geo data: %w", err)
+		}
+		if remaining := time.Until(time.Unix(record.Expires, 0)); remaining > 0 {
+			ttl = remaining
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// All implements Persistence, dropping expired records as it goes
+func (p *boltPersistence) All() (map[string]*GeoData, error) {
+	records := make(map[string]*GeoData)
+	now := time.Now().Unix()
+
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(geoBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var record boltRecord
+			if json.Unmarshal(v, &record) != nil || record.Expires < now || record.Data == nil {
+				expired = append(expired, append([]byte(nil), k...))
+				return nil
+			}
+			records[string(k)] = record.Data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Close implements Persistence; the database itself stays open
+func (p *boltPersistence) Close() error {
+	return nil
+}
@@ -1,16 +1,19 @@
 package geo
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	lru "github.com/hashicorp/golang-lru"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/storage"
 )
 
 // GeoData represents geolocation information
@@ -22,6 +25,7 @@ type GeoData struct {
 	Longitude   float64 `json:"longitude"`
 	Region      string  `json:"region"`
 	TimeZone    string  `json:"timezone"`
+	IP          string  `json:"ip,omitempty"` // Address the record locates
 }
 
 // GeoJSResponse represents the response from the GeoJS API
@@ -40,36 +44,40 @@ type GeoJSResponse struct {
 type GeoCache struct {
 	memCache    *lru.Cache
 	mutex       sync.RWMutex
-	redisPool   *redis.Pool
+	store       Persistence // Shared cache surviving restarts
 	httpClient  *http.Client
 	rateLimiter *time.Ticker // Basic rate limiter for API calls
-	debugMode   bool         // When true, logs detailed information
+	batch       batch        // Lookups waiting for the next batched API call
+	debugMode   atomic.Bool  // When true, logs detailed information
+	refresh     refresher    // Re-resolves active hosts before their records expire
+	metrics     cacheMetrics
 }
 
+// ErrNoPublicAddress is returned for hosts that only resolve to private
+// addresses, which have no location
+var ErrNoPublicAddress = errors.New("no public address")
+
+// resolveTimeout bounds the DNS lookup of a hostname before geolocating it
+const resolveTimeout = 2 * time.Second
+
 // NewGeoCache initializes the geolocation system with Redis and memory cache
-func NewGeoCache(redisDSN string, memoryCacheSize int, debug bool) (*GeoCache, error) {
+func NewGeoCache(opts storage.RedisOptions, memoryCacheSize int, debug bool) (*GeoCache, error) {
+	store, err := NewRedisPersistence(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoCacheWith(store, memoryCacheSize, debug)
+}
+
+// NewGeoCacheWith initializes the geolocation system on top of the given
+// persistence and a memory cache
+func NewGeoCacheWith(store Persistence, memoryCacheSize int, debug bool) (*GeoCache, error) {
 	// Initialize in-memory LRU cache
 	memCache, err := lru.New(memoryCacheSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LRU cache: %w", err)
 	}
 
-	// Initialize Redis connection pool
-	redisPool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisDSN)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if time.Since(t) < time.Minute {
-				return nil
-			}
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-
 	// Initialize HTTP client with reasonable timeouts
 	httpClient := &http.Client{
 		Timeout: 2 * time.Second, // Short timeout since this is for synchronous requests
@@ -81,11 +89,15 @@ func NewGeoCache(redisDSN string, memoryCacheSize int, debug bool) (*GeoCache, e
 	// Create the geo cache
 	cache := &GeoCache{
 		memCache:    memCache,
-		redisPool:   redisPool,
+		store:       store,
 		httpClient:  httpClient,
 		rateLimiter: rateLimiter,
-		debugMode:   debug,
+		batch:       batch{pending: make(map[string][]chan batchResult)},
+		refresh:     refresher{active: make(map[string]time.Time), done: make(chan struct{})},
 	}
+	cache.debugMode.Store(debug)
+	cache.SetTTL(DefaultTTL, DefaultRefreshBefore)
+	go cache.refreshLoop()
 
 	// Start a background goroutine to discard ticker values if not used
 	go func() {
@@ -97,139 +109,136 @@ func NewGeoCache(redisDSN string, memoryCacheSize int, debug bool) (*GeoCache, e
 	return cache, nil
 }
 
-// lookupGeoJS performs a lookup using the GeoJS API
-func (g *GeoCache) lookupGeoJS(host string) (*GeoData, error) {
-	// Rate limit API calls
-	<-g.rateLimiter.C
-
-	// Make API request to GeoJS
-	resp, err := g.httpClient.Get(fmt.Sprintf("https://get.geojs.io/v1/ip/geo/%s.json", host))
-	if err != nil {
-		return nil, fmt.Errorf("GeoJS API request failed: %w", err)
-	}
-	defer resp.Body.Close()
+// Lookup performs a geolocation lookup with caching
+func (g *GeoCache) Lookup(host string) (*GeoData, error) {
+	defer g.metrics.observe(time.Now())
 
-	// Check response status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GeoJS API returned non-OK status: %d", resp.StatusCode)
+	// Check in-memory cache first (fast path)
+	g.mutex.RLock()
+	if data, found := g.memCache.Get(host); found {
+		g.mutex.RUnlock()
+		g.metrics.memoryHits.Add(1)
+		g.markActive(host, time.Time{})
+		return data.(*GeoData), nil
 	}
+	g.mutex.RUnlock()
 
-	// Read and parse the response
-	body, err := io.ReadAll(resp.Body)
+	// Check the persistent cache next
+	data, err := g.store.Get(host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read GeoJS response: %w", err)
-	}
-
-	var geoJSResp GeoJSResponse
-	if err := json.Unmarshal(body, &geoJSResp); err != nil {
-		return nil, fmt.Errorf("failed to parse GeoJS response: %w", err)
+		// Log the error but continue to API lookup
+		// Reduced verbosity, only log if debug enabled
+		if g.debugMode.Load() {
+			g.logError("Cache lookup error: %v", err)
+		}
+	} else if data != nil {
+		// Found in the persistent cache, update in-memory cache
+		g.mutex.Lock()
+		g.memCache.Add(host, data)
+		g.mutex.Unlock()
+		g.metrics.storeHits.Add(1)
+		g.markActive(host, time.Time{})
+		return data, nil
 	}
 
-	// Convert to our internal format
-	geoData := &GeoData{
-		CountryCode: geoJSResp.CountryCode,
-		CountryName: geoJSResp.CountryName,
-		City:        geoJSResp.City,
-		Latitude:    geoJSResp.Latitude,
-		Longitude:   geoJSResp.Longitude,
-		Region:      geoJSResp.Region,
-		TimeZone:    geoJSResp.TimeZone,
+	// Not found in local caches, perform API lookup
+	g.metrics.misses.Add(1)
+	geoData, err := g.locate(host)
+	if err != nil {
+		g.metrics.failures.Add(1)
+		return nil, fmt.Errorf("geolocation failed: %w", err)
 	}
 
+	g.remember(host, geoData)
 	return geoData, nil
 }
 
-// getFromRedis attempts to retrieve geolocation data from Redis
-func (g *GeoCache) getFromRedis(host string) (*GeoData, error) {
-	conn := g.redisPool.Get()
-	defer conn.Close()
-
-	// Try to get data from Redis
-	redisKey := fmt.Sprintf("geo:%s", host)
-	data, err := redis.Bytes(conn.Do("GET", redisKey))
-	if err != nil {
-		if err == redis.ErrNil {
-			// Key not found, not an error
-			return nil, nil
-		}
-		return nil, fmt.Errorf("Redis GET failed: %w", err)
+// LookupAddress returns the location of host as reached at ip, updating
+// the record of host if it located a different address
+func (g *GeoCache) LookupAddress(host, ip string) (*GeoData, error) {
+	g.mutex.RLock()
+	data, found := g.memCache.Get(host)
+	g.mutex.RUnlock()
+	if found && data.(*GeoData).IP == ip {
+		g.markActive(host, time.Time{})
+		return data.(*GeoData), nil
 	}
 
-	// Parse the JSON data
-	var geoData GeoData
-	if err := json.Unmarshal(data, &geoData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal geo data: %w", err)
+	// Records of addresses are shared by every host served from them
+	located, err := g.Lookup(ip)
+	if err != nil {
+		return nil, err
 	}
-
-	return &geoData, nil
+	record := *located
+	record.IP = ip
+	g.remember(host, &record)
+	return &record, nil
 }
 
-// saveToRedis saves geolocation data to Redis
-func (g *GeoCache) saveToRedis(host string, data *GeoData) error {
-	conn := g.redisPool.Get()
-	defer conn.Close()
-
-	// Convert data to JSON
-	jsonData, err := json.Marshal(data)
+// locate resolves host, unless it is an address already, and looks up
+// the address with GeoJS. The API's own resolver and CDN hostnames give
+// unreliable results for names.
+func (g *GeoCache) locate(host string) (*GeoData, error) {
+	ip, err := resolveHost(host)
 	if err != nil {
-		return fmt.Errorf("failed to marshal geo data: %w", err)
+		return nil, err
 	}
-
-	// Store in Redis with 7-day expiration
-	redisKey := fmt.Sprintf("geo:%s", host)
-	_, err = conn.Do("SETEX", redisKey, 86400*7, jsonData)
+	geoData, err := g.lookupGeoJS(ip)
 	if err != nil {
-		return fmt.Errorf("Redis SETEX failed: %w", err)
+		return nil, err
 	}
-
-	return nil
+	// Hosts sharing an address share the batch result; copy it
+	record := *geoData
+	record.IP = ip
+	return &record, nil
 }
 
-// Lookup performs a geolocation lookup with caching
-func (g *GeoCache) Lookup(host string) (*GeoData, error) {
-	// Check in-memory cache first (fast path)
-	g.mutex.RLock()
-	if data, found := g.memCache.Get(host); found {
-		g.mutex.RUnlock()
-		return data.(*GeoData), nil
+// resolveHost returns the public address to locate host by: host itself if
+// it is an address, else its first public IPv4 address, else its first
+// public IPv6 one
+func resolveHost(host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
 	}
-	g.mutex.RUnlock()
-
-	// Check Redis next
-	data, err := g.getFromRedis(host)
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		// Log Redis error but continue to API lookup 
-		// Reduced verbosity, only log if debug enabled
-		if g.debugMode {
-			g.logError("Redis lookup error: %v", err)
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	public := ""
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		if isPrivateIP(ip) || addr.IP.IsUnspecified() {
+			continue
+		}
+		if addr.IP.To4() != nil {
+			return ip, nil
+		}
+		if public == "" {
+			public = ip
 		}
-	} else if data != nil {
-		// Found in Redis, update in-memory cache
-		g.mutex.Lock()
-		g.memCache.Add(host, data)
-		g.mutex.Unlock()
-		return data, nil
 	}
-
-	// Not found in local caches, perform API lookup
-	geoData, err := g.lookupGeoJS(host)
-	if err != nil {
-		return nil, fmt.Errorf("geolocation failed: %w", err)
+	if public == "" {
+		return "", fmt.Errorf("%s: %w", host, ErrNoPublicAddress)
 	}
+	return public, nil
+}
 
-	// Store in both caches
+// remember stores a fresh API result in both caches, persisting it
+// asynchronously
+func (g *GeoCache) remember(host string, geoData *GeoData) {
 	g.mutex.Lock()
 	g.memCache.Add(host, geoData)
 	g.mutex.Unlock()
 
-	// Save to Redis asynchronously
+	ttl := g.TTL()
+	g.markActive(host, time.Now().Add(ttl))
 	go func() {
-		if err := g.saveToRedis(host, geoData); err != nil {
-			g.logError("Failed to save geo data to Redis: %v", err)
+		if err := g.store.Save(host, geoData, ttl); err != nil {
+			g.logError("Failed to save geo data: %v", err)
 		}
 	}()
-
-	return geoData, nil
 }
 
 // LookupAsync performs a non-blocking geolocation lookup
@@ -242,20 +251,26 @@ func (g *GeoCache) LookupAsync(host string) {
 
 // Close cleans up resources used by the geo cache
 func (g *GeoCache) Close() {
+	close(g.refresh.done)
 	g.rateLimiter.Stop()
-	g.redisPool.Close()
+	g.store.Close()
+}
+
+// SetDebug enables or disables verbose logging
+func (g *GeoCache) SetDebug(debug bool) {
+	g.debugMode.Store(debug)
 }
 
 // logError logs an error message if debug mode is enabled
 func (g *GeoCache) logError(format string, args ...interface{}) {
-	if g.debugMode {
-		log.Printf("[GEO ERROR] "+format, args...)
+	if g.debugMode.Load() {
+		logger.Warn("[GEO] "+format, args...)
 	}
 }
 
 // logInfo logs an informational message if debug mode is enabled
 func (g *GeoCache) logInfo(format string, args ...interface{}) {
-	if g.debugMode {
-		log.Printf("[GEO INFO] "+format, args...)
+	if g.debugMode.Load() {
+		logger.Info("[GEO] "+format, args...)
 	}
 }
@@ -1,13 +1,14 @@
 package geo
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/storage"
 )
 
 var (
@@ -15,73 +16,72 @@ var (
 	globalGeoCache *GeoCache
 )
 
-// Initialize sets up the global geocache instance
-func Initialize(redisDSN string, memoryCacheSize int) error {
+// Initialize sets up the global geocache instance backed by Redis
+func Initialize(opts storage.RedisOptions, memoryCacheSize int, debug bool) error {
+	store, err := NewRedisPersistence(opts)
+	if err != nil {
+		return fmt.Errorf("failed to initialize geo cache: %w", err)
+	}
+	return InitializeWith(store, memoryCacheSize, debug)
+}
+
+// InitializeWith sets up the global geocache instance on top of store
+func InitializeWith(store Persistence, memoryCacheSize int, debug bool) error {
 	var err error
-	globalGeoCache, err = NewGeoCache(redisDSN, memoryCacheSize)
+	globalGeoCache, err = NewGeoCacheWith(store, memoryCacheSize, debug)
 	if err != nil {
 		return fmt.Errorf("failed to initialize geo cache: %w", err)
 	}
 
-	// Load data from Redis into memory cache on startup
-	if err := preloadFromRedis(); err != nil {
-		log.Printf("Warning: Failed to preload geo data from Redis: %v", err)
+	// Load persisted data into memory cache on startup
+	if err := preloadFromPersistence(); err != nil {
+		logger.Warn("Failed to preload geo data: %v", err)
 		// Non-fatal error, continue
 	}
 
 	return nil
 }
 
-// preloadFromRedis loads existing geolocation data from Redis into memory cache
-func preloadFromRedis() error {
+// preloadFromPersistence loads existing geolocation data from the persistent
+// cache into the memory cache
+func preloadFromPersistence() error {
 	// Exit if geocache not initialized
 	if globalGeoCache == nil {
 		return fmt.Errorf("geocache not initialized")
 	}
 
-	conn := globalGeoCache.redisPool.Get()
-	defer conn.Close()
-
-	// Get all geo keys
-	keys, err := redis.Strings(conn.Do("KEYS", "geo:*"))
+	records, err := globalGeoCache.store.All()
 	if err != nil {
-		return fmt.Errorf("failed to get geo keys from Redis: %w", err)
+		return err
 	}
 
-	log.Printf("Preloading %d geolocation records from Redis", len(keys))
-
-	// Load data for each key
-	for _, key := range keys {
-		host := strings.TrimPrefix(key, "geo:")
-
-		// Get the data
-		data, err := redis.Bytes(conn.Do("GET", key))
-		if err != nil {
-			continue
-		}
-
-		// Parse the JSON data
-		var geoData GeoData
-		if err := json.Unmarshal(data, &geoData); err != nil {
-			continue
-		}
+	logger.Log("Preloading %d geolocation records", len(records))
 
-		// Add to memory cache
-		globalGeoCache.mutex.Lock()
-		globalGeoCache.memCache.Add(host, &geoData)
-		globalGeoCache.mutex.Unlock()
+	globalGeoCache.mutex.Lock()
+	defer globalGeoCache.mutex.Unlock()
+	for host, geoData := range records {
+		globalGeoCache.memCache.Add(host, geoData)
 	}
-
 	return nil
 }
 
+// Default returns the instance set up by Initialize, or nil
+func Default() *GeoCache {
+	return globalGeoCache
+}
+
 // RecordHostLocation asynchronously records geolocation data for a host
 // This function is meant to be called from your proxy handler
 func RecordHostLocation(host string) {
 	if globalGeoCache == nil {
 		return
 	}
+	globalGeoCache.RecordHostLocation(host)
+}
 
+// RecordHostLocation asynchronously records geolocation data for a host,
+// skipping private addresses
+func (g *GeoCache) RecordHostLocation(host string) {
 	// Clean up the host - remove port if present
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
@@ -93,7 +93,62 @@ func RecordHostLocation(host string) {
 	}
 
 	// Perform lookup asynchronously
-	globalGeoCache.LookupAsync(host)
+	g.LookupAsync(host)
+}
+
+// RecordConnection asynchronously records the location of the address a
+// connection to host actually went to, which for CDNs can be far from
+// where the hostname resolves here
+func (g *GeoCache) RecordConnection(host, addr string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		ip = h
+	}
+	if net.ParseIP(ip) == nil || isPrivateIP(ip) || isPrivateIP(host) {
+		return
+	}
+	go func() {
+		_, _ = g.LookupAddress(host, ip)
+	}()
+}
+
+// CachedCountry returns the country code of host from the memory cache,
+// or "" if it has not been located yet. It never blocks on a lookup.
+func (g *GeoCache) CachedCountry(host string) string {
+	g.mutex.RLock()
+	data, found := g.memCache.Peek(host)
+	g.mutex.RUnlock()
+	if !found {
+		return ""
+	}
+	return strings.ToUpper(data.(*GeoData).CountryCode)
+}
+
+// Records returns every persisted record keyed by host
+func (g *GeoCache) Records() (map[string]*GeoData, error) {
+	return g.store.All()
+}
+
+// Country returns the code of the country host is in, looking it up if
+// need be. Hosts on private addresses have no country: "" and no error.
+func (g *GeoCache) Country(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if isPrivateIP(host) {
+		return "", nil
+	}
+	data, err := g.Lookup(host)
+	if errors.Is(err, ErrNoPublicAddress) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(data.CountryCode), nil
 }
 
 // isPrivateIP checks if the given string is a private/local IP address
@@ -129,6 +184,33 @@ func isPrivateIP(ip string) bool {
 	return false
 }
 
+// SetDebug toggles verbose geolocation logging on the running instance
+func SetDebug(debug bool) {
+	if globalGeoCache != nil {
+		globalGeoCache.SetDebug(debug)
+	}
+}
+
+// SetTTL changes the record TTL and refresh window of the running instance
+func SetTTL(ttl, refreshBefore time.Duration) {
+	if globalGeoCache != nil {
+		globalGeoCache.SetTTL(ttl, refreshBefore)
+	}
+}
+
+// SetLeader makes the running instance refresh records only while leader
+// elects it
+func SetLeader(leader Leader) {
+	if globalGeoCache != nil {
+		globalGeoCache.SetLeader(leader)
+	}
+}
+
+// DebugEnabled reports whether verbose geolocation logging is on
+func DebugEnabled() bool {
+	return globalGeoCache != nil && globalGeoCache.debugMode.Load()
+}
+
 // Shutdown cleans up resources used by the geolocation system
 func Shutdown() {
 	if globalGeoCache != nil {
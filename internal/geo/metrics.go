@@ -0,0 +1,68 @@
+package geo
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// cacheMetrics counts how lookups were answered
+type cacheMetrics struct {
+	memoryHits  atomic.Int64
+	storeHits   atomic.Int64
+	misses      atomic.Int64 // Lookups that went to the API
+	failures    atomic.Int64 // Misses that found no location
+	lookups     atomic.Int64
+	lookupNanos atomic.Int64
+	apiCalls    atomic.Int64 // Batched GeoJS requests
+	apiFailures atomic.Int64
+	apiNanos    atomic.Int64
+}
+
+// CacheStats reports the effectiveness of the geolocation cache since
+// startup, for tuning -geo-cache-size
+type CacheStats struct {
+	MemoryHits      int64   `json:"memory_hits"`
+	StoreHits       int64   `json:"store_hits"` // Found in Redis or bolt
+	Misses          int64   `json:"misses"`     // Looked up with the API
+	Failures        int64   `json:"failures"`
+	HitRatio        float64 `json:"hit_ratio"` // Lookups answered without the API
+	MemoryEntries   int     `json:"memory_entries"`
+	AvgLookupMs     float64 `json:"avg_lookup_ms"`
+	APICalls        int64   `json:"api_calls"`
+	APIFailures     int64   `json:"api_failures"`
+	AvgAPILatencyMs float64 `json:"avg_api_latency_ms"`
+	QueueDepth      int     `json:"queue_depth"` // Hosts waiting for the next API call
+}
+
+// observe records the latency of a lookup that began at start
+func (m *cacheMetrics) observe(start time.Time) {
+	m.lookups.Add(1)
+	m.lookupNanos.Add(int64(time.Since(start)))
+}
+
+// Stats returns the cache counters
+func (g *GeoCache) Stats() CacheStats {
+	m := &g.metrics
+	result := CacheStats{
+		MemoryHits:    m.memoryHits.Load(),
+		StoreHits:     m.storeHits.Load(),
+		Misses:        m.misses.Load(),
+		Failures:      m.failures.Load(),
+		MemoryEntries: g.memCache.Len(),
+		APICalls:      m.apiCalls.Load(),
+		APIFailures:   m.apiFailures.Load(),
+	}
+	if total := result.MemoryHits + result.StoreHits + result.Misses; total > 0 {
+		result.HitRatio = float64(result.MemoryHits+result.StoreHits) / float64(total)
+	}
+	if lookups := m.lookups.Load(); lookups > 0 {
+		result.AvgLookupMs = float64(m.lookupNanos.Load()) / float64(lookups) / 1e6
+	}
+	if result.APICalls > 0 {
+		result.AvgAPILatencyMs = float64(m.apiNanos.Load()) / float64(result.APICalls) / 1e6
+	}
+	g.batch.mutex.Lock()
+	result.QueueDepth = len(g.batch.order)
+	g.batch.mutex.Unlock()
+	return result
+}
@@ -0,0 +1,172 @@
+package geo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"go-proxy/internal/storage"
+)
+
+// Persistence stores geolocation records outside the process, so lookups
+// survive restarts and the GeoJS API is queried once per host
+type Persistence interface {
+	// Get returns the record for host, or nil if there is none
+	Get(host string) (*GeoData, error)
+	// Save stores the record for host for ttl
+	Save(host string, data *GeoData, ttl time.Duration) error
+	// TTL returns how long the record for host remains valid, 0 if there
+	// is none
+	TTL(host string) (time.Duration, error)
+	// All returns every stored record keyed by host
+	All() (map[string]*GeoData, error)
+	Close() error
+}
+
+// redisPersistence keeps records under <prefix>geo:<host> keys. Records
+// written before a prefix was configured are still read.
+type redisPersistence struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisPersistence stores geolocation records in Redis
+func NewRedisPersistence(opts storage.RedisOptions) (Persistence, error) {
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialOptions := []redis.DialOption{
+		redis.DialUsername(opts.Username),
+		redis.DialPassword(opts.Password),
+		redis.DialDatabase(opts.DB),
+		redis.DialUseTLS(tlsConfig != nil),
+		redis.DialTLSConfig(tlsConfig),
+	}
+
+	return &redisPersistence{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", opts.Addr, dialOptions...)
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+		prefix: opts.Prefix,
+	}, nil
+}
+
+// Get implements Persistence
+func (p *redisPersistence) Get(host string) (*GeoData, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", p.prefix+"geo:"+host))
+	if err == redis.ErrNil && p.prefix != "" {
+		data, err = redis.Bytes(conn.Do("GET", "geo:"+host))
+	}
+	if err != nil {
+		if err == redis.ErrNil {
+			// Key not found, not an error
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Redis GET failed: %w", err)
+	}
+
+	var geoData GeoData
+	if err := json.Unmarshal(data, &geoData); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal geo data: %w", err)
+	}
+	return &geoData, nil
+}
+
+// Save implements Persistence
+func (p *redisPersistence) Save(host string, data *GeoData, ttl time.Duration) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal geo data: %w", err)
+	}
+
+	if _, err := conn.Do("SETEX", p.prefix+"geo:"+host, int(ttl.Seconds()), jsonData); err != nil {
+		return fmt.Errorf("Redis SETEX failed: %w", err)
+	}
+	if p.prefix != "" {
+		conn.Do("DEL", "geo:"+host)
+	}
+	return nil
+}
+
+// TTL implements Persistence
+func (p *redisPersistence) TTL(host string) (time.Duration, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	millis, err := redis.Int64(conn.Do("PTTL", p.prefix+"geo:"+host))
+	if err == nil && millis == -2 && p.prefix != "" {
+		millis, err = redis.Int64(conn.Do("PTTL", "geo:"+host))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Redis PTTL failed: %w", err)
+	}
+	if millis < 0 {
+		// -2: no record, -1: no expiry (never set by Save)
+		return 0, nil
+	}
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// All implements Persistence
+func (p *redisPersistence) All() (map[string]*GeoData, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	patterns := []string{p.prefix + "geo:*"}
+	if p.prefix != "" {
+		patterns = append(patterns, "geo:*")
+	}
+
+	records := make(map[string]*GeoData)
+	for _, pattern := range patterns {
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get geo keys: %w", err)
+		}
+
+		for _, key := range keys {
+			host := strings.TrimPrefix(strings.TrimPrefix(key, p.prefix), "geo:")
+			if _, ok := records[host]; ok {
+				// Prefixed record shadows a legacy one
+				continue
+			}
+			data, err := redis.Bytes(conn.Do("GET", key))
+			if err != nil {
+				continue
+			}
+
+			var geoData GeoData
+			if err := json.Unmarshal(data, &geoData); err != nil {
+				continue
+			}
+			records[host] = &geoData
+		}
+	}
+	return records, nil
+}
+
+// Close implements Persistence
+func (p *redisPersistence) Close() error {
+	return p.pool.Close()
+}
@@ -0,0 +1,141 @@
+package geo
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultTTL is how long persisted lookups stay valid unless SetTTL
+	// says otherwise
+	DefaultTTL = 7 * 24 * time.Hour
+	// DefaultRefreshBefore is how long before expiry active hosts are
+	// looked up again
+	DefaultRefreshBefore = 24 * time.Hour
+
+	refreshInterval = 10 * time.Minute // How often expiring records are refreshed
+	refreshJob      = "geo-refresh"    // Lease name of the refresh in a cluster
+)
+
+// Leader decides which instance of a cluster runs a shared job
+type Leader interface {
+	// Hold reports whether this instance runs job, keeping the lease for ttl
+	Hold(job string, ttl time.Duration) (bool, error)
+}
+
+// refresher tracks the hosts looked up since the last refresh round, so
+// records of hosts still in use are renewed before they expire
+type refresher struct {
+	ttl           atomic.Int64 // time.Duration
+	refreshBefore atomic.Int64 // time.Duration; 0 disables refreshing
+	mutex         sync.Mutex
+	active        map[string]time.Time // Host -> record expiry, zero if not known yet
+	leader        Leader               // nil refreshes on every instance
+	done          chan struct{}
+}
+
+// SetLeader makes only the instance leader elects refresh records, for
+// instances sharing one persistent cache
+func (g *GeoCache) SetLeader(leader Leader) {
+	g.refresh.mutex.Lock()
+	g.refresh.leader = leader
+	g.refresh.mutex.Unlock()
+}
+
+// SetTTL sets how long new records are kept and how long before expiry
+// records of active hosts are refreshed (0 lets them expire)
+func (g *GeoCache) SetTTL(ttl, refreshBefore time.Duration) {
+	g.refresh.ttl.Store(int64(ttl))
+	g.refresh.refreshBefore.Store(int64(refreshBefore))
+}
+
+// TTL returns how long new records are kept
+func (g *GeoCache) TTL() time.Duration {
+	return time.Duration(g.refresh.ttl.Load())
+}
+
+// markActive records a lookup of host; a non-zero expires is the expiry of
+// the record just saved for it
+func (g *GeoCache) markActive(host string, expires time.Time) {
+	g.refresh.mutex.Lock()
+	defer g.refresh.mutex.Unlock()
+	if known, ok := g.refresh.active[host]; !ok || !expires.IsZero() || known.IsZero() {
+		g.refresh.active[host] = expires
+	}
+}
+
+// refreshLoop renews expiring records every refreshInterval until Close
+func (g *GeoCache) refreshLoop() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.refresh.done:
+			return
+		case <-ticker.C:
+			g.refreshExpiring()
+		}
+	}
+}
+
+// refreshExpiring looks up again the hosts used since the last round whose
+// records expire within the refresh window. Hosts not used again by the
+// next round are forgotten and left to expire. With a leader set, other
+// instances leave their hosts to be looked up again once expired.
+func (g *GeoCache) refreshExpiring() {
+	g.refresh.mutex.Lock()
+	active := g.refresh.active
+	g.refresh.active = make(map[string]time.Time)
+	leader := g.refresh.leader
+	g.refresh.mutex.Unlock()
+
+	window := time.Duration(g.refresh.refreshBefore.Load())
+	if window <= 0 {
+		return
+	}
+	if leader != nil {
+		// The lease outlasts the interval so the leader keeps it between rounds
+		lead, err := leader.Hold(refreshJob, refreshInterval*3/2)
+		if err != nil {
+			g.logError("Failed to hold the refresh lease: %v", err)
+			return
+		}
+		if !lead {
+			return
+		}
+	}
+	now := time.Now()
+	var wg sync.WaitGroup
+	refreshed := 0
+	for host, expires := range active {
+		if expires.IsZero() {
+			ttl, err := g.store.TTL(host)
+			if err != nil {
+				g.logError("Failed to read TTL of %s: %v", host, err)
+				continue
+			}
+			expires = now.Add(ttl)
+		}
+		if expires.Sub(now) > window {
+			continue
+		}
+
+		refreshed++
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			// Lookups are batched, so refreshing many hosts costs few API calls
+			geoData, err := g.locate(host)
+			if err != nil {
+				g.logError("Failed to refresh %s: %v", host, err)
+				return
+			}
+			g.remember(host, geoData)
+		}(host)
+	}
+	wg.Wait()
+	if refreshed > 0 {
+		g.logInfo("Refreshed %d expiring geolocation records", refreshed)
+	}
+}
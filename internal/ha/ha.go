@@ -0,0 +1,178 @@
+// Package ha runs a proxy instance as the hot standby of a primary. The
+// standby polls the primary's health endpoint and, when it stops
+// answering, runs a notify hook (for example one that lets keepalived
+// move the virtual address) to take over; it hands back once the primary
+// recovers. Shared state such as stats and the blacklist lives in Redis,
+// so the standby serves with it from the first request.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go-proxy/internal/logger"
+)
+
+// Roles an instance reports on its health endpoint
+const (
+	RolePrimary = "primary" // Not watching another instance
+	RoleStandby = "standby" // Watching a healthy primary
+	RoleActive  = "active"  // Standing in for a failed primary
+)
+
+// notifyTimeout bounds a run of the notify hook
+const notifyTimeout = 30 * time.Second
+
+// Options configure the standby. An empty PrimaryURL makes the instance a
+// primary.
+type Options struct {
+	PrimaryURL string        // Health endpoint of the primary
+	Interval   time.Duration // Time between health checks
+	Failures   int           // Consecutive failed checks before taking over
+	Notify     string        // Hook run with the new role as its argument
+}
+
+// Monitor tracks the role of this instance
+type Monitor struct {
+	opts   Options
+	client *http.Client
+	log    logger.Logger
+
+	mutex    sync.Mutex
+	role     string
+	failures int       // Consecutive failed checks
+	since    time.Time // When the role last changed
+	stop     chan struct{}
+}
+
+// HealthResponse is the body of the health endpoint
+type HealthResponse struct {
+	Status  string    `json:"status"`
+	Role    string    `json:"role"`
+	Since   time.Time `json:"since"`
+	Primary string    `json:"primary,omitempty"` // Health endpoint watched by a standby
+}
+
+// New creates a monitor. Start begins watching the primary.
+func New(opts Options, log logger.Logger) *Monitor {
+	m := &Monitor{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Interval},
+		log:    log,
+		role:   RolePrimary,
+		since:  time.Now(),
+		stop:   make(chan struct{}),
+	}
+	if opts.PrimaryURL != "" {
+		m.role = RoleStandby
+	}
+	return m
+}
+
+// Start polls the primary every Interval until Stop. It does nothing on a
+// primary.
+func (m *Monitor) Start() {
+	if m.opts.PrimaryURL == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+}
+
+// Stop ends polling
+func (m *Monitor) Stop() {
+	close(m.stop)
+}
+
+// Role returns the current role of this instance
+func (m *Monitor) Role() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.role
+}
+
+// check polls the primary once and changes role when it failed or came
+// back
+func (m *Monitor) check() {
+	healthy := m.primaryHealthy()
+
+	m.mutex.Lock()
+	next := m.role
+	if healthy {
+		m.failures = 0
+		next = RoleStandby
+	} else if m.failures++; m.failures >= m.opts.Failures {
+		next = RoleActive
+	}
+	changed := next != m.role
+	if changed {
+		m.role, m.since = next, time.Now()
+	}
+	m.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if next == RoleActive {
+		m.log.Warn("Primary %s failed %d health checks; taking over", m.opts.PrimaryURL, m.opts.Failures)
+	} else {
+		m.log.Info("Primary %s is healthy again; standing by", m.opts.PrimaryURL)
+	}
+	m.notify(next)
+}
+
+// primaryHealthy reports whether the primary's health endpoint answered OK
+func (m *Monitor) primaryHealthy() bool {
+	resp, err := m.client.Get(m.opts.PrimaryURL)
+	if err != nil {
+		m.log.Debug("Health check of %s failed: %v", m.opts.PrimaryURL, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// notify runs the notify hook with role as its argument
+func (m *Monitor) notify(role string) {
+	if m.opts.Notify == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, m.opts.Notify, role).CombinedOutput()
+	if err != nil {
+		m.log.Error("HA notify hook %s %s failed: %v: %s", m.opts.Notify, role, err, output)
+		return
+	}
+	m.log.Info("HA notify hook %s %s done", m.opts.Notify, role)
+}
+
+// HandleHealth reports that the instance is up and its role. Load
+// balancers and keepalived checks can use it, and a standby polls it on
+// its primary.
+func (m *Monitor) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mutex.Lock()
+	response := HealthResponse{Status: "ok", Role: m.role, Since: m.since, Primary: m.opts.PrimaryURL}
+	m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,11 +1,38 @@
 package logger
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
-var logger *log.Logger
+// Level is the minimum severity a message needs to be written
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+var (
+	logger *log.Logger
+	level  atomic.Int32
+)
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
 
 func Init(filename string) error {
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -17,8 +44,104 @@ func Init(filename string) error {
 	return nil
 }
 
+// String returns the lower-case name of the level
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a Level
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for l, n := range levelNames {
+		if n == name {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetLevel changes the minimum level written by all packages
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// GetLevel returns the current minimum level
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+// Enabled reports whether messages at l are currently written
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// Log writes an informational message
 func Log(format string, v ...interface{}) {
-	if logger != nil {
-		logger.Printf(format, v...)
+	output(LevelInfo, format, v...)
+}
+
+// Debug writes a message only shown at debug level
+func Debug(format string, v ...interface{}) {
+	output(LevelDebug, format, v...)
+}
+
+// Info writes an informational message
+func Info(format string, v ...interface{}) {
+	output(LevelInfo, format, v...)
+}
+
+// Warn writes a warning message
+func Warn(format string, v ...interface{}) {
+	output(LevelWarn, format, v...)
+}
+
+// Error writes an error message
+func Error(format string, v ...interface{}) {
+	output(LevelError, format, v...)
+}
+
+func output(l Level, format string, v ...interface{}) {
+	if logger == nil || !Enabled(l) {
+		return
 	}
+	logger.Printf("["+strings.ToUpper(l.String())+"] "+format, v...)
 }
+
+// Logger is the logging interface components take as a dependency, so they
+// can be given a different sink than the process-wide log
+type Logger interface {
+	Debug(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// Default returns a Logger writing to the process-wide log
+func Default() Logger {
+	return defaultLogger{}
+}
+
+// Discard returns a Logger that drops every message
+func Discard() Logger {
+	return discardLogger{}
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Debug(format string, v ...interface{}) { output(LevelDebug, format, v...) }
+func (defaultLogger) Info(format string, v ...interface{})  { output(LevelInfo, format, v...) }
+func (defaultLogger) Warn(format string, v ...interface{})  { output(LevelWarn, format, v...) }
+func (defaultLogger) Error(format string, v ...interface{}) { output(LevelError, format, v...) }
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...interface{}) {}
+func (discardLogger) Info(string, ...interface{})  {}
+func (discardLogger) Warn(string, ...interface{})  {}
+func (discardLogger) Error(string, ...interface{}) {}
@@ -1,6 +1,11 @@
 package metrics
 
-import "go-proxy/internal/stats"
+import (
+	"time"
+
+	"go-proxy/internal/geo"
+	"go-proxy/internal/stats"
+)
 
 type MetricPoint struct {
 	Timestamp  int64   `json:"timestamp"`
@@ -40,3 +45,74 @@ func TransformHostStats(stats map[string]stats.HostStats) []MetricPoint {
 
 	return metrics
 }
+
+// TransformGeoStats turns the geolocation cache counters into points for
+// the "geo" host, taken at now
+func TransformGeoStats(cache geo.CacheStats, now time.Time) []MetricPoint {
+	timestamp := now.UnixMilli()
+	values := []struct {
+		metricType string
+		value      float64
+	}{
+		{"geo_memory_hits", float64(cache.MemoryHits)},
+		{"geo_store_hits", float64(cache.StoreHits)},
+		{"geo_misses", float64(cache.Misses)},
+		{"geo_failures", float64(cache.Failures)},
+		{"geo_hit_ratio", cache.HitRatio},
+		{"geo_memory_entries", float64(cache.MemoryEntries)},
+		{"geo_lookup_ms", cache.AvgLookupMs},
+		{"geo_api_calls", float64(cache.APICalls)},
+		{"geo_api_failures", float64(cache.APIFailures)},
+		{"geo_api_latency_ms", cache.AvgAPILatencyMs},
+		{"geo_queue_depth", float64(cache.QueueDepth)},
+	}
+	metrics := make([]MetricPoint, len(values))
+	for i, v := range values {
+		metrics[i] = MetricPoint{Timestamp: timestamp, Value: v.value, Host: "geo", MetricType: v.metricType}
+	}
+	return metrics
+}
+
+// InternalStats are the proxy's own operational counters since startup
+type InternalStats struct {
+	RedisCommands     int64
+	RedisErrors       int64
+	RedisAvgLatencyMs float64
+	RedisMaxLatencyMs float64
+	StatsFlushes      int64
+	StatsFlushErrors  int64   // Hosts and users whose stats could not be saved
+	StatsFlushMs      float64 // Duration of the last flush
+	EventQueueDepth   int     // Events waiting for the sinks
+	EventsDropped     int64
+	BlocklistSize     int
+	Reloads           int64
+	ReloadFailures    int64
+}
+
+// TransformInternalStats turns the proxy's own counters into points for
+// the "proxy" host, taken at now
+func TransformInternalStats(internal InternalStats, now time.Time) []MetricPoint {
+	timestamp := now.UnixMilli()
+	values := []struct {
+		metricType string
+		value      float64
+	}{
+		{"redis_commands", float64(internal.RedisCommands)},
+		{"redis_errors", float64(internal.RedisErrors)},
+		{"redis_latency_ms", internal.RedisAvgLatencyMs},
+		{"redis_max_latency_ms", internal.RedisMaxLatencyMs},
+		{"stats_flushes", float64(internal.StatsFlushes)},
+		{"stats_flush_errors", float64(internal.StatsFlushErrors)},
+		{"stats_flush_ms", internal.StatsFlushMs},
+		{"event_queue_depth", float64(internal.EventQueueDepth)},
+		{"events_dropped", float64(internal.EventsDropped)},
+		{"blocklist_size", float64(internal.BlocklistSize)},
+		{"config_reloads", float64(internal.Reloads)},
+		{"config_reload_failures", float64(internal.ReloadFailures)},
+	}
+	metrics := make([]MetricPoint, len(values))
+	for i, v := range values {
+		metrics[i] = MetricPoint{Timestamp: timestamp, Value: v.value, Host: "proxy", MetricType: v.metricType}
+	}
+	return metrics
+}
@@ -0,0 +1,101 @@
+// Package privdrop confines the proxy after it has bound its listeners:
+// optionally chroot into a data directory and switch to an unprivileged
+// user and group so that port 80/443 deployments do not keep running as
+// root.
+package privdrop
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// envConfined records how Apply confined the process as "uid:gid:chroot".
+// Upgrades pass the environment on, so a child started by an upgrade knows
+// it already runs confined by its parent.
+const envConfined = "GO_PROXY_CONFINED"
+
+// Options describes how to confine the process
+type Options struct {
+	User   string // User name or numeric uid to switch to
+	Group  string // Group name or numeric gid (defaults to the user's primary group)
+	Chroot string // Directory to chroot into before dropping privileges
+	// Upgraded is set in a process started by an upgrade, which may
+	// inherit its confinement from the parent instead of applying it
+	Upgraded bool
+}
+
+// Enabled reports whether any confinement was requested
+func (o Options) Enabled() bool {
+	return o.User != "" || o.Group != "" || o.Chroot != ""
+}
+
+// Apply confines the current process according to opts. It must be called
+// after everything that needs root or files outside the chroot (listeners,
+// log file, blacklist) has been opened.
+func Apply(opts Options) error {
+	if !opts.Enabled() {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if opts.User != "" {
+		u, err := lookupUser(opts.User)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("user %s has non-numeric uid %q", opts.User, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("user %s has non-numeric gid %q", opts.User, u.Gid)
+		}
+	}
+	if opts.Group != "" {
+		g, err := lookupGroup(opts.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %s has non-numeric gid %q", opts.Group, g.Gid)
+		}
+	}
+
+	// The chroot and identity of a confined parent carry over to the
+	// processes it starts
+	marker := fmt.Sprintf("%d:%d:%s", uid, gid, opts.Chroot)
+	if opts.Upgraded && os.Getenv(envConfined) == marker {
+		return nil
+	}
+	if err := apply(opts.Chroot, uid, gid); err != nil {
+		return err
+	}
+	return os.Setenv(envConfined, marker)
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// Numeric ids need not exist in /etc/passwd
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown group %s: %w", name, err)
+	}
+	return g, nil
+}
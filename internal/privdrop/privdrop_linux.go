@@ -0,0 +1,54 @@
+//go:build linux
+
+package privdrop
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS from <linux/prctl.h>
+const prSetNoNewPrivs = 38
+
+func apply(chroot string, uid, gid int) error {
+	// Only root can chroot or switch identities. Asking for the identity
+	// the process already has is fine, but a chroot is never skipped.
+	if euid := os.Geteuid(); euid != 0 {
+		if chroot == "" && (uid < 0 || uid == euid) && (gid < 0 || gid == os.Getegid()) {
+			return nil
+		}
+		return fmt.Errorf("-chroot, -user and -group require starting as root (running as uid %d)", euid)
+	}
+
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("chroot %s: %w", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir after chroot: %w", err)
+		}
+	}
+
+	// Group first: once the uid is dropped we may no longer change it
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		// Switching away from uid 0 clears all capabilities
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+	}
+
+	// Never regain privileges through setuid binaries or file capabilities
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package privdrop
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func apply(chroot string, uid, gid int) error {
+	return fmt.Errorf("privilege dropping is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// alertRuleSweep is how often counters of keys that went quiet are dropped
+const alertRuleSweep = time.Minute
+
+// alertRule raises an alert when more than limit events of a type share a
+// client, user or host within window
+type alertRule struct {
+	name   string // Alert kind
+	event  string // Event type, or * for any
+	by     string // client, user or host
+	limit  int
+	window time.Duration
+}
+
+// alertRules evaluates the loaded rules against every emitted event
+type alertRules struct {
+	mutex     sync.Mutex
+	rules     []alertRule
+	counts    map[alertRuleKey]*alertRuleCount
+	lastSweep time.Time
+}
+
+// alertRuleKey identifies the events a rule counts together
+type alertRuleKey struct {
+	rule int
+	key  string
+}
+
+// alertRuleCount holds the times of recent matching events, at most one
+// more than the rule's limit, oldest first
+type alertRuleCount struct {
+	times []time.Time
+	fired time.Time
+}
+
+// loadAlertRuleFile reads an alert rules file. Each line is
+//
+//	<name> <event type> <client|user|host> <count>/<window>
+//
+// and raises an alert named name when more than count events of the type
+// (* for any) from one client or user, or to one host, are emitted within
+// window. A rule fires at most once per window and key, e.g.
+//
+//	blocked-burst block client 100/5m
+//	auth-failures auth  client 20/1m
+func loadAlertRuleFile(filename string) ([]alertRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open alert rules file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []alertRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("alert rules line %d: want <name> <event type> <client|user|host> <count>/<window>", lineNo)
+		}
+		rule := alertRule{name: fields[0], event: fields[1], by: fields[2]}
+		if rule.event == "alert" {
+			return nil, fmt.Errorf("alert rules line %d: rules cannot count alerts", lineNo)
+		}
+		if rule.by != "client" && rule.by != "user" && rule.by != "host" {
+			return nil, fmt.Errorf("alert rules line %d: invalid key %q, want client, user or host", lineNo, rule.by)
+		}
+		count, window, ok := strings.Cut(fields[3], "/")
+		if rule.limit, err = strconv.Atoi(count); !ok || err != nil || rule.limit < 1 {
+			return nil, fmt.Errorf("alert rules line %d: invalid count %q", lineNo, count)
+		}
+		if rule.window, err = time.ParseDuration(window); err != nil || rule.window <= 0 {
+			return nil, fmt.Errorf("alert rules line %d: invalid window %q", lineNo, window)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read alert rules file: %v", err)
+	}
+	return rules, nil
+}
+
+// loadAlertRules reads the alert rules in path and returns the function
+// swapping them in, which removes them if path is empty. Counts start
+// over.
+func (s *Server) loadAlertRules(path string) (func(), error) {
+	var rules []alertRule
+	if path != "" {
+		var err error
+		if rules, err = loadAlertRuleFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.alertRules.mutex.Lock()
+		s.alertRules.rules = rules
+		s.alertRules.counts = make(map[alertRuleKey]*alertRuleCount)
+		s.alertRules.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d alert rules", len(rules))
+		}
+	}, nil
+}
+
+// evaluateAlertRules counts event against every rule it matches and
+// raises the alerts of those it takes over their limit
+func (s *Server) evaluateAlertRules(event storage.Event) {
+	var fired []Alert
+	s.alertRules.mutex.Lock()
+	if len(s.alertRules.rules) == 0 {
+		s.alertRules.mutex.Unlock()
+		return
+	}
+	if event.Time.Sub(s.alertRules.lastSweep) >= alertRuleSweep {
+		s.alertRules.sweep(event.Time)
+	}
+	for i, rule := range s.alertRules.rules {
+		if rule.event != "*" && rule.event != event.Type {
+			continue
+		}
+		key := ruleKey(rule.by, event)
+		if key == "" {
+			continue
+		}
+		if alert, ok := s.alertRules.count(i, key, event.Time); ok {
+			fired = append(fired, alert)
+		}
+	}
+	s.alertRules.mutex.Unlock()
+
+	for _, alert := range fired {
+		s.raiseAlert(alert)
+	}
+}
+
+// ruleKey returns what events are grouped by for a rule keyed by by: the
+// client's IP, the user or the host
+func ruleKey(by string, event storage.Event) string {
+	switch by {
+	case "client":
+		if host, _, err := net.SplitHostPort(event.Client); err == nil {
+			return host
+		}
+		return event.Client
+	case "user":
+		return event.User
+	}
+	return event.Host
+}
+
+// count adds an event at now to the events of rule i with key and
+// returns the alert to raise if they went over the rule's limit
+func (a *alertRules) count(i int, key string, now time.Time) (Alert, bool) {
+	rule := a.rules[i]
+	c, ok := a.counts[alertRuleKey{i, key}]
+	if !ok {
+		c = &alertRuleCount{}
+		a.counts[alertRuleKey{i, key}] = c
+	}
+	cutoff := now.Add(-rule.window)
+	start := 0
+	for start < len(c.times) && !c.times[start].After(cutoff) {
+		start++
+	}
+	if len(c.times)-start > rule.limit {
+		start = len(c.times) - rule.limit
+	}
+	c.times = append(c.times[start:], now)
+
+	if len(c.times) <= rule.limit || now.Sub(c.fired) < rule.window {
+		return Alert{}, false
+	}
+	c.fired = now
+	alert := Alert{
+		Kind:    rule.name,
+		Message: fmt.Sprintf("more than %d %s events from %s %s within %s", rule.limit, rule.event, rule.by, key, rule.window),
+	}
+	switch rule.by {
+	case "client":
+		alert.Client = key
+	case "user":
+		alert.User = key
+	case "host":
+		alert.Message = fmt.Sprintf("more than %d %s events to %s within %s", rule.limit, rule.event, key, rule.window)
+		alert.Host = key
+	}
+	return alert, true
+}
+
+// sweep drops the counts of keys with no events within their rule's
+// window, so clients and hosts seen once do not pile up
+func (a *alertRules) sweep(now time.Time) {
+	for key, c := range a.counts {
+		window := a.rules[key.rule].window
+		if now.Sub(c.times[len(c.times)-1]) > window && now.Sub(c.fired) > window {
+			delete(a.counts, key)
+		}
+	}
+	a.lastSweep = now
+}
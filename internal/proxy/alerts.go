@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// alertLogSize is how many alerts /api/alerts keeps
+const alertLogSize = 1000
+
+// Alert is a condition an operator should look at, such as a client
+// uploading unusually much to one host
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // exfiltration, origin-down, data-cap, data-cap-projection, cert-change or an -alert-rules rule name
+	Client  string    `json:"client,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Message string    `json:"message"`
+}
+
+// alertLog keeps the most recent alerts in a ring, oldest first from next
+type alertLog struct {
+	mutex  sync.Mutex
+	alerts []Alert
+	next   int
+}
+
+// raiseAlert logs alert, keeps it for /api/alerts and hands it to the event
+// sinks as an alert event, which -alert-webhook posts
+func (s *Server) raiseAlert(alert Alert) {
+	alert.Time = time.Now()
+	s.alerts.add(alert)
+	s.log.Warn("ALERT %s: %s", alert.Kind, alert.Message)
+	if s.events == nil {
+		return
+	}
+	s.queueEvent(storage.Event{
+		Time:   alert.Time,
+		Type:   "alert",
+		Client: alert.Client,
+		User:   alert.User,
+		Host:   alert.Host,
+		Detail: alert.Kind + ": " + alert.Message,
+	})
+}
+
+// add stores alert, replacing the oldest when full
+func (l *alertLog) add(alert Alert) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.alerts) < alertLogSize {
+		l.alerts = append(l.alerts, alert)
+		return
+	}
+	l.alerts[l.next] = alert
+	l.next = (l.next + 1) % alertLogSize
+}
+
+// since returns up to limit alerts of kind ("" for all) after t, oldest
+// first
+func (l *alertLog) since(t time.Time, kind string, limit int) []Alert {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := []Alert{}
+	for i := 0; i < len(l.alerts) && len(result) < limit; i++ {
+		alert := l.alerts[(l.next+i)%len(l.alerts)]
+		if alert.Time.After(t) && (kind == "" || alert.Kind == kind) {
+			result = append(result, alert)
+		}
+	}
+	return result
+}
+
+// HandleAlerts serves recent alerts as JSON, oldest first: those after
+// ?since= (RFC 3339 or Unix seconds) of ?kind=, at most ?limit= (default
+// 100)
+func (s *Server) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid since, want RFC 3339 or Unix seconds", http.StatusBadRequest)
+				return
+			}
+			since = time.Unix(seconds, 0)
+		}
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.since(since, r.URL.Query().Get("kind"), limit))
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// appHeader names the application that made a request. Agents running on
+// LAN devices set it on the requests and CONNECTs they pass on; it is only
+// trusted from -app-agents and never forwarded.
+const appHeader = "X-Proxy-App"
+
+// Bounds of the per-application counters
+const (
+	maxAppName  = 64   // Characters of an application name
+	maxApps     = 1024 // Applications counted; others count as "other"
+	maxAppHosts = 256  // Hosts counted per application
+	topAppHosts = 10   // Hosts reported per application
+)
+
+// appUsage is the traffic of one application since startup
+type appUsage struct {
+	requests int64
+	bytes    uint64
+	lastSeen time.Time
+	clients  map[string]uint64 // Bytes by client (user or IP)
+	hosts    map[string]uint64 // Bytes by host
+}
+
+// appCounters tracks appUsage by application name
+type appCounters struct {
+	mutex sync.Mutex
+	apps  map[string]*appUsage
+}
+
+// AppStats is the traffic of an application for the API
+type AppStats struct {
+	App      string     `json:"app"`
+	Requests int64      `json:"requests"`
+	Bytes    uint64     `json:"bytes"`
+	LastSeen time.Time  `json:"last_seen"`
+	Clients  []AppShare `json:"clients"`   // Most bytes first
+	TopHosts []AppShare `json:"top_hosts"` // Most bytes first
+}
+
+// AppShare is the bytes one client or host accounts for in an AppStats
+type AppShare struct {
+	Name  string `json:"name"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// appName cleans an application name sent by an agent, e.g. a process
+// name, returning "" if nothing usable is left
+func appName(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) && r != '"' && r != '\\' {
+			return r
+		}
+		return -1
+	}, strings.TrimSpace(value))
+	if runes := []rune(value); len(runes) > maxAppName {
+		value = string(runes[:maxAppName])
+	}
+	return value
+}
+
+// tagApp attributes r to the application named in its X-Proxy-App header
+// if it comes from an -app-agents address, and removes the header
+func (s *Server) tagApp(r *http.Request) {
+	value := r.Header.Get(appHeader)
+	if value == "" {
+		return
+	}
+	r.Header.Del(appHeader)
+	if s.appAgents.match("", r.RemoteAddr) {
+		setRequestApp(r.Context(), appName(value))
+	}
+}
+
+// splitSOCKSApp splits a SOCKS username of the form [user;]app=<name>
+// into the user and application
+func splitSOCKSApp(username string) (string, string) {
+	if app, ok := strings.CutPrefix(username, "app="); ok {
+		return "", appName(app)
+	}
+	if i := strings.LastIndex(username, ";app="); i >= 0 {
+		return username[:i], appName(username[i+len(";app="):])
+	}
+	return username, ""
+}
+
+// add counts a finished request of app by client to host
+func (c *appCounters) add(app, client, host string, bytes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.apps == nil {
+		c.apps = make(map[string]*appUsage)
+	}
+	usage, ok := c.apps[app]
+	if !ok {
+		if len(c.apps) >= maxApps {
+			app = "other"
+			usage = c.apps[app]
+		}
+		if usage == nil {
+			usage = &appUsage{clients: make(map[string]uint64), hosts: make(map[string]uint64)}
+			c.apps[app] = usage
+		}
+	}
+	usage.requests++
+	usage.bytes += bytes
+	usage.lastSeen = time.Now()
+	usage.clients[client] += bytes
+	if _, ok := usage.hosts[host]; ok || len(usage.hosts) < maxAppHosts {
+		usage.hosts[host] += bytes
+	}
+}
+
+// stats returns the usage of every application, most bytes first. If
+// client is not "" only its applications are listed, with only its bytes;
+// requests and hosts still count every client.
+func (c *appCounters) stats(client string) []AppStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := []AppStats{}
+	for app, usage := range c.apps {
+		if _, ok := usage.clients[client]; client != "" && !ok {
+			continue
+		}
+		stats := AppStats{
+			App:      app,
+			Requests: usage.requests,
+			Bytes:    usage.bytes,
+			LastSeen: usage.lastSeen,
+			Clients:  appShares(usage.clients, 0),
+			TopHosts: appShares(usage.hosts, topAppHosts),
+		}
+		if client != "" {
+			stats.Bytes = usage.clients[client]
+			stats.Clients = []AppShare{{Name: client, Bytes: stats.Bytes}}
+		}
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].App < result[j].App
+	})
+	return result
+}
+
+// appShares lists counts by name, most bytes first, at most limit of them
+// unless limit is 0
+func appShares(counts map[string]uint64, limit int) []AppShare {
+	shares := make([]AppShare, 0, len(counts))
+	for name, bytes := range counts {
+		shares = append(shares, AppShare{Name: name, Bytes: bytes})
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Bytes != shares[j].Bytes {
+			return shares[i].Bytes > shares[j].Bytes
+		}
+		return shares[i].Name < shares[j].Name
+	})
+	if limit > 0 && len(shares) > limit {
+		shares = shares[:limit]
+	}
+	return shares
+}
+
+// HandleAppStats serves the traffic of each application agents tagged
+// since startup, or of the applications of ?client= (a user or IP)
+func (s *Server) HandleAppStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.apps.stats(r.URL.Query().Get("client")))
+}
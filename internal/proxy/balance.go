@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	originMaxFailures = 3                // Consecutive failures before an address is skipped
+	originDownTime    = 30 * time.Second // How long a failing address is skipped
+	originMaxTracked  = 10000            // Addresses tracked before idle ones are forgotten
+	originIdleTime    = 10 * time.Minute // How long an unused address is remembered
+)
+
+// originAddr tracks dials to one origin address
+type originAddr struct {
+	latency     time.Duration // Moving average of successful connects
+	dials       int64
+	failures    int64
+	consecutive int       // Failures since the last success
+	downUntil   time.Time // Skipped until then, unless every address is
+	lastUsed    time.Time
+}
+
+// originBalancer orders the addresses a host resolves to and fails over
+// between them, skipping addresses that keep failing
+type originBalancer struct {
+	strategy string // first, round-robin or lowest-latency
+	next     atomic.Uint64
+	mutex    sync.Mutex
+	addrs    map[string]*originAddr // By IP
+}
+
+// OriginStats reports the dials to one origin address
+type OriginStats struct {
+	IP        string  `json:"ip"`
+	Dials     int64   `json:"dials"`
+	Failures  int64   `json:"failures"`
+	LatencyMs float64 `json:"latency_ms"` // Moving average connect time
+	Down      bool    `json:"down"`       // Skipped after repeated failures
+}
+
+func newOriginBalancer(strategy string) *originBalancer {
+	return &originBalancer{strategy: strategy, addrs: make(map[string]*originAddr)}
+}
+
+// order returns ips in the order they should be dialed: by strategy, with
+// addresses that are down moved to the end
+func (b *originBalancer) order(ips []net.IPAddr) []net.IPAddr {
+	ordered := make([]net.IPAddr, len(ips))
+	if b.strategy == "round-robin" && len(ips) > 1 {
+		offset := int(b.next.Add(1)-1) % len(ips)
+		copy(ordered, ips[offset:])
+		copy(ordered[len(ips)-offset:], ips[:offset])
+	} else {
+		copy(ordered, ips)
+	}
+
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	down := func(ip net.IPAddr) bool {
+		a, ok := b.addrs[ip.IP.String()]
+		return ok && now.Before(a.downUntil)
+	}
+	latency := func(ip net.IPAddr) time.Duration {
+		if a, ok := b.addrs[ip.IP.String()]; ok {
+			return a.latency
+		}
+		return 0 // Untried addresses go first so they get measured
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if di, dj := down(ordered[i]), down(ordered[j]); di != dj {
+			return dj
+		}
+		if b.strategy == "lowest-latency" {
+			return latency(ordered[i]) < latency(ordered[j])
+		}
+		return false
+	})
+	return ordered
+}
+
+// record notes the outcome of a dial to ip that took elapsed
+func (b *originBalancer) record(ip net.IP, elapsed time.Duration, err error) {
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := ip.String()
+	a, ok := b.addrs[key]
+	if !ok {
+		if len(b.addrs) >= originMaxTracked {
+			b.forgetIdle(now)
+		}
+		a = &originAddr{}
+		b.addrs[key] = a
+	}
+	a.dials++
+	a.lastUsed = now
+	if err != nil {
+		a.failures++
+		a.consecutive++
+		if a.consecutive >= originMaxFailures {
+			a.downUntil = now.Add(originDownTime)
+		}
+		return
+	}
+	a.consecutive = 0
+	a.downUntil = time.Time{}
+	if a.latency == 0 {
+		a.latency = elapsed
+	} else {
+		a.latency = (a.latency*7 + elapsed) / 8
+	}
+}
+
+// forgetIdle drops addresses not dialed for originIdleTime
+func (b *originBalancer) forgetIdle(now time.Time) {
+	for key, a := range b.addrs {
+		if now.Sub(a.lastUsed) > originIdleTime {
+			delete(b.addrs, key)
+		}
+	}
+}
+
+// OriginStats returns the tracked origin addresses that have failed at
+// least once
+func (s *Server) OriginStats() []OriginStats {
+	result := []OriginStats{}
+	if s.balancer == nil {
+		return result
+	}
+	now := time.Now()
+	s.balancer.mutex.Lock()
+	defer s.balancer.mutex.Unlock()
+	for ip, a := range s.balancer.addrs {
+		if a.failures == 0 {
+			continue
+		}
+		result = append(result, OriginStats{
+			IP:        ip,
+			Dials:     a.dials,
+			Failures:  a.failures,
+			LatencyMs: float64(a.latency.Microseconds()) / 1000,
+			Down:      now.Before(a.downUntil),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Failures > result[j].Failures })
+	return result
+}
+
+// HandleOriginStats serves OriginStats as JSON
+func (s *Server) HandleOriginStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.OriginStats())
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// loadBlacklist reads the blacklist in path and returns the function
+// swapping it in, which empties the blacklist if path is empty
+func (s *Server) loadBlacklist(path string) (func(), error) {
+	regs := make([]*regexp.Regexp, 0)
+	if path != "" {
+		var err error
+		if regs, err = s.readBlacklist(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Swap in the new list only once it has been read completely
+	return func() {
+		s.setBlacklist(regs)
+		if path != "" {
+			s.log.Info("Loaded %d blacklist patterns", len(regs))
+		}
+	}, nil
+}
+
+// readBlacklist compiles the patterns in a blacklist file, skipping
+// invalid ones
+func (s *Server) readBlacklist(path string) ([]*regexp.Regexp, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blacklist file: %v", err)
+	}
+	defer file.Close()
+
+	regs := make([]*regexp.Regexp, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			s.log.Info("Invalid regex pattern '%s': %v", pattern, err)
+			continue
+		}
+		regs = append(regs, reg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blacklist file: %v", err)
+	}
+	return regs, nil
+}
+
+// setBlacklist replaces the blacklist patterns
+func (s *Server) setBlacklist(regs []*regexp.Regexp) {
+	s.blockMutex.Lock()
+	s.blockedRegs = regs
+	s.blockMutex.Unlock()
+	s.invalidateDecisions()
+}
+
+// Update isBlocked method
+func (s *Server) isBlocked(host string) bool {
+	s.blockMutex.RLock()
+	defer s.blockMutex.RUnlock()
+
+	if len(s.blockedRegs) == 0 {
+		return false
+	}
+
+	for _, reg := range s.blockedRegs {
+		if reg.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// blacklistRule returns the first blacklist pattern matching host, or ""
+func (s *Server) blacklistRule(host string) string {
+	s.blockMutex.RLock()
+	defer s.blockMutex.RUnlock()
+
+	for _, reg := range s.blockedRegs {
+		if reg.MatchString(host) {
+			return reg.String()
+		}
+	}
+	return ""
+}
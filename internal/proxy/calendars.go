@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	calendarFetchTimeout = 30 * time.Second
+	maxCalendarSize      = 8 << 20
+)
+
+// calendarEvent is a VEVENT of an iCal feed. All-day events run from the
+// local midnight starting their first date to the one ending their last.
+type calendarEvent struct {
+	start, end time.Time
+	allDay     bool
+	yearly     bool // RRULE:FREQ=YEARLY, repeating on the same dates
+}
+
+// calendar is a named iCal feed schedules can refer to, such as school
+// holidays. A feed that fails to refresh keeps its previous events.
+type calendar struct {
+	name   string
+	source string // File or http(s) URL
+
+	mutex   sync.RWMutex
+	events  []calendarEvent
+	updated time.Time
+	err     string // Last refresh failure
+}
+
+// CalendarStatus describes a -calendars feed
+type CalendarStatus struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Events  int       `json:"events"`
+	Today   bool      `json:"today"` // Whether today is in the calendar
+	Updated time.Time `json:"updated"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// parseCalendars parses -calendars, comma separated name=source pairs
+func parseCalendars(value string) (map[string]*calendar, error) {
+	calendars := make(map[string]*calendar)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, source, ok := strings.Cut(item, "=")
+		name, source = strings.TrimSpace(name), strings.TrimSpace(source)
+		if !ok || name == "" || source == "" {
+			return nil, fmt.Errorf("invalid calendar %q, want name=file or name=URL", item)
+		}
+		calendars[name] = &calendar{name: name, source: source}
+	}
+	return calendars, nil
+}
+
+// startCalendars loads the -calendars feeds and refreshes them every
+// -calendar-refresh
+func (s *Server) startCalendars(value string, refresh time.Duration) {
+	calendars, err := parseCalendars(value)
+	if err != nil {
+		s.log.Error("Error loading calendars: %v", err)
+		return
+	}
+	s.calendars = calendars
+	if len(calendars) == 0 {
+		return
+	}
+	s.refreshCalendars()
+	if refresh > 0 {
+		go func() {
+			for range time.Tick(refresh) {
+				s.refreshCalendars()
+			}
+		}()
+	}
+}
+
+// refreshCalendars re-reads every calendar
+func (s *Server) refreshCalendars() {
+	for _, cal := range s.calendars {
+		events, err := loadCalendar(cal.source)
+		cal.mutex.Lock()
+		if err != nil {
+			cal.err = err.Error()
+		} else {
+			cal.events, cal.updated, cal.err = events, time.Now(), ""
+		}
+		cal.mutex.Unlock()
+		if err != nil {
+			s.log.Warn("Failed to load calendar %s: %v", cal.name, err)
+		} else {
+			s.log.Info("Loaded calendar %s: %d events", cal.name, len(events))
+		}
+	}
+}
+
+// loadCalendar reads the events of an iCal file or feed
+func loadCalendar(source string) ([]calendarEvent, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		ctx, cancel := context.WithTimeout(context.Background(), calendarFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		body = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		body = file
+	}
+	defer body.Close()
+	return parseICal(io.LimitReader(body, maxCalendarSize))
+}
+
+// parseICal reads the VEVENTs of an iCal stream. Recurrence rules other
+// than yearly are not expanded: such events count once.
+func parseICal(r io.Reader) ([]calendarEvent, error) {
+	var events []calendarEvent
+	var event *calendarEvent
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Long lines are folded onto lines starting with a space or tab
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		property, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(property, ";")
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				event = &calendarEvent{}
+			}
+		case "END":
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				if !event.start.IsZero() {
+					if event.end.IsZero() {
+						event.end = event.start
+						if event.allDay {
+							event.end = event.start.AddDate(0, 0, 1)
+						}
+					}
+					events = append(events, *event)
+				}
+				event = nil
+			}
+		case "DTSTART", "DTEND":
+			if event == nil {
+				continue
+			}
+			t, allDay, err := parseICalTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", name, value, err)
+			}
+			if strings.EqualFold(name, "DTSTART") {
+				event.start, event.allDay = t, allDay
+			} else {
+				event.end = t
+			}
+		case "RRULE":
+			if event != nil && strings.Contains(strings.ToUpper(value), "FREQ=YEARLY") {
+				event.yearly = true
+			}
+		}
+	}
+	return events, nil
+}
+
+// parseICalTime parses a DATE or DATE-TIME value. Times in UTC end in Z;
+// others are taken in their TZID, or local time.
+func parseICalTime(value, params string) (time.Time, bool, error) {
+	location := time.Local
+	allDay := len(value) == 8
+	for _, param := range strings.Split(params, ";") {
+		key, v, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "VALUE":
+			allDay = strings.EqualFold(v, "DATE")
+		case "TZID":
+			if loc, err := time.LoadLocation(strings.Trim(v, `"`)); err == nil {
+				location = loc
+			}
+		}
+	}
+	if allDay {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location)
+	return t, false, err
+}
+
+// covers reports whether the event falls on the local date of day
+func (e calendarEvent) covers(day time.Time) bool {
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	next := date.AddDate(0, 0, 1)
+	overlaps := func(start, end time.Time) bool {
+		if end.Equal(start) {
+			return !start.Before(date) && start.Before(next)
+		}
+		return start.Before(next) && end.After(date)
+	}
+	if !e.yearly {
+		return overlaps(e.start, e.end)
+	}
+	// Move the event into the year of date, or the year before for events
+	// spanning New Year
+	for _, years := range []int{date.Year() - e.start.Year(), date.Year() - e.start.Year() - 1} {
+		if years >= 0 && overlaps(e.start.AddDate(years, 0, 0), e.end.AddDate(years, 0, 0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// on reports whether day is in the calendar
+func (c *calendar) on(day time.Time) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, event := range c.events {
+		if event.covers(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// status reports the calendar for the API
+func (c *calendar) status(now time.Time) CalendarStatus {
+	today := c.on(now)
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return CalendarStatus{
+		Name:    c.name,
+		Source:  c.source,
+		Events:  len(c.events),
+		Today:   today,
+		Updated: c.updated,
+		Error:   c.err,
+	}
+}
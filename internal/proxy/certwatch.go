@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bounds of the certificates -cert-watch keeps
+const (
+	certWatchHostsMax = 10000 // Hosts watched; further ones are not
+	certChangesMax    = 10    // Changes kept per host
+	certSaveInterval  = time.Minute
+	// certRenewalWindow is how long before the old certificate expires a
+	// new key from the same CA counts as a renewal rather than a surprise
+	certRenewalWindow = 30 * 24 * time.Hour
+)
+
+// certWatch is the certificate last seen for each HTTPS host
+type certWatch struct {
+	mutex    sync.Mutex
+	certs    map[string]*CertRecord
+	checking map[string]bool // Hosts being checked right now
+	dirty    bool            // Changed since last saved
+}
+
+// CertRecord is the certificate a host presents, and how it changed
+type CertRecord struct {
+	Host        string       `json:"host"`
+	Fingerprint string       `json:"fingerprint"` // SHA-256 of the certificate, hex
+	Key         string       `json:"key"`         // SHA-256 of its public key, base64 as in -origin-pins
+	Issuer      string       `json:"issuer"`      // Organisation of the issuing CA, else its name
+	Subject     string       `json:"subject"`
+	NotAfter    time.Time    `json:"not_after"`
+	FirstSeen   time.Time    `json:"first_seen"` // When this certificate was first seen
+	LastChecked time.Time    `json:"last_checked"`
+	Changes     []CertChange `json:"changes,omitempty"` // Oldest first
+}
+
+// CertChange is a host switching certificates
+type CertChange struct {
+	Time          time.Time `json:"time"`
+	From          string    `json:"from"` // Fingerprints
+	To            string    `json:"to"`
+	IssuerChanged bool      `json:"issuer_changed"`
+	KeyChanged    bool      `json:"key_changed"`
+	Expected      bool      `json:"expected"` // A renewal: no alert was raised
+}
+
+// certIssuer names the CA that issued cert. Organisations are compared
+// rather than names, which change as CAs rotate intermediates.
+func certIssuer(cert *x509.Certificate) string {
+	if len(cert.Issuer.Organization) > 0 {
+		return cert.Issuer.Organization[0]
+	}
+	return cert.Issuer.String()
+}
+
+// watchCert checks the certificate of addr, the host:port of a TLS tunnel,
+// unless it was checked less than -cert-watch ago. Only port 443 of named
+// hosts is watched, as other ports may well serve other certificates.
+func (s *Server) watchCert(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if s.cfg.CertWatch <= 0 || err != nil || port != "443" || net.ParseIP(host) != nil {
+		return
+	}
+	c := &s.certWatch
+	c.mutex.Lock()
+	record, ok := c.certs[host]
+	if c.checking[host] || (ok && time.Since(record.LastChecked) < s.cfg.CertWatch) ||
+		(!ok && len(c.certs) >= certWatchHostsMax) {
+		c.mutex.Unlock()
+		return
+	}
+	if c.checking == nil {
+		c.checking = make(map[string]bool)
+	}
+	c.checking[host] = true
+	c.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.checking, host)
+			c.mutex.Unlock()
+		}()
+		certs, err := s.fetchCert(host, addr)
+		if err != nil {
+			s.log.Debug("Checking the certificate of %s failed: %v", host, err)
+			return
+		}
+		s.observeCert(host, certs)
+	}()
+}
+
+// fetchCert returns the certificates host presents at addr, reached the
+// way tunnels are. They are not verified: the tunnels are end to end, and
+// the point is to notice what changes.
+func (s *Server) fetchCert(host, addr string) ([]*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if s.upstreams != nil {
+		conn, err = s.dialUpstream(ctx, s.upstreams.pick(host), addr, "")
+	} else {
+		conn, err = s.dialContext(ctx, "tcp", addr, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return certs, nil
+}
+
+// observeCert records certs as presented by host, raising a cert-change
+// alert if the issuing CA changed, or the key did outside the renewal
+// window of the previous certificate
+func (s *Server) observeCert(host string, certs []*x509.Certificate) {
+	if s.cfg.CertWatch <= 0 || host == "" || len(certs) == 0 {
+		return
+	}
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.Raw)
+	keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	fingerprint := hex.EncodeToString(sum[:])
+	key := base64.StdEncoding.EncodeToString(keySum[:])
+	issuer := certIssuer(leaf)
+	now := time.Now()
+
+	c := &s.certWatch
+	c.mutex.Lock()
+	record, ok := c.certs[host]
+	if !ok && len(c.certs) >= certWatchHostsMax {
+		c.mutex.Unlock()
+		return
+	}
+	c.dirty = true
+	if !ok {
+		if c.certs == nil {
+			c.certs = make(map[string]*CertRecord)
+		}
+		c.certs[host] = &CertRecord{Host: host, Fingerprint: fingerprint, Key: key, Issuer: issuer,
+			Subject: leaf.Subject.String(), NotAfter: leaf.NotAfter, FirstSeen: now, LastChecked: now}
+		c.mutex.Unlock()
+		return
+	}
+	record.LastChecked = now
+	if record.Fingerprint == fingerprint {
+		c.mutex.Unlock()
+		return
+	}
+
+	previous := *record
+	change := CertChange{
+		Time:          now,
+		From:          record.Fingerprint,
+		To:            fingerprint,
+		IssuerChanged: record.Issuer != issuer,
+		KeyChanged:    record.Key != key,
+	}
+	change.Expected = !change.IssuerChanged && (!change.KeyChanged || now.Add(certRenewalWindow).After(record.NotAfter))
+	record.Fingerprint, record.Key, record.Issuer = fingerprint, key, issuer
+	record.Subject, record.NotAfter, record.FirstSeen = leaf.Subject.String(), leaf.NotAfter, now
+	record.Changes = append(record.Changes, change)
+	if len(record.Changes) > certChangesMax {
+		record.Changes = record.Changes[len(record.Changes)-certChangesMax:]
+	}
+	c.mutex.Unlock()
+
+	if change.Expected {
+		s.log.Info("Certificate of %s renewed (issuer %s, expires %s)", host, issuer, leaf.NotAfter.Format("2006-01-02"))
+		return
+	}
+	var message string
+	if change.IssuerChanged {
+		message = fmt.Sprintf("Certificate of %s changed issuer from %s to %s", host, previous.Issuer, issuer)
+	} else {
+		message = fmt.Sprintf("Certificate of %s changed key %d days before the previous one expired (issuer %s)",
+			host, int(previous.NotAfter.Sub(now).Hours()/24), issuer)
+	}
+	s.raiseAlert(Alert{Kind: "cert-change", Host: host, Message: message})
+}
+
+// startCertWatch loads the certificates seen before from path, if set,
+// and saves them there every minute
+func (s *Server) startCertWatch(path string) {
+	if s.cfg.CertWatch <= 0 || path == "" {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		certs := make(map[string]*CertRecord)
+		if err := json.Unmarshal(data, &certs); err != nil {
+			s.log.Warn("Ignoring certificate state %s: %v", path, err)
+		} else {
+			s.certWatch.mutex.Lock()
+			s.certWatch.certs = certs
+			s.certWatch.mutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		s.log.Warn("Failed to read certificate state: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(certSaveInterval) {
+			if err := s.saveCerts(path); err != nil {
+				s.log.Warn("Failed to save certificate state: %v", err)
+			}
+		}
+	}()
+}
+
+// saveCerts writes the certificates seen to path if they changed
+func (s *Server) saveCerts(path string) error {
+	s.certWatch.mutex.Lock()
+	if !s.certWatch.dirty {
+		s.certWatch.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.certWatch.certs)
+	s.certWatch.dirty = false
+	s.certWatch.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// HandleCerts reports the certificate last seen for every watched host,
+// or for ?host=, those that changed most recently first
+func (s *Server) HandleCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := r.URL.Query().Get("host")
+
+	records := []CertRecord{}
+	s.certWatch.mutex.Lock()
+	for host, record := range s.certWatch.certs {
+		if only == "" || host == only {
+			copied := *record
+			copied.Changes = append([]CertChange(nil), record.Changes...)
+			records = append(records, copied)
+		}
+	}
+	s.certWatch.mutex.Unlock()
+	if only != "" && len(records) == 0 {
+		http.Error(w, "No certificate seen for "+only, http.StatusNotFound)
+		return
+	}
+	changed := func(record CertRecord) time.Time {
+		if len(record.Changes) == 0 {
+			return time.Time{}
+		}
+		return record.Changes[len(record.Changes)-1].Time
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if a, b := changed(records[i]), changed(records[j]); !a.Equal(b) {
+			return a.After(b)
+		}
+		return records[i].Host < records[j].Host
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
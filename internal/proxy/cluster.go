@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+)
+
+// ClusterBus delivers messages to every proxy instance of a cluster
+type ClusterBus interface {
+	// Publish sends payload to all subscribers, the sender included
+	Publish(payload []byte) error
+	// Subscribe calls handler with every message published from now on
+	Subscribe(handler func(payload []byte))
+}
+
+// clusterMessage is a rule change broadcast to the cluster
+type clusterMessage struct {
+	Origin   string   `json:"origin"` // Instance that made the change
+	Type     string   `json:"type"`   // blacklist
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// clusterSync shares rule changes with the other instances
+type clusterSync struct {
+	bus ClusterBus
+	id  string // This instance, so it skips its own messages
+}
+
+// startCluster subscribes to rule changes made by other instances
+func (s *Server) startCluster(bus ClusterBus) *clusterSync {
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &clusterSync{bus: bus, id: hex.EncodeToString(id)}
+	bus.Subscribe(func(payload []byte) {
+		var msg clusterMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			s.log.Warn("Invalid cluster message: %v", err)
+			return
+		}
+		if msg.Origin != c.id {
+			s.applyClusterMessage(msg)
+		}
+	})
+	return c
+}
+
+// broadcastBlacklist sends the current blacklist to the other instances
+func (s *Server) broadcastBlacklist() {
+	if s.cluster == nil {
+		return
+	}
+	s.blockMutex.RLock()
+	patterns := make([]string, len(s.blockedRegs))
+	for i, reg := range s.blockedRegs {
+		patterns[i] = reg.String()
+	}
+	s.blockMutex.RUnlock()
+
+	payload, _ := json.Marshal(clusterMessage{Origin: s.cluster.id, Type: "blacklist", Patterns: patterns})
+	if err := s.cluster.bus.Publish(payload); err != nil {
+		s.log.Warn("Error broadcasting blacklist: %v", err)
+	}
+}
+
+// applyClusterMessage applies a change made on another instance. It lasts
+// until the next local reload.
+func (s *Server) applyClusterMessage(msg clusterMessage) {
+	switch msg.Type {
+	case "blacklist":
+		regs := make([]*regexp.Regexp, 0, len(msg.Patterns))
+		for _, pattern := range msg.Patterns {
+			reg, err := regexp.Compile(pattern)
+			if err != nil {
+				s.log.Info("Invalid regex pattern '%s': %v", pattern, err)
+				continue
+			}
+			regs = append(regs, reg)
+		}
+		s.setBlacklist(regs)
+		s.log.Info("Applied %d blacklist patterns from instance %s", len(regs), msg.Origin)
+	default:
+		s.log.Warn("Unknown cluster message type %q from instance %s", msg.Type, msg.Origin)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brotliLevel trades ratio for speed; the top levels are far too slow for
+// compressing on the fly
+const brotliLevel = 4
+
+// compressibleTypes are the media types worth compressing; structured
+// suffixes (+json, +xml) are compressible too
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/wasm":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+	"image/x-icon":           true,
+}
+
+// compressionCounters accumulate the outcome of compressed responses
+type compressionCounters struct {
+	responses   atomic.Int64
+	originBytes atomic.Uint64
+	sentBytes   atomic.Uint64
+}
+
+// CompressionStats summarises the responses the proxy compressed
+type CompressionStats struct {
+	Responses   int64  `json:"responses"`
+	OriginBytes uint64 `json:"origin_bytes"` // Body bytes received from origins
+	SentBytes   uint64 `json:"sent_bytes"`   // Body bytes sent after compression
+	SavedBytes  uint64 `json:"saved_bytes"`
+}
+
+// compressWriter is implemented by gzip.Writer and brotli.Writer
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressionStats returns the bandwidth saved by -compress since startup
+func (s *Server) CompressionStats() CompressionStats {
+	stats := CompressionStats{
+		Responses:   s.compression.responses.Load(),
+		OriginBytes: s.compression.originBytes.Load(),
+		SentBytes:   s.compression.sentBytes.Load(),
+	}
+	if stats.OriginBytes > stats.SentBytes {
+		stats.SavedBytes = stats.OriginBytes - stats.SentBytes
+	}
+	return stats
+}
+
+// HandleCompressionStats serves CompressionStats as JSON
+func (s *Server) HandleCompressionStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.CompressionStats())
+}
+
+// compressionFor returns the encoding ("br" or "gzip") to compress resp
+// with for the client of r, or "" to pass it through unchanged
+func (s *Server) compressionFor(r *http.Request, resp *http.Response, host string) string {
+	if !s.cfg.Compress || r.Method == http.MethodHead {
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return ""
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" ||
+		headerHasToken(resp.Header, "Cache-Control", "no-transform") {
+		return ""
+	}
+	if resp.ContentLength != -1 && resp.ContentLength < int64(s.cfg.CompressMinSize) {
+		return ""
+	}
+	if !compressible(resp.Header.Get("Content-Type")) || s.compressionExcluded(host) {
+		return ""
+	}
+	return acceptedEncoding(r.Header)
+}
+
+// compressionExcluded reports whether host or a parent domain of it is
+// listed in -compress-exclude
+func (s *Server) compressionExcluded(host string) bool {
+	for _, excluded := range s.compressExclude {
+		if host == excluded || strings.HasSuffix(host, "."+excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a body of contentType is worth compressing.
+// Event streams are left alone: each event is flushed on its own.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// acceptedEncoding picks br or gzip from the client's Accept-Encoding,
+// preferring br, or returns "" if it accepts neither
+func acceptedEncoding(h http.Header) string {
+	accepted := make(map[string]bool)
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			// q=0 means "not acceptable"
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					continue
+				}
+			}
+			accepted[name] = true
+		}
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+// prepareCompressed adjusts the headers of resp for a body compressed with
+// encoding
+func prepareCompressed(resp *http.Response, encoding string) {
+	header := resp.Header
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", encoding)
+	if !headerHasToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	// The compressed body is no longer byte-identical to the origin's
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// newCompressWriter compresses into w with encoding
+func newCompressWriter(w io.Writer, encoding string) compressWriter {
+	if encoding == "br" {
+		return brotli.NewWriterLevel(w, brotliLevel)
+	}
+	return gzip.NewWriter(w)
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connLimiter counts new client connections per -conn-limit-window, in
+// total and per client IP, and keeps the banned IPs: those opening too
+// many and those banned through the API
+type connLimiter struct {
+	mutex    sync.Mutex
+	start    time.Time            // Start of the current window
+	total    int                  // Connections accepted in the window
+	perIP    map[string]int       // Client IP -> connections in the window
+	bans     map[string]time.Time // Client IP -> end of its ban
+	rejected atomic.Int64         // Connections over the global limit
+	refused  atomic.Int64         // Connections from banned IPs
+	banned   atomic.Int64         // Bans imposed, including through the API
+}
+
+// Ban is a client IP refused at accept time
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// BansResponse lists the banned client IPs with the connection limit counters
+type BansResponse struct {
+	Bans     []Ban `json:"bans"`
+	Rejected int64 `json:"rejected"` // Connections over -conn-limit
+	Refused  int64 `json:"refused"`  // Connections from banned IPs
+	Banned   int64 `json:"banned"`   // Bans imposed since startup
+}
+
+// allow reports whether a new connection from ip may be served, banning
+// ip if it exceeds -ip-conn-limit
+func (s *Server) allow(ip string) bool {
+	c := &s.conns
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if until, ok := c.bans[ip]; ok {
+		if now.Before(until) {
+			c.refused.Add(1)
+			return false
+		}
+		delete(c.bans, ip)
+	}
+	if now.Sub(c.start) >= s.cfg.ConnLimitWindow {
+		c.start, c.total, c.perIP = now, 0, make(map[string]int)
+	}
+
+	if limit := s.cfg.ConnLimit; limit > 0 && c.total >= limit {
+		c.rejected.Add(1)
+		return false
+	}
+	c.total++
+	c.perIP[ip]++
+	if limit := s.cfg.IPConnLimit; limit > 0 && c.perIP[ip] > limit {
+		if c.bans == nil {
+			c.bans = make(map[string]time.Time)
+		}
+		c.bans[ip] = now.Add(s.cfg.IPBanTime)
+		c.banned.Add(1)
+		s.log.Warn("Banned %s for %v: more than %d connections in %v", ip, s.cfg.IPBanTime, limit, s.cfg.ConnLimitWindow)
+		s.emitClient("abuse", ip, "", "connection flood")
+		return false
+	}
+	return true
+}
+
+// ban refuses connections from ip for duration
+func (s *Server) ban(ip string, duration time.Duration) {
+	s.conns.mutex.Lock()
+	defer s.conns.mutex.Unlock()
+	if s.conns.bans == nil {
+		s.conns.bans = make(map[string]time.Time)
+	}
+	s.conns.bans[ip] = time.Now().Add(duration)
+	s.conns.banned.Add(1)
+}
+
+// unban lifts the ban on ip, reporting whether there was one
+func (s *Server) unban(ip string) bool {
+	s.conns.mutex.Lock()
+	defer s.conns.mutex.Unlock()
+	_, ok := s.conns.bans[ip]
+	delete(s.conns.bans, ip)
+	delete(s.conns.perIP, ip)
+	return ok
+}
+
+// HandleBans lists the banned client IPs (GET), bans ?ip= for ?duration=,
+// -ip-ban-time by default (POST), or lifts the ban on ?ip= (DELETE)
+func (s *Server) HandleBans(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var ip string
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		// Bans are keyed by the address as accepted connections report it
+		parsed := net.ParseIP(query.Get("ip"))
+		if parsed == nil {
+			http.Error(w, "Invalid ip", http.StatusBadRequest)
+			return
+		}
+		ip = parsed.String()
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		duration := s.cfg.IPBanTime
+		if value := query.Get("duration"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		s.ban(ip, duration)
+		s.log.Info("Banned %s for %v from %s", ip, duration, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodDelete:
+		if !s.unban(ip) {
+			http.Error(w, ip+" is not banned", http.StatusNotFound)
+			return
+		}
+		s.log.Info("Unbanned %s from %s", ip, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	response := BansResponse{
+		Bans:     []Ban{},
+		Rejected: s.conns.rejected.Load(),
+		Refused:  s.conns.refused.Load(),
+		Banned:   s.conns.banned.Load(),
+	}
+	s.conns.mutex.Lock()
+	for ip, until := range s.conns.bans {
+		if now.Before(until) {
+			response.Bans = append(response.Bans, Ban{IP: ip, Until: until})
+		}
+	}
+	s.conns.mutex.Unlock()
+	sort.Slice(response.Bans, func(i, j int) bool { return response.Bans[i].IP < response.Bans[j].IP })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LimitListener wraps l so that connections over -conn-limit and from
+// banned client IPs are closed as soon as they are accepted
+func (s *Server) LimitListener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, s: s}
+}
+
+type limitListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || l.s.allow(ip) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+const (
+	// dataCapCheckInterval is how often usage is projected against -data-cap
+	dataCapCheckInterval = time.Hour
+	// projectionHistory is how many full days before today the daily rate
+	// is averaged over, reaching back into the previous billing cycle
+	projectionHistory = 14
+)
+
+// Projection is the usage of the current billing cycle so far and where
+// it is heading, for the whole network and per client
+type Projection struct {
+	CycleStart time.Time          `json:"cycle_start"`
+	CycleEnd   time.Time          `json:"cycle_end"`
+	Cap        uint64             `json:"cap,omitempty"` // Bytes; 0 without -data-cap
+	Used       uint64             `json:"used"`
+	DailyRate  uint64             `json:"daily_rate"` // Average bytes per day the projection assumes
+	Projected  uint64             `json:"projected"`  // Expected use by CycleEnd
+	OverCap    bool               `json:"over_cap"`   // Projected beyond Cap
+	Clients    []ClientProjection `json:"clients"`    // Most projected first
+}
+
+// ClientProjection is a client's share of a Projection
+type ClientProjection struct {
+	Client    string `json:"client"`
+	Used      uint64 `json:"used"`
+	DailyRate uint64 `json:"daily_rate"`
+	Projected uint64 `json:"projected"`
+}
+
+// dataCapWarnings remembers which warnings were raised in a billing cycle,
+// so each is raised once
+type dataCapWarnings struct {
+	mutex     sync.Mutex
+	cycle     time.Time
+	projected bool
+	exceeded  bool
+}
+
+// dataCapCycle is the billing cycle starting on -data-cap-day
+func (s *Server) dataCapCycle() quotaCycle {
+	return quotaCycle{period: "monthly", day: s.cfg.DataCapDay}
+}
+
+// project projects usage to the end of the billing cycle running at now.
+// The rate is the daily average of the projectionHistory days before
+// today, or of the cycle so far when there is no earlier traffic.
+func (s *Server) project(now time.Time) (*Projection, error) {
+	if s.store == nil {
+		return nil, storage.ErrUnavailable
+	}
+	cycle := s.dataCapCycle()
+	start := cycle.start(now)
+	projection := &Projection{
+		CycleStart: start,
+		CycleEnd:   cycle.next(start),
+		Cap:        uint64(s.cfg.DataCap) * 1e9,
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	first := today.AddDate(0, 0, -projectionHistory)
+	if start.Before(first) {
+		first = start
+	}
+
+	// Bytes by day, for the network and by client
+	total := make(map[time.Time]uint64)
+	clients := make(map[string]map[time.Time]uint64)
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		_, records, err := s.store.GetDailyStats(day, day, "", "day")
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			total[day] += record.BytesTransferred
+		}
+		_, users, err := s.store.GetUserStats(day, day)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range users {
+			if clients[record.User] == nil {
+				clients[record.User] = make(map[time.Time]uint64)
+			}
+			clients[record.User][day] += record.BytesTransferred
+		}
+	}
+
+	// Counters not yet saved to the store belong to today
+	s.statsMutex.RLock()
+	for _, hostStats := range s.stats.HostStats {
+		total[today] += hostStats.BytesTransferred
+	}
+	for user, userStats := range s.stats.UserStats {
+		if clients[user] == nil {
+			clients[user] = make(map[time.Time]uint64)
+		}
+		clients[user][today] += userStats.BytesTransferred
+	}
+	s.statsMutex.RUnlock()
+
+	remaining := projection.CycleEnd.Sub(now).Hours() / 24
+	project := func(days map[time.Time]uint64) (used, rate, projected uint64) {
+		// History starts on the first day with traffic, so a new client or
+		// install is not averaged down by days before it was seen
+		var history uint64
+		historyDays := 0
+		for day := first; day.Before(today); day = day.AddDate(0, 0, 1) {
+			if !day.Before(today.AddDate(0, 0, -projectionHistory)) && (historyDays > 0 || days[day] > 0) {
+				history += days[day]
+				historyDays++
+			}
+			if !day.Before(start) {
+				used += days[day]
+			}
+		}
+		used += days[today]
+		if historyDays > 0 {
+			rate = history / uint64(historyDays)
+		} else if elapsed := now.Sub(start).Hours() / 24; elapsed > 0 {
+			rate = uint64(float64(used) / elapsed)
+		}
+		return used, rate, used + uint64(float64(rate)*remaining)
+	}
+
+	projection.Used, projection.DailyRate, projection.Projected = project(total)
+	projection.OverCap = projection.Cap > 0 && projection.Projected > projection.Cap
+	projection.Clients = []ClientProjection{}
+	for client, days := range clients {
+		used, rate, projected := project(days)
+		if projected == 0 {
+			continue
+		}
+		projection.Clients = append(projection.Clients, ClientProjection{
+			Client:    client,
+			Used:      used,
+			DailyRate: rate,
+			Projected: projected,
+		})
+	}
+	sort.Slice(projection.Clients, func(i, j int) bool {
+		a, b := projection.Clients[i], projection.Clients[j]
+		if a.Projected != b.Projected {
+			return a.Projected > b.Projected
+		}
+		return a.Client < b.Client
+	})
+	return projection, nil
+}
+
+// startDataCap projects usage against -data-cap every
+// dataCapCheckInterval and raises an alert once per billing cycle when
+// the projection goes over the cap, and again when usage does
+func (s *Server) startDataCap() {
+	if s.cfg.DataCap <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(dataCapCheckInterval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			s.checkDataCap(time.Now())
+		}
+	}()
+}
+
+// checkDataCap raises the data cap alerts not yet raised this cycle
+func (s *Server) checkDataCap(now time.Time) {
+	projection, err := s.project(now)
+	if err != nil {
+		s.log.Debug("Data cap: failed to project usage: %v", err)
+		return
+	}
+
+	s.dataCap.mutex.Lock()
+	defer s.dataCap.mutex.Unlock()
+	if !s.dataCap.cycle.Equal(projection.CycleStart) {
+		s.dataCap.cycle = projection.CycleStart
+		s.dataCap.projected, s.dataCap.exceeded = false, false
+	}
+	end := projection.CycleEnd.Format("2006-01-02")
+	switch {
+	case projection.Used > projection.Cap && !s.dataCap.exceeded:
+		s.dataCap.exceeded, s.dataCap.projected = true, true
+		s.raiseAlert(Alert{
+			Kind: "data-cap",
+			Message: fmt.Sprintf("%s used of the %s data cap, which resets %s",
+				formatGB(projection.Used), formatGB(projection.Cap), end),
+		})
+	case projection.OverCap && !s.dataCap.projected:
+		s.dataCap.projected = true
+		s.raiseAlert(Alert{
+			Kind: "data-cap-projection",
+			Message: fmt.Sprintf("Projected to use %s of the %s data cap by %s (%s used, %s a day)",
+				formatGB(projection.Projected), formatGB(projection.Cap), end,
+				formatGB(projection.Used), formatGB(projection.DailyRate)),
+		})
+	}
+}
+
+// formatGB renders bytes in decimal gigabytes, as ISPs state caps
+func formatGB(bytes uint64) string {
+	return strconv.FormatFloat(float64(bytes)/1e9, 'f', 1, 64) + " GB"
+}
+
+// HandleProjection reports usage of the billing cycle so far and its
+// projection to the cycle's end against -data-cap, with the ?limit=
+// (default 20) clients projected to use the most
+func (s *Server) HandleProjection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	projection, err := s.project(time.Now())
+	if err != nil {
+		s.log.Error("API Error: Projecting usage failed: %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrUnavailable) {
+			w.Header().Set("Retry-After", "5")
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "Projection failed", status)
+		return
+	}
+	if len(projection.Clients) > limit {
+		projection.Clients = projection.Clients[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projection)
+}
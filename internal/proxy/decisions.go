@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// decisionKey identifies a blacklist decision: the destination, which is
+// all the blacklist matches
+type decisionKey struct {
+	host string
+	port string
+}
+
+type decisionEntry struct {
+	rule    string // Matching blacklist pattern, "" if none
+	expires time.Time
+}
+
+// decisionCache remembers recent blacklist matches so hot hosts don't run
+// every blacklist pattern on each request. The other policies depend on the
+// client, the time or the request itself and are evaluated every time. Any
+// blacklist change invalidates the whole cache.
+type decisionCache struct {
+	mutex      sync.Mutex
+	entries    map[decisionKey]decisionEntry
+	ttl        time.Duration
+	maxEntries int
+	generation uint64 // Bumped on invalidation so in-flight lookups aren't cached
+}
+
+func newDecisionCache(ttl time.Duration, maxEntries int) *decisionCache {
+	return &decisionCache{
+		entries:    make(map[decisionKey]decisionEntry),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}
+}
+
+// get returns a cached decision and the current generation
+func (c *decisionCache) get(key decisionKey) (rule string, ok bool, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[key]
+	if found && time.Now().Before(entry.expires) {
+		return entry.rule, true, c.generation
+	}
+	if found {
+		delete(c.entries, key)
+	}
+	return "", false, c.generation
+}
+
+// put stores a decision unless the rules changed since it was evaluated
+func (c *decisionCache) put(key decisionKey, rule string, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		// Cheaper than tracking recency; the cache refills within a TTL
+		c.entries = make(map[decisionKey]decisionEntry)
+	}
+	c.entries[key] = decisionEntry{rule: rule, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops every cached decision
+func (c *decisionCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	c.entries = make(map[decisionKey]decisionEntry)
+}
+
+// blacklistRuleFor is blacklistRule behind the decision cache. An empty
+// port means the patterns are matched against the host alone.
+func (s *Server) blacklistRuleFor(host, port string) string {
+	target := host
+	if port != "" {
+		target = net.JoinHostPort(host, port)
+	}
+	if s.decisions == nil {
+		return s.blacklistRule(target)
+	}
+
+	key := decisionKey{host: host, port: port}
+	rule, ok, generation := s.decisions.get(key)
+	if ok {
+		return rule
+	}
+
+	rule = s.blacklistRule(target)
+	s.decisions.put(key, rule, generation)
+	return rule
+}
+
+// invalidateDecisions must be called whenever the blacklist changes
+func (s *Server) invalidateDecisions() {
+	if s.decisions != nil {
+		s.decisions.invalidate()
+	}
+}
+
+// clientKey identifies the client a policy decision applies to
+func clientKey(user, remoteAddr string) string {
+	if user != "" {
+		return user
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds of the User-Agent profiles kept in memory
+const (
+	maxDeviceClients = 4096 // Client IPs; the longest unseen is dropped
+	maxClientAgents  = 16   // Distinct User-Agents per IP; the least seen is dropped
+)
+
+// deviceRulePrefix starts the blocking rule of requests matched by a
+// -device-rules line; the line's conditions follow
+const deviceRulePrefix = "device:"
+
+// agentSeen is a User-Agent a client sent and how often
+type agentSeen struct {
+	userAgent
+	UserAgent string    `json:"user_agent"`
+	Requests  int64     `json:"requests"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// deviceProfile is what the User-Agents a client IP sent tell about it
+type deviceProfile struct {
+	agents   map[string]*agentSeen
+	lastSeen time.Time
+}
+
+// devices are the profiles of the client IPs seen, and the rules blocking
+// requests by User-Agent
+type devices struct {
+	mutex    sync.Mutex
+	profiles map[string]*deviceProfile // By client IP
+
+	rulesMutex sync.RWMutex
+	rules      []deviceRule
+}
+
+// DeviceProfile is the device profile of a client IP for the API. OS and
+// Device are those of the browser User-Agents sent most, leaving out
+// tools and bots when there are others.
+type DeviceProfile struct {
+	Client   string      `json:"client"`
+	OS       string      `json:"os"`
+	Device   string      `json:"device"`
+	Requests int64       `json:"requests"`
+	LastSeen time.Time   `json:"last_seen"`
+	Agents   []agentSeen `json:"agents"` // Most requests first
+}
+
+// deviceCondition matches one property of a parsed User-Agent: field is
+// browser, os or device, and below an optional version the property's
+// version must be older than
+type deviceCondition struct {
+	field, value, below string
+	pattern             *regexp.Regexp // For ua~<regexp>
+}
+
+// deviceRule blocks requests whose User-Agent meets every condition
+type deviceRule struct {
+	spec       string // Conditions as written in the rules file
+	clients    *clientSet
+	conditions []deviceCondition
+}
+
+// loadDeviceRules reads a file of
+//
+//	<clients|*> <condition> [condition...]
+//
+// lines blocking requests of the clients whose User-Agent meets every
+// condition. A condition is browser=<name>, os=<name> or device=<type>,
+// the first two optionally followed by <version to block versions older
+// than it, or ua~<regexp> matching the raw User-Agent, e.g.
+//
+//	kids  device=console
+//	*     browser=ie
+//	*     os=windows<10
+//	*     os=android<8 device=mobile
+//
+// OS versions browsers freeze, such as macOS 10.15.7 or Windows 10 sent by
+// Windows 11 too, never count as older, as the real one may be newer.
+func loadDeviceRules(filename string) ([]deviceRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device rules file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []deviceRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("device rules line %d: want <clients> <condition> [condition...]", lineNo)
+		}
+		rule := deviceRule{spec: strings.Join(fields[1:], " ")}
+		if fields[0] != "*" {
+			clients := parseClientSet(fields[0])
+			rule.clients = &clients
+		}
+		for _, field := range fields[1:] {
+			condition, err := parseDeviceCondition(field)
+			if err != nil {
+				return nil, fmt.Errorf("device rules line %d: %v", lineNo, err)
+			}
+			rule.conditions = append(rule.conditions, condition)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device rules file: %v", err)
+	}
+	return rules, nil
+}
+
+// parseDeviceCondition parses browser=, os=, device= or ua~ conditions
+func parseDeviceCondition(value string) (deviceCondition, error) {
+	if pattern, ok := strings.CutPrefix(value, "ua~"); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return deviceCondition{}, fmt.Errorf("invalid ua pattern %q: %v", pattern, err)
+		}
+		return deviceCondition{field: "ua", pattern: re}, nil
+	}
+	field, match, ok := strings.Cut(value, "=")
+	if !ok || match == "" {
+		return deviceCondition{}, fmt.Errorf("invalid condition %q, want browser=, os=, device= or ua~", value)
+	}
+	condition := deviceCondition{field: field}
+	condition.value, condition.below, _ = strings.Cut(strings.ToLower(match), "<")
+	switch field {
+	case "browser", "os":
+	case "device":
+		if condition.below != "" {
+			return deviceCondition{}, fmt.Errorf("invalid condition %q: devices have no version", value)
+		}
+	default:
+		return deviceCondition{}, fmt.Errorf("invalid condition %q, want browser=, os=, device= or ua~", value)
+	}
+	return condition, nil
+}
+
+// matches reports whether the User-Agent ua, parsed as agent, meets the
+// condition. Versions that are unknown or frozen never count as older.
+func (c deviceCondition) matches(ua string, agent userAgent) bool {
+	var value, version string
+	switch c.field {
+	case "ua":
+		return c.pattern.MatchString(ua)
+	case "browser":
+		value, version = agent.Browser, agent.BrowserVersion
+	case "os":
+		value = agent.OS
+		if !agent.OSVersionFrozen {
+			version = agent.OSVersion
+		}
+	case "device":
+		value = agent.Device
+	}
+	if value != c.value {
+		return false
+	}
+	return c.below == "" || (version != "" && versionLess(version, c.below))
+}
+
+// loadDevices reads the device rules in path and returns the function
+// swapping them in, which removes them if path is empty
+func (s *Server) loadDevices(path string) (func(), error) {
+	var rules []deviceRule
+	if path != "" {
+		var err error
+		if rules, err = loadDeviceRules(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.devices.rulesMutex.Lock()
+		s.devices.rules = rules
+		s.devices.rulesMutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d device rules", len(rules))
+		}
+	}, nil
+}
+
+// deviceRule returns the blocking rule for the request r of user if a
+// -device-rules line matches its User-Agent, else ""
+func (s *Server) deviceRule(r *http.Request, user string) string {
+	s.devices.rulesMutex.RLock()
+	rules := s.devices.rules
+	s.devices.rulesMutex.RUnlock()
+	ua := r.Header.Get("User-Agent")
+	if len(rules) == 0 || ua == "" {
+		return ""
+	}
+
+	agent := parseUserAgent(ua)
+	for _, rule := range rules {
+		if rule.clients != nil && !rule.clients.match(user, r.RemoteAddr) {
+			continue
+		}
+		matched := true
+		for _, condition := range rule.conditions {
+			if !condition.matches(ua, agent) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return deviceRulePrefix + rule.spec
+		}
+	}
+	return ""
+}
+
+// observeDevice adds the User-Agent of r to the profile of its client IP
+func (s *Server) observeDevice(r *http.Request) {
+	ua := r.Header.Get("User-Agent")
+	if ua == "" {
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	now := time.Now()
+
+	s.devices.mutex.Lock()
+	defer s.devices.mutex.Unlock()
+	profile, ok := s.devices.profiles[ip]
+	if !ok {
+		if s.devices.profiles == nil {
+			s.devices.profiles = make(map[string]*deviceProfile)
+		}
+		if len(s.devices.profiles) >= maxDeviceClients {
+			s.devices.evictLocked()
+		}
+		profile = &deviceProfile{agents: make(map[string]*agentSeen)}
+		s.devices.profiles[ip] = profile
+	}
+	profile.lastSeen = now
+	seen, ok := profile.agents[ua]
+	if !ok {
+		if len(profile.agents) >= maxClientAgents {
+			profile.evictLocked()
+		}
+		seen = &agentSeen{userAgent: parseUserAgent(ua), UserAgent: ua}
+		profile.agents[ua] = seen
+	}
+	seen.Requests++
+	seen.LastSeen = now
+}
+
+// evictLocked drops the profile seen longest ago. The caller holds the
+// devices mutex.
+func (d *devices) evictLocked() {
+	var oldest string
+	for ip, profile := range d.profiles {
+		if oldest == "" || profile.lastSeen.Before(d.profiles[oldest].lastSeen) {
+			oldest = ip
+		}
+	}
+	delete(d.profiles, oldest)
+}
+
+// evictLocked drops the User-Agent seen least. The caller holds the
+// devices mutex.
+func (p *deviceProfile) evictLocked() {
+	var least string
+	for ua, seen := range p.agents {
+		if least == "" || seen.Requests < p.agents[least].Requests {
+			least = ua
+		}
+	}
+	delete(p.agents, least)
+}
+
+// status summarizes the profile of client for the API. The caller holds
+// the devices mutex.
+func (p *deviceProfile) status(client string) DeviceProfile {
+	status := DeviceProfile{Client: client, LastSeen: p.lastSeen, Agents: []agentSeen{}}
+	for _, seen := range p.agents {
+		status.Agents = append(status.Agents, *seen)
+		status.Requests += seen.Requests
+	}
+	sort.Slice(status.Agents, func(i, j int) bool {
+		if status.Agents[i].Requests != status.Agents[j].Requests {
+			return status.Agents[i].Requests > status.Agents[j].Requests
+		}
+		return status.Agents[i].UserAgent < status.Agents[j].UserAgent
+	})
+	// The OS and device of the browser sent most, else of any agent
+	for _, browsersOnly := range []bool{true, false} {
+		for _, seen := range status.Agents {
+			if seen.OS != "" && (!browsersOnly || seen.Device != "bot" && seen.Device != "other") {
+				status.OS, status.Device = seen.OS, seen.Device
+				return status
+			}
+		}
+	}
+	if len(status.Agents) > 0 {
+		status.Device = status.Agents[0].Device
+	}
+	return status
+}
+
+// HandleDevices serves the device profile of every client IP seen since
+// startup, or of ?client=, most recently seen first
+func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := r.URL.Query().Get("client")
+
+	profiles := []DeviceProfile{}
+	s.devices.mutex.Lock()
+	for ip, profile := range s.devices.profiles {
+		if only == "" || ip == only {
+			profiles = append(profiles, profile.status(ip))
+		}
+	}
+	s.devices.mutex.Unlock()
+	if only != "" && len(profiles) == 0 {
+		http.Error(w, "No User-Agents seen from "+only, http.StatusNotFound)
+		return
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		if !profiles[i].LastSeen.Equal(profiles[j].LastSeen) {
+			return profiles[i].LastSeen.After(profiles[j].LastSeen)
+		}
+		return profiles[i].Client < profiles[j].Client
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
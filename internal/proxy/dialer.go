@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-proxy/internal/config"
+)
+
+// dialTimeout bounds establishing a TCP connection to an origin
+const dialTimeout = 10 * time.Second
+
+// startOutbound brings up the WireGuard tunnels, upstream proxies and
+// pre-warming configured in cfg
+func (s *Server) startOutbound(cfg *config.Config) {
+	if cfg.WireGuard != "" {
+		s.startTunnels(cfg.WireGuard)
+	}
+	if cfg.Upstreams != "" {
+		s.startUpstreams(cfg.Upstreams, cfg.UpstreamStrategy, cfg.UpstreamHealth)
+	}
+	if cfg.Prewarm > 0 {
+		s.startPrewarm(cfg.Prewarm, cfg.PrewarmHours)
+	}
+}
+
+// newTransport returns a transport forwarding plain HTTP requests via
+// egress ("" for the default outbound interfaces). It dials through
+// dialContext so the same outbound restrictions apply to HTTP and CONNECT
+// traffic. Connections to -upstreams are pooled across origins and so are
+// not capped per origin.
+func (s *Server) newTransport(egress string) *http.Transport {
+	return &http.Transport{
+		Proxy: upstreamProxy, // Only -upstreams, never the environment's proxy
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if up, ok := ctx.Value(upstreamKey{}).(*upstream); ok && addr == up.url.Host {
+				return s.dialOrigin(ctx, network, addr, egress)
+			}
+			return s.dialContext(ctx, network, addr, egress)
+		},
+		TLSClientConfig:     s.originTLS.config,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// Hold bodies of "Expect: 100-continue" requests until the origin
+		// asks for them; the client is sent its 100 Continue only then
+		ExpectContinueTimeout: time.Second,
+		// Bodies are unbounded (see copyResponse); only the wait for headers is
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+}
+
+// dialContext opens an outbound connection to addr via egress, handing out
+// a pre-warmed connection when there is one and no egress rule applies.
+// Connections over the cap on concurrent connections to the host of addr
+// fail with errOriginBusy.
+func (s *Server) dialContext(ctx context.Context, network, addr, egress string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acquireOrigin(host); err != nil {
+		return nil, err
+	}
+	conn, err := s.dialOrigin(ctx, network, addr, egress)
+	if err != nil {
+		s.releaseOrigin(host)
+		return nil, err
+	}
+	return &originConn{Conn: conn, s: s, host: host}, nil
+}
+
+// dialOrigin takes a pre-warmed connection to addr or dials a new one
+func (s *Server) dialOrigin(ctx context.Context, network, addr, egress string) (net.Conn, error) {
+	if egress == "" && s.prewarm != nil {
+		if conn := s.prewarm.take(addr); conn != nil {
+			return conn, nil
+		}
+	}
+	return s.dial(ctx, network, addr, egress)
+}
+
+// dial opens a new outbound connection to addr via egress, a tunnel,
+// interface name or source IP chosen by the egress rules. Without one the
+// configured outbound interfaces are used. When bound to interfaces the
+// connection uses an address of one of them, and destinations that none
+// of them can reach are refused. The addresses of addr are raced in the
+// order -origin-balance picks, IPv6 and IPv4 alternating.
+func (s *Server) dial(ctx context.Context, network, addr, egress string) (net.Conn, error) {
+	if t, ok := s.tunnels[egress]; ok {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		return t.DialContext(ctx, network, addr)
+	}
+
+	ifaces := s.outboundIfaces
+	source := net.ParseIP(egress)
+	if egress != "" && source == nil {
+		ifaces = []string{egress}
+	}
+	bound := len(ifaces) > 0 || source != nil
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts []dialAttempt
+	for _, ip := range interleaveFamilies(s.balancer.order(ips)) {
+		attempt := dialAttempt{ip: ip.IP}
+		if bound {
+			attempt.local = source
+			if attempt.local == nil {
+				attempt.local = outboundAddrFor(ip.IP, ifaces)
+			} else if (attempt.local.To4() != nil) != (ip.IP.To4() != nil) {
+				attempt.local = nil
+			}
+			if attempt.local == nil {
+				continue
+			}
+		}
+		attempts = append(attempts, attempt)
+	}
+	if len(attempts) == 0 {
+		if source != nil {
+			return nil, fmt.Errorf("no address of %s reachable from %s", host, source)
+		}
+		return nil, fmt.Errorf("no address of %s reachable via outbound interfaces %s",
+			host, strings.Join(ifaces, ","))
+	}
+	return s.race(ctx, network, port, attempts)
+}
+
+// dialAttempt is one origin address to try and the local address to bind
+type dialAttempt struct {
+	ip    net.IP
+	local net.IP // nil lets the system choose
+}
+
+// race dials the attempts Happy Eyeballs style (RFC 8305): each starts
+// when the previous one fails or -happy-eyeballs-delay passes without it
+// connecting, and the first connection wins. A zero delay dials them one
+// after the other.
+func (s *Server) race(ctx context.Context, network, port string, attempts []dialAttempt) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(attempts))
+	next, pending := 0, 0
+	startNext := func() {
+		attempt := attempts[next]
+		next++
+		pending++
+		go func() {
+			dialer := &net.Dialer{Timeout: dialTimeout}
+			if s.cfg.OutboundMark != 0 || s.cfg.OutboundDevice != "" {
+				dialer.Control = s.outboundControl
+			}
+			if attempt.local != nil && strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: attempt.local}
+			} else if attempt.local != nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: attempt.local}
+			}
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(attempt.ip.String(), port))
+			if ctx.Err() == nil {
+				// Cancelled dials say nothing about the address
+				s.balancer.record(attempt.ip, time.Since(start), err)
+			}
+			results <- result{conn, err}
+		}()
+	}
+
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		var delay <-chan time.Time
+		if next < len(attempts) && s.cfg.HappyEyeballsDelay > 0 {
+			delay = time.After(s.cfg.HappyEyeballsDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts that lose the race
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(attempts) {
+				startNext()
+			}
+		case <-delay:
+			startNext()
+		}
+	}
+	return nil, lastErr
+}
+
+// interleaveFamilies alternates IPv6 and IPv4 addresses, starting with the
+// family of the first, so a broken family delays a connection by at most
+// one attempt. The order within each family is kept.
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) < 2 {
+		return ips
+	}
+	firstV4 := ips[0].IP.To4() != nil
+	var first, second []net.IPAddr
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == firstV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	interleaved := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// outboundAddrFor returns the first address of ifaces in the same family
+// as dest, or nil if there is none.
+func outboundAddrFor(dest net.IP, ifaces []string) net.IP {
+	wantV4 := dest.To4() != nil
+	for _, name := range ifaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if (ipNet.IP.To4() != nil) == wantV4 {
+				return ipNet.IP
+			}
+		}
+	}
+	return nil
+}
+
+// connectTarget splits the authority of a CONNECT request into host and
+// port. The port defaults to 443, IPv6 literals may be bracketed or bare
+// ("[::1]:8443", "[::1]", "::1") and the host is returned unbracketed.
+func connectTarget(authority string) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, "443"
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("invalid CONNECT target %q", authority)
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "[]/ ") {
+		return "", "", fmt.Errorf("invalid CONNECT target %q", authority)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port in CONNECT target %q", authority)
+	}
+	return host, port, nil
+}
+
+// splitList parses a comma separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
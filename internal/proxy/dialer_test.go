@@ -0,0 +1,46 @@
+package proxy
+
+import "testing"
+
+func TestConnectTarget(t *testing.T) {
+	tests := []struct {
+		authority string
+		host      string
+		port      string
+		wantErr   bool
+	}{
+		{authority: "example.com:443", host: "example.com", port: "443"},
+		{authority: "example.com:8443", host: "example.com", port: "8443"},
+		{authority: "example.com", host: "example.com", port: "443"},
+		{authority: "192.0.2.1:22", host: "192.0.2.1", port: "22"},
+		{authority: "[2001:db8::1]:8443", host: "2001:db8::1", port: "8443"},
+		{authority: "[2001:db8::1]", host: "2001:db8::1", port: "443"},
+		{authority: "2001:db8::1", host: "2001:db8::1", port: "443"},
+		{authority: "example.com:0", wantErr: true},
+		{authority: "example.com:65536", wantErr: true},
+		{authority: "example.com:", wantErr: true},
+		{authority: "example.com:https", wantErr: true},
+		{authority: "a/b", wantErr: true},
+		{authority: "a/b:443", wantErr: true},
+		{authority: "", wantErr: true},
+		{authority: ":443", wantErr: true},
+		{authority: "[2001:db8::1", wantErr: true},
+		{authority: "not:an:ip", wantErr: true},
+	}
+	for _, test := range tests {
+		host, port, err := connectTarget(test.authority)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("connectTarget(%q) = %q, %q, want an error", test.authority, host, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("connectTarget(%q) failed: %v", test.authority, err)
+			continue
+		}
+		if host != test.host || port != test.port {
+			t.Errorf("connectTarget(%q) = %q, %q, want %q, %q", test.authority, host, port, test.host, test.port)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+//go:build integration
+
+// End-to-end checks against a proxy started in-process on ephemeral ports,
+// backed by an embedded Redis (miniredis) or a real one given with
+// -redis-addr (e.g. the docker-compose service). Run them with
+//
+//	go test -tags integration ./internal/proxy -run TestEndToEnd [-args -redis-addr localhost:6379]
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"go-proxy/internal/api"
+	"go-proxy/internal/config"
+	"go-proxy/internal/geo"
+	"go-proxy/internal/logger"
+	"go-proxy/internal/proxy"
+	"go-proxy/internal/storage"
+)
+
+// env is the running system under test
+type env struct {
+	server      *proxy.Server
+	store       storage.StatsStore
+	httpAddr    string // HTTP proxy and API listener
+	connectAddr string // CONNECT listener
+	origin      string // Local origin, HTTP and raw echo
+	udpOrigin   string // Local UDP echo
+	client      *http.Client
+}
+
+// redisAddr is a Redis to use instead of an embedded one
+var redisAddr = flag.String("redis-addr", "", "Use this Redis instead of an embedded one (its data is modified)")
+
+// TestEndToEnd runs the checks in order against one proxy: the stats
+// checks count the traffic of those before them
+func TestEndToEnd(t *testing.T) {
+	if !testing.Verbose() {
+		logger.SetLevel(logger.LevelError)
+	}
+
+	addr := *redisAddr
+	if addr == "" {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("Failed to start embedded Redis: %v", err)
+		}
+		defer mr.Close()
+		addr = mr.Addr()
+	}
+
+	e, err := start(t.TempDir(), addr)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer geo.Shutdown()
+
+	for _, check := range []struct {
+		name string
+		run  func(e *env) error
+	}{
+		{"HTTP request is proxied", checkHTTP},
+		{"CONNECT tunnel carries data", checkConnect},
+		{"CONNECT-UDP tunnel carries datagrams", checkConnectUDP},
+		{"Blacklisted host is blocked over HTTP", checkBlockedHTTP},
+		{"Blacklisted host is blocked over CONNECT", checkBlockedConnect},
+		{"Stats are flushed to Redis", checkStats},
+		{"Stats API reports traffic", checkStatsAPI},
+		{"Geo API responds", checkGeoAPI},
+	} {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.run(e); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// start wires the proxy the same way cmd/proxy does, on ephemeral ports,
+// keeping its files in dir
+func start(dir, redisAddr string) (*env, error) {
+	blacklist := filepath.Join(dir, "blacklist.txt")
+	if err := os.WriteFile(blacklist, []byte("blocked\\.test\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.Load([]string{"-blacklist", blacklist, "-redis-addr", redisAddr, "-connect-udp"})
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.NewRedisStore(cfg.Redis())
+	if err != nil {
+		return nil, err
+	}
+	if err := geo.Initialize(cfg.Redis(), cfg.GeoCacheSize, false); err != nil {
+		return nil, err
+	}
+
+	server := proxy.NewServer(cfg, proxy.Deps{Store: store, Geo: geo.Default()})
+	apiHandler := api.NewHandler(store, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats/daily", apiHandler.HandleDailyStats)
+	geo.AddAPIHandler(mux)
+	mux.HandleFunc("/", server.HandleHTTP)
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	connectListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(httpListener, mux)
+	go http.Serve(connectListener, server)
+
+	origin, err := startOrigin()
+	if err != nil {
+		return nil, err
+	}
+	udpOrigin, err := startUDPOrigin()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyURL := &url.URL{Scheme: "http", Host: httpListener.Addr().String()}
+	return &env{
+		server:      server,
+		store:       store,
+		httpAddr:    httpListener.Addr().String(),
+		connectAddr: connectListener.Addr().String(),
+		origin:      origin,
+		udpOrigin:   udpOrigin,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			Timeout:   10 * time.Second,
+		},
+	}, nil
+}
+
+func checkHTTP(e *env) error {
+	resp, err := e.client.Get("http://" + e.origin + "/hello")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from origin" {
+		return fmt.Errorf("got %s %q", resp.Status, body)
+	}
+	return nil
+}
+
+func checkConnect(e *env) error {
+	conn, reader, err := connect(e.connectAddr, e.origin)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		return err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != "ping\n" {
+		return fmt.Errorf("echo returned %q", line)
+	}
+	return nil
+}
+
+func checkConnectUDP(e *env) error {
+	conn, err := net.DialTimeout("tcp", e.httpAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	host, port, _ := net.SplitHostPort(e.udpOrigin)
+	fmt.Fprintf(conn, "GET /.well-known/masque/udp/%s/%s/ HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n", host, port, e.httpAddr)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("CONNECT-UDP returned %s", resp.Status)
+	}
+
+	// A DATAGRAM capsule (type 0, length, context ID 0) with a short payload
+	if _, err := conn.Write([]byte{0x00, 5, 0x00, 'p', 'i', 'n', 'g'}); err != nil {
+		return err
+	}
+	capsule := make([]byte, 7)
+	if _, err := io.ReadFull(reader, capsule); err != nil {
+		return err
+	}
+	if string(capsule) != "\x00\x05\x00ping" {
+		return fmt.Errorf("echo returned capsule %q", capsule)
+	}
+	return nil
+}
+
+func checkBlockedHTTP(e *env) error {
+	resp, err := e.client.Get("http://blocked.test/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("expected 403, got %s", resp.Status)
+	}
+	return nil
+}
+
+func checkBlockedConnect(e *env) error {
+	conn, _, err := connect(e.connectAddr, "blocked.test:443")
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("tunnel to a blacklisted host was established")
+	}
+	if !strings.Contains(err.Error(), "403") {
+		return err
+	}
+	return nil
+}
+
+func checkStats(e *env) error {
+	e.server.FlushStats()
+
+	// Stats keys carry bare dates, compared as UTC midnight
+	today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	hosts, hostStats, err := e.store.GetDailyStats(today, today, "", "day")
+	if err != nil {
+		return err
+	}
+
+	origin, _, _ := net.SplitHostPort(e.origin)
+	found := false
+	for _, host := range hosts {
+		hs := hostStats[host]
+		switch hs.Host {
+		case origin:
+			found = true
+			if hs.BytesTransferred == 0 {
+				return fmt.Errorf("no bytes recorded for %s", origin)
+			}
+		case "blocked.test":
+			if !hs.Blocked {
+				return fmt.Errorf("blocked.test not marked as blocked")
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no stats for %s in %v", origin, hosts)
+	}
+	return nil
+}
+
+func checkStatsAPI(e *env) error {
+	today := time.Now().Format("2006-01-02")
+	var resp api.StatsResponse
+	if err := getJSON(fmt.Sprintf("http://%s/api/stats/daily?from_date=%s&to_date=%s", e.httpAddr, today, today), &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("API error: %s", resp.Error)
+	}
+	return nil
+}
+
+func checkGeoAPI(e *env) error {
+	var resp geo.GeoAPIResponse
+	return getJSON(fmt.Sprintf("http://%s/api/geo", e.httpAddr), &resp)
+}
+
+// connect opens a CONNECT tunnel through the proxy
+func connect(proxyAddr, target string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("CONNECT returned %s", resp.Status)
+	}
+	return conn, reader, nil
+}
+
+// getJSON fetches an API endpoint directly (not through the proxy)
+func getJSON(target string, v interface{}) error {
+	resp, err := http.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// startOrigin serves HTTP, and echoes raw lines on connections that start
+// with "ping"
+func startOrigin() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	httpConns := make(chan net.Conn)
+	go http.Serve(&chanListener{conns: httpConns, addr: listener.Addr()}, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello from origin")
+		}))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buffered := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+				first, err := buffered.reader.Peek(4)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if string(first) == "ping" {
+					io.Copy(conn, buffered.reader)
+					conn.Close()
+					return
+				}
+				httpConns <- buffered
+			}()
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// startUDPOrigin starts a UDP echo server
+func startUDPOrigin() (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String(), nil
+}
+
+// peekedConn is a connection whose first bytes were peeked at
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// chanListener accepts the connections sent to conns
+type chanListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *chanListener) Close() error {
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
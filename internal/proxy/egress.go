@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// egressRule sends connections to matching destinations, optionally only
+// those of some clients, out of an interface, source address or tunnel
+type egressRule struct {
+	host    string     // Host glob ("example.com", "*.example.com", "*"); empty if dest is set
+	dest    *net.IPNet // Destination network
+	clients *clientSet // Clients the rule applies to (nil for all)
+	egress  string     // Tunnel name, interface name or source IP
+}
+
+// egressRules holds the loaded rules and a forwarding client per egress so
+// pooled connections are never reused across egresses
+type egressRules struct {
+	mutex   sync.RWMutex
+	rules   []egressRule
+	clients map[string]*http.Client
+}
+
+// loadEgressRules reads an egress rules file. Each line is
+//
+//	<destination> <egress> [clients]
+//
+// where destination is a host glob or a CIDR, egress a -wireguard tunnel,
+// an interface name or a source IP and clients a comma separated list of
+// users, IPs and CIDRs. The first matching rule wins, e.g.
+//
+//	*.netflix.com  eth1
+//	*.corp.example vpn
+//	*              wg0    alice,10.0.2.0/24
+func loadEgressRules(filename string) ([]egressRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open egress rules file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []egressRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 || len(fields) < 2 {
+			return nil, fmt.Errorf("egress rules line %d: want <destination> <egress> [clients]", lineNo)
+		}
+
+		rule := egressRule{egress: fields[1]}
+		if _, dest, err := net.ParseCIDR(fields[0]); err == nil {
+			rule.dest = dest
+		} else {
+			rule.host = strings.ToLower(fields[0])
+			if _, err := path.Match(rule.host, ""); err != nil {
+				return nil, fmt.Errorf("egress rules line %d: invalid destination %q", lineNo, fields[0])
+			}
+		}
+		if len(fields) == 3 {
+			clients := parseClientSet(fields[2])
+			rule.clients = &clients
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read egress rules file: %v", err)
+	}
+	return rules, nil
+}
+
+// loadEgress reads the egress rules in path and returns the function
+// swapping them in, which removes them if path is empty
+func (s *Server) loadEgress(path string) (func(), error) {
+	var rules []egressRule
+	if path != "" {
+		var err error
+		if rules, err = loadEgressRules(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.egress.mutex.Lock()
+		s.egress.rules = rules
+		s.egress.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d egress rules", len(rules))
+		}
+	}, nil
+}
+
+// egressFor returns the egress for a connection from user at remoteAddr to
+// host, or "" for the default outbound interfaces. Hosts are only resolved
+// when a CIDR rule needs their addresses.
+func (s *Server) egressFor(ctx context.Context, user, remoteAddr, host string) string {
+	s.egress.mutex.RLock()
+	rules := s.egress.rules
+	s.egress.mutex.RUnlock()
+	if len(rules) == 0 {
+		return ""
+	}
+
+	host = strings.ToLower(host)
+	var addrs []net.IP
+	resolved := false
+	for _, rule := range rules {
+		if rule.clients != nil && !rule.clients.match(user, remoteAddr) {
+			continue
+		}
+		if rule.dest == nil {
+			if ok, _ := path.Match(rule.host, host); ok {
+				return rule.egress
+			}
+			continue
+		}
+		if !resolved {
+			resolved = true
+			if ip := net.ParseIP(host); ip != nil {
+				addrs = []net.IP{ip}
+			} else if ips, err := net.DefaultResolver.LookupIPAddr(ctx, host); err == nil {
+				for _, ip := range ips {
+					addrs = append(addrs, ip.IP)
+				}
+			}
+		}
+		for _, ip := range addrs {
+			if rule.dest.Contains(ip) {
+				return rule.egress
+			}
+		}
+	}
+	return ""
+}
+
+// clientFor returns the client forwarding plain HTTP requests via egress
+func (s *Server) clientFor(egress string) *http.Client {
+	if egress == "" {
+		return s.client
+	}
+	s.egress.mutex.Lock()
+	defer s.egress.mutex.Unlock()
+	client, ok := s.egress.clients[egress]
+	if !ok {
+		client = &http.Client{Transport: s.newTransport(egress)}
+		s.egress.clients[egress] = client
+	}
+	return client
+}
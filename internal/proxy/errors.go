@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorPage is the data error page templates are executed with
+type errorPage struct {
+	Status     int    // e.g. 502
+	StatusText string // e.g. "Bad Gateway"
+	Message    string // What went wrong
+	Host       string // Requested host
+	URL        string // Requested URL (empty for CONNECT)
+	RequestID  string // ID to quote when reporting the error
+}
+
+// errorResponse is the body of errors sent to clients that accept JSON
+type errorResponse struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	Host      string `json:"host,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// loadErrorPages reads the "<status>.html" templates in dir, e.g. 403.html
+// for blocked requests and 502.html or 504.html for unreachable origins
+func loadErrorPages(dir string) (map[int]*template.Template, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[int]*template.Template)
+	for _, path := range paths {
+		status, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".html"))
+		if err != nil || http.StatusText(status) == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(filepath.Base(path)).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %s: %w", path, err)
+		}
+		pages[status] = tmpl
+	}
+	return pages, nil
+}
+
+// writeError sends an error generated by the proxy itself: JSON if the
+// client prefers it, else the configured page for status, else plain text
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if status >= 500 {
+		s.emit(r, "error", errorHost(r), message)
+	}
+	s.writeErrorPage(w, r, status, message)
+}
+
+// writeBlocked answers a request blocked by rule: with the countdown page
+// if its client is paused, else with a 403 error
+func (s *Server) writeBlocked(w http.ResponseWriter, r *http.Request, rule string) {
+	if end, ok := strings.CutPrefix(rule, pauseRulePrefix); ok {
+		if until, err := time.Parse(time.RFC3339, end); err == nil {
+			s.writePaused(w, r, until)
+			return
+		}
+	}
+	if end, ok := strings.CutPrefix(rule, quotaRulePrefix); ok {
+		if resets, err := time.Parse(time.RFC3339, end); err == nil {
+			s.writeError(w, r, http.StatusForbidden,
+				"Data quota used up until "+resets.Local().Format("Mon Jan 2 15:04"))
+			return
+		}
+	}
+	s.writeError(w, r, http.StatusForbidden, "Blocked")
+}
+
+// errorHost is the requested host of r, without port
+func errorHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// writeErrorPage sends an error like writeError without recording an
+// error event
+func (s *Server) writeErrorPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	host := errorHost(r)
+	id := requestID(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse{Error: message, Status: status, Host: host, RequestID: id})
+		return
+	}
+
+	if tmpl, ok := s.errorPages[status]; ok {
+		page := errorPage{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			Message:    message,
+			Host:       host,
+			RequestID:  id,
+		}
+		if r.Method != http.MethodConnect {
+			page.URL = r.URL.String()
+		}
+		// Render first so a broken template still gets a plain error out
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, page)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write(buf.Bytes())
+			return
+		}
+		s.log.Warn("Error page %d failed: %v", status, err)
+	}
+
+	if id != "" {
+		message += "\nRequest ID: " + id
+	}
+	http.Error(w, message, status)
+}
+
+// gatewayStatus is the status for a failure to reach an origin: 408 if the
+// client was too slow sending the body, 504 if the origin timed out, 502
+// otherwise
+func gatewayStatus(err error) int {
+	if errors.Is(err, errSlowClient) {
+		return http.StatusRequestTimeout
+	}
+	if errors.Is(err, errOriginBusy) {
+		return http.StatusServiceUnavailable
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// wantsJSON reports whether the Accept header of r prefers JSON over HTML
+func wantsJSON(r *http.Request) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	jsonFirst := false
+	for _, value := range r.Header.Values("Accept") {
+		for _, item := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(item)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+			switch {
+			case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+				if q > jsonQ {
+					jsonFirst = jsonFirst || htmlQ < 0
+					jsonQ = q
+				}
+			case mediaType == "text/html":
+				htmlQ = max(htmlQ, q)
+			}
+		}
+	}
+	return jsonQ > 0 && (jsonQ > htmlQ || (jsonQ == htmlQ && jsonFirst))
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// eventQueueSize is how many events may wait for the sinks before new
+// ones are dropped
+const eventQueueSize = 4096
+
+// eventQueue hands events to the sinks off the request path
+type eventQueue struct {
+	events  chan storage.Event
+	dropped atomic.Int64
+}
+
+// startEvents starts writing queued events to every sink
+func (s *Server) startEvents(sinks []EventSink) *eventQueue {
+	q := &eventQueue{events: make(chan storage.Event, eventQueueSize)}
+	go func() {
+		failing := make([]bool, len(sinks))
+		for event := range q.events {
+			for i, sink := range sinks {
+				err := sink.Append(event)
+				// Log once per outage rather than for every event
+				if err != nil && !failing[i] {
+					s.log.Warn("Error writing event: %v", err)
+				} else if err == nil && failing[i] {
+					s.log.Info("Event writes recovered (%d events dropped)", q.dropped.Load())
+				}
+				if err != nil {
+					q.dropped.Add(1)
+				}
+				failing[i] = err != nil
+			}
+		}
+	}()
+	return q
+}
+
+// emit queues an event of kind about the request r to host and counts it
+// against -alert-rules. Nothing waits for the sinks; events are dropped
+// while they are behind. Connect events of requests sampled out are left
+// out of the sinks.
+func (s *Server) emit(r *http.Request, kind, host, detail string) {
+	event := storage.Event{
+		Time:   time.Now(),
+		Type:   kind,
+		Client: r.RemoteAddr,
+		Host:   host,
+		Detail: detail,
+	}
+	if record, ok := r.Context().Value(requestKey{}).(*RequestRecord); ok {
+		event.User = record.User
+		event.RequestID = record.ID
+	}
+	s.evaluateAlertRules(event)
+	if s.events == nil || (kind == "connect" && requestWeight(r.Context()) == 0) {
+		return
+	}
+	s.queueEvent(event)
+}
+
+// emitClient queues an event of kind about client that is not tied to a
+// request, such as an authentication failure or abuse of the proxy itself
+func (s *Server) emitClient(kind, client, user, detail string) {
+	event := storage.Event{
+		Time:   time.Now(),
+		Type:   kind,
+		Client: client,
+		User:   user,
+		Detail: detail,
+	}
+	s.evaluateAlertRules(event)
+	if s.events == nil {
+		return
+	}
+	s.queueEvent(event)
+}
+
+// queueEvent hands event to the sinks unless they are behind
+func (s *Server) queueEvent(event storage.Event) {
+	select {
+	case s.events.events <- event:
+	default:
+		s.events.dropped.Add(1)
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// blockedLogSize is how many blocked attempts /api/events/blocked keeps
+const blockedLogSize = 10000
+
+// BlockedEvent records one request refused by policy
+type BlockedEvent struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Host      string    `json:"host"`
+	Rule      string    `json:"rule"` // blacklist:<pattern>, filter:<list> or geo:<country>
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// blockedLog keeps the most recent blocked events in a ring, oldest first
+// from next
+type blockedLog struct {
+	mutex  sync.Mutex
+	events []BlockedEvent
+	next   int
+}
+
+// blockingRule returns the rule that blocks the request r from user to
+// host, or "" if it may go through. A non-empty port marks a CONNECT,
+// which filter lists can only match by host.
+func (s *Server) blockingRule(r *http.Request, user, host, port string) string {
+	if rule := s.pauseRule(user, r.RemoteAddr); rule != "" {
+		return rule
+	}
+	if rule := s.quotaRule(user, r.RemoteAddr); rule != "" {
+		return rule
+	}
+	if rule := s.serviceRule(user, r.RemoteAddr, host); rule != "" {
+		return rule
+	}
+	if rule := s.deviceRule(r, user); rule != "" {
+		return rule
+	}
+	if pattern := s.blacklistRuleFor(host, port); pattern != "" {
+		return "blacklist:" + pattern
+	}
+	list := ""
+	if port != "" {
+		list = s.filterBlockedHost(host)
+	} else {
+		list = s.filterBlocked(r, host)
+	}
+	if list != "" {
+		return "filter:" + list
+	}
+	target := host
+	if port != "" {
+		target = net.JoinHostPort(host, port)
+	}
+	if rule := s.tenantRule(r, target); rule != "" {
+		return rule
+	}
+	if rule := s.geoFenced(host); rule != "" {
+		return rule
+	}
+	return s.domainRule(r, host)
+}
+
+// recordBlocked adds a blocked attempt by user to the blocked events log
+// and the event stream
+func (s *Server) recordBlocked(r *http.Request, user, host, rule string) {
+	s.emit(r, "block", host, rule)
+	s.blocked.add(BlockedEvent{
+		Time:      time.Now(),
+		Client:    r.RemoteAddr,
+		User:      user,
+		Host:      host,
+		Rule:      rule,
+		RequestID: requestID(r.Context()),
+	})
+}
+
+// add stores an event, replacing the oldest when full
+func (l *blockedLog) add(event BlockedEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.events) < blockedLogSize {
+		l.events = append(l.events, event)
+		return
+	}
+	l.events[l.next] = event
+	l.next = (l.next + 1) % blockedLogSize
+}
+
+// since returns up to limit events after t, oldest first
+func (l *blockedLog) since(t time.Time, limit int) []BlockedEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := []BlockedEvent{}
+	for i := 0; i < len(l.events) && len(result) < limit; i++ {
+		event := l.events[(l.next+i)%len(l.events)]
+		if event.Time.After(t) {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// HandleBlockedEvents serves blocked attempts as JSON, oldest first: those
+// after ?since= (RFC 3339 or Unix seconds), at most ?limit= (default 1000).
+// Polling with since set to the last event's time returns only new ones.
+func (s *Server) HandleBlockedEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid since, want RFC 3339 or Unix seconds", http.StatusBadRequest)
+				return
+			}
+			since = time.Unix(seconds, 0)
+		}
+	}
+	limit := 1000
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.blocked.since(since, limit))
+}
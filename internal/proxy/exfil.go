@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploadFlushSize is how many bytes a metered upload reads before adding
+// them to its client's window
+const uploadFlushSize = 64 * 1024
+
+// uploadWindow counts what one client uploaded to one host since start
+type uploadWindow struct {
+	start   time.Time
+	bytes   int64
+	alerted bool
+}
+
+// uploadMeter tracks uploads per client and destination for
+// -exfil-threshold
+type uploadMeter struct {
+	mutex   sync.Mutex
+	windows map[string]*uploadWindow // By client and host
+	pruned  time.Time
+}
+
+// meterUpload returns body, which the client r came from is sending to
+// host, counting what is read from it towards -exfil-threshold. Uploads to
+// private addresses are not counted.
+func (s *Server) meterUpload(r *http.Request, host string, body io.ReadCloser) io.ReadCloser {
+	if s.cfg.ExfilThreshold <= 0 || body == nil || body == http.NoBody {
+		return body
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return body
+	}
+	user := requestUser(r.Context())
+	return &meteredBody{ReadCloser: body, s: s, client: clientKey(user, r.RemoteAddr), user: user, host: host}
+}
+
+// meteredBody adds the bytes read from it to the upload window of its
+// client and host every uploadFlushSize bytes and at the end
+type meteredBody struct {
+	io.ReadCloser
+	s       *Server
+	client  string
+	user    string
+	host    string
+	pending int64
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.pending += int64(n)
+	if b.pending >= uploadFlushSize || (err != nil && b.pending > 0) {
+		b.s.addUpload(b.client, b.user, b.host, b.pending)
+		b.pending = 0
+	}
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	if b.pending > 0 {
+		b.s.addUpload(b.client, b.user, b.host, b.pending)
+		b.pending = 0
+	}
+	return b.ReadCloser.Close()
+}
+
+// addUpload counts bytes client uploaded to host, raising an exfiltration
+// alert the first time a window goes over -exfil-threshold
+func (s *Server) addUpload(client, user, host string, bytes int64) {
+	window := s.cfg.ExfilWindow
+	now := time.Now()
+	key := client + " " + host
+
+	s.uploads.mutex.Lock()
+	if s.uploads.windows == nil {
+		s.uploads.windows = make(map[string]*uploadWindow)
+	}
+	if now.Sub(s.uploads.pruned) > window {
+		for k, w := range s.uploads.windows {
+			if now.Sub(w.start) >= window {
+				delete(s.uploads.windows, k)
+			}
+		}
+		s.uploads.pruned = now
+	}
+	w, ok := s.uploads.windows[key]
+	if !ok || now.Sub(w.start) >= window {
+		w = &uploadWindow{start: now}
+		s.uploads.windows[key] = w
+	}
+	w.bytes += bytes
+	exceeded := !w.alerted && w.bytes >= s.cfg.ExfilThreshold*1024*1024
+	if exceeded {
+		w.alerted = true
+	}
+	uploaded := w.bytes
+	s.uploads.mutex.Unlock()
+
+	if exceeded {
+		s.raiseAlert(Alert{
+			Kind:    "exfiltration",
+			Client:  client,
+			User:    user,
+			Host:    host,
+			Message: fmt.Sprintf("%s uploaded %.1f MB to %s within %s", client, float64(uploaded)/(1024*1024), host, window),
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// failureHostsMax bounds the hosts failures are kept for; requests to
+// further hosts only count in the totals
+const failureHostsMax = 10000
+
+// FailureClass names why a request failed
+type FailureClass string
+
+const (
+	FailureDNS           FailureClass = "dns"            // The origin's name does not exist
+	FailureResolver      FailureClass = "resolver"       // DNS lookup timed out or failed
+	FailureDialTimeout   FailureClass = "dial_timeout"   // The origin did not accept in time
+	FailureRefused       FailureClass = "refused"        // The origin refused the connection
+	FailureUnreachable   FailureClass = "unreachable"    // No route to the origin
+	FailureTLS           FailureClass = "tls"            // TLS handshake or certificate error
+	FailureOriginTimeout FailureClass = "origin_timeout" // The origin was too slow to respond
+	FailureOriginReset   FailureClass = "origin_reset"   // The origin dropped the connection
+	FailureOrigin5xx     FailureClass = "origin_5xx"     // The origin answered with a server error
+	FailureClientAbort   FailureClass = "client_abort"   // The client went away first
+	FailureSlowClient    FailureClass = "slow_client"    // Below -min-transfer-rate
+	FailureOriginBusy    FailureClass = "origin_busy"    // Refused at -origin-conn-limit
+	FailureProxy         FailureClass = "proxy"          // Anything else
+)
+
+// Sides a failure is blamed on
+const (
+	sideOrigin = "origin"
+	sideClient = "client"
+	sideProxy  = "proxy"
+)
+
+// side returns whether the origin, the client or the proxy is to blame
+// for failures of class c
+func (c FailureClass) side() string {
+	switch c {
+	case FailureClientAbort, FailureSlowClient:
+		return sideClient
+	case FailureResolver, FailureOriginBusy, FailureProxy:
+		return sideProxy
+	}
+	return sideOrigin
+}
+
+// classifyFailure returns the class of an error reaching or reading from
+// an origin
+func classifyFailure(err error) FailureClass {
+	switch {
+	case errors.Is(err, errSlowClient):
+		return FailureSlowClient
+	case errors.Is(err, errOriginBusy):
+		return FailureOriginBusy
+	case errors.Is(err, context.Canceled):
+		return FailureClientAbort
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return FailureDNS
+		}
+		return FailureResolver
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var pinErr pinMismatchError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &pinErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return FailureTLS
+	}
+
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		switch {
+		case timeout:
+			return FailureDialTimeout
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return FailureRefused
+		case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+			return FailureUnreachable
+		}
+	}
+	switch {
+	case timeout:
+		return FailureOriginTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureOriginReset
+	}
+	return FailureProxy
+}
+
+// recordFailure marks the request r as failed for class; the first
+// failure of a request is the one counted
+func recordFailure(r *http.Request, class FailureClass) {
+	if record, ok := r.Context().Value(requestKey{}).(*RequestRecord); ok && record.Error == "" {
+		record.Error = class
+	}
+}
+
+// copyFailure returns the class of an error copying a response to the
+// client of r
+func copyFailure(r *http.Request, err error) FailureClass {
+	if r.Context().Err() != nil {
+		return FailureClientAbort
+	}
+	return classifyFailure(err)
+}
+
+// failureCounters count requests and their failures by host since startup
+type failureCounters struct {
+	mutex    sync.Mutex
+	hosts    map[string]*HostFailures
+	requests int64
+	classes  map[FailureClass]int64
+}
+
+// HostFailures counts the requests to a host and how they failed
+type HostFailures struct {
+	Host      string                 `json:"host"`
+	Requests  int64                  `json:"requests"`
+	Errors    int64                  `json:"errors"`
+	ErrorRate float64                `json:"error_rate"`
+	Classes   map[FailureClass]int64 `json:"classes"`
+}
+
+// FailureStats reports request failures since startup, with the share of
+// requests that failed because of the origin, the client or the proxy
+type FailureStats struct {
+	Requests   int64                  `json:"requests"`
+	OriginRate float64                `json:"origin_error_rate"`
+	ClientRate float64                `json:"client_error_rate"`
+	ProxyRate  float64                `json:"proxy_error_rate"`
+	Classes    map[FailureClass]int64 `json:"classes"`
+	Hosts      []HostFailures         `json:"hosts"` // Most errors first
+}
+
+// add counts a finished request to host that failed for class ("" if it
+// did not)
+func (c *failureCounters) add(host string, class FailureClass) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]*HostFailures)
+		c.classes = make(map[FailureClass]int64)
+	}
+	c.requests++
+	if class != "" {
+		c.classes[class]++
+	}
+
+	stats, ok := c.hosts[host]
+	if !ok {
+		if host == "" || len(c.hosts) >= failureHostsMax {
+			return
+		}
+		stats = &HostFailures{Host: host, Classes: make(map[FailureClass]int64)}
+		c.hosts[host] = stats
+	}
+	stats.Requests++
+	if class != "" {
+		stats.Errors++
+		stats.Classes[class]++
+	}
+}
+
+// HandleFailureStats reports failed requests by class and the ?limit=
+// (default 50) hosts with the most of them
+func (s *Server) HandleFailureStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	response := FailureStats{Classes: make(map[FailureClass]int64), Hosts: []HostFailures{}}
+	s.failures.mutex.Lock()
+	response.Requests = s.failures.requests
+	sides := make(map[string]int64)
+	for class, n := range s.failures.classes {
+		response.Classes[class] = n
+		sides[class.side()] += n
+	}
+	for _, stats := range s.failures.hosts {
+		if stats.Errors == 0 {
+			continue
+		}
+		host := *stats
+		host.ErrorRate = float64(host.Errors) / float64(host.Requests)
+		host.Classes = make(map[FailureClass]int64, len(stats.Classes))
+		for class, n := range stats.Classes {
+			host.Classes[class] = n
+		}
+		response.Hosts = append(response.Hosts, host)
+	}
+	s.failures.mutex.Unlock()
+
+	if response.Requests > 0 {
+		response.OriginRate = float64(sides[sideOrigin]) / float64(response.Requests)
+		response.ClientRate = float64(sides[sideClient]) / float64(response.Requests)
+		response.ProxyRate = float64(sides[sideProxy]) / float64(response.Requests)
+	}
+	sort.Slice(response.Hosts, func(i, j int) bool {
+		if response.Hosts[i].Errors != response.Hosts[j].Errors {
+			return response.Hosts[i].Errors > response.Hosts[j].Errors
+		}
+		return response.Hosts[i].Host < response.Hosts[j].Host
+	})
+	if len(response.Hosts) > limit {
+		response.Hosts = response.Hosts[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
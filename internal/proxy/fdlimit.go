@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// fdCheckInterval is how long a count of open file descriptors is used
+// before they are counted again
+const fdCheckInterval = 100 * time.Millisecond
+
+// fdOverloadResponse answers connections to the plain HTTP proxy ports
+// refused for lack of file descriptors
+const fdOverloadResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Retry-After: 5\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: 49\r\n" +
+	"\r\n" +
+	"The proxy is too busy right now, try again soon.\n"
+
+// fdGuard refuses new client connections while fewer than -fd-reserve file
+// descriptors are left below RLIMIT_NOFILE, so that accepted connections
+// can still reach their origins and the proxy its logs and Redis
+type fdGuard struct {
+	limit      int64        // Soft RLIMIT_NOFILE (0 disables the guard)
+	open       atomic.Int64 // File descriptors open when last counted
+	accepted   atomic.Int64 // Connections accepted since
+	checked    atomic.Int64 // When they were counted, in Unix nanoseconds
+	overloaded atomic.Bool
+	rejected   atomic.Int64 // Connections refused for lack of descriptors
+}
+
+// startFDGuard reads the file descriptor limit; the guard stays disabled
+// where open descriptors cannot be counted or -fd-reserve is 0
+func (s *Server) startFDGuard() {
+	if s.cfg.FDReserve <= 0 {
+		return
+	}
+	limit, err := fdLimit()
+	if err != nil {
+		s.log.Info("File descriptor limit unknown, not reserving any: %v", err)
+		return
+	}
+	open, err := openFDs()
+	if err != nil {
+		s.log.Info("Open file descriptors cannot be counted, not reserving any: %v", err)
+		return
+	}
+	if limit > uint64(1<<62) {
+		limit = 1 << 62
+	}
+	if int64(limit) <= 2*int64(s.cfg.FDReserve) {
+		s.log.Warn("File descriptor limit %d leaves little room above -fd-reserve %d; raise it with ulimit -n or LimitNOFILE=", limit, s.cfg.FDReserve)
+	}
+	s.fds.limit = int64(limit)
+	s.fds.open.Store(int64(open))
+	s.fds.checked.Store(time.Now().UnixNano())
+	s.log.Info("File descriptor limit %d, refusing new connections with fewer than %d left", limit, s.cfg.FDReserve)
+}
+
+// fdsExhausted reports whether a new connection would eat into the
+// reserved file descriptors, counting it as accepted if not
+func (s *Server) fdsExhausted() bool {
+	g := &s.fds
+	if g.limit == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if checked := g.checked.Load(); now-checked > int64(fdCheckInterval) && g.checked.CompareAndSwap(checked, now) {
+		if n, err := openFDs(); err == nil {
+			g.open.Store(int64(n))
+			g.accepted.Store(0)
+		}
+	}
+
+	exhausted := g.open.Load()+g.accepted.Load() >= g.limit-int64(s.cfg.FDReserve)
+	if exhausted {
+		g.rejected.Add(1)
+	} else {
+		g.accepted.Add(1)
+	}
+	if g.overloaded.Swap(exhausted) != exhausted {
+		if exhausted {
+			s.log.Warn("Near the file descriptor limit of %d, refusing new connections", g.limit)
+		} else {
+			s.log.Info("File descriptors available again (%d connections refused so far)", g.rejected.Load())
+		}
+	}
+	return exhausted
+}
+
+// FDListener wraps l so that connections accepted near the file descriptor
+// limit are closed right away. Those on plain HTTP proxy ports get a 503
+// first.
+func (s *Server) FDListener(l net.Listener, plainHTTP bool) net.Listener {
+	return &fdListener{Listener: l, s: s, plainHTTP: plainHTTP}
+}
+
+type fdListener struct {
+	net.Listener
+	s         *Server
+	plainHTTP bool
+}
+
+func (l *fdListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.s.fdsExhausted() {
+			return conn, nil
+		}
+		if !l.plainHTTP {
+			conn.Close()
+			continue
+		}
+		// A slow client must not hold up the accept loop
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			io.WriteString(conn, fdOverloadResponse)
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package proxy
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of file descriptors the process has open
+func openFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	// Reading the directory took one of them
+	return len(entries) - 1, nil
+}
+
+// fdLimit returns the soft limit on open file descriptors
+func fdLimit() (uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return limit.Cur, nil
+}
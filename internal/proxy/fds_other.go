@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func openFDs() (int, error) {
+	return 0, fmt.Errorf("counting file descriptors is not supported on %s", runtime.GOOS)
+}
+
+func fdLimit() (uint64, error) {
+	return 0, fmt.Errorf("file descriptor limits are not supported on %s", runtime.GOOS)
+}
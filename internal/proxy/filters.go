@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"go-proxy/internal/adblock"
+)
+
+// SetFilters enables blocking by Adblock Plus filter lists. Plain HTTP
+// requests are matched by URL; CONNECT tunnels can only be matched by host.
+func (s *Server) SetFilters(engine *adblock.Engine) {
+	s.filters = engine
+}
+
+// filterBlocked returns the filter list that blocks the plain HTTP
+// request r to host, or "" if none does
+func (s *Server) filterBlocked(r *http.Request, host string) string {
+	if s.filters == nil {
+		return ""
+	}
+	referrer := ""
+	if ref, err := url.Parse(r.Referer()); err == nil {
+		referrer = ref.Hostname()
+	}
+	list, blocked := s.filters.Match(r.URL.String(), host, referrer)
+	if blocked {
+		s.log.Info("BLOCKED HTTP by filter list %s: %s", list, r.URL)
+		return list
+	}
+	return ""
+}
+
+// filterBlockedHost returns the filter list that blocks every request to
+// host, which is what decides a CONNECT tunnel, or "" if none does
+func (s *Server) filterBlockedHost(host string) string {
+	if s.filters == nil {
+		return ""
+	}
+	list, blocked := s.filters.MatchHost(host)
+	if blocked {
+		s.log.Info("BLOCKED HTTPS by filter list %s: %s", list, host)
+		return list
+	}
+	return ""
+}
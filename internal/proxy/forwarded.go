@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardedRequest returns r with the client address a -trusted-proxies
+// downstream proxy passed on in X-Forwarded-For, or else X-Real-IP, as its
+// RemoteAddr, keeping the port of the connection. Requests from other
+// addresses, and those whose header is malformed, are returned unchanged:
+// anyone else could claim to be any client.
+func (s *Server) forwardedRequest(r *http.Request) *http.Request {
+	if len(s.trustedProxies.nets) == 0 || !s.trustedProxies.match("", r.RemoteAddr) {
+		return r
+	}
+	client, ok := s.forwardedClient(r.Header)
+	if !ok {
+		return r
+	}
+	_, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		port = "0"
+	}
+	forwarded := r.WithContext(r.Context())
+	forwarded.RemoteAddr = net.JoinHostPort(client.String(), port)
+	return forwarded
+}
+
+// forwardedClient returns the client named in header. X-Forwarded-For is
+// read from the right, skipping the trusted proxies each hop appended, so
+// entries the client made up itself are never reached while an untrusted
+// address comes after them.
+func (s *Server) forwardedClient(header http.Header) (netip.Addr, bool) {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	if len(hops) == 0 {
+		return parseForwardedAddr(header.Get("X-Real-IP"))
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			return netip.Addr{}, false
+		}
+		client = addr
+		if !s.trustedProxies.match("", addr.String()) {
+			break
+		}
+	}
+	return client, true
+}
+
+// parseForwardedAddr parses an IP, optionally with a port, as proxies put
+// them in X-Forwarded-For and X-Real-IP
+func parseForwardedAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
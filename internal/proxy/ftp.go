@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"go-proxy/internal/ftp"
+)
+
+// ftpListing renders FTP directory listings
+var ftpListing = template.Must(template.New("ftp").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}} on {{.Host}}</title></head>
+<body>
+<h1>Index of {{.Path}} on {{.Host}}</h1>
+<pre>
+{{if ne .Path "/"}}<a href="../">../</a>
+{{end}}{{range .Entries}}<a href="{{.Href}}">{{.Name}}</a>{{if .Dir}}/{{end}}	{{.Line}}
+{{end}}</pre>
+</body>
+</html>
+`))
+
+// ftpEntry is one row of a rendered listing
+type ftpEntry struct {
+	ftp.Entry
+	Href string
+}
+
+// handleFTP serves a GET or HEAD for an ftp:// URL: files are sent as is
+// and directories as an HTML listing. Blocking has already been checked.
+func (s *Server) handleFTP(w http.ResponseWriter, r *http.Request, user string, target *url.URL) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.writeError(w, r, http.StatusMethodNotAllowed, "Only GET and HEAD are supported for ftp:// URLs")
+		return
+	}
+	filePath := target.Path
+	if filePath == "" {
+		filePath = "/"
+	}
+	if strings.ContainsAny(filePath, "\r\n") {
+		s.writeError(w, r, http.StatusBadRequest, "Invalid FTP path")
+		return
+	}
+
+	host := target.Hostname()
+	port := target.Port()
+	if port == "" {
+		port = "21"
+	}
+	egress := s.egressFor(r.Context(), user, r.RemoteAddr, host)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return s.dialContext(ctx, network, addr, egress)
+	}
+
+	conn, err := ftp.Dial(r.Context(), net.JoinHostPort(host, port), dial)
+	if err != nil {
+		s.log.Warn("Error connecting to FTP server %s: %v", host, err)
+		recordFailure(r, classifyFailure(err))
+		s.writeError(w, r, gatewayStatus(err), "Error connecting to FTP server")
+		return
+	}
+	defer conn.Close()
+
+	ftpUser, password := "anonymous", "proxy@"
+	if target.User != nil {
+		ftpUser = target.User.Username()
+		password, _ = target.User.Password()
+	}
+	if err := conn.Login(ftpUser, password); err != nil {
+		if ftp.IsLoginFailed(err) {
+			s.writeError(w, r, http.StatusForbidden, "FTP login failed")
+		} else {
+			s.writeError(w, r, http.StatusBadGateway, err.Error())
+		}
+		return
+	}
+
+	countingWriter := &CountingWriter{ResponseWriter: w}
+	if err := conn.ChangeDir(filePath); err == nil {
+		if !strings.HasSuffix(filePath, "/") {
+			// Relative links in the listing need the trailing slash
+			redirect := *target
+			redirect.Path = filePath + "/"
+			redirect.User = nil
+			http.Redirect(w, r, redirect.String(), http.StatusMovedPermanently)
+			return
+		}
+		err = s.serveFTPListing(countingWriter, r, conn, host, filePath)
+	} else {
+		err = s.serveFTPFile(countingWriter, r, conn, filePath)
+	}
+	if err != nil {
+		s.log.Warn("Error fetching %s from FTP server %s: %v", filePath, host, err)
+	}
+
+	written := countingWriter.BytesWritten
+	s.geo.RecordHostLocation(host)
+	n := statsWeight(r, false)
+	s.updateStats(statsName(r, host), false, written*n, n)
+	s.updateUserStats(statsName(r, user), false, written*n, n)
+}
+
+// serveFTPFile sends the file at filePath
+func (s *Server) serveFTPFile(w http.ResponseWriter, r *http.Request, conn *ftp.Conn, filePath string) error {
+	size := conn.Size(filePath)
+	var body io.ReadCloser
+	if r.Method == http.MethodGet {
+		var err error
+		body, err = conn.Retrieve(r.Context(), filePath)
+		if err != nil {
+			if ftp.IsNotFound(err) {
+				s.writeError(w, r, http.StatusNotFound, "Not found on FTP server")
+				return nil
+			}
+			s.writeError(w, r, http.StatusBadGateway, err.Error())
+			return err
+		}
+		defer body.Close()
+	} else if size < 0 {
+		// HEAD without SIZE support: nothing tells whether the file exists
+		s.writeError(w, r, http.StatusNotFound, "Not found on FTP server")
+		return nil
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if body == nil {
+		return nil
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// serveFTPListing sends the working directory, filePath, as HTML
+func (s *Server) serveFTPListing(w http.ResponseWriter, r *http.Request, conn *ftp.Conn, host, filePath string) error {
+	entries, err := conn.List(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusBadGateway, err.Error())
+		return err
+	}
+	rows := make([]ftpEntry, len(entries))
+	for i, entry := range entries {
+		href := (&url.URL{Path: entry.Name}).EscapedPath()
+		if strings.Contains(entry.Name, ":") {
+			// Keep names like "a:b" from parsing as a scheme
+			href = "./" + href
+		}
+		if entry.Dir {
+			href += "/"
+		}
+		rows[i] = ftpEntry{Entry: entry, Href: href}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return ftpListing.Execute(w, struct {
+		Host    string
+		Path    string
+		Entries []ftpEntry
+	}{host, filePath, rows})
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// noGeo is the GeoResolver used when geolocation is disabled
+type noGeo struct{}
+
+func (noGeo) RecordHostLocation(string)       {}
+func (noGeo) RecordConnection(string, string) {}
+
+func (noGeo) Country(string) (string, error) {
+	return "", errors.New("geolocation is disabled")
+}
+
+// traceOriginAddr returns req set up to store the remote address of the
+// connection it is sent on in addr
+func traceOriginAddr(req *http.Request, addr *string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			*addr = info.Conn.RemoteAddr().String()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// recordOrigin geolocates host by addr, the address its connection went
+// to, so stats show where traffic went even for anycast and regional CDN
+// edges. Through an upstream proxy addr is the proxy's, so the name is
+// located instead.
+func (s *Server) recordOrigin(host, addr string, viaUpstream bool) {
+	if viaUpstream || addr == "" {
+		s.geo.RecordHostLocation(host)
+		return
+	}
+	s.geo.RecordConnection(host, addr)
+}
+
+// geoFence limits destinations to the countries of -geo-allow-countries
+type geoFence struct {
+	allowed   map[string]bool
+	mutex     sync.Mutex
+	blocked   map[string]int64 // Country -> refused requests, "" for unknown
+	lastError atomic.Int64     // Unix time of the last logged lookup failure
+}
+
+// GeoFenceStats reports the requests refused by the country allow-list
+// since startup
+type GeoFenceStats struct {
+	Allowed   []string         `json:"allowed"`    // Country codes destinations must be in
+	Blocked   int64            `json:"blocked"`    // Requests refused
+	ByCountry map[string]int64 `json:"by_country"` // Refused requests by destination country
+	Unknown   int64            `json:"unknown"`    // Refused because the location could not be found
+}
+
+// newGeoFence parses a comma separated list of country codes; nil if empty
+func newGeoFence(countries string) *geoFence {
+	codes := splitList(strings.ToUpper(countries))
+	if len(codes) == 0 {
+		return nil
+	}
+	f := &geoFence{allowed: make(map[string]bool), blocked: make(map[string]int64)}
+	for _, code := range codes {
+		f.allowed[code] = true
+	}
+	return f
+}
+
+// geoFenced returns the rule refusing host because it is outside the
+// allowed countries, or "" if it may be reached. Hosts that cannot be
+// located are refused; those on private addresses are allowed.
+func (s *Server) geoFenced(host string) string {
+	f := s.geoFence
+	if f == nil {
+		return ""
+	}
+	country, err := s.geo.Country(host)
+	if err == nil && (country == "" || f.allowed[country]) {
+		return ""
+	}
+	if err != nil {
+		// One log line a minute is enough while lookups fail
+		if now := time.Now().Unix(); f.lastError.Swap(now) < now-60 {
+			s.log.Warn("Geo-fencing: failed to locate %s, refusing it: %v", host, err)
+		}
+		country = ""
+	}
+
+	f.mutex.Lock()
+	f.blocked[country]++
+	f.mutex.Unlock()
+	if country == "" {
+		return "geo:unknown"
+	}
+	return "geo:" + country
+}
+
+// GeoFenceStats returns the geo-fencing counters
+func (s *Server) GeoFenceStats() GeoFenceStats {
+	result := GeoFenceStats{Allowed: []string{}, ByCountry: make(map[string]int64)}
+	f := s.geoFence
+	if f == nil {
+		return result
+	}
+	for code := range f.allowed {
+		result.Allowed = append(result.Allowed, code)
+	}
+	sort.Strings(result.Allowed)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for country, count := range f.blocked {
+		result.Blocked += count
+		if country == "" {
+			result.Unknown = count
+		} else {
+			result.ByCountry[country] = count
+		}
+	}
+	return result
+}
+
+// HandleGeoFenceStats serves GeoFenceStats as JSON
+func (s *Server) HandleGeoFenceStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.GeoFenceStats())
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hopHeaders are meaningful for a single connection only and are never
+// forwarded (RFC 7230 section 6.1). Proxy-Connection is a non-standard
+// header some clients still send; Trailer is included per RFC 7230
+// erratum 4522.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// named in its Connection headers (e.g. "Connection: X-Custom")
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// proxyMethods is the Allow header of OPTIONS requests the proxy answers
+const proxyMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, CONNECT"
+
+// notProxyMessage answers requests sent to the proxy port as if it were a
+// web server
+const notProxyMessage = "This is a proxy server. Configure your browser or client to use it as an HTTP proxy instead of opening it directly."
+
+// ProxyRequests routes proxy requests (CONNECT and absolute URIs) to the
+// proxy and all other requests to local, so that a proxied path such as
+// http://example.com/api/ never reaches the local web API
+func (s *Server) ProxyRequests(local http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markServed(r)
+		if r.Method == http.MethodConnect || r.URL.Host != "" {
+			s.HandleHTTP(w, r)
+			return
+		}
+		local.ServeHTTP(w, r)
+	})
+}
+
+// handleLocal answers requests that name no origin: "OPTIONS *" is
+// answered with the supported methods, anything else is not a proxy
+// request and gets a page explaining how to use the proxy
+func (s *Server) handleLocal(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions && r.RequestURI == "*" {
+		w.Header().Set("Allow", proxyMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.writeError(w, r, http.StatusBadRequest, notProxyMessage)
+}
+
+// absoluteURL returns the URL r is for, defaulting a missing scheme to
+// http. Only http and https origins can be proxied, and ftp through the
+// FTP gateway.
+func absoluteURL(r *http.Request) (*url.URL, error) {
+	target := *r.URL
+	target.Scheme = strings.ToLower(target.Scheme)
+	if target.Scheme == "" {
+		target.Scheme = "http"
+	}
+	if target.Scheme != "http" && target.Scheme != "https" && target.Scheme != "ftp" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", target.Scheme)
+	}
+	if target.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %q", r.RequestURI)
+	}
+	if target.Path == "" && target.RawPath == "" && target.Opaque == "" {
+		target.Path = "/"
+	}
+	return &target, nil
+}
+
+// outboundRequest returns a copy of r to forward to the origin
+func outboundRequest(r *http.Request) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *r
+
+	// Ensure we're not forwarding the original connection settings
+	outReq.Close = false
+	outReq.RequestURI = ""
+	outReq.Header = outboundHeader(r)
+	if n, err := strconv.Atoi(outReq.Header.Get("Max-Forwards")); err == nil && n > 0 {
+		outReq.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+	}
+	return outReq
+}
+
+// outboundHeader returns the headers of r to send to the origin. It is a
+// copy, so the client's request is left untouched.
+func outboundHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	// TE: trailers only says the client accepts trailers, which the
+	// origin needs to know to send them
+	acceptsTrailers := headerHasToken(header, "Te", "trailers")
+	removeHopHeaders(header)
+	if acceptsTrailers {
+		header.Set("Te", "trailers")
+	}
+	return header
+}
+
+// headerHasToken reports whether a comma separated header of h contains
+// token, compared case-insensitively
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			// Strip parameters such as "trailers;q=1"
+			if idx := strings.IndexByte(item, ';'); idx != -1 {
+				item = item[:idx]
+			}
+			if strings.EqualFold(textproto.TrimString(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
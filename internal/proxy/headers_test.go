@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name: "hop-by-hop",
+			header: http.Header{
+				"Connection":          {"keep-alive"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authenticate":  {"Basic"},
+				"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+				"Te":                  {"trailers"},
+				"Trailer":             {"Expires"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+				"Accept":              {"*/*"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "listed in Connection",
+			header: http.Header{
+				"Connection": {"X-Custom, x-other", "X-Third"},
+				"X-Custom":   {"a"},
+				"X-Other":    {"b"},
+				"X-Third":    {"c"},
+				"X-Kept":     {"d"},
+			},
+			want: http.Header{"X-Kept": {"d"}},
+		},
+		{
+			name: "empty and padded Connection tokens",
+			header: http.Header{
+				"Connection": {" ,  X-Custom\t,"},
+				"X-Custom":   {"a"},
+				"Host":       {"example.com"},
+			},
+			want: http.Header{"Host": {"example.com"}},
+		},
+		{
+			name:   "nothing to strip",
+			header: http.Header{"Accept": {"*/*"}, "Cookie": {"a=b"}},
+			want:   http.Header{"Accept": {"*/*"}, "Cookie": {"a=b"}},
+		},
+	}
+	for _, test := range tests {
+		removeHopHeaders(test.header)
+		if !reflect.DeepEqual(test.header, test.want) {
+			t.Errorf("%s: left %v, want %v", test.name, test.header, test.want)
+		}
+	}
+}
+
+func TestOutboundHeader(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header = http.Header{
+		"Connection": {"X-Custom"},
+		"X-Custom":   {"a"},
+		"Te":         {"gzip, Trailers;q=1"},
+		"Accept":     {"*/*"},
+	}
+	header := outboundHeader(r)
+	want := http.Header{"Te": {"trailers"}, "Accept": {"*/*"}}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("outboundHeader = %v, want %v", header, want)
+	}
+	if r.Header.Get("X-Custom") != "a" {
+		t.Errorf("outboundHeader changed the client's request headers")
+	}
+
+	r.Header = http.Header{"Te": {"gzip"}}
+	if header := outboundHeader(r); len(header) != 0 {
+		t.Errorf("outboundHeader kept %v, want TE dropped without trailers", header)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upgradeTTL        = 24 * time.Hour // How long a learned HTTPS redirect is trusted
+	upgradeMaxTracked = 10000          // Learned hosts kept before expired ones are dropped
+)
+
+// httpsHosts remembers the hosts that always send plain HTTP clients to
+// HTTPS: learned from permanent redirects, or listed as HSTS preloaded
+type httpsHosts struct {
+	mutex    sync.RWMutex
+	learned  map[string]time.Time // Host -> when the learned redirect expires
+	preload  map[string]bool      // Preloaded domains, subdomains included
+	learns   atomic.Int64
+	warned   atomic.Int64
+	upgraded atomic.Int64
+}
+
+// HTTPSUpgradeStats reports the plain HTTP requests seen for HTTPS-only
+// hosts since startup
+type HTTPSUpgradeStats struct {
+	Mode         string `json:"mode"`          // off, warn or redirect
+	LearnedHosts int    `json:"learned_hosts"` // Hosts currently known to redirect
+	PreloadHosts int    `json:"preload_hosts"`
+	Learned      int64  `json:"learned"`  // Permanent HTTPS redirects seen
+	Warned       int64  `json:"warned"`   // Requests logged in warn mode
+	Upgraded     int64  `json:"upgraded"` // Requests redirected by the proxy itself
+}
+
+// loadHSTSPreload reads a file of domains, one per line, that are only
+// served over HTTPS, subdomains included
+func loadHSTSPreload(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open HSTS preload file: %v", err)
+	}
+	defer file.Close()
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if domain := strings.Trim(strings.ToLower(strings.TrimSpace(line)), "."); domain != "" {
+			domains[strings.TrimPrefix(domain, "*.")] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read HSTS preload file: %v", err)
+	}
+	return domains, nil
+}
+
+// httpsOnly reports whether host is known to be served over HTTPS only
+func (h *httpsHosts) httpsOnly(host string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if expires, ok := h.learned[host]; ok && time.Now().Before(expires) {
+		return true
+	}
+	for domain := host; domain != ""; {
+		if h.preload[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+// learn records the outcome of a plain HTTP request to host: a permanent
+// redirect to HTTPS on the same host marks it, anything else but another
+// redirect clears it
+func (h *httpsHosts) learn(host string, resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		location, err := resp.Location()
+		if err != nil || location.Scheme != "https" || !strings.EqualFold(location.Hostname(), host) {
+			return
+		}
+		now := time.Now()
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if _, ok := h.learned[host]; !ok && len(h.learned) >= upgradeMaxTracked {
+			for known, expires := range h.learned {
+				if now.After(expires) {
+					delete(h.learned, known)
+				}
+			}
+			if len(h.learned) >= upgradeMaxTracked {
+				return
+			}
+		}
+		h.learned[host] = now.Add(upgradeTTL)
+		h.learns.Add(1)
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusNotModified:
+	default:
+		h.mutex.Lock()
+		delete(h.learned, host)
+		h.mutex.Unlock()
+	}
+}
+
+// upgradeHTTPS handles a plain HTTP GET or HEAD for a host that is known to
+// be HTTPS only: -https-upgrade=warn logs it, =redirect answers it with a
+// redirect to HTTPS instead of asking the origin. It reports whether the
+// request was answered.
+func (s *Server) upgradeHTTPS(w http.ResponseWriter, r *http.Request, target *url.URL) bool {
+	mode := s.cfg.HTTPSUpgrade
+	if mode == "off" || target.Scheme != "http" ||
+		(r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		!s.httpsHosts.httpsOnly(target.Hostname()) {
+		return false
+	}
+	if mode == "warn" {
+		s.httpsHosts.warned.Add(1)
+		s.log.Info("Plain HTTP request for HTTPS-only host: %s", target.Redacted())
+		return false
+	}
+
+	secure := *target
+	secure.Scheme = "https"
+	secure.User = nil
+	if secure.Port() == "80" {
+		secure.Host = secure.Hostname()
+		if strings.Contains(secure.Host, ":") {
+			secure.Host = "[" + secure.Host + "]"
+		}
+	}
+	s.httpsHosts.upgraded.Add(1)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, secure.String(), http.StatusPermanentRedirect)
+	return true
+}
+
+// HTTPSUpgradeStats returns the HTTPS upgrade counters
+func (s *Server) HTTPSUpgradeStats() HTTPSUpgradeStats {
+	h := &s.httpsHosts
+	h.mutex.RLock()
+	learned, preload := len(h.learned), len(h.preload)
+	h.mutex.RUnlock()
+	return HTTPSUpgradeStats{
+		Mode:         s.cfg.HTTPSUpgrade,
+		LearnedHosts: learned,
+		PreloadHosts: preload,
+		Learned:      h.learns.Load(),
+		Warned:       h.warned.Load(),
+		Upgraded:     h.upgraded.Load(),
+	}
+}
+
+// HandleHTTPSUpgradeStats serves HTTPSUpgradeStats as JSON
+func (s *Server) HandleHTTPSUpgradeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.HTTPSUpgradeStats())
+}
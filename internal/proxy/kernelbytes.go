@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// kernelCountedConn reads the kernel's byte counters of an origin
+// connection just before it is closed, for -tunnel-accounting=kernel.
+// The counters are the socket's own TCP_INFO ones rather than an eBPF
+// program's: they give the same per-connection totals without loading BPF
+// programs, which would need CAP_BPF and a compiled object per kernel.
+type kernelCountedConn struct {
+	net.Conn
+	once     sync.Once
+	sent     uint64 // Acknowledged by the origin
+	received uint64 // Received from the origin
+	ok       bool
+}
+
+func (c *kernelCountedConn) Close() error {
+	c.once.Do(func() {
+		c.sent, c.received, c.ok = tcpCounters(c.Conn)
+	})
+	return c.Conn.Close()
+}
+
+// counts returns the bytes the client sent and received through the
+// tunnel by the kernel's count, or sent and received if the kernel's
+// count could not be read
+func (c *kernelCountedConn) counts(sent, received int64) (int64, int64) {
+	c.Close()
+	if !c.ok {
+		return sent, received
+	}
+	// The origin's downloads went to the client and its uploads came from it
+	return int64(c.received), int64(c.sent)
+}
+
+// tcpConn returns the TCP connection under conn, unwrapping TLS and the
+// proxy's own connection wrappers, or nil if there is none
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpCounters reads the bytes acknowledged by and received from the peer
+// of conn from its TCP_INFO (Linux 4.2 and later)
+func tcpCounters(conn net.Conn) (acked, received uint64, ok bool) {
+	tcp := tcpConn(conn)
+	if tcp == nil {
+		return 0, 0, false
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || sockErr != nil {
+		return 0, 0, false
+	}
+	return info.Bytes_acked, info.Bytes_received, true
+}
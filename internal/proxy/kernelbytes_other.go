@@ -0,0 +1,11 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// tcpCounters reports no counts; config.Load refuses
+// -tunnel-accounting=kernel outside Linux
+func tcpCounters(conn net.Conn) (acked, received uint64, ok bool) {
+	return 0, 0, false
+}
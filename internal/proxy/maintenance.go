@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenanceMessage is shown when -maintenance-message is empty
+const defaultMaintenanceMessage = "The proxy is down for maintenance and will be back shortly."
+
+// maintenanceRetry is the Retry-After sent with maintenance responses
+const maintenanceRetry = 5 * time.Minute
+
+// maintenancePage is the 503 page sent during maintenance unless the
+// -error-pages directory has a 503.html
+var maintenancePage = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Down for maintenance</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333">
+<h1>Down for maintenance</h1>
+<p>{{.Message}}</p>
+<p style="color: #888">Maintenance started {{.Since.Format "15:04 MST"}}.</p>
+</body>
+</html>
+`))
+
+// maintenanceMode refuses proxy traffic from all but the allow-listed
+// clients while it is enabled
+type maintenanceMode struct {
+	enabled atomic.Bool
+	mutex   sync.RWMutex
+	message string
+	since   time.Time
+	allow   clientSet
+}
+
+// MaintenanceStatus represents the maintenance mode of the proxy
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"` // Unset when disabled
+}
+
+// setMaintenance enables or disables maintenance mode, keeping the current
+// message if message is empty
+func (s *Server) setMaintenance(enabled bool, message string) {
+	s.maintenance.mutex.Lock()
+	defer s.maintenance.mutex.Unlock()
+	if message != "" {
+		s.maintenance.message = message
+	}
+	if enabled && !s.maintenance.enabled.Load() {
+		s.maintenance.since = time.Now()
+	}
+	s.maintenance.enabled.Store(enabled)
+}
+
+// setMaintenanceAllow replaces the clients served during maintenance
+func (s *Server) setMaintenanceAllow(value string) {
+	allow := parseClientSet(value)
+	s.maintenance.mutex.Lock()
+	s.maintenance.allow = allow
+	s.maintenance.mutex.Unlock()
+}
+
+// maintenanceStatus returns the current maintenance mode
+func (s *Server) maintenanceStatus() MaintenanceStatus {
+	s.maintenance.mutex.RLock()
+	defer s.maintenance.mutex.RUnlock()
+	status := MaintenanceStatus{Enabled: s.maintenance.enabled.Load(), Message: s.maintenance.message}
+	if status.Message == "" {
+		status.Message = defaultMaintenanceMessage
+	}
+	if status.Enabled {
+		since := s.maintenance.since
+		status.Since = &since
+	}
+	return status
+}
+
+// inMaintenance reports whether r is refused because of maintenance mode.
+// Clients are matched by IP only, before they authenticate.
+func (s *Server) inMaintenance(r *http.Request) bool {
+	if !s.maintenance.enabled.Load() {
+		return false
+	}
+	s.maintenance.mutex.RLock()
+	defer s.maintenance.mutex.RUnlock()
+	return !s.maintenance.allow.match("", r.RemoteAddr)
+}
+
+// writeMaintenance answers r with a 503: JSON if the client prefers it,
+// else the configured 503 page, else the built-in maintenance page
+func (s *Server) writeMaintenance(w http.ResponseWriter, r *http.Request) {
+	status := s.maintenanceStatus()
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetry.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) || s.errorPages[http.StatusServiceUnavailable] != nil {
+		// Not written through writeError: maintenance is not a proxy error
+		// worth an event per request
+		s.writeErrorPage(w, r, http.StatusServiceUnavailable, status.Message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodConnect {
+		maintenancePage.Execute(w, status)
+	}
+}
+
+// HandleMaintenance reports (GET) or switches (PUT) maintenance mode,
+// during which proxy clients not in -maintenance-allow get a 503 page
+func (s *Server) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req MaintenanceStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		s.setMaintenance(req.Enabled, req.Message)
+		if req.Enabled {
+			s.log.Warn("Maintenance mode enabled from %s", r.RemoteAddr)
+		} else {
+			s.log.Info("Maintenance mode disabled from %s", r.RemoteAddr)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.maintenanceStatus())
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CONNECT-UDP (RFC 9298, the MASQUE UDP proxying protocol) as clients ask
+// for it over HTTP/1.1: a GET of /.well-known/masque/udp/{host}/{port}/
+// upgraded to connect-udp, after which UDP payloads travel both ways in
+// DATAGRAM capsules (RFC 9297) on the connection. Over HTTP/3 they would
+// be QUIC datagrams, which needs a QUIC listener this proxy does not have.
+
+const (
+	masquePath      = "/.well-known/masque/udp/"
+	capsuleDatagram = 0x00
+	// udpPayloadMax is the largest UDP payload over IPv4 or IPv6 without
+	// jumbograms; longer DATAGRAM capsules end the tunnel
+	udpPayloadMax = 65527
+	// capsuleSkipMax bounds the capsules of other types, which are skipped
+	capsuleSkipMax = 1 << 16
+)
+
+// errCapsuleTooLong ends tunnels whose client sends oversized capsules
+var errCapsuleTooLong = errors.New("capsule too long")
+
+// isConnectUDP reports whether r asks to open a CONNECT-UDP tunnel
+func isConnectUDP(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, masquePath) && headerHasToken(r.Header, "Upgrade", "connect-udp")
+}
+
+// masqueTarget returns the host and port of the CONNECT-UDP path, the
+// default /.well-known/masque/udp/{target_host}/{target_port}/ template
+func masqueTarget(path string) (host, port string, err error) {
+	rest := strings.TrimPrefix(path, masquePath)
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid CONNECT-UDP target %q", rest)
+	}
+	return connectTarget(net.JoinHostPort(parts[0], parts[1]))
+}
+
+// handleConnectUDP opens the CONNECT-UDP tunnel r asks for, if
+// -connect-udp allows them
+func (s *Server) handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	w, r, finish := s.trackRequest(w, r)
+	defer finish()
+	if !s.cfg.ConnectUDP {
+		s.writeError(w, r, http.StatusNotFound, "CONNECT-UDP is disabled")
+		return
+	}
+	if s.inMaintenance(r) {
+		s.writeMaintenance(w, r)
+		return
+	}
+
+	user, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	setRequestUser(r.Context(), user)
+	s.tagApp(r)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 1 {
+		s.writeError(w, r, http.StatusNotImplemented, "CONNECT-UDP is only supported over HTTP/1.1")
+		return
+	}
+	if r.Header.Get("Capsule-Protocol") != "?1" {
+		s.writeError(w, r, http.StatusBadRequest, "CONNECT-UDP requires Capsule-Protocol: ?1")
+		return
+	}
+	targetHost, targetPort, err := masqueTarget(r.URL.Path)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	host := net.JoinHostPort(targetHost, targetPort)
+	rule := s.blockingRule(r, user, targetHost, targetPort)
+	if rule != "" {
+		s.updateStats(statsName(r, host), true, 0, 1)
+		s.updateUserStats(statsName(r, user), true, 0, 1)
+		s.log.Info("BLOCKED UDP: %s", host)
+		s.recordBlocked(r, user, host, rule)
+		s.geo.RecordHostLocation(targetHost)
+		s.writeBlocked(w, r, rule)
+		return
+	}
+
+	// Upstream proxies only tunnel TCP, so UDP always goes out directly
+	egress := s.egressFor(r.Context(), user, r.RemoteAddr, targetHost)
+	dialHost := net.JoinHostPort(s.serviceHost(user, r.RemoteAddr, targetHost), targetPort)
+	destConn, err := s.dialUDP(r, dialHost, egress)
+	n := statsWeight(r, err != nil)
+	s.updateStats(statsName(r, host), false, 0, n)
+	s.updateUserStats(statsName(r, user), false, 0, n)
+	if err != nil {
+		recordFailure(r, classifyFailure(err))
+		s.writeError(w, r, gatewayStatus(err), err.Error())
+		return
+	}
+
+	s.recordOrigin(targetHost, destConn.RemoteAddr().String(), false)
+	conn, client, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		destConn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	client.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n" +
+		"Upgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	if err := client.Flush(); err != nil {
+		conn.Close()
+		destConn.Close()
+		return
+	}
+
+	s.emit(r, "connect", host, "udp")
+	s.activeTunnels.Add(1)
+	defer s.activeTunnels.Add(-1)
+	sent, received := s.relayUDP(r, host, conn, client.Reader, destConn)
+	addRequestBytes(r.Context(), uint64(sent+received))
+	s.updateUserStats(statsName(r, user), false, uint64(sent+received)*n, 0)
+}
+
+// dialUDP opens the UDP socket of a CONNECT-UDP tunnel to addr, counted
+// against the origin's -origin-conn-limit. Pre-warmed connections are TCP
+// and never taken.
+func (s *Server) dialUDP(r *http.Request, addr, egress string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acquireOrigin(host); err != nil {
+		return nil, err
+	}
+	conn, err := s.dial(r.Context(), "udp", addr, egress)
+	if err != nil {
+		s.releaseOrigin(host)
+		return nil, err
+	}
+	return &originConn{Conn: conn, s: s, host: host}, nil
+}
+
+// relayUDP passes datagrams between the capsules of client, whose reads
+// go through buffered, and destConn until the client closes or sends a
+// malformed capsule. It returns the UDP payload bytes sent to and received
+// from the client.
+func (s *Server) relayUDP(r *http.Request, host string, client net.Conn, buffered *bufio.Reader, destConn net.Conn) (int64, int64) {
+	t := s.registerTunnel(r, host)
+	defer s.unregisterTunnel(t)
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			destConn.Close()
+		})
+	}
+
+	var sent int64
+	done := make(chan struct{})
+	s.tunnelGoroutine(t, 1)
+	go func() {
+		defer s.tunnelGoroutine(t, -1)
+		defer close(done)
+		defer closeBoth()
+		buf := make([]byte, udpPayloadMax)
+		var capsule []byte
+		for {
+			n, err := destConn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				continue // An ICMP error of an earlier datagram
+			}
+			capsule = appendDatagramCapsule(capsule[:0], buf[:n])
+			if _, err := client.Write(capsule); err != nil {
+				return
+			}
+			sent += int64(n)
+		}
+	}()
+
+	s.tunnelGoroutine(t, 1)
+	var received int64
+	buf := make([]byte, udpPayloadMax)
+	for {
+		payload, err := readDatagramCapsule(buffered, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.log.Debug("CONNECT-UDP tunnel to %s ended: %v", host, err)
+			}
+			break
+		}
+		if payload == nil {
+			continue
+		}
+		if _, err := destConn.Write(payload); err != nil {
+			// ICMP errors of earlier datagrams fail writes too
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue
+		}
+		received += int64(len(payload))
+	}
+	s.tunnelGoroutine(t, -1)
+	closeBoth()
+	<-done
+	return sent, received
+}
+
+// readDatagramCapsule reads the next capsule from r, returning the UDP
+// payload of a DATAGRAM capsule in buf, or nil for capsules of other types
+// and context IDs, which are skipped
+func readDatagramCapsule(r *bufio.Reader, buf []byte) ([]byte, error) {
+	capsuleType, _, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	length, _, err := readVarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if capsuleType != capsuleDatagram {
+		if length > capsuleSkipMax {
+			return nil, errCapsuleTooLong
+		}
+		_, err := r.Discard(int(length))
+		return nil, unexpectedEOF(err)
+	}
+	if length > udpPayloadMax+8 { // Payload and the longest context ID
+		return nil, errCapsuleTooLong
+	}
+	contextID, idLength, err := readVarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	payloadLength := int(length) - idLength
+	if payloadLength < 0 {
+		return nil, fmt.Errorf("DATAGRAM capsule shorter than its context ID")
+	}
+	if payloadLength > udpPayloadMax {
+		return nil, errCapsuleTooLong
+	}
+	payload := buf[:payloadLength]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if contextID != 0 {
+		// Context IDs other than 0 belong to extensions nobody negotiated
+		return nil, nil
+	}
+	return payload, nil
+}
+
+// appendDatagramCapsule appends to b the DATAGRAM capsule carrying the UDP
+// payload, with context ID 0
+func appendDatagramCapsule(b, payload []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// unexpectedEOF turns an EOF in the middle of a capsule into
+// io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendVarint appends v as a QUIC variable-length integer (RFC 9000
+// section 16), which capsules use for their fields
+func appendVarint(b []byte, v uint64) []byte {
+	switch varintLength(v) {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case 4:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// varintLength is the bytes appendVarint encodes v in
+func varintLength(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	}
+	return 8
+}
+
+// readVarint reads a QUIC variable-length integer, returning it and the
+// bytes it took, which need not be the fewest possible
+func readVarint(r io.ByteReader) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	v := uint64(first & 0x3f)
+	length := 1 << (first >> 6)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, unexpectedEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, length, nil
+}
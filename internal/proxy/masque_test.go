@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		encoded []byte
+	}{
+		// The examples of RFC 9000 appendix A.1
+		{151288809941952652, []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}},
+		{494878333, []byte{0x9d, 0x7f, 0x3e, 0x7d}},
+		{15293, []byte{0x7b, 0xbd}},
+		{37, []byte{0x25}},
+	}
+	for _, test := range tests {
+		if got := appendVarint(nil, test.value); !bytes.Equal(got, test.encoded) {
+			t.Errorf("appendVarint(%d) = %x, want %x", test.value, got, test.encoded)
+		}
+		value, n, err := readVarint(bytes.NewReader(test.encoded))
+		if value != test.value || n != len(test.encoded) || err != nil {
+			t.Errorf("readVarint(%x) = %d, %d, %v; want %d", test.encoded, value, n, err, test.value)
+		}
+	}
+	// Not the shortest encoding, which is allowed
+	if value, n, err := readVarint(bytes.NewReader([]byte{0x40, 0x25})); value != 37 || n != 2 || err != nil {
+		t.Errorf("readVarint(4025) = %d, %d, %v; want 37 in 2 bytes", value, n, err)
+	}
+	if _, _, err := readVarint(bytes.NewReader([]byte{0x9d, 0x7f})); err != io.ErrUnexpectedEOF {
+		t.Errorf("readVarint of a truncated integer: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReadDatagramCapsule(t *testing.T) {
+	var stream []byte
+	stream = appendDatagramCapsule(stream, []byte("first"))
+	stream = append(stream, 0x17, 0x03, 'a', 'b', 'c')                  // Unknown capsule type
+	stream = append(stream, capsuleDatagram, 0x04, 0x01, 'x', 'y', 'z') // Context ID 1
+	stream = append(stream, capsuleDatagram, 0x40, 0x01, 0x00)          // Empty, length in 2 bytes
+	stream = appendDatagramCapsule(stream, []byte("second"))
+
+	r := bufio.NewReader(bytes.NewReader(stream))
+	buf := make([]byte, udpPayloadMax)
+	var got []string
+	for {
+		payload, err := readDatagramCapsule(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading capsules: %v", err)
+		}
+		if payload != nil {
+			got = append(got, string(payload))
+		}
+	}
+	if want := []string{"first", "", "second"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("read payloads %q, want %q", got, want)
+	}
+}
+
+func TestReadDatagramCapsuleMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		capsule []byte
+		want    error
+	}{
+		{"truncated payload", []byte{capsuleDatagram, 0x05, 0x00, 'a'}, io.ErrUnexpectedEOF},
+		{"truncated length", []byte{capsuleDatagram, 0x40}, io.ErrUnexpectedEOF},
+		{"too long", appendVarint([]byte{capsuleDatagram}, udpPayloadMax+9), errCapsuleTooLong},
+		{"unknown too long", appendVarint([]byte{0x17}, capsuleSkipMax+1), errCapsuleTooLong},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(test.capsule))
+		if _, err := readDatagramCapsule(r, make([]byte, udpPayloadMax)); !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+	r := bufio.NewReader(bytes.NewReader([]byte{capsuleDatagram, 0x00}))
+	if _, err := readDatagramCapsule(r, make([]byte, udpPayloadMax)); err == nil {
+		t.Error("DATAGRAM capsule without a context ID was accepted")
+	}
+}
+
+func TestMasqueTarget(t *testing.T) {
+	tests := []struct {
+		path       string
+		host, port string // "" if invalid
+	}{
+		{"/.well-known/masque/udp/192.0.2.6/443/", "192.0.2.6", "443"},
+		{"/.well-known/masque/udp/example.com/53/", "example.com", "53"},
+		{"/.well-known/masque/udp/2001:db8::42/443/", "2001:db8::42", "443"},
+		{"/.well-known/masque/udp/example.com/53", "example.com", "53"},
+		{"/.well-known/masque/udp/example.com/", "", ""},
+		{"/.well-known/masque/udp/example.com/0/", "", ""},
+		{"/.well-known/masque/udp/example.com/53/extra/", "", ""},
+		{"/.well-known/masque/udp//53/", "", ""},
+	}
+	for _, test := range tests {
+		host, port, err := masqueTarget(test.path)
+		if test.host == "" {
+			if err == nil {
+				t.Errorf("masqueTarget(%q) = %q, %q; want an error", test.path, host, port)
+			}
+			continue
+		}
+		if host != test.host || port != test.port || err != nil {
+			t.Errorf("masqueTarget(%q) = %q, %q, %v; want %q, %q", test.path, host, port, err, test.host, test.port)
+		}
+	}
+}
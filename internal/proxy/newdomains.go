@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	domainCacheMax  = 100000         // First-seen times kept in memory before the cache is reset
+	domainAgeRetry  = time.Hour      // How long failed registration lookups are remembered
+	domainAgeExpiry = 24 * time.Hour // How long registration dates are cached
+)
+
+// DomainHistory remembers when destination domains were first seen
+type DomainHistory interface {
+	// FirstSeen returns when domain was first seen, recording now if it
+	// has not been seen before, and whether it was new
+	FirstSeen(domain string, now time.Time) (time.Time, bool, error)
+	// Since returns the domains first seen at or after since
+	Since(since time.Time) (map[string]time.Time, error)
+}
+
+// memoryDomains is the DomainHistory of instances without Redis; it is
+// lost on restart
+type memoryDomains struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// FirstSeen implements DomainHistory
+func (m *memoryDomains) FirstSeen(domain string, now time.Time) (time.Time, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if first, ok := m.seen[domain]; ok {
+		return first, false, nil
+	}
+	m.seen[domain] = now
+	return now, true, nil
+}
+
+// Since implements DomainHistory
+func (m *memoryDomains) Since(since time.Time) (map[string]time.Time, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	domains := make(map[string]time.Time)
+	for domain, first := range m.seen {
+		if !first.Before(since) {
+			domains[domain] = first
+		}
+	}
+	return domains, nil
+}
+
+// domainAge is the outcome of a registration date lookup
+type domainAge struct {
+	registered time.Time // Zero if the lookup failed
+	checked    time.Time
+}
+
+// newDomains tracks the first-seen times of destination domains and, with
+// -new-domain-age, their registration dates
+type newDomains struct {
+	history  DomainHistory
+	mutex    sync.Mutex
+	seen     map[string]time.Time // Cache of history
+	ages     map[string]domainAge
+	found    atomic.Int64 // Domains seen for the first time since startup
+	young    atomic.Int64 // Lookups finding a domain younger than -new-domain-age
+	failures atomic.Int64 // Failed registration lookups
+}
+
+// NewDomain is a destination domain first seen recently
+type NewDomain struct {
+	Domain     string     `json:"domain"`
+	FirstSeen  time.Time  `json:"first_seen"`
+	Registered *time.Time `json:"registered,omitempty"` // When looked up
+}
+
+// NewDomainsResponse lists the domains first seen in the requested period
+type NewDomainsResponse struct {
+	Domains        []NewDomain `json:"domains"`
+	Since          time.Time   `json:"since"`
+	NewDomains     int64       `json:"new_domains"`   // Since startup
+	YoungDomains   int64       `json:"young_domains"` // Since startup
+	LookupFailures int64       `json:"lookup_failures"`
+}
+
+// secondLevels are second level labels of country code TLDs that domains
+// are commonly registered under, e.g. co.uk
+var secondLevels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"ne": true, "net": true, "or": true, "org": true,
+}
+
+// registrableDomain returns the domain host is registered under, e.g.
+// example.co.uk for www.example.co.uk
+func registrableDomain(host string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+	keep := 2
+	if n := len(labels); n > 2 && len(labels[n-1]) == 2 && secondLevels[labels[n-2]] {
+		keep = 3
+	}
+	if len(labels) > keep {
+		labels = labels[len(labels)-keep:]
+	}
+	return strings.Join(labels, ".")
+}
+
+// domainRule records the first sighting of the domain of host and returns
+// the blocking rule for it: with -new-domain-policy block, domains
+// registered less than -new-domain-age days ago are refused
+func (s *Server) domainRule(r *http.Request, host string) string {
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	domain := registrableDomain(host)
+	s.firstSeen(r, domain)
+	if s.cfg.NewDomainAge <= 0 {
+		return ""
+	}
+
+	registered, fresh := s.registeredAt(domain)
+	if registered.IsZero() || time.Since(registered) >= time.Duration(s.cfg.NewDomainAge)*24*time.Hour {
+		return ""
+	}
+	if fresh {
+		s.domains.young.Add(1)
+		s.log.Warn("%s was registered %s, less than %d days ago", domain, registered.Format("2006-01-02"), s.cfg.NewDomainAge)
+		s.emit(r, "young-domain", domain, "registered "+registered.Format("2006-01-02"))
+	}
+	if s.cfg.NewDomainPolicy == "block" {
+		return "young-domain:" + domain
+	}
+	return ""
+}
+
+// firstSeen looks domain up in the history, reporting it if it is new
+func (s *Server) firstSeen(r *http.Request, domain string) {
+	s.domains.mutex.Lock()
+	_, known := s.domains.seen[domain]
+	s.domains.mutex.Unlock()
+	if known {
+		return
+	}
+
+	first, isNew, err := s.domains.history.FirstSeen(domain, time.Now())
+	if err != nil {
+		s.log.Warn("Error recording first sighting of %s: %v", domain, err)
+		return
+	}
+	s.domains.mutex.Lock()
+	if len(s.domains.seen) >= domainCacheMax {
+		s.domains.seen = make(map[string]time.Time)
+	}
+	s.domains.seen[domain] = first
+	s.domains.mutex.Unlock()
+	if isNew {
+		s.domains.found.Add(1)
+		s.log.Info("New domain: %s", domain)
+		s.emit(r, "new-domain", domain, "")
+	}
+}
+
+// registeredAt returns when domain was registered, zero if unknown, and
+// whether it was just looked up rather than cached
+func (s *Server) registeredAt(domain string) (time.Time, bool) {
+	s.domains.mutex.Lock()
+	age, ok := s.domains.ages[domain]
+	s.domains.mutex.Unlock()
+	if ok && (time.Since(age.checked) < domainAgeRetry || (!age.registered.IsZero() && time.Since(age.checked) < domainAgeExpiry)) {
+		return age.registered, false
+	}
+
+	registered, err := s.lookupRegistration(domain)
+	if err != nil {
+		s.domains.failures.Add(1)
+		s.log.Debug("Registration lookup of %s failed: %v", domain, err)
+	}
+	s.domains.mutex.Lock()
+	if len(s.domains.ages) >= domainCacheMax {
+		s.domains.ages = make(map[string]domainAge)
+	}
+	s.domains.ages[domain] = domainAge{registered: registered, checked: time.Now()}
+	s.domains.mutex.Unlock()
+	return registered, true
+}
+
+// rdapResponse is the part of an RDAP domain response holding its events
+type rdapResponse struct {
+	Events []struct {
+		Action string    `json:"eventAction"`
+		Date   time.Time `json:"eventDate"`
+	} `json:"events"`
+}
+
+// lookupRegistration asks the -rdap-url service when domain was registered
+func (s *Server) lookupRegistration(domain string) (time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, s.cfg.RDAPURL+domain, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("RDAP returned status %d", resp.StatusCode)
+	}
+
+	var rdap rdapResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rdap); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse RDAP response: %w", err)
+	}
+	for _, event := range rdap.Events {
+		if event.Action == "registration" {
+			return event.Date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("RDAP response has no registration date")
+}
+
+// HandleNewDomains lists the destination domains first seen within
+// ?since= (a duration, 24h by default)
+func (s *Server) HandleNewDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	period := 24 * time.Hour
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if period, err = time.ParseDuration(value); err != nil || period <= 0 {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	since := time.Now().Add(-period)
+	domains, err := s.domains.history.Since(since)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get new domains: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := NewDomainsResponse{
+		Domains:        make([]NewDomain, 0, len(domains)),
+		Since:          since,
+		NewDomains:     s.domains.found.Load(),
+		YoungDomains:   s.domains.young.Load(),
+		LookupFailures: s.domains.failures.Load(),
+	}
+	s.domains.mutex.Lock()
+	for domain, first := range domains {
+		entry := NewDomain{Domain: domain, FirstSeen: first}
+		if age := s.domains.ages[domain]; !age.registered.IsZero() {
+			entry.Registered = &age.registered
+		}
+		response.Domains = append(response.Domains, entry)
+	}
+	s.domains.mutex.Unlock()
+	sort.Slice(response.Domains, func(i, j int) bool {
+		return response.Domains[i].FirstSeen.After(response.Domains[j].FirstSeen)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warnMaxInput is the largest HTML body a warning banner is injected into;
+// larger pages pass through untouched
+const warnMaxInput = 4 << 20
+
+// warningBanner is inserted at the start of the <body> of HTML pages
+var warningBanner = template.Must(template.New("banner").Parse(
+	`<div style="position:sticky;top:0;z-index:2147483647;margin:0;padding:8px 12px;background:#ffcc00;color:#222;font:14px/1.4 sans-serif;text-align:center;border-bottom:1px solid #b38f00">{{.}}</div>`))
+
+// warningPage is the interstitial shown before a page while a warning is
+// pending. Continuing loads the page; the interstitial returns after
+// -warn-interval.
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Heads up</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; text-align: center">
+<h1>Heads up</h1>
+<p>{{.Message}}</p>
+<p><a href="{{.URL}}" style="font-size: 1.2em">Continue to {{.Host}}</a></p>
+</body>
+</html>
+`))
+
+// warningPageData is the data warningPage is executed with
+type warningPageData struct {
+	Message string
+	URL     string
+	Host    string
+}
+
+// warnings tracks when each client last saw the warning interstitial
+type warnings struct {
+	mutex sync.Mutex
+	shown map[string]time.Time // By client (user or IP)
+}
+
+// clientWarning returns advance notice for user at remoteAddr of a pause
+// starting within -warn-before or of a data quota -warn-quota percent
+// used, or "" if there is nothing to warn about
+func (s *Server) clientWarning(user, remoteAddr string, now time.Time) string {
+	if start := s.nextPause(user, remoteAddr, now, s.cfg.WarnBefore); !start.IsZero() {
+		minutes := int(start.Sub(now).Round(time.Minute).Minutes())
+		return fmt.Sprintf("Internet access will be paused at %s (in %d minutes).", start.Format("15:04"), max(minutes, 1))
+	}
+
+	s.quotas.mutex.Lock()
+	defer s.quotas.mutex.Unlock()
+	rule := s.quotas.quotaFor(user, remoteAddr)
+	if rule == nil {
+		return ""
+	}
+	usage := s.quotas.current(clientKey(user, remoteAddr), rule, now)
+	percent := usage.Bytes * 100 / rule.limit
+	if percent < int64(s.cfg.WarnQuota) || percent >= 100 {
+		return ""
+	}
+	return fmt.Sprintf("You have used %d%% of your %s data quota. It resets %s.",
+		percent, formatGB(uint64(rule.limit)), rule.cycle.next(usage.Start).Format("Mon Jan 2 15:04"))
+}
+
+// nextPause returns when the first pause of user at remoteAddr starting
+// within lead of now begins, or the zero time if none does
+func (s *Server) nextPause(user, remoteAddr string, now time.Time, lead time.Duration) time.Time {
+	if lead <= 0 {
+		return time.Time{}
+	}
+	var next time.Time
+	s.pauses.mutex.RLock()
+	defer s.pauses.mutex.RUnlock()
+	for _, schedule := range s.pauses.schedules {
+		if !schedule.clients.match(user, remoteAddr) || !schedule.activeUntil(now).IsZero() {
+			continue
+		}
+		// A pause starting within lead starts today or, close to midnight,
+		// tomorrow
+		for days := 0; days <= 1; days++ {
+			day := now.AddDate(0, 0, days)
+			start := time.Date(day.Year(), day.Month(), day.Day(), schedule.from/60, schedule.from%60, 0, 0, time.Local)
+			if start.After(now) && !start.After(now.Add(lead)) && schedule.runsOn(start) &&
+				(next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return next
+}
+
+// warnMode reports whether -warn includes mode
+func (s *Server) warnMode(mode string) bool {
+	for _, item := range splitList(s.cfg.Warn) {
+		if item == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// warnInterstitial answers a page load of a client with a pending warning
+// with the warning interstitial, at most once per -warn-interval, and
+// reports whether it did. Only top-level page loads qualify, so images
+// and scripts are never replaced.
+func (s *Server) warnInterstitial(w http.ResponseWriter, r *http.Request, user string) bool {
+	if !s.warnMode("interstitial") || r.Method != http.MethodGet || wantsJSON(r) ||
+		!strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" && dest != "document" {
+		return false
+	}
+	now := time.Now()
+	client := clientKey(user, r.RemoteAddr)
+	s.warnings.mutex.Lock()
+	last, ok := s.warnings.shown[client]
+	s.warnings.mutex.Unlock()
+	if ok && now.Sub(last) < s.cfg.WarnInterval {
+		return false
+	}
+	message := s.clientWarning(user, r.RemoteAddr, now)
+	if message == "" {
+		return false
+	}
+
+	s.warnings.mutex.Lock()
+	if s.warnings.shown == nil {
+		s.warnings.shown = make(map[string]time.Time)
+	}
+	for key, at := range s.warnings.shown {
+		if now.Sub(at) >= s.cfg.WarnInterval {
+			delete(s.warnings.shown, key)
+		}
+	}
+	s.warnings.shown[client] = now
+	s.warnings.mutex.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	warningPage.Execute(w, warningPageData{Message: message, URL: r.URL.String(), Host: r.URL.Hostname()})
+	return true
+}
+
+// injectWarning inserts a banner with the client's pending warning at the
+// start of an HTML resp, if -warn-rewrite-pages allows it. Only plain HTTP
+// responses pass through the proxy readable; HTTPS stays inside CONNECT
+// tunnels, as there is no TLS interception.
+func (s *Server) injectWarning(r *http.Request, resp *http.Response, user string) {
+	if !s.warnMode("banner") || !s.cfg.WarnRewritePages || r.Method != http.MethodGet || !bannerAllowed(resp) {
+		return
+	}
+	message := s.clientWarning(user, r.RemoteAddr, time.Now())
+	if message == "" {
+		return
+	}
+	injectBanner(resp, message)
+}
+
+// bannerAllowed reports whether resp is a whole, unencoded HTML page of at
+// most warnMaxInput bytes that the origin allows to be transformed
+func bannerAllowed(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" ||
+		resp.Header.Get("Content-Range") != "" || headerHasToken(resp.Header, "Cache-Control", "no-transform") {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/html" && resp.ContentLength <= warnMaxInput
+}
+
+// injectBanner inserts the warning banner with message into the page in
+// resp, leaving pages longer than warnMaxInput untouched
+func injectBanner(resp *http.Response, message string) {
+	original, err := io.ReadAll(io.LimitReader(resp.Body, warnMaxInput+1))
+	if err != nil || len(original) > warnMaxInput {
+		resp.Body = replacedBody{io.MultiReader(bytes.NewReader(original), resp.Body), resp.Body}
+		return
+	}
+	var banner bytes.Buffer
+	warningBanner.Execute(&banner, message)
+	injected := insertAfterBody(original, banner.Bytes())
+
+	resp.Body = replacedBody{bytes.NewReader(injected), resp.Body}
+	resp.ContentLength = int64(len(injected))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(injected)))
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Del("Accept-Ranges")
+	resp.Header.Del("ETag")
+	resp.Header.Del("Last-Modified")
+}
+
+// insertAfterBody inserts html right after the <body> tag of page, or at
+// its start if it has none
+func insertAfterBody(page, html []byte) []byte {
+	at := 0
+	if i := bytes.Index(bytes.ToLower(page), []byte("<body")); i >= 0 {
+		if end := bytes.IndexByte(page[i:], '>'); end >= 0 {
+			at = i + end + 1
+		}
+	}
+	result := make([]byte, 0, len(page)+len(html))
+	result = append(result, page[:at]...)
+	result = append(result, html...)
+	return append(result, page[at:]...)
+}
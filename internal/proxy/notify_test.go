@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-proxy/internal/config"
+)
+
+func TestInsertAfterBody(t *testing.T) {
+	tests := []struct {
+		page, want string
+	}{
+		{"<html><body><p>hi</p></body></html>", "<html><body>[B]<p>hi</p></body></html>"},
+		{`<HTML><BODY class="x"><p>hi</p>`, `<HTML><BODY class="x">[B]<p>hi</p>`},
+		{"<p>no body tag</p>", "[B]<p>no body tag</p>"},
+		{"<html><body", "[B]<html><body"}, // Unterminated tag
+		{"", "[B]"},
+	}
+	for _, test := range tests {
+		if got := string(insertAfterBody([]byte(test.page), []byte("[B]"))); got != test.want {
+			t.Errorf("insertAfterBody(%q) = %q, want %q", test.page, got, test.want)
+		}
+	}
+}
+
+// htmlResponse returns a 200 response with an HTML page of body
+func htmlResponse(body string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp
+}
+
+func TestBannerAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*http.Response)
+		want   bool
+	}{
+		{"plain page", func(*http.Response) {}, true},
+		{"unknown length", func(resp *http.Response) { resp.ContentLength = -1 }, true},
+		{"no-transform", func(resp *http.Response) { resp.Header.Set("Cache-Control", "public, no-transform") }, false},
+		{"compressed", func(resp *http.Response) { resp.Header.Set("Content-Encoding", "gzip") }, false},
+		{"partial", func(resp *http.Response) { resp.Header.Set("Content-Range", "bytes 0-9/100") }, false},
+		{"oversize", func(resp *http.Response) { resp.ContentLength = warnMaxInput + 1 }, false},
+		{"not HTML", func(resp *http.Response) { resp.Header.Set("Content-Type", "application/json") }, false},
+		{"not 200", func(resp *http.Response) { resp.StatusCode = http.StatusNotFound }, false},
+	}
+	for _, test := range tests {
+		resp := htmlResponse("<body></body>")
+		test.change(resp)
+		if got := bannerAllowed(resp); got != test.want {
+			t.Errorf("%s: bannerAllowed = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInjectBanner(t *testing.T) {
+	resp := htmlResponse("<html><body><p>page</p></body></html>")
+	resp.Header.Set("ETag", `"abc"`)
+	injectBanner(resp, "Paused at 21:00")
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Contains(body, []byte("<body><div")) || !bytes.Contains(body, []byte("Paused at 21:00</div><p>page</p>")) {
+		t.Errorf("banner not inserted after <body>: %s", body)
+	}
+	if resp.ContentLength != int64(len(body)) || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("length %d (header %s) for a %d byte body", resp.ContentLength, resp.Header.Get("Content-Length"), len(body))
+	}
+	if resp.Header.Get("ETag") != "" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("validators kept or caching allowed: %v", resp.Header)
+	}
+
+	// Pages without a declared length that turn out too long pass through
+	page := "<body>" + strings.Repeat("x", warnMaxInput)
+	resp = htmlResponse(page)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	injectBanner(resp, "Paused at 21:00")
+	if body, _ := io.ReadAll(resp.Body); string(body) != page || resp.ContentLength != -1 {
+		t.Errorf("oversize page changed: %d bytes, length %d", len(body), resp.ContentLength)
+	}
+}
+
+func TestInjectWarningNeedsOptIn(t *testing.T) {
+	s := &Server{cfg: &config.Config{Warn: "banner"}}
+	page := "<html><body></body></html>"
+	resp := htmlResponse(page)
+	s.injectWarning(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), resp, "")
+	if body, _ := io.ReadAll(resp.Body); string(body) != page {
+		t.Errorf("page changed without -warn-rewrite-pages: %s", body)
+	}
+}
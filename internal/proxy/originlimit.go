@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// errOriginBusy refuses a connection to an origin at its concurrency cap
+var errOriginBusy = errors.New("too many connections to this origin")
+
+// originLimitRule caps the concurrent connections to hosts matching a glob
+type originLimitRule struct {
+	host  string
+	limit int // 0 for no cap
+}
+
+// originLimits counts the open connections to each origin host and
+// refuses new ones over its cap
+type originLimits struct {
+	mutex    sync.Mutex
+	rules    []originLimitRule
+	open     map[string]int // Host -> open connections
+	rejected atomic.Int64
+}
+
+// OriginLimitsResponse lists the origins with the most open connections
+type OriginLimitsResponse struct {
+	Origins  []OriginConnections `json:"origins"`
+	Default  int                 `json:"default"` // -origin-conn-limit
+	Rejected int64               `json:"rejected"`
+}
+
+// OriginConnections is the number of open connections to an origin host
+type OriginConnections struct {
+	Host  string `json:"host"`
+	Open  int    `json:"open"`
+	Limit int    `json:"limit"` // 0 for no cap
+}
+
+// loadOriginLimitRules reads an origin limits file. Each line is
+//
+//	<host glob> <limit>
+//
+// and the first matching line sets the cap on concurrent connections to a
+// host, 0 lifting it, e.g.
+//
+//	*.googlevideo.com 2000
+//	updates.example.com 20
+func loadOriginLimitRules(filename string) ([]originLimitRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open origin limits file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []originLimitRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("origin limits line %d: want <host glob> <limit>", lineNo)
+		}
+		host := strings.ToLower(fields[0])
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("origin limits line %d: invalid host %q", lineNo, fields[0])
+		}
+		limit, err := strconv.Atoi(fields[1])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("origin limits line %d: invalid limit %q", lineNo, fields[1])
+		}
+		rules = append(rules, originLimitRule{host: host, limit: limit})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read origin limits file: %v", err)
+	}
+	return rules, nil
+}
+
+// loadOriginLimits reads the per-host caps in path and returns the
+// function swapping them in, which removes them if path is empty
+func (s *Server) loadOriginLimits(path string) (func(), error) {
+	var rules []originLimitRule
+	if path != "" {
+		var err error
+		if rules, err = loadOriginLimitRules(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.origins.mutex.Lock()
+		s.origins.rules = rules
+		s.origins.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d origin connection limits", len(rules))
+		}
+	}, nil
+}
+
+// originLimit returns the cap on connections to host. Callers must hold
+// the origins mutex.
+func (s *Server) originLimit(host string) int {
+	for _, rule := range s.origins.rules {
+		if ok, _ := path.Match(rule.host, host); ok {
+			return rule.limit
+		}
+	}
+	return s.cfg.OriginConnLimit
+}
+
+// acquireOrigin counts a new connection to host, failing with
+// errOriginBusy if host is at its cap
+func (s *Server) acquireOrigin(host string) error {
+	host = strings.ToLower(host)
+	s.origins.mutex.Lock()
+	defer s.origins.mutex.Unlock()
+	limit := s.originLimit(host)
+	if limit == 0 {
+		return nil
+	}
+	if s.origins.open == nil {
+		s.origins.open = make(map[string]int)
+	}
+	if s.origins.open[host] >= limit {
+		if s.origins.rejected.Add(1)%100 == 1 {
+			s.log.Warn("Refusing connections to %s: %d open, the limit", host, limit)
+		}
+		return fmt.Errorf("%s: %w", host, errOriginBusy)
+	}
+	s.origins.open[host]++
+	return nil
+}
+
+// releaseOrigin counts a connection to host acquired with acquireOrigin
+// as closed
+func (s *Server) releaseOrigin(host string) {
+	host = strings.ToLower(host)
+	s.origins.mutex.Lock()
+	defer s.origins.mutex.Unlock()
+	if n, ok := s.origins.open[host]; ok {
+		if n <= 1 {
+			delete(s.origins.open, host)
+		} else {
+			s.origins.open[host] = n - 1
+		}
+	}
+}
+
+// originConn releases its origin's connection count once when closed
+type originConn struct {
+	net.Conn
+	s    *Server
+	host string
+	once sync.Once
+}
+
+func (c *originConn) Close() error {
+	c.once.Do(func() { c.s.releaseOrigin(c.host) })
+	return c.Conn.Close()
+}
+
+// NetConn returns the connection to the origin
+func (c *originConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// HandleOriginLimits lists the ?limit= (default 50) origins with the most
+// open connections and their caps
+func (s *Server) HandleOriginLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	response := OriginLimitsResponse{
+		Origins:  []OriginConnections{},
+		Default:  s.cfg.OriginConnLimit,
+		Rejected: s.origins.rejected.Load(),
+	}
+	s.origins.mutex.Lock()
+	for host, open := range s.origins.open {
+		response.Origins = append(response.Origins, OriginConnections{Host: host, Open: open, Limit: s.originLimit(host)})
+	}
+	s.origins.mutex.Unlock()
+	sort.Slice(response.Origins, func(i, j int) bool {
+		if response.Origins[i].Open != response.Origins[j].Open {
+			return response.Origins[i].Open > response.Origins[j].Open
+		}
+		return response.Origins[i].Host < response.Origins[j].Host
+	})
+	if len(response.Origins) > limit {
+		response.Origins = response.Origins[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
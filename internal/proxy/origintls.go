@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// originTLSHostsMax bounds the hosts verification failures are kept for
+const originTLSHostsMax = 1000
+
+// originTLSVersions are the -origin-tls-min values
+var originTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// originTLS is how the proxy verifies origins it connects to over TLS
+// itself, for https:// URLs requested as plain proxy requests. CONNECT
+// tunnels are end to end and never checked.
+type originTLS struct {
+	config *tls.Config
+
+	pinsMutex sync.RWMutex
+	pins      []originPin
+
+	mutex    sync.Mutex
+	failures map[string]*OriginTLSFailure // By host
+}
+
+// originPin lists the public keys a host's certificate chain must include
+// one of
+type originPin struct {
+	host   string // Host name, or *.domain for its subdomains
+	hashes map[string]bool
+}
+
+// pinMismatchError fails handshakes with origins whose certificate chain
+// has none of their pinned keys
+type pinMismatchError struct {
+	host string
+}
+
+func (e pinMismatchError) Error() string {
+	return fmt.Sprintf("certificate of %s matches none of its -origin-pins", e.host)
+}
+
+// OriginTLSFailure counts the failed TLS verifications of an origin
+type OriginTLSFailure struct {
+	Host      string    `json:"host"`
+	Reason    string    `json:"reason"` // Of the last failure: see originTLSReason
+	Error     string    `json:"error"`  // Last failure
+	Failures  int64     `json:"failures"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// newOriginTLSConfig returns the TLS settings of origin connections:
+// certificates signed by the system roots or by a CA of the caFile bundle,
+// at least minVersion, and the -origin-pins checked on every handshake,
+// which -cert-watch also sees. If the bundle cannot be read the config
+// only trusts the system roots, along with the error.
+func (s *Server) newOriginTLSConfig(caFile, minVersion string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: originTLSVersions[minVersion],
+		VerifyConnection: func(state tls.ConnectionState) error {
+			s.observeCert(strings.ToLower(state.ServerName), state.PeerCertificates)
+			return s.verifyOriginPins(state)
+		},
+	}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return config, fmt.Errorf("failed to read origin CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return config, fmt.Errorf("no certificates in origin CA bundle %s", caFile)
+	}
+	config.RootCAs = pool
+	s.log.Info("Trusting the CAs of %s for origin connections", caFile)
+	return config, nil
+}
+
+// loadOriginPinFile reads a file of
+//
+//	<host|*.domain> sha256/<base64> [sha256/<base64>...]
+//
+// lines pinning hosts to public keys: the SHA-256 of a certificate's
+// SubjectPublicKeyInfo, as in HPKP, which one of the certificates the
+// host presents must have. Pins of a host take precedence over those of
+// its domains. Hosts are matched by the name sent in SNI, so origins
+// requested by IP address cannot be pinned.
+func loadOriginPinFile(filename string) ([]originPin, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open origin pins file: %v", err)
+	}
+	defer file.Close()
+
+	var pins []originPin
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("origin pins line %d: want <host> sha256/<base64> [...]", lineNo)
+		}
+		pin := originPin{host: strings.ToLower(strings.TrimSuffix(fields[0], ".")), hashes: make(map[string]bool)}
+		for _, field := range fields[1:] {
+			hash, ok := strings.CutPrefix(field, "sha256/")
+			decoded, err := base64.StdEncoding.DecodeString(hash)
+			if !ok || err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("origin pins line %d: invalid pin %q, want sha256/<base64 SHA-256>", lineNo, field)
+			}
+			pin.hashes[hash] = true
+		}
+		pins = append(pins, pin)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read origin pins file: %v", err)
+	}
+	return pins, nil
+}
+
+// loadOriginPins reads the origin pins in path and returns the function
+// swapping them in, which removes them if path is empty
+func (s *Server) loadOriginPins(path string) (func(), error) {
+	var pins []originPin
+	if path != "" {
+		var err error
+		if pins, err = loadOriginPinFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.originTLS.pinsMutex.Lock()
+		s.originTLS.pins = pins
+		s.originTLS.pinsMutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded public key pins of %d origins", len(pins))
+		}
+	}, nil
+}
+
+// pinsFor returns the pinned key hashes of host, nil if it has none
+func (o *originTLS) pinsFor(host string) map[string]bool {
+	o.pinsMutex.RLock()
+	defer o.pinsMutex.RUnlock()
+	var domain map[string]bool
+	for _, pin := range o.pins {
+		if pin.host == host {
+			return pin.hashes
+		}
+		if suffix, ok := strings.CutPrefix(pin.host, "*"); ok && strings.HasSuffix(host, suffix) && domain == nil {
+			domain = pin.hashes
+		}
+	}
+	return domain
+}
+
+// verifyOriginPins is the VerifyConnection of origin connections, run once
+// the certificate chain is verified: the chain must include a key pinned
+// for the host, if any are
+func (s *Server) verifyOriginPins(state tls.ConnectionState) error {
+	host := strings.ToLower(state.ServerName)
+	hashes := s.originTLS.pinsFor(host)
+	if hashes == nil {
+		return nil
+	}
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if hashes[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+	}
+	return pinMismatchError{host: host}
+}
+
+// originTLSReason names why a TLS connection to an origin failed:
+// untrusted (unknown CA), hostname, expired, invalid (another certificate
+// problem), pin, version (below -origin-tls-min or unsupported) or
+// handshake
+func originTLSReason(err error) string {
+	var pinErr pinMismatchError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var alertErr tls.AlertError
+	switch {
+	case errors.As(err, &pinErr):
+		return "pin"
+	case errors.As(err, &authorityErr):
+		return "untrusted"
+	case errors.As(err, &hostnameErr):
+		return "hostname"
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "expired"
+	case errors.As(err, &invalidErr):
+		return "invalid"
+	case errors.As(err, &alertErr) && alertErr == 70, // protocol_version
+		strings.Contains(err.Error(), "protocol version"):
+		return "version"
+	}
+	return "handshake"
+}
+
+// recordOriginTLSFailure notes that a TLS connection to host failed with
+// err, for the verification report
+func (s *Server) recordOriginTLSFailure(host string, err error) {
+	reason := originTLSReason(err)
+	now := time.Now()
+	o := &s.originTLS
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	failure, ok := o.failures[host]
+	if !ok {
+		if o.failures == nil {
+			o.failures = make(map[string]*OriginTLSFailure)
+		}
+		if len(o.failures) >= originTLSHostsMax {
+			return
+		}
+		failure = &OriginTLSFailure{Host: host, FirstSeen: now}
+		o.failures[host] = failure
+		s.log.Warn("TLS verification of origin %s failed (%s): %v", host, reason, err)
+	}
+	failure.Reason = reason
+	failure.Error = err.Error()
+	failure.Failures++
+	failure.LastSeen = now
+}
+
+// HandleOriginTLS reports the origins whose TLS verification failed since
+// startup, most recent first
+func (s *Server) HandleOriginTLS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	failures := []OriginTLSFailure{}
+	s.originTLS.mutex.Lock()
+	for _, failure := range s.originTLS.failures {
+		failures = append(failures, *failure)
+	}
+	s.originTLS.mutex.Unlock()
+	sort.Slice(failures, func(i, j int) bool {
+		if !failures[i].LastSeen.Equal(failures[j].LastSeen) {
+			return failures[i].LastSeen.After(failures[j].LastSeen)
+		}
+		return failures[i].Host < failures[j].Host
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failures)
+}
@@ -0,0 +1,396 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pauseRulePrefix starts the blocking rule of paused clients; the end of
+// the pause follows in RFC 3339
+const pauseRulePrefix = "pause:"
+
+// weekdays are the day names of -pause-schedule, in time.Weekday order
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// pausedPage is the block page of paused clients unless the -error-pages
+// directory has a 403.html. It counts down to the end of the pause and
+// reloads then.
+var pausedPage = template.Must(template.New("paused").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Internet paused</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; text-align: center">
+<h1>Internet paused</h1>
+<p>Internet access is paused until {{.Until.Format "15:04"}}.</p>
+<p style="font-size: 3em" id="left">{{.Left}}</p>
+<script>
+var until = {{.Until.UnixMilli}};
+function tick() {
+	var left = Math.max(0, Math.ceil((until - Date.now()) / 1000));
+	if (left == 0) { location.reload(); return; }
+	var h = Math.floor(left / 3600), m = Math.floor(left / 60) % 60, s = left % 60;
+	document.getElementById("left").textContent = (h ? h + ":" + String(m).padStart(2, "0") : m) + ":" + String(s).padStart(2, "0");
+	setTimeout(tick, 1000);
+}
+tick();
+</script>
+</body>
+</html>
+`))
+
+// pausedPageData is the data pausedPage is executed with
+type pausedPageData struct {
+	Until time.Time
+	Left  string // Time left when the page was sent
+}
+
+// pauseSchedule pauses clients on days between two times of day, in local
+// time. A schedule with to before from runs past midnight. With a
+// calendar it only runs on the days in it, or with except on the others.
+type pauseSchedule struct {
+	spec     string // Clients as written in the schedule file
+	clients  clientSet
+	days     [7]bool // By time.Weekday
+	from, to int     // Minutes since midnight
+	calendar *calendar
+	except   bool
+}
+
+// pauses are the clients whose internet access is paused, for N minutes
+// through the API or on a schedule
+type pauses struct {
+	mutex     sync.RWMutex
+	manual    map[string]manualPause // Client (IP, CIDR or user) -> its pause
+	schedules []pauseSchedule
+}
+
+// manualPause is a pause started through the API
+type manualPause struct {
+	clients clientSet
+	until   time.Time
+}
+
+// Pause is a client paused through the API
+type Pause struct {
+	Client      string    `json:"client"`
+	Until       time.Time `json:"until"`
+	SecondsLeft int64     `json:"seconds_left"`
+}
+
+// PauseScheduleStatus is a -pause-schedule entry
+type PauseScheduleStatus struct {
+	Clients  string     `json:"clients"`
+	Days     string     `json:"days"`
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Calendar string     `json:"calendar,omitempty"` // Calendar the schedule runs on, or with ! does not
+	Until    *time.Time `json:"until,omitempty"`    // Set while the schedule pauses its clients
+}
+
+// PausesResponse lists the pauses and pause schedules, and the calendars
+// schedules can refer to
+type PausesResponse struct {
+	Pauses    []Pause               `json:"pauses"`
+	Schedules []PauseScheduleStatus `json:"schedules"`
+	Calendars []CalendarStatus      `json:"calendars"`
+}
+
+// loadPauseSchedule reads a file of
+//
+//	<clients> <days> <HH:MM>-<HH:MM> [[!]<calendar>]
+//
+// lines, where clients is a comma separated list of users, IPs and CIDRs
+// and days a comma separated list of day names or ranges, or * for every
+// day. A line naming one of calendars only applies on the days in it, or
+// with ! on the days not in it, e.g.
+//
+//	kids,192.168.1.40  mon-thu,sun  21:00-07:00  !school-holidays
+//	alice              *            12:30-13:30
+func loadPauseSchedule(filename string, calendars map[string]*calendar) ([]pauseSchedule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pause schedule: %v", err)
+	}
+	defer file.Close()
+
+	var schedules []pauseSchedule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("pause schedule line %d: want <clients> <days> <HH:MM>-<HH:MM> [[!]<calendar>]", lineNo)
+		}
+		schedule := pauseSchedule{spec: fields[0], clients: parseClientSet(fields[0])}
+		if schedule.days, err = parseDays(fields[1]); err != nil {
+			return nil, fmt.Errorf("pause schedule line %d: %v", lineNo, err)
+		}
+		from, to, ok := strings.Cut(fields[2], "-")
+		if schedule.from, err = parseTimeOfDay(from); ok && err == nil {
+			schedule.to, err = parseTimeOfDay(to)
+		}
+		if !ok || err != nil || schedule.from == schedule.to {
+			return nil, fmt.Errorf("pause schedule line %d: invalid times %q", lineNo, fields[2])
+		}
+		if len(fields) == 4 {
+			name, except := strings.CutPrefix(fields[3], "!")
+			if schedule.calendar = calendars[name]; schedule.calendar == nil {
+				return nil, fmt.Errorf("pause schedule line %d: unknown calendar %q (see -calendars)", lineNo, name)
+			}
+			schedule.except = except
+		}
+		schedules = append(schedules, schedule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pause schedule: %v", err)
+	}
+	return schedules, nil
+}
+
+// parseDays parses "*" or a comma separated list of days and day ranges
+// such as "mon-fri,sun"
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	if value == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, item := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		from, to := dayIndex(first), dayIndex(last)
+		if from < 0 || to < 0 {
+			return days, fmt.Errorf("invalid days %q", value)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// dayIndex returns the time.Weekday of a day name, or -1
+func dayIndex(name string) int {
+	for i, day := range weekdays {
+		if name == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// runsOn reports whether the schedule starts a pause on the date of day
+func (p pauseSchedule) runsOn(day time.Time) bool {
+	if !p.days[day.Weekday()] {
+		return false
+	}
+	return p.calendar == nil || p.calendar.on(day) != p.except
+}
+
+// activeUntil returns the end of the schedule's pause running at now, or
+// the zero time if it is not running
+func (p pauseSchedule) activeUntil(now time.Time) time.Time {
+	minute := now.Hour()*60 + now.Minute()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	at := func(days, minutes int) time.Time {
+		return midnight.AddDate(0, 0, days).Add(time.Duration(minutes) * time.Minute)
+	}
+	switch {
+	case p.from < p.to:
+		if minute >= p.from && minute < p.to && p.runsOn(now) {
+			return at(0, p.to)
+		}
+	case minute >= p.from && p.runsOn(now):
+		return at(1, p.to)
+	case minute < p.to && p.runsOn(midnight.AddDate(0, 0, -1)):
+		return at(0, p.to)
+	}
+	return time.Time{}
+}
+
+// loadPauses reads the pause schedules in path and returns the function
+// swapping them in, which removes them if path is empty
+func (s *Server) loadPauses(path string) (func(), error) {
+	var schedules []pauseSchedule
+	if path != "" {
+		var err error
+		if schedules, err = loadPauseSchedule(path, s.calendars); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.pauses.mutex.Lock()
+		s.pauses.schedules = schedules
+		s.pauses.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d pause schedules", len(schedules))
+		}
+	}, nil
+}
+
+// pauseRule returns the blocking rule for user at remoteAddr if their
+// internet access is paused, else ""
+func (s *Server) pauseRule(user, remoteAddr string) string {
+	now := time.Now()
+	var until time.Time
+	s.pauses.mutex.RLock()
+	for _, pause := range s.pauses.manual {
+		if pause.until.After(until) && pause.until.After(now) && pause.clients.match(user, remoteAddr) {
+			until = pause.until
+		}
+	}
+	for _, schedule := range s.pauses.schedules {
+		if end := schedule.activeUntil(now); end.After(until) && schedule.clients.match(user, remoteAddr) {
+			until = end
+		}
+	}
+	s.pauses.mutex.RUnlock()
+	if until.IsZero() {
+		return ""
+	}
+	return pauseRulePrefix + until.Format(time.RFC3339)
+}
+
+// writePaused answers a request blocked by the pause ending at until: JSON
+// if the client prefers it, else the configured 403 page, else a page
+// counting down to the end of the pause
+func (s *Server) writePaused(w http.ResponseWriter, r *http.Request, until time.Time) {
+	left := time.Until(until).Round(time.Minute)
+	if left < time.Minute {
+		left = time.Minute
+	}
+	if wantsJSON(r) || s.errorPages[http.StatusForbidden] != nil || r.Method == http.MethodConnect {
+		message := fmt.Sprintf("Internet access is paused until %s (%d minutes left)", until.Format("15:04"), int(left.Minutes()))
+		s.writeError(w, r, http.StatusForbidden, message)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	pausedPage.Execute(w, pausedPageData{
+		Until: until,
+		Left:  fmt.Sprintf("%d min", int(left.Minutes())),
+	})
+}
+
+// HandlePauses lists the paused clients and pause schedules (GET), pauses
+// ?client= (a user, IP or CIDR) for ?minutes= (POST), or resumes it
+// (DELETE)
+func (s *Server) HandlePauses(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	client := query.Get("client")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		minutes, err := strconv.Atoi(query.Get("minutes"))
+		if client == "" || err != nil || minutes <= 0 {
+			http.Error(w, "Want ?client= and ?minutes=", http.StatusBadRequest)
+			return
+		}
+		until := time.Now().Add(time.Duration(minutes) * time.Minute)
+		s.pauses.mutex.Lock()
+		if s.pauses.manual == nil {
+			s.pauses.manual = make(map[string]manualPause)
+		}
+		s.pauses.manual[client] = manualPause{clients: parseClientSet(client), until: until}
+		s.pauses.mutex.Unlock()
+		s.log.Info("Paused internet access for %s until %s", client, until.Format("15:04"))
+	case http.MethodDelete:
+		s.pauses.mutex.Lock()
+		_, ok := s.pauses.manual[client]
+		delete(s.pauses.manual, client)
+		s.pauses.mutex.Unlock()
+		if !ok {
+			http.Error(w, client+" is not paused", http.StatusNotFound)
+			return
+		}
+		s.log.Info("Resumed internet access for %s", client)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	response := PausesResponse{Pauses: []Pause{}, Schedules: []PauseScheduleStatus{}, Calendars: []CalendarStatus{}}
+	s.pauses.mutex.Lock()
+	for client, pause := range s.pauses.manual {
+		if !pause.until.After(now) {
+			delete(s.pauses.manual, client)
+			continue
+		}
+		response.Pauses = append(response.Pauses, Pause{
+			Client:      client,
+			Until:       pause.until,
+			SecondsLeft: int64(math.Ceil(pause.until.Sub(now).Seconds())),
+		})
+	}
+	for _, schedule := range s.pauses.schedules {
+		status := PauseScheduleStatus{
+			Clients: schedule.spec,
+			Days:    scheduleDays(schedule.days),
+			From:    fmt.Sprintf("%02d:%02d", schedule.from/60, schedule.from%60),
+			To:      fmt.Sprintf("%02d:%02d", schedule.to/60, schedule.to%60),
+		}
+		if schedule.calendar != nil {
+			status.Calendar = schedule.calendar.name
+			if schedule.except {
+				status.Calendar = "!" + status.Calendar
+			}
+		}
+		if until := schedule.activeUntil(now); !until.IsZero() {
+			status.Until = &until
+		}
+		response.Schedules = append(response.Schedules, status)
+	}
+	s.pauses.mutex.Unlock()
+	sort.Slice(response.Pauses, func(i, j int) bool { return response.Pauses[i].Client < response.Pauses[j].Client })
+	for _, cal := range s.calendars {
+		response.Calendars = append(response.Calendars, cal.status(now))
+	}
+	sort.Slice(response.Calendars, func(i, j int) bool { return response.Calendars[i].Name < response.Calendars[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// scheduleDays lists the names of the days set in days
+func scheduleDays(days [7]bool) string {
+	var names []string
+	for i, set := range days {
+		if set {
+			names = append(names, weekdays[i])
+		}
+	}
+	if len(names) == len(weekdays) {
+		return "*"
+	}
+	return strings.Join(names, ",")
+}
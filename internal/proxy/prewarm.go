@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	prewarmPort     = "443"            // Most traffic is CONNECT to HTTPS origins
+	prewarmMaxIdle  = 15 * time.Second // Origins close idle connections; replace them before they do
+	prewarmTick     = 5 * time.Second  // How often expired connections are replaced
+	prewarmRefresh  = 10 * time.Minute // How often the top destinations are recomputed
+	prewarmLookback = 7 * 24 * time.Hour
+)
+
+// warmConn is a connection dialed ahead of a request
+type warmConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// prewarmer keeps a connection to each of the busiest origins open so the
+// next CONNECT to them skips DNS and the TCP handshake
+type prewarmer struct {
+	count        int
+	hours        [2]int // Business hours [start, end) in local time; equal for always
+	mutex        sync.Mutex
+	addrs        []string // host:port being warmed
+	conns        map[string]*warmConn
+	hits         atomic.Int64
+	misses       atomic.Int64
+	dials        atomic.Int64
+	expired      atomic.Int64
+	lastSelected time.Time
+}
+
+// PrewarmStats reports how effective pre-warming has been since startup
+type PrewarmStats struct {
+	Destinations []string `json:"destinations"` // Origins currently kept warm
+	Hits         int64    `json:"hits"`         // Requests served by a warm connection
+	Misses       int64    `json:"misses"`       // Requests to a warmed origin that found none ready
+	Dials        int64    `json:"dials"`        // Connections dialed ahead of time
+	Expired      int64    `json:"expired"`      // Warm connections closed unused
+	HitRate      float64  `json:"hit_rate"`
+}
+
+// parseHours parses business hours such as "8-18"; empty means all day
+func parseHours(value string) ([2]int, error) {
+	if value == "" {
+		return [2]int{}, nil
+	}
+	from, to, ok := strings.Cut(value, "-")
+	start, err1 := strconv.Atoi(strings.TrimSpace(from))
+	end, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil || start < 0 || end > 24 || start >= end {
+		return [2]int{}, fmt.Errorf("invalid hours %q: want <start>-<end>, e.g. 8-18", value)
+	}
+	return [2]int{start, end}, nil
+}
+
+// startPrewarm keeps connections to the count busiest origins warm during
+// hours
+func (s *Server) startPrewarm(count int, hours string) {
+	if s.upstreams != nil {
+		s.log.Info("Pre-warming disabled: requests go through -upstreams")
+		return
+	}
+	window, err := parseHours(hours)
+	if err != nil {
+		s.log.Info("Error starting pre-warming: %v", err)
+		return
+	}
+	s.prewarm = &prewarmer{count: count, hours: window, conns: make(map[string]*warmConn)}
+	go s.prewarmLoop()
+}
+
+// prewarmLoop replaces expired warm connections, and periodically picks the
+// destinations to warm, for as long as the process runs
+func (s *Server) prewarmLoop() {
+	ticker := time.NewTicker(prewarmTick)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		p := s.prewarm
+		now := time.Now()
+		if !p.inHours(now) {
+			p.closeAll()
+			continue
+		}
+		if now.Sub(p.lastSelected) >= prewarmRefresh {
+			addrs := s.topDestinations(p.count)
+			p.mutex.Lock()
+			p.addrs = addrs
+			p.lastSelected = now
+			p.mutex.Unlock()
+		}
+		for _, addr := range p.expire(now) {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			conn, err := s.dial(ctx, "tcp", addr, "")
+			cancel()
+			if err != nil {
+				s.log.Debug("Pre-warming %s: %v", addr, err)
+				continue
+			}
+			p.dials.Add(1)
+			p.put(addr, conn)
+		}
+	}
+}
+
+// inHours reports whether now is within the business hours
+func (p *prewarmer) inHours(now time.Time) bool {
+	if p.hours[0] == p.hours[1] {
+		return true
+	}
+	return now.Hour() >= p.hours[0] && now.Hour() < p.hours[1]
+}
+
+// expire closes warm connections that are too old or no longer wanted and
+// returns the destinations that need a new one
+func (p *prewarmer) expire(now time.Time) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	wanted := make(map[string]bool, len(p.addrs))
+	var missing []string
+	for _, addr := range p.addrs {
+		wanted[addr] = true
+		if w, ok := p.conns[addr]; ok && now.Sub(w.dialed) < prewarmMaxIdle {
+			continue
+		}
+		missing = append(missing, addr)
+	}
+	for addr, w := range p.conns {
+		if !wanted[addr] || now.Sub(w.dialed) >= prewarmMaxIdle {
+			w.conn.Close()
+			delete(p.conns, addr)
+			p.expired.Add(1)
+		}
+	}
+	return missing
+}
+
+// put stores a freshly dialed connection to addr
+func (p *prewarmer) put(addr string, conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if old, ok := p.conns[addr]; ok {
+		old.conn.Close()
+	}
+	p.conns[addr] = &warmConn{conn: conn, dialed: time.Now()}
+}
+
+// take returns the warm connection to addr, if there is one
+func (p *prewarmer) take(addr string) net.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	w, ok := p.conns[addr]
+	if !ok || time.Since(w.dialed) >= prewarmMaxIdle {
+		for _, warmed := range p.addrs {
+			if warmed == addr {
+				p.misses.Add(1)
+				break
+			}
+		}
+		return nil
+	}
+	delete(p.conns, addr)
+	p.hits.Add(1)
+	return w.conn
+}
+
+// closeAll closes every warm connection, e.g. outside business hours
+func (p *prewarmer) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr, w := range p.conns {
+		w.conn.Close()
+		delete(p.conns, addr)
+		p.expired.Add(1)
+	}
+}
+
+// topDestinations returns the HTTPS addresses of the count unblocked hosts
+// with the most connections over the last week, from the stats store and
+// the counters not yet saved to it
+func (s *Server) topDestinations(count int) []string {
+	connections := make(map[string]int64)
+	if s.store != nil {
+		now := time.Now()
+		_, records, err := s.store.GetDailyStats(now.Add(-prewarmLookback), now, "", "day")
+		if err != nil {
+			s.log.Debug("Pre-warming: failed to read stats: %v", err)
+		}
+		for _, record := range records {
+			if !record.Blocked {
+				connections[record.Host] += record.Connections
+			}
+		}
+	}
+	s.statsMutex.RLock()
+	for host, hostStats := range s.stats.HostStats {
+		if !hostStats.Blocked {
+			connections[host] += hostStats.Connections
+		}
+	}
+	s.statsMutex.RUnlock()
+
+	hosts := make([]string, 0, len(connections))
+	for host := range connections {
+		if host != "" && !s.isBlocked(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if connections[hosts[i]] != connections[hosts[j]] {
+			return connections[hosts[i]] > connections[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) > count {
+		hosts = hosts[:count]
+	}
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, prewarmPort)
+	}
+	return addrs
+}
+
+// PrewarmStats returns the pre-warming counters
+func (s *Server) PrewarmStats() PrewarmStats {
+	result := PrewarmStats{Destinations: []string{}}
+	p := s.prewarm
+	if p == nil {
+		return result
+	}
+	p.mutex.Lock()
+	result.Destinations = append(result.Destinations, p.addrs...)
+	p.mutex.Unlock()
+	result.Hits = p.hits.Load()
+	result.Misses = p.misses.Load()
+	result.Dials = p.dials.Load()
+	result.Expired = p.expired.Load()
+	if total := result.Hits + result.Misses; total > 0 {
+		result.HitRate = float64(result.Hits) / float64(total)
+	}
+	return result
+}
+
+// HandlePrewarmStats serves PrewarmStats as JSON
+func (s *Server) HandlePrewarmStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.PrewarmStats())
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"go-proxy/internal/adblock"
+)
+
+// privacyCounters count what privacy mode removed
+type privacyCounters struct {
+	params     atomic.Int64
+	cookies    atomic.Int64
+	setCookies atomic.Int64
+}
+
+// PrivacyStats reports what privacy mode has stripped since startup
+type PrivacyStats struct {
+	TrackingParams int64 `json:"tracking_params"` // Query parameters removed
+	Cookies        int64 `json:"cookies"`         // Cookie headers withheld from third parties
+	SetCookies     int64 `json:"set_cookies"`     // Set-Cookie headers dropped from third parties
+}
+
+// PrivacyStats returns the privacy mode counters
+func (s *Server) PrivacyStats() PrivacyStats {
+	return PrivacyStats{
+		TrackingParams: s.privacy.params.Load(),
+		Cookies:        s.privacy.cookies.Load(),
+		SetCookies:     s.privacy.setCookies.Load(),
+	}
+}
+
+// HandlePrivacyStats serves PrivacyStats as JSON
+func (s *Server) HandlePrivacyStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.PrivacyStats())
+}
+
+// applyPrivacy removes tracking parameters from the URL of the forwarded
+// request outReq and withholds cookies from third-party requests
+func (s *Server) applyPrivacy(outReq *http.Request) {
+	if !s.cfg.Privacy {
+		return
+	}
+
+	if outReq.URL.RawQuery != "" {
+		query, removed := stripParams(outReq.URL.RawQuery, s.trackingParams)
+		if removed > 0 {
+			u := *outReq.URL
+			u.RawQuery = query
+			outReq.URL = &u
+			s.privacy.params.Add(int64(removed))
+		}
+	}
+
+	if outReq.Header.Get("Cookie") != "" && thirdPartyRequest(outReq, outReq.URL.Hostname()) {
+		outReq.Header.Del("Cookie")
+		s.privacy.cookies.Add(1)
+	}
+}
+
+// stripThirdPartySetCookies keeps third-party responses from setting
+// cookies in privacy mode
+func (s *Server) stripThirdPartySetCookies(r *http.Request, resp *http.Response, host string) {
+	if !s.cfg.Privacy {
+		return
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 && thirdPartyRequest(r, host) {
+		resp.Header.Del("Set-Cookie")
+		s.privacy.setCookies.Add(int64(len(cookies)))
+	}
+}
+
+// thirdPartyRequest reports whether r was made by a page on another site,
+// judged by its Referer; requests without one are first-party
+func thirdPartyRequest(r *http.Request, host string) bool {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Hostname() == "" {
+		return false
+	}
+	return adblock.ThirdParty(host, ref.Hostname())
+}
+
+// stripParams removes the parameters matching patterns from a raw query,
+// keeping the order and encoding of the others. It returns the new query
+// and the number of parameters removed.
+func stripParams(rawQuery string, patterns []string) (string, int) {
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	removed := 0
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if matchParam(name, patterns) {
+			removed++
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&"), removed
+}
+
+// matchParam reports whether name matches one of patterns; a trailing *
+// matches any suffix (utm_*)
+func matchParam(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
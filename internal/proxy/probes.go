@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeHistory     = 60               // Results kept per origin
+	probeRefresh     = 10 * time.Minute // How often the origins to probe are recomputed
+	probeConcurrency = 8                // Probes running at once
+)
+
+// ProbeResult is the outcome of one probe of an origin
+type ProbeResult struct {
+	Time      time.Time `json:"time"`
+	OK        bool      `json:"ok"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// OriginHealth is the probe history of an origin
+type OriginHealth struct {
+	Host                string        `json:"host"`
+	Up                  bool          `json:"up"`
+	Availability        float64       `json:"availability"`   // Share of the kept probes that succeeded
+	LatencyMs           float64       `json:"avg_latency_ms"` // Of the successful ones
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	History             []ProbeResult `json:"history"` // Oldest first
+}
+
+// originProbes actively checks the busiest origins, so an origin going
+// down shows before users report it
+type originProbes struct {
+	mutex        sync.Mutex
+	origins      map[string]*OriginHealth
+	lastSelected time.Time
+}
+
+// startProbes probes the -probe-origins busiest origins every
+// -probe-interval
+func (s *Server) startProbes() {
+	if s.cfg.ProbeOrigins <= 0 {
+		return
+	}
+	s.probes.origins = make(map[string]*OriginHealth)
+	go s.probeLoop()
+}
+
+// probeLoop runs a round of probes every -probe-interval, for as long as
+// the process runs
+func (s *Server) probeLoop() {
+	ticker := time.NewTicker(s.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		if time.Since(s.probes.lastSelected) >= probeRefresh {
+			s.selectProbed(s.probedHosts())
+		}
+
+		s.probes.mutex.Lock()
+		hosts := make([]string, 0, len(s.probes.origins))
+		for host := range s.probes.origins {
+			hosts = append(hosts, host)
+		}
+		s.probes.mutex.Unlock()
+
+		var wg sync.WaitGroup
+		limit := make(chan struct{}, probeConcurrency)
+		for _, host := range hosts {
+			wg.Add(1)
+			limit <- struct{}{}
+			go func(host string) {
+				defer wg.Done()
+				s.recordProbe(host, s.probe(host))
+				<-limit
+			}(host)
+		}
+		wg.Wait()
+	}
+}
+
+// probedHosts returns the hosts of the busiest origins, out of their
+// tenant's namespace
+func (s *Server) probedHosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, addr := range s.topDestinations(s.cfg.ProbeOrigins) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		host = host[strings.LastIndex(host, "/")+1:]
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// selectProbed makes hosts the origins probed, keeping the history of
+// those already probed
+func (s *Server) selectProbed(hosts []string) {
+	s.probes.mutex.Lock()
+	defer s.probes.mutex.Unlock()
+	origins := make(map[string]*OriginHealth, len(hosts))
+	for _, host := range hosts {
+		if health, ok := s.probes.origins[host]; ok {
+			origins[host] = health
+		} else {
+			origins[host] = &OriginHealth{Host: host}
+		}
+	}
+	s.probes.origins = origins
+	s.probes.lastSelected = time.Now()
+}
+
+// probe checks that host accepts TCP connections on port 443 or, with
+// -probe-method=head, answers a HEAD request for / without a server error
+func (s *Server) probe(host string) ProbeResult {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	result := ProbeResult{Time: time.Now()}
+
+	var err error
+	if s.cfg.ProbeMethod == "head" {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodHead, "https://"+host+"/", nil)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = s.client.Do(req); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 500 {
+					err = fmt.Errorf("status %d", resp.StatusCode)
+				}
+			}
+		}
+	} else {
+		var conn net.Conn
+		if conn, err = s.dial(ctx, "tcp", net.JoinHostPort(host, prewarmPort), ""); err == nil {
+			conn.Close()
+		}
+	}
+
+	result.LatencyMs = float64(time.Since(result.Time).Microseconds()) / 1000
+	result.OK = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// recordProbe adds result to the history of host, raising an alert when
+// the origin has failed -probe-alert-after probes in a row
+func (s *Server) recordProbe(host string, result ProbeResult) {
+	s.probes.mutex.Lock()
+	health, ok := s.probes.origins[host]
+	if !ok {
+		// No longer among the busiest
+		s.probes.mutex.Unlock()
+		return
+	}
+	health.History = append(health.History, result)
+	if len(health.History) > probeHistory {
+		health.History = health.History[len(health.History)-probeHistory:]
+	}
+	recovered := result.OK && health.ConsecutiveFailures >= s.cfg.ProbeAlertAfter
+	if result.OK {
+		health.ConsecutiveFailures = 0
+	} else {
+		health.ConsecutiveFailures++
+	}
+	failures := health.ConsecutiveFailures
+	s.probes.mutex.Unlock()
+
+	switch {
+	case failures == s.cfg.ProbeAlertAfter:
+		s.raiseAlert(Alert{
+			Kind:    "origin-down",
+			Host:    host,
+			Message: fmt.Sprintf("%s failed %d probes in a row: %s", host, failures, result.Error),
+		})
+	case recovered:
+		s.log.Info("Origin %s is reachable again", host)
+	}
+}
+
+// HandleOriginHealth reports the probe history of the busiest origins,
+// those failing first
+func (s *Server) HandleOriginHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	origins := []OriginHealth{}
+	s.probes.mutex.Lock()
+	for _, health := range s.probes.origins {
+		report := *health
+		report.History = append([]ProbeResult{}, health.History...)
+		origins = append(origins, report)
+	}
+	s.probes.mutex.Unlock()
+
+	for i := range origins {
+		health := &origins[i]
+		var ok int
+		var latency float64
+		for _, result := range health.History {
+			if result.OK {
+				ok++
+				latency += result.LatencyMs
+			}
+		}
+		if len(health.History) > 0 {
+			health.Availability = float64(ok) / float64(len(health.History))
+			health.Up = health.History[len(health.History)-1].OK
+		}
+		if ok > 0 {
+			health.LatencyMs = latency / float64(ok)
+		}
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		if origins[i].ConsecutiveFailures != origins[j].ConsecutiveFailures {
+			return origins[i].ConsecutiveFailures > origins[j].ConsecutiveFailures
+		}
+		return origins[i].Host < origins[j].Host
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(origins)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Application protocols tunnels are classified as
+const (
+	protoTLS        = "tls"
+	protoSSH        = "ssh"
+	protoBitTorrent = "bittorrent"
+	protoHTTP       = "http"
+	protoUnknown    = "unknown" // Unrecognised, or the server speaks first
+)
+
+// errProtocolDenied ends tunnels whose protocol -deny-protocols lists
+var errProtocolDenied = errors.New("protocol denied")
+
+// httpMethods are request line prefixes of plain HTTP
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "), []byte("PRI * HTTP/2.0"),
+}
+
+// classifyProtocol names the application protocol a client's first bytes
+// belong to
+func classifyProtocol(first []byte) string {
+	switch {
+	// Handshake record, SSL 3.0 to TLS 1.3 record versions
+	case len(first) >= 3 && first[0] == 0x16 && first[1] == 0x03 && first[2] <= 0x04:
+		return protoTLS
+	case bytes.HasPrefix(first, []byte("SSH-")):
+		return protoSSH
+	case bytes.HasPrefix(first, []byte("\x13BitTorrent protocol")):
+		return protoBitTorrent
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(first, method) {
+			return protoHTTP
+		}
+	}
+	return protoUnknown
+}
+
+// protocolCounters count tunnels and their bytes by application protocol
+type protocolCounters struct {
+	mutex  sync.Mutex
+	counts map[string]*ProtocolStats
+}
+
+// ProtocolStats summarises the tunnels of one application protocol
+type ProtocolStats struct {
+	Tunnels int64  `json:"tunnels"`
+	Denied  int64  `json:"denied"`
+	Bytes   uint64 `json:"bytes"` // Both directions
+}
+
+// add counts a tunnel of proto
+func (c *protocolCounters) add(proto string, denied bool, bytes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]*ProtocolStats)
+	}
+	stats, ok := c.counts[proto]
+	if !ok {
+		stats = &ProtocolStats{}
+		c.counts[proto] = stats
+	}
+	stats.Tunnels++
+	if denied {
+		stats.Denied++
+	}
+	stats.Bytes += bytes
+}
+
+// HandleProtocolStats reports tunnels by application protocol since startup
+func (s *Server) HandleProtocolStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.protocols.mutex.Lock()
+	counts := make(map[string]ProtocolStats, len(s.protocols.counts))
+	for proto, stats := range s.protocols.counts {
+		counts[proto] = *stats
+	}
+	s.protocols.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
+// sniffer classifies a tunnel by the first bytes its client sends, and
+// fails the tunnel if the protocol is denied. Relaying in the other
+// direction goes on meanwhile, so server-first protocols are not held up.
+type sniffer struct {
+	io.ReadCloser
+	s      *Server
+	r      *http.Request
+	host   string
+	proto  string // "" until the client has sent something
+	denied bool
+}
+
+func (c *sniffer) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if c.proto != "" || n == 0 {
+		return n, err
+	}
+	c.proto = classifyProtocol(p[:n])
+	setRequestProtocol(c.r, c.proto)
+	if c.s.protocolDenied(c.proto) {
+		c.denied = true
+		user := ""
+		if record, ok := c.r.Context().Value(requestKey{}).(*RequestRecord); ok {
+			user = record.User
+		}
+		c.s.log.Info("BLOCKED %s tunnel to %s", c.proto, c.host)
+		c.s.recordBlocked(c.r, user, c.host, "protocol:"+c.proto)
+		return 0, errProtocolDenied
+	}
+	return n, err
+}
+
+// protocol returns the classified protocol, protoUnknown if the client
+// never sent anything
+func (c *sniffer) protocol() string {
+	if c.proto == "" {
+		return protoUnknown
+	}
+	return c.proto
+}
+
+// protocolDenied reports whether -deny-protocols lists proto
+func (s *Server) protocolDenied(proto string) bool {
+	for _, denied := range s.deniedProtocols {
+		if denied == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// setRequestProtocol records the application protocol of the tunnel of r
+func setRequestProtocol(r *http.Request, proto string) {
+	if record, ok := r.Context().Value(requestKey{}).(*RequestRecord); ok {
+		record.Protocol = proto
+	}
+}
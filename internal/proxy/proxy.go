@@ -1,19 +1,18 @@
 package proxy
 
 import (
-	"bufio"
-	"fmt"
-	"io"
-	"net"
+	"context"
+	"html/template"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go-proxy/internal/adblock"
+	"go-proxy/internal/auth"
 	"go-proxy/internal/config"
-	"go-proxy/internal/geo" // Add geolocation package
 	"go-proxy/internal/logger"
 	"go-proxy/internal/stats"
 	"go-proxy/internal/storage"
@@ -22,295 +21,415 @@ import (
 type Server struct {
 	cfg         *config.Config
 	blockedRegs []*regexp.Regexp
+	blockMutex  sync.RWMutex
+	decisions   *decisionCache // nil when decision caching is disabled
 	stats       *ProxyStats
 	statsMutex  sync.RWMutex
+
+	activeTunnels atomic.Int64 // CONNECT tunnels currently open
+	openTunnels   tunnelRegistry
+	compression   compressionCounters
+	protocols     protocolCounters
+	strict        strictCounters
+	slow          slowCounters
+	conns         connLimiter
+	fds           fdGuard
+	origins       originLimits
+	failures      failureCounters
+	probes        originProbes
+	self          selfMetrics
+	maintenance   maintenanceMode
+	pauses        pauses
+	calendars     map[string]*calendar // -calendars by name
+	services      serviceRules
+	domains       newDomains
+	uploads       uploadMeter
+	saver         saverCounters
+	privacy       privacyCounters
+	apps          appCounters
+	originTLS     originTLS
+	certWatch     certWatch
+
+	outboundIfaces  []string                   // Interfaces outbound connections are bound to
+	compressExclude []string                   // Hosts whose responses are never compressed
+	saverClients    clientSet                  // Clients whose images are downgraded
+	appAgents       clientSet                  // Clients trusted to tag requests with their application
+	proxyProtoFrom  clientSet                  // Load balancers whose connections start with a PROXY protocol header
+	trustedProxies  clientSet                  // Downstream proxies whose X-Forwarded-For names the client
+	trackingParams  []string                   // Query parameters privacy mode removes
+	deniedProtocols []string                   // Tunnel protocols that are refused
+	errorPages      map[int]*template.Template // Custom error pages by status
+	client          *http.Client               // Client used to forward plain HTTP requests
+	egress          egressRules                // Per-destination outbound interfaces
+	tunnels         map[string]tunnel          // WireGuard tunnels by name
+	upstreams       *upstreamPool              // Upstream proxies (nil connects directly)
+	balancer        *originBalancer            // Order origin addresses are dialed in
+	prewarm         *prewarmer                 // Warm connections to top origins (nil disables)
+	ring            *uring                     // Copies tunnel data through io_uring (nil uses io.Copy)
+	httpsHosts      httpsHosts                 // Hosts that redirect plain HTTP to HTTPS
+	requests        requestLog                 // Recent requests by ID
+	blocked         blockedLog                 // Recent blocked attempts
+	alerts          alertLog                   // Recent alerts
+	alertRules      alertRules                 // Rules raising alerts on bursts of events
+	quotas          quotas                     // Data quotas and their use
+	dataCap         dataCapWarnings            // -data-cap alerts raised this billing cycle
+	warnings        warnings                   // When clients last saw the -warn interstitial
+	devices         devices                    // User-Agent profiles of client IPs and -device-rules
+	geoFence        *geoFence                  // Countries destinations must be in (nil allows all)
+	tenants         tenantSet                  // Tenants and their blacklists
+	events          *eventQueue                // Events on their way to the sinks (nil disables)
+	cluster         *clusterSync               // Rule changes shared with other instances (nil disables)
+	sampler         sampler                    // Allowed requests recorded in stats
+
+	certUsers     map[string]string // Client certificate subject -> user
+	identityMutex sync.RWMutex
+	auth          auth.Chain      // Proxy-Authorization schemes (empty disables)
+	filters       *adblock.Engine // Filter lists (nil disables)
+
+	store storage.StatsStore // nil keeps stats in memory only
+	geo   GeoResolver
+	log   logger.Logger
+}
+
+// GeoResolver records the location of hosts the proxy connects to
+type GeoResolver interface {
+	// RecordHostLocation locates host by its name
+	RecordHostLocation(host string)
+	// RecordConnection locates host by the address a connection reached
+	RecordConnection(host, addr string)
+	// Country returns the country code of host, "" for private addresses
+	Country(host string) (string, error)
+}
+
+// EventSink stores significant proxy events for later consumption
+type EventSink interface {
+	Append(event storage.Event) error
 }
 
-type ProxyStats struct {
-	HostStats map[string]*stats.HostStats
+// Deps are the services a Server depends on. A nil Store keeps stats in
+// memory only, a nil Geo disables geolocation, every event is written to
+// each of the Events sinks, a nil Cluster keeps rule changes local and a
+// nil Log uses the process-wide log.
+type Deps struct {
+	Store   storage.StatsStore
+	Geo     GeoResolver
+	Events  []EventSink
+	Cluster ClusterBus
+	Domains DomainHistory
+	Log     logger.Logger
 }
 
-func NewServer(cfg *config.Config) *Server {
+// NewServer creates a proxy server using the services in deps
+func NewServer(cfg *config.Config, deps Deps) *Server {
 	s := &Server{
 		cfg:         cfg,
 		blockedRegs: make([]*regexp.Regexp, 0),
 		stats: &ProxyStats{
 			HostStats: make(map[string]*stats.HostStats),
+			UserStats: make(map[string]*stats.UserStats),
 		},
+		saver:           saverCounters{clients: make(map[string]*SaverStats)},
+		egress:          egressRules{clients: make(map[string]*http.Client)},
+		httpsHosts:      httpsHosts{learned: make(map[string]time.Time)},
+		balancer:        newOriginBalancer(cfg.OriginBalance),
+		geoFence:        newGeoFence(cfg.GeoAllowCountries),
+		domains:         newDomains{history: deps.Domains, seen: make(map[string]time.Time), ages: make(map[string]domainAge)},
+		outboundIfaces:  splitList(cfg.OutboundInterfaces),
+		compressExclude: splitList(cfg.CompressExclude),
+		saverClients:    parseClientSet(cfg.SaverClients),
+		appAgents:       parseClientSet(cfg.AppAgents),
+		proxyProtoFrom:  parseClientSet(cfg.ProxyProtocol),
+		trustedProxies:  parseClientSet(cfg.TrustedProxies),
+		trackingParams:  splitList(strings.ToLower(cfg.PrivacyParams)),
+		deniedProtocols: splitList(strings.ToLower(cfg.DenyProtocols)),
+		store:           deps.Store,
+		geo:             deps.Geo,
+		log:             deps.Log,
 	}
-
-	// Start periodic stats saving
-	go s.periodicStatsSave()
-
-	// Load blacklist if file is specified
-	if cfg.BlockFile != "" {
-		if err := s.loadBlacklist(); err != nil {
-			logger.Log("Error loading blacklist: %v", err)
-		}
+	if s.geo == nil {
+		s.geo = noGeo{}
 	}
-
-	// Start stats monitoring
-	s.startStatsMonitoring()
-
-	return s
-}
-
-// Add method to load blacklist
-func (s *Server) loadBlacklist() error {
-	file, err := os.Open(s.cfg.BlockFile)
+	if s.domains.history == nil {
+		s.domains.history = &memoryDomains{seen: make(map[string]time.Time)}
+	}
+	if s.log == nil {
+		s.log = logger.Default()
+	}
+	if len(deps.Events) > 0 {
+		s.events = s.startEvents(deps.Events)
+	}
+	if deps.Cluster != nil {
+		s.cluster = s.startCluster(deps.Cluster)
+	}
+	s.setMaintenanceAllow(cfg.MaintenanceAllow)
+	s.setMaintenance(cfg.Maintenance, cfg.MaintenanceMessage)
+	if cfg.DecisionCacheTTL > 0 && cfg.DecisionCacheSize > 0 {
+		s.decisions = newDecisionCache(cfg.DecisionCacheTTL, cfg.DecisionCacheSize)
+	}
+	originTLSConfig, err := s.newOriginTLSConfig(cfg.OriginCA, cfg.OriginTLSMin)
 	if err != nil {
-		return fmt.Errorf("failed to open blacklist file: %v", err)
+		s.log.Info("Error loading origin CA bundle: %v", err)
+	}
+	s.originTLS.config = originTLSConfig
+	// No overall timeout: streamed responses can stay open indefinitely
+	s.client = &http.Client{
+		Transport: s.newTransport(""),
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		pattern := strings.TrimSpace(scanner.Text())
-		if pattern == "" || strings.HasPrefix(pattern, "#") {
-			continue
-		}
+	// Start periodic stats saving
+	go s.periodicStatsSave()
 
-		reg, err := regexp.Compile(pattern)
+	s.startFDGuard()
+	if cfg.TunnelMaxLifetime > 0 {
+		go s.watchTunnels()
+	}
+	if cfg.TunnelIOURing {
+		ring, err := newURing()
 		if err != nil {
-			logger.Log("Invalid regex pattern '%s': %v", pattern, err)
-			continue
+			s.log.Info("Error starting io_uring, tunnels are copied without it: %v", err)
+		} else {
+			s.ring = ring
+			s.log.Info("Copying tunnel data through io_uring (experimental)")
 		}
-		s.blockedRegs = append(s.blockedRegs, reg)
 	}
 
-	logger.Log("Loaded %d blacklist patterns", len(s.blockedRegs))
-	return scanner.Err()
-}
-
-// Update isBlocked method
-func (s *Server) isBlocked(host string) bool {
-	if len(s.blockedRegs) == 0 {
-		return false
+	// Load blacklist if file is specified
+	if cfg.BlockFile != "" {
+		if err := applyLoaded(s.loadBlacklist(cfg.BlockFile)); err != nil {
+			s.log.Info("Error loading blacklist: %v", err)
+		}
 	}
 
-	for _, reg := range s.blockedRegs {
-		if reg.MatchString(host) {
-			return true
+	if cfg.TLSUserMap != "" {
+		if err := applyLoaded(s.loadCertUsers(cfg.TLSUserMap)); err != nil {
+			s.log.Info("Error loading cert user map: %v", err)
 		}
 	}
-	return false
-}
-
-// Implement http.Handler interface
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// This method will handle all HTTPS requests
-	s.HandleHTTPS(w, r)
-}
-
-// Add method to periodically save stats
-func (s *Server) periodicStatsSave() {
-	ticker := time.NewTicker(60 * time.Minute)
-	defer ticker.Stop()
 
-	for range ticker.C {
-		s.saveStatsToRedis()
+	if err := applyLoaded(s.loadTenants(cfg.Tenants)); err != nil {
+		s.log.Info("Error loading tenants: %v", err)
 	}
-}
-
-// Add method to save accumulated stats to Redis
-func (s *Server) saveStatsToRedis() {
-	s.statsMutex.Lock()
-	defer s.statsMutex.Unlock()
-
-	now := time.Now()
-
-	for host, stats := range s.stats.HostStats {
-		if stats.Connections > 0 || stats.BlockedAttempts > 0 {
-			stats.LastSeen = now
 
-			err := storage.RecordHostActivity(host, stats.Blocked, stats.BytesTransferred)
-			if err != nil {
-				logger.Log("Error saving stats for host %s: %v", host, err)
-				continue
-			}
-
-			// Reset counters after saving
-			stats.Connections = 0
-			stats.BlockedAttempts = 0
-			stats.BytesTransferred = 0
-		}
+	s.startCalendars(cfg.Calendars, cfg.CalendarRefresh)
+	if err := applyLoaded(s.loadPauses(cfg.PauseSchedule)); err != nil {
+		s.log.Info("Error loading pause schedule: %v", err)
 	}
-}
 
-func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
-	// Get the original host
-	host := r.Host
-	if host == "" {
-		host = r.URL.Host
+	if err := applyLoaded(s.loadServices(cfg.ServicePolicies)); err != nil {
+		s.log.Info("Error loading service policies: %v", err)
 	}
 
-	// Clean the host
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
+	if err := applyLoaded(s.loadQuotas(cfg.Quotas)); err != nil {
+		s.log.Info("Error loading quotas: %v", err)
 	}
-
-	blocked := s.isBlocked(host)
-	if blocked {
-		logger.Log("BLOCKED HTTP: %s", host)
-		s.updateStats(host, blocked, 0, false)
-		http.Error(w, "Blocked", http.StatusForbidden)
-		return
+	if err := applyLoaded(s.loadDevices(cfg.DeviceRules)); err != nil {
+		s.log.Info("Error loading device rules: %v", err)
 	}
+	if err := applyLoaded(s.loadOriginPins(cfg.OriginPins)); err != nil {
+		s.log.Info("Error loading origin pins: %v", err)
+	}
+	s.startQuotas(cfg.QuotaState)
+	s.startCertWatch(cfg.CertWatchState)
 
-	// Create a new request to forward
-	outReq := new(http.Request)
-	*outReq = *r // Copy the original request
-
-	// Ensure we're not forwarding the original connection settings
-	outReq.Close = false
-	outReq.RequestURI = ""
+	s.startOutbound(cfg)
+	s.startProbes()
+	s.startDataCap()
 
-	// Create a counting writer to track bytes
-	countingWriter := &CountingWriter{ResponseWriter: w}
+	sampler, err := newSampler(cfg.SampleRate, cfg.SampleHosts)
+	if err != nil {
+		s.log.Info("Error loading sampling rates: %v", err)
+	}
+	s.sampler = sampler
 
-	// Create client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	if cfg.EgressRules != "" {
+		if err := applyLoaded(s.loadEgress(cfg.EgressRules)); err != nil {
+			s.log.Info("Error loading egress rules: %v", err)
+		}
 	}
 
-	// Make the request
-	resp, err := client.Do(outReq)
-	if err != nil {
-		fmt.Printf("Error proxying request: %v\n", err)
-		http.Error(w, "Error proxying request", http.StatusBadGateway)
-		return
+	if err := applyLoaded(s.loadOriginLimits(cfg.OriginLimits)); err != nil {
+		s.log.Info("Error loading origin limits: %v", err)
 	}
-	defer resp.Body.Close()
 
-	// Copy headers
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	if err := applyLoaded(s.loadAlertRules(cfg.AlertRules)); err != nil {
+		s.log.Info("Error loading alert rules: %v", err)
 	}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+	if cfg.HSTSPreload != "" {
+		preload, err := loadHSTSPreload(cfg.HSTSPreload)
+		if err != nil {
+			s.log.Info("Error loading HSTS preload list: %v", err)
+		}
+		s.httpsHosts.preload = preload
+	}
 
-	// Copy the response body
-	written, err := io.Copy(countingWriter, resp.Body)
-	if err != nil {
-		fmt.Printf("Error copying response: %v\n", err)
-		return
+	if cfg.ErrorPages != "" {
+		pages, err := loadErrorPages(cfg.ErrorPages)
+		if err != nil {
+			s.log.Info("Error loading error pages: %v", err)
+		}
+		s.errorPages = pages
 	}
 
-	s.updateStats(host, blocked, uint64(written), true)
-}
+	// Start stats monitoring
+	s.startStatsMonitoring()
 
-// CountingWriter to track response size
-type CountingWriter struct {
-	http.ResponseWriter
-	BytesWritten uint64
+	return s
 }
 
-func (w *CountingWriter) Write(bytes []byte) (int, error) {
-	n, err := w.ResponseWriter.Write(bytes)
-	w.BytesWritten += uint64(n)
-	return n, err
+// Implement http.Handler interface
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// This method will handle all HTTPS requests
+	markServed(r)
+	s.HandleHTTPS(w, r)
 }
 
-func (s *Server) HandleHTTPS(w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	blocked := s.isBlocked(host)
-
-	s.updateStats(host, blocked, 0, true)
-
-	if r.Method != "CONNECT" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		s.HandleHTTPS(w, r)
 		return
 	}
-
-	if blocked {
-		logger.Log("BLOCKED HTTPS: %s", host)
-		http.Error(w, "Blocked", http.StatusForbidden)
+	if r.URL.Host == "" {
+		if isConnectUDP(r) {
+			s.handleConnectUDP(w, r)
+			return
+		}
+		s.handleLocal(w, r)
 		return
 	}
-
-	destConn, err := net.DialTimeout("tcp", host, 10*time.Second)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	w, r, finish := s.trackRequest(w, r)
+	defer finish()
+	if s.inMaintenance(r) {
+		s.writeMaintenance(w, r)
 		return
 	}
 
-	hijacker, ok := w.(http.Hijacker)
+	user, ok := s.authorize(w, r)
 	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
+	setRequestUser(r.Context(), user)
+	s.tagApp(r)
 
-	w.WriteHeader(http.StatusOK)
-	clientConn, _, err := hijacker.Hijack()
+	target, err := absoluteURL(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	go s.transfer(host, destConn, clientConn, true)
-	go s.transfer(host, clientConn, destConn, false)
-}
-
-func (s *Server) transfer(host string, dest io.WriteCloser, src io.ReadCloser, logCall bool) {
-	defer dest.Close()
-	defer src.Close()
-	writenBVytes, err := io.Copy(dest, src)
-	if err != nil && logCall {
-		s.updateStats(host, false, uint64(writenBVytes), false)
+	host := target.Hostname()
+	if r.Method == http.MethodOptions && r.Header.Get("Max-Forwards") == "0" {
+		// Addressed to the proxy itself (RFC 9110 section 7.6.2)
+		w.Header().Set("Allow", proxyMethods)
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-}
+	rule := s.blockingRule(r, user, host, "")
+	blocked := rule != ""
+	if blocked {
+		s.log.Info("BLOCKED HTTP: %s", host)
+		s.recordBlocked(r, user, host, rule)
+		s.geo.RecordHostLocation(host)
+		s.updateStats(statsName(r, host), blocked, 0, 0)
+		s.updateUserStats(statsName(r, user), blocked, 0, 1)
+		s.writeBlocked(w, r, rule)
+		return
+	}
 
-// Add method to update in-memory stats
-func (s *Server) updateStats(host string, blocked bool, bytes uint64, incrementConnections bool) {
-	// Extract host without port
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
+	if target.Scheme == "ftp" {
+		s.handleFTP(w, r, user, target)
+		return
+	}
+	if s.upgradeHTTPS(w, r, target) {
+		return
+	}
+	if s.warnInterstitial(w, r, user) {
+		return
 	}
 
-	// Record geolocation data asynchronously
-	geo.RecordHostLocation(host)
+	// Create a new request to forward
+	outReq := outboundRequest(r)
+	outReq.URL = target
+	outReq.Body = s.meterUpload(r, host, s.paceBody(w, r))
+	if name := s.cfg.RequestIDHeader; name != "" {
+		outReq.Header.Set(name, requestID(r.Context()))
+	}
+	s.applyPrivacy(outReq)
+	s.applyServiceHeaders(outReq, user, r.RemoteAddr)
 
-	s.statsMutex.Lock()
-	defer s.statsMutex.Unlock()
+	// Create a counting writer to track bytes
+	countingWriter := &CountingWriter{ResponseWriter: w}
 
-	hostStats, exists := s.stats.HostStats[host]
-	if !exists {
-		// Resolve IPs for the host
-		ips, err := net.LookupHost(host)
-		ipList := "unknown"
-		if err == nil && len(ips) > 0 {
-			ipList = strings.Join(ips, ",")
+	// Make the request
+	egress := s.egressFor(r.Context(), user, r.RemoteAddr, r.URL.Hostname())
+	up := s.upstreamFor(r.URL.Hostname())
+	if up != nil {
+		outReq = outReq.WithContext(context.WithValue(outReq.Context(), upstreamKey{}, up))
+	}
+	var originAddr string
+	outReq = traceOriginAddr(outReq, &originAddr)
+	resp, err := s.clientFor(egress).Do(outReq)
+	if err != nil {
+		if up != nil {
+			up.failures.Add(1)
 		}
-
-		hostStats = &stats.HostStats{
-			Host:     host,
-			IPs:      ipList,
-			LastSeen: time.Now(),
+		s.log.Warn("Error proxying request to %s: %v", host, err)
+		class := classifyFailure(err)
+		recordFailure(r, class)
+		if class == FailureTLS && target.Scheme == "https" && up == nil {
+			s.recordOriginTLSFailure(host, err)
 		}
-		s.stats.HostStats[host] = hostStats
+		s.writeError(w, r, gatewayStatus(err), "Error proxying request")
+		return
+	}
+	defer resp.Body.Close()
+	s.recordOrigin(host, originAddr, up != nil)
+	if resp.StatusCode >= 500 {
+		recordFailure(r, FailureOrigin5xx)
+	}
+	if target.Scheme == "http" {
+		s.httpsHosts.learn(host, resp)
 	}
 
-	if incrementConnections {
-		hostStats.Connections++
+	// Copy headers, except those about the origin connection
+	removeHopHeaders(resp.Header)
+	s.stripThirdPartySetCookies(r, resp, host)
+	s.saveBandwidth(r, resp, user)
+	s.injectWarning(r, resp, user)
+	encoding := s.compressionFor(r, resp, host)
+	if encoding != "" {
+		prepareCompressed(resp, encoding)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
 	}
 
-	hostStats.BytesTransferred += bytes
-	if blocked {
-		if incrementConnections {
-			hostStats.BlockedAttempts++
-		}
-		hostStats.Blocked = true
+	announceTrailers(w, resp)
+
+	// Set status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy the response body, flushing streamed responses as they arrive
+	read, err := s.copyResponse(countingWriter, resp, encoding)
+	if err != nil {
+		s.log.Warn("Error copying response from %s: %v", host, err)
+		recordFailure(r, copyFailure(r, err))
+		s.updateStats(statsName(r, host), false, countingWriter.BytesWritten, 1)
+		s.updateUserStats(statsName(r, user), false, countingWriter.BytesWritten, 1)
+		return
+	}
+	copyTrailers(w, resp)
+	if encoding != "" {
+		s.compression.responses.Add(1)
+		s.compression.originBytes.Add(uint64(read))
+		s.compression.sentBytes.Add(countingWriter.BytesWritten)
 	}
-}
 
-func (s *Server) startStatsMonitoring() {
-	ticker := time.NewTicker(1 * time.Minute)
-	go func() {
-		for range ticker.C {
-			storage.DisplayAllHostStats()
-		}
-	}()
+	written := countingWriter.BytesWritten
+	if up != nil {
+		up.bytes.Add(written)
+	}
+	n := statsWeight(r, resp.StatusCode >= 500)
+	s.updateStats(statsName(r, host), false, written*n, n)
+	s.updateUserStats(statsName(r, user), false, written*n, n)
 }
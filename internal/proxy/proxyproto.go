@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoTimeout is how long a load balancer has to send the PROXY
+// protocol header of a connection
+const proxyProtoTimeout = 5 * time.Second
+
+// proxyProtoV1Max is the longest PROXY protocol v1 header, CRLF included
+const proxyProtoV1Max = 107
+
+// proxyProtoSignature starts every PROXY protocol v2 header
+var proxyProtoSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtoListener wraps l so that connections from -proxy-protocol load
+// balancers report the client address of their PROXY protocol header as
+// their remote address, for the wrappers and handlers after it. It must
+// wrap the listener first. Headers are read off the accept loop, so a load
+// balancer slow to send one holds up no other connection.
+func (s *Server) ProxyProtoListener(l net.Listener) net.Listener {
+	pl := &proxyProtoListener{
+		Listener: l,
+		s:        s,
+		accepted: make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	go pl.run()
+	return pl
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	s         *Server
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptResult is a connection, with its header read, or an accept error
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// run accepts connections until the listener is closed, handing them to
+// Accept once their header is read
+func (l *proxyProtoListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.hand(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.s.proxyProtoFrom.match("", conn.RemoteAddr().String()) {
+			l.hand(acceptResult{conn: conn})
+			continue
+		}
+		go func() {
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				l.s.log.Warn("Closed connection from load balancer %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			l.hand(acceptResult{conn: proxied})
+		}()
+	}
+}
+
+// hand passes result to Accept, reporting false, and closing the
+// connection, if the listener was closed first
+func (l *proxyProtoListener) hand(result acceptResult) bool {
+	select {
+	case l.accepted <- result:
+		return true
+	case <-l.closed:
+		if result.conn != nil {
+			result.conn.Close()
+		}
+		return false
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection whose client address came in a PROXY protocol
+// header. Bytes read past the header are kept in reader.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the v1 or v2 PROXY protocol header conn starts
+// with. Headers of health checks (v1 UNKNOWN, v2 LOCAL) and of other than
+// TCP connections leave the load balancer as the remote address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(len(proxyProtoSignature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %v", err)
+	}
+	var remote netip.AddrPort
+	switch {
+	case bytes.Equal(start, proxyProtoSignature):
+		remote, err = readProxyHeaderV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = readProxyHeaderV1(reader)
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	proxied := &proxyConn{Conn: conn, reader: reader, remote: conn.RemoteAddr()}
+	if remote.IsValid() {
+		proxied.remote = net.TCPAddrFromAddrPort(remote)
+	}
+	return proxied, nil
+}
+
+// readProxyHeaderV1 reads a "PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport>
+// <dport>" line and returns its source address, zero for UNKNOWN
+func readProxyHeaderV1(reader *bufio.Reader) (netip.AddrPort, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtoV1Max || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.AddrPort{}, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	port, portErr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || portErr != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// readProxyHeaderV2 reads a binary header and returns its source address,
+// zero for LOCAL commands and other than TCP over IPv4 or IPv6
+func readProxyHeaderV2(reader *bufio.Reader) (netip.AddrPort, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("reading PROXY protocol v2 header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("reading PROXY protocol v2 header: %v", err)
+	}
+
+	command, family := header[12]&0x0f, header[13]
+	switch {
+	case command == 0:
+		// LOCAL: the load balancer's own connection, e.g. a health check
+		return netip.AddrPort{}, nil
+	case command != 1:
+		return netip.AddrPort{}, fmt.Errorf("unsupported PROXY protocol v2 command %d", command)
+	case family == 0x11 && len(payload) >= 12:
+		ip := netip.AddrFrom4([4]byte(payload[0:4]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(payload[8:])), nil
+	case family == 0x21 && len(payload) >= 36:
+		ip := netip.AddrFrom16([16]byte(payload[0:16]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(payload[32:])), nil
+	case family == 0x11 || family == 0x21:
+		return netip.AddrPort{}, errors.New("truncated PROXY protocol v2 addresses")
+	}
+	return netip.AddrPort{}, nil
+}
+
+// proxyHeader returns the PROXY protocol header, version v1 or v2, of a
+// connection from src to dst. Unless both are valid addresses the header
+// says the connection's origin is unknown.
+func proxyHeader(version string, src, dst netip.AddrPort) []byte {
+	known := src.IsValid() && dst.IsValid()
+	if known && src.Addr().Unmap().Is4() != dst.Addr().Unmap().Is4() {
+		// Both must be of one family; map IPv4 into IPv6
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	} else if known {
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	header := append([]byte{}, proxyProtoSignature...)
+	switch {
+	case !known:
+		// PROXY command, unspecified family, no addresses
+		return append(header, 0x21, 0x00, 0, 0)
+	case src.Addr().Is4():
+		header = append(header, 0x21, 0x11, 0, 12)
+	default:
+		header = append(header, 0x21, 0x21, 0, 36)
+	}
+	header = append(header, src.Addr().AsSlice()...)
+	header = append(header, dst.Addr().AsSlice()...)
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	return binary.BigEndian.AppendUint16(header, dst.Port())
+}
+
+// requestAddrs returns the client address of the request ctx belongs to and
+// the proxy address it connected to, zero where unknown
+func requestAddrs(ctx context.Context) (client, local netip.AddrPort) {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		client, _ = netip.ParseAddrPort(record.Client)
+	}
+	if addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local, _ = netip.ParseAddrPort(addr.String())
+	}
+	return client, local
+}
@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotaRulePrefix starts the blocking rule of clients over their quota;
+// the end of the cycle follows in RFC 3339
+const quotaRulePrefix = "quota:"
+
+// quotaSaveInterval is how often usage is written to -quota-state
+const quotaSaveInterval = time.Minute
+
+// quotaUnits are the size suffixes of quota limits
+var quotaUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+}
+
+// quotaCycle is when quota usage starts over: daily at a time of day,
+// weekly on a weekday or monthly on a day of the month, in local time
+type quotaCycle struct {
+	period string // daily, weekly or monthly
+	day    int    // time.Weekday for weekly, day of the month for monthly
+	minute int    // Minutes since midnight for daily
+}
+
+// quotaRule gives each client it matches limit bytes per cycle
+type quotaRule struct {
+	spec    string     // Clients as written in the quotas file
+	clients *clientSet // nil matches every client
+	limit   int64
+	cycle   quotaCycle
+}
+
+// quotaUsage is what a client transferred in its current cycle
+type quotaUsage struct {
+	Rule  string    `json:"rule"` // Clients of the quota line counted against
+	Start time.Time `json:"start"`
+	Bytes int64     `json:"bytes"`
+}
+
+// quotas are the data quotas of -quotas and what each client used of them
+type quotas struct {
+	mutex sync.Mutex
+	rules []quotaRule
+	usage map[string]*quotaUsage // By client (user or IP)
+	dirty bool                   // Usage changed since the last save
+}
+
+// QuotaStatus is a client's use of its quota
+type QuotaStatus struct {
+	Client    string    `json:"client"`
+	Rule      string    `json:"rule"` // Clients of the quota line that applies
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Cycle     string    `json:"cycle"`
+	Start     time.Time `json:"start"`  // Of the current cycle
+	Resets    time.Time `json:"resets"` // Start of the next cycle
+}
+
+// loadQuotaRules reads a quotas file. Each line is
+//
+//	<clients> <limit> <cycle>
+//
+// where clients is a comma separated list of users, IPs and CIDRs, or *
+// for every client, limit a size such as 500MB or 20GiB and cycle one of
+// daily[@HH:MM], weekly[@<day>] or monthly[@<day of month>]. Each client
+// matched gets the limit for itself; the first matching line applies. A
+// cycle on a day of the month some months lack resets on their last day,
+// e.g.
+//
+//	kids       20GB   monthly@15
+//	10.0.0.0/8 2GB    daily@06:00
+//	*          100GB  monthly
+func loadQuotaRules(filename string) ([]quotaRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open quotas file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []quotaRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("quotas line %d: want <clients> <limit> <cycle>", lineNo)
+		}
+		rule := quotaRule{spec: fields[0]}
+		if fields[0] != "*" {
+			clients := parseClientSet(fields[0])
+			rule.clients = &clients
+		}
+		if rule.limit, err = parseQuotaSize(fields[1]); err != nil {
+			return nil, fmt.Errorf("quotas line %d: %v", lineNo, err)
+		}
+		if rule.cycle, err = parseQuotaCycle(fields[2]); err != nil {
+			return nil, fmt.Errorf("quotas line %d: %v", lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read quotas file: %v", err)
+	}
+	return rules, nil
+}
+
+// parseQuotaSize parses a size such as 1.5GB (decimal units) or 20GiB
+// (binary units)
+func parseQuotaSize(value string) (int64, error) {
+	upper := strings.ToUpper(value)
+	for _, unit := range quotaUnits {
+		if number, ok := strings.CutSuffix(upper, unit.suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return int64(n * unit.bytes), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid limit %q", value)
+}
+
+// parseQuotaCycle parses daily[@HH:MM], weekly[@<day>] or
+// monthly[@<day of month>]
+func parseQuotaCycle(value string) (quotaCycle, error) {
+	period, anchor, hasAnchor := strings.Cut(strings.ToLower(value), "@")
+	cycle := quotaCycle{period: period}
+	var err error
+	switch period {
+	case "daily":
+		if hasAnchor {
+			cycle.minute, err = parseTimeOfDay(anchor)
+		}
+	case "weekly":
+		if hasAnchor {
+			if cycle.day = dayIndex(anchor); cycle.day < 0 {
+				err = fmt.Errorf("invalid day %q", anchor)
+			}
+		} else {
+			cycle.day = int(time.Monday)
+		}
+	case "monthly":
+		cycle.day = 1
+		if hasAnchor {
+			if cycle.day, err = strconv.Atoi(anchor); err == nil && (cycle.day < 1 || cycle.day > 31) {
+				err = fmt.Errorf("day %d out of range", cycle.day)
+			}
+		}
+	default:
+		return cycle, fmt.Errorf("invalid cycle %q, want daily, weekly or monthly", value)
+	}
+	if err != nil {
+		return cycle, fmt.Errorf("invalid cycle %q: %v", value, err)
+	}
+	return cycle, nil
+}
+
+// String formats the cycle as in the quotas file
+func (c quotaCycle) String() string {
+	switch c.period {
+	case "daily":
+		return fmt.Sprintf("daily@%02d:%02d", c.minute/60, c.minute%60)
+	case "weekly":
+		return "weekly@" + weekdays[c.day]
+	}
+	return fmt.Sprintf("monthly@%d", c.day)
+}
+
+// monthAnchor returns the cycle's day in the month of year, or the last
+// day of a shorter month
+func (c quotaCycle) monthAnchor(year int, month time.Month) time.Time {
+	day := c.day
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// start returns when the cycle running at now started
+func (c quotaCycle) start(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch c.period {
+	case "daily":
+		start := time.Date(now.Year(), now.Month(), now.Day(), c.minute/60, c.minute%60, 0, 0, time.Local)
+		if now.Before(start) {
+			start = start.AddDate(0, 0, -1)
+		}
+		return start
+	case "weekly":
+		return midnight.AddDate(0, 0, -((int(now.Weekday()) - c.day + 7) % 7))
+	}
+	start := c.monthAnchor(now.Year(), now.Month())
+	if now.Before(start) {
+		start = c.monthAnchor(now.Year(), now.Month()-1)
+	}
+	return start
+}
+
+// next returns when the cycle started at start ends
+func (c quotaCycle) next(start time.Time) time.Time {
+	switch c.period {
+	case "daily":
+		return start.AddDate(0, 0, 1)
+	case "weekly":
+		return start.AddDate(0, 0, 7)
+	}
+	return c.monthAnchor(start.Year(), start.Month()+1)
+}
+
+// loadQuotas reads the quotas in path and returns the function swapping
+// them in, which removes them if path is empty. Usage carries over; a
+// client whose cycle changed starts the new one from zero.
+func (s *Server) loadQuotas(path string) (func(), error) {
+	var rules []quotaRule
+	if path != "" {
+		var err error
+		if rules, err = loadQuotaRules(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.quotas.mutex.Lock()
+		s.quotas.rules = rules
+		if s.quotas.usage == nil {
+			s.quotas.usage = make(map[string]*quotaUsage)
+		}
+		s.quotas.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d quotas", len(rules))
+		}
+	}, nil
+}
+
+// quotaFor returns the quota rule applying to user at remoteAddr, or nil.
+// The caller holds the quotas mutex.
+func (q *quotas) quotaFor(user, remoteAddr string) *quotaRule {
+	for i := range q.rules {
+		if rule := &q.rules[i]; rule.clients == nil || rule.clients.match(user, remoteAddr) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// current returns the usage of client in the cycle of rule running at
+// now, starting over if the cycle changed. The caller holds the quotas
+// mutex.
+func (q *quotas) current(client string, rule *quotaRule, now time.Time) *quotaUsage {
+	start := rule.cycle.start(now)
+	usage, ok := q.usage[client]
+	if !ok {
+		usage = &quotaUsage{Rule: rule.spec, Start: start}
+		q.usage[client] = usage
+	} else if !usage.Start.Equal(start) {
+		usage.Start, usage.Bytes = start, 0
+		q.dirty = true
+	}
+	usage.Rule = rule.spec
+	return usage
+}
+
+// addQuotaUsage counts bytes transferred by user at remoteAddr against
+// their quota. Requests are counted when they finish, so a long download
+// can take a client past its limit.
+func (s *Server) addQuotaUsage(user, remoteAddr string, bytes uint64) {
+	if bytes == 0 {
+		return
+	}
+	s.quotas.mutex.Lock()
+	defer s.quotas.mutex.Unlock()
+	rule := s.quotas.quotaFor(user, remoteAddr)
+	if rule == nil {
+		return
+	}
+	usage := s.quotas.current(clientKey(user, remoteAddr), rule, time.Now())
+	usage.Bytes += int64(bytes)
+	s.quotas.dirty = true
+}
+
+// quotaRule returns the blocking rule for user at remoteAddr if they used
+// up their quota, else ""
+func (s *Server) quotaRule(user, remoteAddr string) string {
+	s.quotas.mutex.Lock()
+	defer s.quotas.mutex.Unlock()
+	rule := s.quotas.quotaFor(user, remoteAddr)
+	if rule == nil {
+		return ""
+	}
+	usage := s.quotas.current(clientKey(user, remoteAddr), rule, time.Now())
+	if usage.Bytes < rule.limit {
+		return ""
+	}
+	return quotaRulePrefix + rule.cycle.next(usage.Start).Format(time.RFC3339)
+}
+
+// startQuotas restores the usage saved in -quota-state and saves it there
+// every quotaSaveInterval
+func (s *Server) startQuotas(path string) {
+	if path == "" {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		usage := make(map[string]*quotaUsage)
+		if err := json.Unmarshal(data, &usage); err != nil {
+			s.log.Warn("Ignoring quota state %s: %v", path, err)
+		} else {
+			s.quotas.mutex.Lock()
+			s.quotas.usage = usage
+			s.quotas.mutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		s.log.Warn("Failed to read quota state: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(quotaSaveInterval) {
+			if err := s.saveQuotas(path); err != nil {
+				s.log.Warn("Failed to save quota state: %v", err)
+			}
+		}
+	}()
+}
+
+// saveQuotas writes quota usage to path if it changed
+func (s *Server) saveQuotas(path string) error {
+	s.quotas.mutex.Lock()
+	if !s.quotas.dirty {
+		s.quotas.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.quotas.usage)
+	s.quotas.dirty = false
+	s.quotas.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// HandleQuotas reports the quota use of every client seen this cycle, or
+// of ?client= (a user or IP), those closest to their limit first
+func (s *Server) HandleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := r.URL.Query().Get("client")
+
+	now := time.Now()
+	statuses := []QuotaStatus{}
+	s.quotas.mutex.Lock()
+	for client := range s.quotas.usage {
+		if only != "" && client != only {
+			continue
+		}
+		statuses = append(statuses, s.quotas.status(client, now))
+	}
+	if only != "" && len(statuses) == 0 && s.quotas.quotaFor(only, only) != nil {
+		// No traffic yet this cycle
+		statuses = append(statuses, s.quotas.status(only, now))
+	}
+	s.quotas.mutex.Unlock()
+
+	filtered := statuses[:0]
+	for _, status := range statuses {
+		if status.Limit > 0 {
+			filtered = append(filtered, status)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		if filtered[i].Remaining != filtered[j].Remaining {
+			return filtered[i].Remaining < filtered[j].Remaining
+		}
+		return filtered[i].Client < filtered[j].Client
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+// status reports client's quota use at now, with a zero Limit if no quota
+// applies to it any more. The caller holds the quotas mutex.
+func (q *quotas) status(client string, now time.Time) QuotaStatus {
+	// Usage is kept by user or IP, which may not match the rule on its own
+	// when a user's quota comes from their address
+	var rule *quotaRule
+	if usage, ok := q.usage[client]; ok {
+		for i := range q.rules {
+			if q.rules[i].spec == usage.Rule {
+				rule = &q.rules[i]
+				break
+			}
+		}
+	}
+	if rule == nil {
+		rule = q.quotaFor(client, client)
+	}
+	status := QuotaStatus{Client: client}
+	if rule == nil {
+		return status
+	}
+	usage := q.current(client, rule, now)
+	status.Rule = rule.spec
+	status.Limit = rule.limit
+	status.Used = usage.Bytes
+	status.Remaining = max(rule.limit-usage.Bytes, 0)
+	status.Cycle = rule.cycle.String()
+	status.Start = usage.Start
+	status.Resets = rule.cycle.next(usage.Start)
+	return status
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import "go-proxy/internal/config"
+
+// loadCertUsers reads the client certificate user map in path and returns
+// the function swapping it in
+func (s *Server) loadCertUsers(path string) (func(), error) {
+	users, err := loadCertUserMap(path)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.identityMutex.Lock()
+		s.certUsers = users
+		s.identityMutex.Unlock()
+		s.log.Info("Loaded %d client certificate users", len(users))
+	}, nil
+}
+
+// applyLoaded runs the swap a loader returned, unless loading failed
+func applyLoaded(swap func(), err error) error {
+	if err != nil {
+		return err
+	}
+	swap()
+	return nil
+}
+
+// Reload applies the reloadable settings of cfg to the running server.
+// The blacklist, tenants, pause schedule, service policies, egress rules,
+// origin limits and alert rules files are re-read even if their paths did
+// not change. With -cluster-sync the resulting blacklist is sent to the
+// other instances.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.self.reloads.Add(1)
+	err := s.reload(cfg)
+	if err != nil {
+		s.self.reloadFailures.Add(1)
+	}
+	return err
+}
+
+// reload reads every file before applying any, so one that fails to load
+// leaves the running policy as it was rather than partly replaced
+func (s *Server) reload(cfg *config.Config) error {
+	loaders := []func() (func(), error){
+		func() (func(), error) { return s.loadTenants(cfg.Tenants) },
+		func() (func(), error) { return s.loadPauses(cfg.PauseSchedule) },
+		func() (func(), error) { return s.loadServices(cfg.ServicePolicies) },
+		func() (func(), error) { return s.loadQuotas(cfg.Quotas) },
+		func() (func(), error) { return s.loadDevices(cfg.DeviceRules) },
+		func() (func(), error) { return s.loadOriginPins(cfg.OriginPins) },
+		func() (func(), error) { return s.loadEgress(cfg.EgressRules) },
+		func() (func(), error) { return s.loadOriginLimits(cfg.OriginLimits) },
+		func() (func(), error) { return s.loadAlertRules(cfg.AlertRules) },
+		func() (func(), error) { return s.loadBlacklist(cfg.BlockFile) },
+	}
+	if cfg.TLSUserMap != "" {
+		loaders = append(loaders, func() (func(), error) { return s.loadCertUsers(cfg.TLSUserMap) })
+	}
+
+	swaps := make([]func(), 0, len(loaders))
+	for _, load := range loaders {
+		swap, err := load()
+		if err != nil {
+			return err
+		}
+		swaps = append(swaps, swap)
+	}
+
+	s.setMaintenanceAllow(cfg.MaintenanceAllow)
+	for _, swap := range swaps {
+		swap()
+	}
+	s.broadcastBlacklist()
+	return nil
+}
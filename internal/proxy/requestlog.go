@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requestLogSize is how many finished requests /api/requests can find
+const requestLogSize = 10000
+
+// RequestRecord describes one proxied request
+type RequestRecord struct {
+	ID         string       `json:"id"`
+	Time       time.Time    `json:"time"`
+	Client     string       `json:"client"`
+	User       string       `json:"user,omitempty"`
+	Tenant     string       `json:"tenant,omitempty"`
+	Protocol   string       `json:"protocol,omitempty"` // Application protocol of a tunnel
+	App        string       `json:"app,omitempty"`      // Client application, as tagged by an -app-agents agent
+	Method     string       `json:"method"`
+	URL        string       `json:"url"`
+	Status     int          `json:"status"`
+	Bytes      uint64       `json:"bytes"` // Sent to the client, or both ways for CONNECT
+	DurationMs float64      `json:"duration_ms"`
+	Error      FailureClass `json:"error,omitempty"` // Why the request failed
+
+	weight uint64 // Times the request counts in stats, 0 if sampled out
+}
+
+// requestLog keeps the most recent requests in a ring
+type requestLog struct {
+	mutex   sync.Mutex
+	records []RequestRecord
+	next    int
+}
+
+// requestKey is the context key of the *RequestRecord of a request
+type requestKey struct{}
+
+// trackingWriter records the status and body size of a response
+type trackingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  uint64
+}
+
+func (t *trackingWriter) WriteHeader(status int) {
+	if t.status == 0 && status >= 200 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(p)
+	t.bytes += uint64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *trackingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// newRequestID returns a random 96-bit ID in hex
+func newRequestID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the ID of the request ctx belongs to, or ""
+func requestID(ctx context.Context) string {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		return record.ID
+	}
+	return ""
+}
+
+// setRequestUser attributes the request ctx belongs to to user
+func setRequestUser(ctx context.Context, user string) {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		record.User = user
+	}
+}
+
+// setRequestApp attributes the request ctx belongs to to the client
+// application app
+func setRequestApp(ctx context.Context, app string) {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		record.App = app
+	}
+}
+
+// requestUser returns the user the request ctx belongs to is attributed to
+func requestUser(ctx context.Context) string {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		return record.User
+	}
+	return ""
+}
+
+// addRequestBytes counts tunnelled bytes, which bypass the response writer
+func addRequestBytes(ctx context.Context, bytes uint64) {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		record.Bytes += bytes
+	}
+}
+
+// trackRequest gives r an ID, returned to the client in the
+// -request-id-header, and returns the writer and request the handler
+// should use, the latter with the client address -trusted-proxies passed
+// on. The returned function logs the request when it is done.
+func (s *Server) trackRequest(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	r = s.forwardedRequest(r)
+	record := &RequestRecord{
+		ID:     newRequestID(),
+		Time:   time.Now(),
+		Client: r.RemoteAddr,
+		Method: r.Method,
+		URL:    r.URL.Redacted(),
+	}
+	record.weight = s.sampler.weight(requestHost(r))
+	if r.Method == http.MethodConnect {
+		record.URL = r.Host
+	}
+	if name := s.cfg.RequestIDHeader; name != "" {
+		w.Header().Set(name, record.ID)
+	}
+	s.observeDevice(r)
+	tracker := &trackingWriter{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), requestKey{}, record))
+
+	return tracker, r, func() {
+		record.Status = tracker.status
+		record.Bytes += tracker.bytes
+		record.DurationMs = float64(time.Since(record.Time).Microseconds()) / 1000
+		if s.cfg.AccessLog {
+			user := record.User
+			if user == "" {
+				user = "-"
+			}
+			s.log.Info("ACCESS %s %s %s \"%s %s\" %d %d %.1fms", record.ID, record.Client, user,
+				record.Method, record.URL, record.Status, record.Bytes, record.DurationMs)
+		}
+		s.requests.add(*record)
+		s.failures.add(requestHost(r), record.Error)
+		s.addQuotaUsage(record.User, record.Client, record.Bytes)
+		if record.App != "" {
+			s.apps.add(record.App, clientKey(record.User, record.Client), requestHost(r), record.Bytes)
+		}
+	}
+}
+
+// add stores a finished request, replacing the oldest when full
+func (l *requestLog) add(record RequestRecord) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.records) < requestLogSize {
+		l.records = append(l.records, record)
+		return
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % requestLogSize
+}
+
+// find returns the request with id, or the newest limit requests if id is
+// empty, newest first
+func (l *requestLog) find(id string, limit int) []RequestRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	result := []RequestRecord{}
+	for i := 0; i < len(l.records) && len(result) < limit; i++ {
+		// Walk back from the newest entry
+		idx := (l.next - 1 - i + 2*len(l.records)) % len(l.records)
+		if id == "" || l.records[idx].ID == id {
+			result = append(result, l.records[idx])
+		}
+	}
+	return result
+}
+
+// HandleRequests serves recent requests as JSON: ?id= looks one up by the
+// ID in its error page or -request-id-header, otherwise the newest ?limit=
+// (default 100) are listed
+func (s *Server) HandleRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	limit := 100
+	if id != "" {
+		limit = 1
+	} else if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records := s.requests.find(id, limit)
+	if id != "" && len(records) == 0 {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
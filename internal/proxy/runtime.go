@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelCheckInterval is how often open tunnels are checked against
+// -tunnel-max-lifetime
+const tunnelCheckInterval = time.Minute
+
+// TunnelInfo describes an open CONNECT or SOCKS tunnel
+type TunnelInfo struct {
+	RequestID  string    `json:"request_id,omitempty"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Host       string    `json:"host"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Goroutines int32     `json:"goroutines"` // Copying for the tunnel
+	Leaked     bool      `json:"leaked,omitempty"`
+}
+
+// openTunnel is the registry entry of a tunnel
+type openTunnel struct {
+	info       TunnelInfo
+	goroutines atomic.Int32
+	leaked     atomic.Bool
+}
+
+// tunnelRegistry keeps the open tunnels and the goroutines copying for
+// them, so tunnels that never end can be found
+type tunnelRegistry struct {
+	mutex      sync.Mutex
+	open       map[*openTunnel]struct{}
+	goroutines atomic.Int64 // Copying for all tunnels
+	leaked     atomic.Int64 // Tunnels found open past -tunnel-max-lifetime
+}
+
+// RuntimeStatus reports the resource usage of the proxy process
+type RuntimeStatus struct {
+	Goroutines       int          `json:"goroutines"`
+	GOMAXPROCS       int          `json:"gomaxprocs"`
+	NumCPU           int          `json:"num_cpu"`
+	OpenFDs          int          `json:"open_fds"` // -1 if unknown
+	FDLimit          uint64       `json:"fd_limit"` // 0 if unknown
+	FDReserve        int          `json:"fd_reserve"`
+	FDRejections     int64        `json:"fd_rejections"` // Connections refused near FDLimit
+	HeapBytes        uint64       `json:"heap_bytes"`
+	Tunnels          int          `json:"tunnels"`
+	TunnelGoroutines int64        `json:"tunnel_goroutines"`
+	LeakedTunnels    int64        `json:"leaked_tunnels"`            // Since startup
+	IOURingOps       int64        `json:"io_uring_ops,omitempty"`    // Tunnel sends and receives through io_uring
+	IOURingEnters    int64        `json:"io_uring_enters,omitempty"` // Syscalls submitting them
+	Oldest           []TunnelInfo `json:"oldest"`
+}
+
+// registerTunnel adds the tunnel of the request r to host to the registry
+func (s *Server) registerTunnel(r *http.Request, host string) *openTunnel {
+	t := &openTunnel{info: TunnelInfo{
+		RequestID: requestID(r.Context()),
+		Client:    r.RemoteAddr,
+		User:      requestUser(r.Context()),
+		Host:      host,
+		Started:   time.Now(),
+	}}
+	s.openTunnels.mutex.Lock()
+	if s.openTunnels.open == nil {
+		s.openTunnels.open = make(map[*openTunnel]struct{})
+	}
+	s.openTunnels.open[t] = struct{}{}
+	s.openTunnels.mutex.Unlock()
+	return t
+}
+
+// unregisterTunnel removes a closed tunnel from the registry
+func (s *Server) unregisterTunnel(t *openTunnel) {
+	s.openTunnels.mutex.Lock()
+	delete(s.openTunnels.open, t)
+	s.openTunnels.mutex.Unlock()
+}
+
+// tunnelGoroutine counts a goroutine starting (delta 1) or finishing
+// (delta -1) copying for t
+func (s *Server) tunnelGoroutine(t *openTunnel, delta int32) {
+	t.goroutines.Add(delta)
+	s.openTunnels.goroutines.Add(int64(delta))
+}
+
+// watchTunnels warns about tunnels open longer than -tunnel-max-lifetime,
+// once per tunnel; they usually mean goroutines stuck on a peer that
+// vanished without closing its connection
+func (s *Server) watchTunnels() {
+	ticker := time.NewTicker(tunnelCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, t := range s.tunnelSnapshot() {
+			if time.Since(t.info.Started) < s.cfg.TunnelMaxLifetime || t.leaked.Swap(true) {
+				continue
+			}
+			s.openTunnels.leaked.Add(1)
+			s.log.Warn("Tunnel %s from %s to %s open for %s with %d goroutines, over -tunnel-max-lifetime",
+				t.info.RequestID, t.info.Client, t.info.Host, time.Since(t.info.Started).Round(time.Second), t.goroutines.Load())
+		}
+	}
+}
+
+// tunnelSnapshot returns the open tunnels
+func (s *Server) tunnelSnapshot() []*openTunnel {
+	s.openTunnels.mutex.Lock()
+	defer s.openTunnels.mutex.Unlock()
+	tunnels := make([]*openTunnel, 0, len(s.openTunnels.open))
+	for t := range s.openTunnels.open {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// HandleRuntime reports goroutine, file descriptor and memory usage along
+// with the ?limit= (default 20) oldest open tunnels
+func (s *Server) HandleRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status := RuntimeStatus{
+		Goroutines:       runtime.NumGoroutine(),
+		GOMAXPROCS:       runtime.GOMAXPROCS(0),
+		NumCPU:           runtime.NumCPU(),
+		OpenFDs:          -1,
+		FDReserve:        s.cfg.FDReserve,
+		FDRejections:     s.fds.rejected.Load(),
+		HeapBytes:        mem.HeapAlloc,
+		TunnelGoroutines: s.openTunnels.goroutines.Load(),
+		LeakedTunnels:    s.openTunnels.leaked.Load(),
+		Oldest:           []TunnelInfo{},
+	}
+	if s.ring != nil {
+		status.IOURingOps, status.IOURingEnters = s.ring.counts()
+	}
+	if n, err := openFDs(); err == nil {
+		status.OpenFDs = n
+	}
+	if n, err := fdLimit(); err == nil {
+		status.FDLimit = n
+	}
+
+	tunnels := s.tunnelSnapshot()
+	status.Tunnels = len(tunnels)
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].info.Started.Before(tunnels[j].info.Started)
+	})
+	if len(tunnels) > limit {
+		tunnels = tunnels[:limit]
+	}
+	for _, t := range tunnels {
+		info := t.info
+		info.AgeSeconds = time.Since(info.Started).Seconds()
+		info.Goroutines = t.goroutines.Load()
+		info.Leaked = t.leaked.Load()
+		status.Oldest = append(status.Oldest, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
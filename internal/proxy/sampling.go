@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sampleRule records 1 in rate of the allowed requests to hosts matching
+// pattern
+type sampleRule struct {
+	pattern string
+	rate    uint64
+}
+
+// sampler picks the allowed requests whose stats are recorded, with
+// -sample-rate and -sample-hosts
+type sampler struct {
+	rate  uint64
+	rules []sampleRule
+}
+
+// newSampler returns the sampler recording 1 in rate requests, or 1 in the
+// rate of the first of the comma separated pattern=rate hosts matching
+func newSampler(rate int, hosts string) (sampler, error) {
+	sampler := sampler{rate: 1}
+	if rate > 1 {
+		sampler.rate = uint64(rate)
+	}
+	for _, entry := range splitList(hosts) {
+		pattern, value, ok := strings.Cut(entry, "=")
+		n, err := strconv.ParseUint(value, 10, 63)
+		if !ok || err != nil || n == 0 {
+			return sampler, fmt.Errorf("invalid -sample-hosts entry %q (want pattern=rate)", entry)
+		}
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return sampler, fmt.Errorf("invalid -sample-hosts pattern %q", pattern)
+		}
+		sampler.rules = append(sampler.rules, sampleRule{pattern: pattern, rate: n})
+	}
+	return sampler, nil
+}
+
+// weight decides whether a request to host is recorded. It returns 0 for
+// requests left out and the sampling rate for those recorded, which count
+// that many times so stored totals remain estimates of all traffic.
+func (p sampler) weight(host string) uint64 {
+	rate := p.rate
+	if len(p.rules) > 0 {
+		host = strings.ToLower(host)
+		for _, rule := range p.rules {
+			if ok, _ := path.Match(rule.pattern, host); ok {
+				rate = rule.rate
+				break
+			}
+		}
+	}
+	if rate <= 1 {
+		return 1
+	}
+	if rand.Int63n(int64(rate)) != 0 {
+		return 0
+	}
+	return rate
+}
+
+// requestHost returns the destination host of the proxy request r
+func requestHost(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			return host
+		}
+		return r.Host
+	}
+	return r.URL.Hostname()
+}
+
+// requestWeight returns how many times the stats of the request ctx
+// belongs to count, 0 if it was sampled out
+func requestWeight(ctx context.Context) uint64 {
+	if record, ok := ctx.Value(requestKey{}).(*RequestRecord); ok {
+		return record.weight
+	}
+	return 1
+}
+
+// statsWeight returns how many times the request r counts in stats, given
+// its outcome. Blocked and failed requests are always recorded, once, so
+// sampling never hides them.
+func statsWeight(r *http.Request, failed bool) uint64 {
+	if failed {
+		return 1
+	}
+	return requestWeight(r.Context())
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Limits of the bandwidth saver. Larger images pass through untouched so a
+// single response can't exhaust memory or CPU.
+const (
+	saverMaxInput  = 20 << 20   // Bytes of an image read into memory
+	saverMaxPixels = 50_000_000 // Pixels of a decoded image
+)
+
+// SaverStats counts the images downgraded for one client
+type SaverStats struct {
+	Images        int64  `json:"images"`
+	OriginalBytes uint64 `json:"original_bytes"`
+	SentBytes     uint64 `json:"sent_bytes"`
+	SavedBytes    uint64 `json:"saved_bytes"`
+}
+
+// saverCounters tracks SaverStats per client key
+type saverCounters struct {
+	mutex   sync.Mutex
+	clients map[string]*SaverStats
+}
+
+// SaverStats returns the bandwidth saved for each client since startup
+func (s *Server) SaverStats() map[string]SaverStats {
+	s.saver.mutex.Lock()
+	defer s.saver.mutex.Unlock()
+	result := make(map[string]SaverStats, len(s.saver.clients))
+	for client, stats := range s.saver.clients {
+		result[client] = *stats
+	}
+	return result
+}
+
+// HandleSaverStats serves SaverStats as JSON
+func (s *Server) HandleSaverStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.SaverStats())
+}
+
+// saveBandwidth replaces a large JPEG or PNG body of resp with a smaller
+// re-encoding (lower quality, at most -saver-max-dimension pixels across)
+// for clients with the bandwidth saver enabled. Anything it can't shrink
+// is passed through unchanged.
+func (s *Server) saveBandwidth(r *http.Request, resp *http.Response, user string) {
+	if !s.saverClients.match(user, r.RemoteAddr) {
+		return
+	}
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" ||
+		headerHasToken(resp.Header, "Cache-Control", "no-transform") {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		return
+	}
+	if resp.ContentLength != -1 &&
+		(resp.ContentLength < int64(s.cfg.SaverMinSize) || resp.ContentLength > saverMaxInput) {
+		return
+	}
+
+	original, err := io.ReadAll(io.LimitReader(resp.Body, saverMaxInput+1))
+	if err != nil || len(original) < s.cfg.SaverMinSize || len(original) > saverMaxInput {
+		// Send what was read followed by the rest
+		resp.Body = replacedBody{io.MultiReader(bytes.NewReader(original), resp.Body), resp.Body}
+		return
+	}
+
+	downgraded, ok := downgradeImage(original, mediaType, s.cfg.SaverQuality, s.cfg.SaverMaxDimension)
+	if !ok || len(downgraded) >= len(original) {
+		resp.Body = replacedBody{bytes.NewReader(original), resp.Body}
+		return
+	}
+
+	resp.Body = replacedBody{bytes.NewReader(downgraded), resp.Body}
+	resp.ContentLength = int64(len(downgraded))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(downgraded)))
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	s.recordSaving(clientKey(user, r.RemoteAddr), len(original), len(downgraded))
+}
+
+func (s *Server) recordSaving(client string, original, sent int) {
+	s.saver.mutex.Lock()
+	defer s.saver.mutex.Unlock()
+	stats, ok := s.saver.clients[client]
+	if !ok {
+		stats = &SaverStats{}
+		s.saver.clients[client] = stats
+	}
+	stats.Images++
+	stats.OriginalBytes += uint64(original)
+	stats.SentBytes += uint64(sent)
+	stats.SavedBytes += uint64(original - sent)
+}
+
+// downgradeImage decodes data, scales it to fit maxDimension and
+// re-encodes it: JPEGs at quality, PNGs losslessly (so only when scaled).
+// It reports false if the image can't or needn't be re-encoded.
+func downgradeImage(data []byte, mediaType string, quality, maxDimension int) ([]byte, bool) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > saverMaxPixels {
+		return nil, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+
+	scaled := false
+	if bounds := img.Bounds(); maxDimension > 0 && (bounds.Dx() > maxDimension || bounds.Dy() > maxDimension) {
+		width, height := maxDimension, bounds.Dy()*maxDimension/bounds.Dx()
+		if bounds.Dy() > bounds.Dx() {
+			width, height = bounds.Dx()*maxDimension/bounds.Dy(), maxDimension
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		img, scaled = dst, true
+	}
+
+	var buf bytes.Buffer
+	switch {
+	case mediaType == "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case scaled:
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	default:
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// replacedBody reads a substitute body but closes the origin's
+type replacedBody struct {
+	io.Reader
+	io.Closer
+}
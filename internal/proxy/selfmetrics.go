@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"go-proxy/internal/metrics"
+	"go-proxy/internal/storage"
+)
+
+// selfMetrics count the proxy's own housekeeping, so its health can be
+// watched alongside the traffic it carries
+type selfMetrics struct {
+	flushes        atomic.Int64
+	flushErrors    atomic.Int64 // Hosts and users whose stats could not be saved
+	flushNanos     atomic.Int64 // Duration of the last flush
+	reloads        atomic.Int64
+	reloadFailures atomic.Int64
+}
+
+// InternalStats returns the proxy's operational counters for /api/metrics
+func (s *Server) InternalStats() metrics.InternalStats {
+	redis := storage.RedisCommandStats()
+	internal := metrics.InternalStats{
+		RedisCommands:     redis.Commands,
+		RedisErrors:       redis.Errors,
+		RedisAvgLatencyMs: redis.AvgLatencyMs,
+		RedisMaxLatencyMs: redis.MaxLatencyMs,
+		StatsFlushes:      s.self.flushes.Load(),
+		StatsFlushErrors:  s.self.flushErrors.Load(),
+		StatsFlushMs:      float64(s.self.flushNanos.Load()) / 1e6,
+		Reloads:           s.self.reloads.Load(),
+		ReloadFailures:    s.self.reloadFailures.Load(),
+	}
+	if s.events != nil {
+		internal.EventQueueDepth = len(s.events.events)
+		internal.EventsDropped = s.events.dropped.Load()
+	}
+	s.blockMutex.RLock()
+	internal.BlocklistSize = len(s.blockedRegs)
+	s.blockMutex.RUnlock()
+	return internal
+}
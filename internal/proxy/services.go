@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServicePolicy is a built-in policy for a popular service. Without TLS
+// interception the proxy sees only the host of HTTPS traffic, so policies
+// work on hosts: they block them, send them to the service's restricted
+// servers (as the services document for network-level enforcement) or,
+// on plain HTTP, add the service's restriction header.
+type ServicePolicy struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Hosts       []string `json:"hosts"`              // Host globs the policy applies to
+	Block       bool     `json:"block,omitempty"`    // Refuse connections to the hosts
+	Redirect    string   `json:"redirect,omitempty"` // Host connections are made to instead
+	Header      string   `json:"header,omitempty"`   // "Name: value" added to plain HTTP requests
+}
+
+// youtubeHosts are the hosts YouTube's restricted mode applies to
+var youtubeHosts = []string{"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com", "youtube.googleapis.com", "www.youtube-nocookie.com"}
+
+// servicePolicies are the built-in policies -service-policies can apply
+var servicePolicies = map[string]*ServicePolicy{
+	"youtube-strict": {
+		Description: "YouTube Strict Restricted Mode",
+		Hosts:       youtubeHosts,
+		Redirect:    "restrict.youtube.com",
+		Header:      "YouTube-Restrict: Strict",
+	},
+	"youtube-moderate": {
+		Description: "YouTube Moderate Restricted Mode",
+		Hosts:       youtubeHosts,
+		Redirect:    "restrictmoderate.youtube.com",
+		Header:      "YouTube-Restrict: Moderate",
+	},
+	"google-safesearch": {
+		Description: "Google SafeSearch",
+		Hosts:       []string{"www.google.*", "google.*"},
+		Redirect:    "forcesafesearch.google.com",
+	},
+	"bing-safesearch": {
+		Description: "Bing strict SafeSearch",
+		Hosts:       []string{"www.bing.com", "bing.com"},
+		Redirect:    "strict.bing.com",
+	},
+	"duckduckgo-safesearch": {
+		Description: "DuckDuckGo safe search",
+		Hosts:       []string{"duckduckgo.com", "www.duckduckgo.com"},
+		Redirect:    "safe.duckduckgo.com",
+	},
+	"block-youtube": {
+		Description: "Block YouTube, including embedded videos",
+		Hosts:       []string{"youtube.com", "*.youtube.com", "youtu.be", "*.googlevideo.com", "*.ytimg.com", "youtubei.googleapis.com", "www.youtube-nocookie.com"},
+		Block:       true,
+	},
+	"block-youtube-uploads": {
+		Description: "Block uploading videos to YouTube",
+		Hosts:       []string{"upload.youtube.com", "youtube.googleapis.com"},
+		Block:       true,
+	},
+	"block-tiktok": {
+		Description: "Block TikTok",
+		Hosts:       []string{"tiktok.com", "*.tiktok.com", "*.tiktokv.com", "*.tiktokcdn.com", "*.byteoversea.com"},
+		Block:       true,
+	},
+	"block-facebook": {
+		Description: "Block Facebook and Messenger",
+		Hosts:       []string{"facebook.com", "*.facebook.com", "*.facebook.net", "*.fbcdn.net", "messenger.com", "*.messenger.com"},
+		Block:       true,
+	},
+	"block-instagram": {
+		Description: "Block Instagram",
+		Hosts:       []string{"instagram.com", "*.instagram.com", "*.cdninstagram.com"},
+		Block:       true,
+	},
+	"block-snapchat": {
+		Description: "Block Snapchat",
+		Hosts:       []string{"snapchat.com", "*.snapchat.com", "*.sc-cdn.net"},
+		Block:       true,
+	},
+	"block-discord": {
+		Description: "Block Discord",
+		Hosts:       []string{"discord.com", "*.discord.com", "discord.gg", "*.discordapp.com", "*.discordapp.net"},
+		Block:       true,
+	},
+	"block-twitch": {
+		Description: "Block Twitch",
+		Hosts:       []string{"twitch.tv", "*.twitch.tv", "*.ttvnw.net"},
+		Block:       true,
+	},
+	"block-roblox": {
+		Description: "Block Roblox",
+		Hosts:       []string{"roblox.com", "*.roblox.com", "*.rbxcdn.com"},
+		Block:       true,
+	},
+}
+
+// serviceRule applies policies to the clients it matches
+type serviceRule struct {
+	policies []string
+	clients  *clientSet // nil matches every client
+}
+
+// serviceRules are the per-client policies of -service-policies
+type serviceRules struct {
+	mutex sync.RWMutex
+	rules []serviceRule
+}
+
+// loadServiceRules reads a file of "<policies> [clients]" lines, where
+// policies is a comma separated list of built-in policy names and clients
+// a comma separated list of users, IPs and CIDRs. The first line matching
+// the client applies, e.g.
+//
+//	youtube-strict,google-safesearch,block-tiktok  kids,192.168.1.64/26
+//	youtube-moderate
+func loadServiceRules(filename string) ([]serviceRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open service policies file: %v", err)
+	}
+	defer file.Close()
+
+	var rules []serviceRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("service policies line %d: want <policies> [clients]", lineNo)
+		}
+		rule := serviceRule{policies: splitList(fields[0])}
+		for _, name := range rule.policies {
+			if servicePolicies[name] == nil {
+				return nil, fmt.Errorf("service policies line %d: unknown policy %q", lineNo, name)
+			}
+		}
+		if len(fields) == 2 {
+			clients := parseClientSet(fields[1])
+			rule.clients = &clients
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read service policies file: %v", err)
+	}
+	return rules, nil
+}
+
+// loadServices reads the service policy rules in path and returns the
+// function swapping them in, which removes them if path is empty
+func (s *Server) loadServices(path string) (func(), error) {
+	var rules []serviceRule
+	if path != "" {
+		var err error
+		if rules, err = loadServiceRules(path); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		s.services.mutex.Lock()
+		s.services.rules = rules
+		s.services.mutex.Unlock()
+		if path != "" {
+			s.log.Info("Loaded %d service policy rules", len(rules))
+		}
+	}, nil
+}
+
+// servicePolicy returns the name and policy applying to user at remoteAddr
+// connecting to host, if any. Blocking policies take precedence.
+func (s *Server) servicePolicy(user, remoteAddr, host string) (string, *ServicePolicy) {
+	s.services.mutex.RLock()
+	rules := s.services.rules
+	s.services.mutex.RUnlock()
+
+	host = strings.ToLower(host)
+	for _, rule := range rules {
+		if rule.clients != nil && !rule.clients.match(user, remoteAddr) {
+			continue
+		}
+		var found string
+		for _, name := range rule.policies {
+			policy := servicePolicies[name]
+			if policy.matches(host) && (found == "" || policy.Block) {
+				found = name
+			}
+		}
+		if found == "" {
+			return "", nil
+		}
+		return found, servicePolicies[found]
+	}
+	return "", nil
+}
+
+// matches reports whether the policy applies to host
+func (p *ServicePolicy) matches(host string) bool {
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceRule returns the blocking rule of a blocking service policy for
+// user at remoteAddr connecting to host, else ""
+func (s *Server) serviceRule(user, remoteAddr, host string) string {
+	if name, policy := s.servicePolicy(user, remoteAddr, host); policy != nil && policy.Block {
+		return "service:" + name
+	}
+	return ""
+}
+
+// serviceHost returns the host connections by user at remoteAddr to host
+// are made to: the restricted servers of the service if a policy says so,
+// else host itself
+func (s *Server) serviceHost(user, remoteAddr, host string) string {
+	if _, policy := s.servicePolicy(user, remoteAddr, host); policy != nil && policy.Redirect != "" {
+		return policy.Redirect
+	}
+	return host
+}
+
+// applyServiceHeaders adds the restriction header of a service policy to
+// req, a plain HTTP request by user at remoteAddr
+func (s *Server) applyServiceHeaders(req *http.Request, user, remoteAddr string) {
+	if _, policy := s.servicePolicy(user, remoteAddr, req.URL.Hostname()); policy != nil && policy.Header != "" {
+		name, value, _ := strings.Cut(policy.Header, ":")
+		req.Header.Set(name, strings.TrimSpace(value))
+	}
+}
+
+// HandleServicePolicies lists the built-in service policies
+func (s *Server) HandleServicePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names := make([]string, 0, len(servicePolicies))
+	for name := range servicePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	response := make([]ServicePolicy, 0, len(names))
+	for _, name := range names {
+		policy := *servicePolicies[name]
+		policy.Name = name
+		response = append(response, policy)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
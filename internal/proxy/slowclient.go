@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errSlowClient ends transfers with clients below -min-transfer-rate
+var errSlowClient = errors.New("client below minimum transfer rate")
+
+// slowCounters count the client connections reaped for being too slow
+type slowCounters struct {
+	slowReads  atomic.Int64 // Clients not reading responses
+	slowBodies atomic.Int64 // Clients trickling request bodies
+	idleHeads  atomic.Int64 // Connections closed before a full request head arrived
+	conns      sync.Map     // net.Conn -> *atomic.Bool, set once a request arrived
+}
+
+// connKey is the context key of a connection's request-arrived flag
+type connKey struct{}
+
+// SlowClientStats reports the connections reaped for being too slow
+type SlowClientStats struct {
+	SlowReads        int64 `json:"slow_reads"`
+	SlowBodies       int64 `json:"slow_bodies"`
+	NoRequestHeaders int64 `json:"no_request_headers"` // Includes -read-header-timeout expiries
+}
+
+// HandleSlowClientStats reports the connections reaped for being too slow
+func (s *Server) HandleSlowClientStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SlowClientStats{
+		SlowReads:        s.slow.slowReads.Load(),
+		SlowBodies:       s.slow.slowBodies.Load(),
+		NoRequestHeaders: s.slow.idleHeads.Load(),
+	})
+}
+
+// ConfigureServer applies the client timeouts to srv and has it report
+// connections reaped before sending a request
+func (s *Server) ConfigureServer(srv *http.Server) {
+	srv.ReadHeaderTimeout = s.cfg.ReadHeaderTimeout
+	srv.IdleTimeout = s.cfg.IdleTimeout
+	srv.ConnContext = s.ConnContext
+	srv.ConnState = s.TrackConnState
+}
+
+// ConnContext is an http.Server ConnContext hook tracking each connection
+// for TrackConnState
+func (s *Server) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	served := new(atomic.Bool)
+	s.slow.conns.Store(conn, served)
+	return context.WithValue(ctx, connKey{}, served)
+}
+
+// TrackConnState is an http.Server ConnState hook counting connections
+// that close without ever sending a complete request head, which is what
+// slowloris connections do once -read-header-timeout expires
+func (s *Server) TrackConnState(conn net.Conn, state http.ConnState) {
+	if state != http.StateHijacked && state != http.StateClosed {
+		return
+	}
+	if served, ok := s.slow.conns.LoadAndDelete(conn); ok && state == http.StateClosed && !served.(*atomic.Bool).Load() {
+		s.slow.idleHeads.Add(1)
+	}
+}
+
+// markServed records that a complete request arrived on the connection of r
+func markServed(r *http.Request) {
+	if served, ok := r.Context().Value(connKey{}).(*atomic.Bool); ok {
+		served.Store(true)
+	}
+}
+
+// RateListener wraps l so that writes to clients that do not read at
+// -min-transfer-rate fail and close the connection. It returns l unchanged
+// when no minimum rate is set.
+func (s *Server) RateListener(l net.Listener) net.Listener {
+	if s.cfg.MinTransferRate <= 0 {
+		return l
+	}
+	return &rateListener{Listener: l, s: s}
+}
+
+type rateListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *rateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rateConn{Conn: conn, s: l.s}, nil
+}
+
+// rateConn writes in chunks that must drain within -min-rate-window each
+type rateConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c *rateConn) Write(p []byte) (int, error) {
+	window := c.s.cfg.MinRateWindow
+	chunk := int(c.s.cfg.MinTransferRate * int64(window/time.Second))
+	chunk = max(chunk, 1)
+	written := 0
+	for written < len(p) {
+		end := min(written+chunk, len(p))
+		c.Conn.SetWriteDeadline(time.Now().Add(window))
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.s.slow.slowReads.Add(1)
+			c.s.log.Warn("Reaped %s: reading below %d bytes/s", c.RemoteAddr(), c.s.cfg.MinTransferRate)
+			c.s.emitClient("abuse", c.RemoteAddr().String(), "", "slow read")
+			c.Conn.Close()
+			return written, errSlowClient
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	c.Conn.SetWriteDeadline(time.Time{})
+	return written, nil
+}
+
+// paceBody returns the body of r, failing reads when the client sends it
+// slower than -min-transfer-rate
+func (s *Server) paceBody(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	if s.cfg.MinTransferRate <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return r.Body
+	}
+	return &pacedBody{ReadCloser: r.Body, s: s, controller: http.NewResponseController(w), client: r.RemoteAddr}
+}
+
+// pacedBody reaps clients trickling a request body: every read must
+// complete within -min-rate-window, and after the first window the
+// average rate must stay above -min-transfer-rate
+type pacedBody struct {
+	io.ReadCloser
+	s          *Server
+	controller *http.ResponseController
+	client     string
+	start      time.Time
+	bytes      int64
+}
+
+func (b *pacedBody) Read(p []byte) (int, error) {
+	window := b.s.cfg.MinRateWindow
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	b.controller.SetReadDeadline(time.Now().Add(window))
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err == io.EOF {
+		b.controller.SetReadDeadline(time.Time{})
+		return n, err
+	}
+	elapsed := time.Since(b.start)
+	if errors.Is(err, os.ErrDeadlineExceeded) ||
+		(elapsed > window && float64(b.bytes) < float64(b.s.cfg.MinTransferRate)*elapsed.Seconds()) {
+		b.s.slow.slowBodies.Add(1)
+		b.s.log.Warn("Reaped %s: sending its request body below %d bytes/s", b.client, b.s.cfg.MinTransferRate)
+		b.s.emitClient("abuse", b.client, "", "slow request body")
+		return n, errSlowClient
+	}
+	return n, err
+}
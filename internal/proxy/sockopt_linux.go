@@ -0,0 +1,32 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// outboundControl sets the -outbound-mark firewall mark and binds to the
+// -outbound-device of outbound sockets before they connect, so policy
+// routing rules can pick their routing table
+func (s *Server) outboundControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if mark := s.cfg.OutboundMark; mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+				sockErr = fmt.Errorf("failed to set SO_MARK %d: %w", mark, err)
+				return
+			}
+		}
+		if device := s.cfg.OutboundDevice; device != "" {
+			if err := syscall.BindToDevice(int(fd), device); err != nil {
+				sockErr = fmt.Errorf("failed to bind to device %s: %w", device, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// outboundControl does nothing; config.Load refuses -outbound-mark and
+// -outbound-device outside Linux
+func (s *Server) outboundControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
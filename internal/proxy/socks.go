@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion        = 5
+	socksAuthVersion    = 1
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksMethodRejected = 0xff
+	socksCmdConnect     = 0x01
+	socksAtypIPv4       = 0x01
+	socksAtypDomain     = 0x03
+	socksAtypIPv6       = 0x04
+
+	socksSucceeded       = 0x00
+	socksFailure         = 0x01
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	socksCmdUnsupported  = 0x07
+	socksAtypUnsupported = 0x08
+)
+
+// socksHandshakeTimeout bounds the negotiation before the tunnel starts
+const socksHandshakeTimeout = 30 * time.Second
+
+// errSOCKSAuth is returned for rejected SOCKS credentials
+var errSOCKSAuth = errors.New("SOCKS authentication failed")
+
+// ServeSOCKS accepts SOCKS5 clients on l until it is closed. Only CONNECT
+// is supported. With proxy authentication enabled clients must log in with
+// a username and password (RFC 1929), checked by the Basic scheme.
+func (s *Server) ServeSOCKS(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS serves one SOCKS5 connection
+func (s *Server) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+
+	user, groups, app, err := s.socksNegotiate(reader, conn)
+	if err != nil {
+		s.log.Debug("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	target, err := readSOCKSRequest(reader, conn)
+	if err != nil {
+		s.log.Debug("Bad SOCKS request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Route the tunnel through the same request tracking, rules and stats
+	// as CONNECT
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, conn.LocalAddr())
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		Host:       target,
+		URL:        &url.URL{Host: target},
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(ctx)
+	w, r, finish := s.trackRequest(&socksWriter{header: make(http.Header)}, r)
+	defer finish()
+	if s.inMaintenance(r) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeSOCKSReply(conn, socksFailure, nil)
+		return
+	}
+	setRequestUser(r.Context(), user)
+	if app != "" {
+		setRequestApp(r.Context(), app)
+	}
+	s.resolveTenant(r, user, groups)
+
+	targetHost, targetPort, _ := net.SplitHostPort(target)
+	rule := s.blockingRule(r, user, targetHost, targetPort)
+	if rule != "" {
+		s.updateStats(statsName(r, target), true, 0, 1)
+		s.updateUserStats(statsName(r, user), true, 0, 1)
+		s.log.Info("BLOCKED SOCKS: %s", target)
+		s.recordBlocked(r, user, target, rule)
+		s.geo.RecordHostLocation(targetHost)
+		w.WriteHeader(http.StatusForbidden)
+		writeSOCKSReply(conn, socksNotAllowed, nil)
+		return
+	}
+
+	egress := s.egressFor(r.Context(), user, r.RemoteAddr, targetHost)
+	dialTarget := net.JoinHostPort(s.serviceHost(user, r.RemoteAddr, targetHost), targetPort)
+	var destConn net.Conn
+	up := s.upstreamFor(targetHost)
+	if up != nil {
+		destConn, err = s.dialUpstream(r.Context(), up, dialTarget, egress)
+	} else {
+		destConn, err = s.dialContext(r.Context(), "tcp", dialTarget, egress)
+	}
+	n := statsWeight(r, err != nil)
+	s.updateStats(statsName(r, target), false, 0, n)
+	s.updateUserStats(statsName(r, user), false, 0, n)
+	if err != nil {
+		if up != nil {
+			up.failures.Add(1)
+		}
+		s.log.Warn("SOCKS connect to %s failed: %v", target, err)
+		recordFailure(r, classifyFailure(err))
+		w.WriteHeader(gatewayStatus(err))
+		writeSOCKSReply(conn, socksHostUnreachable, nil)
+		return
+	}
+	s.recordOrigin(targetHost, destConn.RemoteAddr().String(), up != nil)
+	w.WriteHeader(http.StatusOK)
+	if err := writeSOCKSReply(conn, socksSucceeded, destConn.LocalAddr()); err != nil {
+		destConn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.emit(r, "connect", target, "socks")
+	s.activeTunnels.Add(1)
+	defer s.activeTunnels.Add(-1)
+
+	// Bytes the client sent along with the request are in reader
+	sent, received := s.relay(r, target, &socksConn{Conn: conn, reader: reader}, destConn)
+
+	if up != nil {
+		up.bytes.Add(uint64(sent + received))
+	}
+	addRequestBytes(r.Context(), uint64(sent+received))
+	s.updateUserStats(statsName(r, user), false, uint64(sent+received)*n, 0)
+}
+
+// socksNegotiate picks the authentication method and, with proxy
+// authentication enabled, verifies the client's username and password. It
+// returns the authenticated user and groups, and the application an
+// -app-agents agent tagged the connection with in a username of
+// [user;]app=<name>. Agents may log in that way without proxy
+// authentication too.
+func (s *Server) socksNegotiate(reader *bufio.Reader, conn net.Conn) (string, []string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", nil, "", err
+	}
+	if header[0] != socksVersion {
+		return "", nil, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", nil, "", err
+	}
+
+	agent := s.appAgents.match("", conn.RemoteAddr().String())
+	want := byte(socksMethodNone)
+	if len(s.auth) > 0 || (agent && bytes.IndexByte(methods, socksMethodPassword) >= 0) {
+		want = socksMethodPassword
+	}
+	offered := bytes.IndexByte(methods, want) >= 0
+	if !offered {
+		conn.Write([]byte{socksVersion, socksMethodRejected})
+		return "", nil, "", fmt.Errorf("client offered no acceptable method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", nil, "", err
+	}
+	if want == socksMethodNone {
+		return "", nil, "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	username, password, err := readSOCKSCredentials(reader)
+	if err != nil {
+		return "", nil, "", err
+	}
+	username, app := splitSOCKSApp(username)
+	if !agent {
+		app = ""
+	}
+	if len(s.auth) == 0 {
+		_, err := conn.Write([]byte{socksAuthVersion, socksSucceeded})
+		return "", nil, app, err
+	}
+	probe := &http.Request{Header: make(http.Header), RemoteAddr: conn.RemoteAddr().String()}
+	probe.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	identity, err := s.auth.Authenticate(probe)
+	if err != nil {
+		s.log.Warn("SOCKS authentication failed for %s: %v", conn.RemoteAddr(), err)
+		s.emitClient("auth", probe.RemoteAddr, username, err.Error())
+		conn.Write([]byte{socksAuthVersion, socksFailure})
+		return "", nil, "", errSOCKSAuth
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, socksSucceeded}); err != nil {
+		return "", nil, "", err
+	}
+	s.log.Debug("Authenticated SOCKS client %s as %s", conn.RemoteAddr(), identity.User)
+	return identity.User, identity.Groups, app, nil
+}
+
+// readSOCKSCredentials reads an RFC 1929 username/password request
+func readSOCKSCredentials(reader *bufio.Reader) (string, string, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != socksAuthVersion {
+		return "", "", fmt.Errorf("unsupported authentication version %d", version)
+	}
+	fields := make([]string, 2)
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], nil
+}
+
+// readSOCKSRequest reads a SOCKS5 request and returns its host:port target.
+// Unsupported requests are answered with an error reply.
+func readSOCKSRequest(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksCmdUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(conn, socksAtypUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKSReply sends a reply with status rep and the bound address, or
+// 0.0.0.0:0 when there is none
+func writeSOCKSReply(conn net.Conn, rep byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	atyp := byte(socksAtypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = socksAtypIPv6
+	}
+	reply := append([]byte{socksVersion, rep, 0, atyp}, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksConn reads through the buffered reader of the handshake
+type socksConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *socksConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socksWriter stands in for the response writer SOCKS requests do not
+// have, so they are tracked like CONNECT requests
+type socksWriter struct {
+	header http.Header
+}
+
+func (w *socksWriter) Header() http.Header         { return w.header }
+func (w *socksWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *socksWriter) WriteHeader(int)             {}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"go-proxy/internal/stats"
+)
+
+type ProxyStats struct {
+	HostStats map[string]*stats.HostStats
+	UserStats map[string]*stats.UserStats
+}
+
+// Add method to periodically save stats
+func (s *Server) periodicStatsSave() {
+	ticker := time.NewTicker(60 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.saveStatsToRedis()
+	}
+}
+
+// FlushStats writes the stats accumulated since the last periodic save to
+// Redis right away
+func (s *Server) FlushStats() {
+	s.saveStatsToRedis()
+}
+
+// Add method to save accumulated stats to Redis
+func (s *Server) saveStatsToRedis() {
+	if s.store == nil {
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		s.self.flushes.Add(1)
+		s.self.flushNanos.Store(int64(time.Since(start)))
+	}()
+
+	// Take the counters and let requests go on updating them while the
+	// store resolves hosts and waits on the network
+	hosts := s.takeHostStats()
+	for host, delta := range hosts {
+		err := s.store.RecordHostActivity(host, delta.Blocked, delta.BytesTransferred)
+		if err != nil {
+			s.log.Info("Error saving stats for host %s: %v", host, err)
+			s.self.flushErrors.Add(1)
+			s.restoreHostStats(host, delta)
+		}
+	}
+
+	s.saveUserStats()
+}
+
+// takeHostStats returns the activity of every host since the last save and
+// resets its counters
+func (s *Server) takeHostStats() map[string]stats.HostStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	now := time.Now()
+	hosts := make(map[string]stats.HostStats, len(s.stats.HostStats))
+	for host, hostStats := range s.stats.HostStats {
+		if hostStats.Connections > 0 || hostStats.BlockedAttempts > 0 {
+			hostStats.LastSeen = now
+			hosts[host] = *hostStats
+
+			hostStats.Connections = 0
+			hostStats.BlockedAttempts = 0
+			hostStats.BytesTransferred = 0
+		}
+	}
+	return hosts
+}
+
+// restoreHostStats adds back activity of host that could not be saved, to
+// be saved with the next flush
+func (s *Server) restoreHostStats(host string, delta stats.HostStats) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	hostStats, exists := s.stats.HostStats[host]
+	if !exists {
+		hostStats = &stats.HostStats{Host: host, Blocked: delta.Blocked, LastSeen: delta.LastSeen}
+		s.stats.HostStats[host] = hostStats
+	}
+	hostStats.Connections += delta.Connections
+	hostStats.BlockedAttempts += delta.BlockedAttempts
+	hostStats.BytesTransferred += delta.BytesTransferred
+}
+
+// updateStats adds connections and bytes to the in-memory stats of host
+func (s *Server) updateStats(host string, blocked bool, bytes uint64, connections uint64) {
+	// Nothing to count, e.g. for a request sampled out
+	if !blocked && bytes == 0 && connections == 0 {
+		return
+	}
+
+	// Extract host without port
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	hostStats, exists := s.stats.HostStats[host]
+	if !exists {
+		// The store resolves the IPs of hosts when it saves their
+		// first record, off the request path
+		hostStats = &stats.HostStats{
+			Host:     host,
+			LastSeen: time.Now(),
+		}
+		s.stats.HostStats[host] = hostStats
+	}
+
+	hostStats.Connections += int64(connections)
+	hostStats.BytesTransferred += bytes
+	if blocked {
+		hostStats.BlockedAttempts += int64(connections)
+		hostStats.Blocked = true
+	}
+}
+
+func (s *Server) startStatsMonitoring() {
+	// Only stores that can dump their contents take part
+	display, ok := s.store.(interface{ DisplayAllHostStats() })
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Minute)
+	go func() {
+		for range ticker.C {
+			display.DisplayAllHostStats()
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+
+	"go-proxy/internal/stats"
+)
+
+func newStatsServer() *Server {
+	return &Server{stats: &ProxyStats{
+		HostStats: make(map[string]*stats.HostStats),
+		UserStats: make(map[string]*stats.UserStats),
+	}}
+}
+
+func BenchmarkUpdateStats(b *testing.B) {
+	s := newStatsServer()
+	hosts := make([]string, 64)
+	for i := range hosts {
+		hosts[i] = "host" + strconv.Itoa(i) + ".example.com:443"
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.updateStats(hosts[i%len(hosts)], false, 1500, 1)
+	}
+}
+
+func BenchmarkUpdateUserStats(b *testing.B) {
+	s := newStatsServer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.updateUserStats("alice", false, 1500, 1)
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// responseHeaderTimeout bounds the wait for an origin's response headers.
+// It is generous so long polls get through; bodies have no deadline so
+// event streams can stay open.
+const responseHeaderTimeout = 2 * time.Minute
+
+// flushIntervalFor returns how often the body of resp is flushed to the
+// client: -1 flushes after every write, 0 only at the end
+func (s *Server) flushIntervalFor(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return -1
+	}
+	// Chunked or close-delimited bodies are usually streamed by the origin
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return s.cfg.FlushInterval
+}
+
+// copyResponse writes the body of resp to w, compressed with encoding
+// unless it is empty and flushed as flushIntervalFor decides. It returns
+// the number of body bytes read from the origin.
+func (s *Server) copyResponse(w http.ResponseWriter, resp *http.Response, encoding string) (int64, error) {
+	rc := http.NewResponseController(w)
+	var dst io.Writer = w
+	flush := rc.Flush
+
+	var compressor compressWriter
+	if encoding != "" {
+		compressor = newCompressWriter(w, encoding)
+		dst = compressor
+		flush = func() error {
+			if err := compressor.Flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+	}
+
+	n, err := copyFlushing(dst, resp.Body, flush, s.flushIntervalFor(resp))
+	if compressor != nil {
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return n, err
+}
+
+// copyFlushing copies src to dst, calling flush after every write for a
+// negative interval, at most interval after a write otherwise, and not at
+// all for 0
+func copyFlushing(dst io.Writer, src io.Reader, flush func() error, interval time.Duration) (int64, error) {
+	if interval == 0 {
+		return io.Copy(dst, src)
+	}
+	if interval < 0 {
+		// Let the client see the headers before the first event
+		if err := flush(); err != nil {
+			return io.Copy(dst, src)
+		}
+	}
+
+	fw := &flushWriter{dst: dst, flush: flush, latency: interval}
+	defer fw.stop()
+	return io.Copy(fw, src)
+}
+
+// announceTrailers declares the trailers resp announced, so the client
+// connection is chunked and can carry them after the body
+func announceTrailers(w http.ResponseWriter, resp *http.Response) {
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+}
+
+// copyTrailers sends the trailers of resp, which are only known once its
+// body has been read. Trailers the origin did not announce are sent too.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	announced := make(map[string]bool)
+	for _, value := range w.Header().Values("Trailer") {
+		announced[http.CanonicalHeaderKey(value)] = true
+	}
+	for name, values := range resp.Trailer {
+		if !announced[name] {
+			name = http.TrailerPrefix + name
+		}
+		w.Header()[name] = values
+	}
+}
+
+// CountingWriter to track response size
+type CountingWriter struct {
+	http.ResponseWriter
+	BytesWritten uint64
+}
+
+func (w *CountingWriter) Write(bytes []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(bytes)
+	w.BytesWritten += uint64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *CountingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flushWriter flushes dst after every write (negative latency) or at most
+// latency after the first unflushed write
+type flushWriter struct {
+	dst     io.Writer
+	flush   func() error
+	latency time.Duration
+
+	mutex   sync.Mutex // Serialises writes with timer flushes
+	timer   *time.Timer
+	pending bool // A timer flush is scheduled
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n, err := f.dst.Write(p)
+	if f.latency < 0 {
+		f.flush()
+		return n, err
+	}
+	if f.pending {
+		return n, err
+	}
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.latency, f.delayedFlush)
+	} else {
+		f.timer.Reset(f.latency)
+	}
+	f.pending = true
+	return n, err
+}
+
+func (f *flushWriter) delayedFlush() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// stop may have run since the timer fired
+	if !f.pending {
+		return
+	}
+	f.flush()
+	f.pending = false
+}
+
+// stop cancels a scheduled flush; the server flushes when the handler returns
+func (f *flushWriter) stop() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.pending = false
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// strictHeaderMax bounds the request head a strict connection inspects
+const strictHeaderMax = 1 << 20
+
+// strictCounters count the requests strict parsing rejected, by reason
+type strictCounters struct {
+	bareLF        atomic.Int64
+	duplicateCL   atomic.Int64
+	clAndTE       atomic.Int64
+	badTE         atomic.Int64
+	obsFold       atomic.Int64
+	spaceInHeader atomic.Int64
+}
+
+// StrictStats reports the requests -strict-parsing rejected
+type StrictStats struct {
+	BareLF        int64 `json:"bare_lf"`
+	DuplicateCL   int64 `json:"duplicate_content_length"`
+	CLAndTE       int64 `json:"content_length_and_transfer_encoding"`
+	BadTE         int64 `json:"bad_transfer_encoding"`
+	ObsFold       int64 `json:"obs_fold"`
+	SpaceInHeader int64 `json:"space_before_colon"`
+}
+
+// HandleStrictStats reports the requests rejected by strict parsing
+func (s *Server) HandleStrictStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StrictStats{
+		BareLF:        s.strict.bareLF.Load(),
+		DuplicateCL:   s.strict.duplicateCL.Load(),
+		CLAndTE:       s.strict.clAndTE.Load(),
+		BadTE:         s.strict.badTE.Load(),
+		ObsFold:       s.strict.obsFold.Load(),
+		SpaceInHeader: s.strict.spaceInHeader.Load(),
+	})
+}
+
+// StrictListener wraps a plain HTTP listener so that requests carrying
+// smuggling vectors are rejected before net/http, which tolerates some of
+// them, parses them. Only the first request of a connection is checked,
+// so the server using the listener must have keep-alives disabled.
+func (s *Server) StrictListener(l net.Listener) net.Listener {
+	return &strictListener{Listener: l, s: s}
+}
+
+type strictListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *strictListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictConn{Conn: conn, s: l.s}, nil
+}
+
+// errStrictRejected fails reads of a connection whose request was rejected
+var errStrictRejected = errors.New("request rejected by strict parsing")
+
+// strictConn holds back the request head until it is complete and valid;
+// everything after it (body, tunnelled bytes) passes through
+type strictConn struct {
+	net.Conn
+	s       *Server
+	head    []byte // Buffered request head
+	pending []byte // Checked bytes not yet returned to the reader
+	checked bool
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	for !c.checked {
+		buf := make([]byte, 4096)
+		n, err := c.Conn.Read(buf)
+		c.head = append(c.head, buf[:n]...)
+		end := headEnd(c.head)
+		if end < 0 && len(c.head) < strictHeaderMax && err == nil {
+			continue
+		}
+		if end < 0 {
+			// Incomplete or oversized; let net/http report it
+			end = len(c.head)
+		}
+		if reason := c.s.strictViolation(c.head[:end]); reason != "" {
+			c.s.log.Warn("Rejected request from %s: %s", c.RemoteAddr(), reason)
+			c.s.emitClient("abuse", c.RemoteAddr().String(), "", "malformed request: "+reason)
+			c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			c.Conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n" + reason + "\n"))
+			c.Conn.Close()
+			return 0, errStrictRejected
+		}
+		c.checked, c.pending, c.head = true, c.head, nil
+		if len(c.pending) == 0 && err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// headEnd returns the length of the request head in data, including the
+// blank line ending it, or -1 if it is incomplete. Bare LF line endings
+// count so they can be rejected.
+func headEnd(data []byte) int {
+	if i := bytes.Index(data, []byte("\n\r\n")); i >= 0 {
+		if j := bytes.Index(data, []byte("\n\n")); j >= 0 && j < i {
+			return j + 2
+		}
+		return i + 3
+	}
+	if j := bytes.Index(data, []byte("\n\n")); j >= 0 {
+		return j + 2
+	}
+	return -1
+}
+
+// strictViolation returns why head is rejected, or "" if it is acceptable
+func (s *Server) strictViolation(head []byte) string {
+	for i, b := range head {
+		if b == '\n' && (i == 0 || head[i-1] != '\r') {
+			s.strict.bareLF.Add(1)
+			return "bare LF line ending"
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(head, []byte("\r\n\r\n")), []byte("\r\n"))
+	contentLengths, transferEncodings := 0, 0
+	for _, line := range lines[1:] {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			s.strict.obsFold.Add(1)
+			return "obsolete header line folding"
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		if len(name) > 0 && (name[len(name)-1] == ' ' || name[len(name)-1] == '\t') {
+			s.strict.spaceInHeader.Add(1)
+			return "whitespace before header colon"
+		}
+		switch {
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			contentLengths++
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			transferEncodings++
+			if !bytes.EqualFold(bytes.TrimSpace(value), []byte("chunked")) {
+				s.strict.badTE.Add(1)
+				return "Transfer-Encoding other than chunked"
+			}
+		}
+	}
+	switch {
+	case contentLengths > 1:
+		s.strict.duplicateCL.Add(1)
+		return "duplicate Content-Length"
+	case transferEncodings > 1:
+		s.strict.badTE.Add(1)
+		return "duplicate Transfer-Encoding"
+	case contentLengths > 0 && transferEncodings > 0:
+		s.strict.clAndTE.Add(1)
+		return "both Content-Length and Transfer-Encoding"
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"go-proxy/internal/logger"
+)
+
+// pipeClient is the address strict connections in tests come from
+var pipeClient = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+// pipeConn is a client connection reading from in and recording what the
+// proxy writes back
+type pipeConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *pipeConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *pipeConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *pipeConn) Close() error                { return nil }
+func (c *pipeConn) RemoteAddr() net.Addr        { return pipeClient }
+
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// readStrict passes data through a strict connection, one byte per read
+// if slow is set, and returns what net/http would read and what the client
+// is sent back
+func readStrict(s *Server, data []byte, slow bool) ([]byte, string, error) {
+	var in io.Reader = bytes.NewReader(data)
+	if slow {
+		in = iotest.OneByteReader(in)
+	}
+	client := &pipeConn{in: in}
+	read, err := io.ReadAll(&strictConn{Conn: client, s: s})
+	return read, client.out.String(), err
+}
+
+func TestStrictConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		reason  string // "" if accepted
+	}{
+		{
+			name:    "valid",
+			request: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name:    "valid with body",
+			request: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody",
+		},
+		{
+			name:    "chunked",
+			request: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+		},
+		{
+			name:    "bare LF",
+			request: "GET http://example.com/ HTTP/1.1\nHost: example.com\r\n\r\n",
+			reason:  "bare LF line ending",
+		},
+		{
+			name:    "bare LF head end",
+			request: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\n\n",
+			reason:  "bare LF line ending",
+		},
+		{
+			name:    "duplicate Content-Length",
+			request: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\ncontent-length: 5\r\n\r\nbody",
+			reason:  "duplicate Content-Length",
+		},
+		{
+			name:    "Content-Length and Transfer-Encoding",
+			request: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			reason:  "both Content-Length and Transfer-Encoding",
+		},
+		{
+			name:    "Transfer-Encoding other than chunked",
+			request: "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+			reason:  "Transfer-Encoding other than chunked",
+		},
+		{
+			name:    "obs-fold",
+			request: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Folded: a\r\n b\r\n\r\n",
+			reason:  "obsolete header line folding",
+		},
+		{
+			name:    "space before colon",
+			request: "GET http://example.com/ HTTP/1.1\r\nHost : example.com\r\n\r\n",
+			reason:  "whitespace before header colon",
+		},
+	}
+	for _, test := range tests {
+		for _, slow := range []bool{false, true} {
+			s := &Server{log: logger.Discard()}
+			read, reply, err := readStrict(s, []byte(test.request), slow)
+			if test.reason == "" {
+				if err != nil || string(read) != test.request || reply != "" {
+					t.Errorf("%s (slow %t): read %q, %v, replied %q; want the request passed through",
+						test.name, slow, read, err, reply)
+				}
+				continue
+			}
+			if !errors.Is(err, errStrictRejected) || len(read) != 0 {
+				t.Errorf("%s (slow %t): read %q, %v; want it rejected", test.name, slow, read, err)
+			}
+			if !strings.HasPrefix(reply, "HTTP/1.1 400 ") || !strings.HasSuffix(reply, test.reason+"\n") {
+				t.Errorf("%s (slow %t): replied %q, want a 400 giving %q", test.name, slow, reply, test.reason)
+			}
+		}
+	}
+}
+
+func TestStrictConnCounts(t *testing.T) {
+	s := &Server{log: logger.Discard()}
+	readStrict(s, []byte("GET / HTTP/1.1\nHost: a\n\n"), false)
+	readStrict(s, []byte("POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 1\r\n\r\nab"), false)
+	readStrict(s, []byte("GET / HTTP/1.1\r\nX: a\r\n\tb\r\n\r\n"), false)
+	if s.strict.bareLF.Load() != 1 || s.strict.duplicateCL.Load() != 1 || s.strict.obsFold.Load() != 1 {
+		t.Errorf("counted bare LF %d, duplicate Content-Length %d, obs-fold %d; want 1 each",
+			s.strict.bareLF.Load(), s.strict.duplicateCL.Load(), s.strict.obsFold.Load())
+	}
+}
+
+// FuzzStrictConn checks that any input is either rejected with a 400 or
+// passed through unchanged, however it arrives
+func FuzzStrictConn(f *testing.F) {
+	f.Add([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"), false)
+	f.Add([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"), true)
+	f.Add([]byte("GET / HTTP/1.1\nHost: a\r\n\r\n"), false)
+	f.Add([]byte("GET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n"), true)
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n\x16\x03\x01"), false)
+	f.Fuzz(func(t *testing.T, data []byte, slow bool) {
+		s := &Server{log: logger.Discard()}
+		read, reply, err := readStrict(s, data, slow)
+		if errors.Is(err, errStrictRejected) {
+			if !strings.HasPrefix(reply, "HTTP/1.1 400 ") {
+				t.Fatalf("rejected %q replying %q, want a 400", data, reply)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("reading %q: %v", data, err)
+		}
+		if !bytes.Equal(read, data) || reply != "" {
+			t.Fatalf("passed %q through as %q, replying %q", data, read, reply)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"go-proxy/internal/tenant"
+)
+
+// tenantSet holds the tenants of -tenants and their blacklists
+type tenantSet struct {
+	mutex      sync.RWMutex
+	registry   *tenant.Registry            // nil without -tenants
+	blacklists map[string][]*regexp.Regexp // Tenant -> its own patterns
+}
+
+// loadTenants reads the tenants in path, and their blacklists, and returns
+// the function swapping them in. An empty path removes every tenant.
+func (s *Server) loadTenants(path string) (func(), error) {
+	var registry *tenant.Registry
+	blacklists := make(map[string][]*regexp.Regexp)
+	if path != "" {
+		var err error
+		if registry, err = tenant.Load(path); err != nil {
+			return nil, err
+		}
+		for _, t := range registry.Tenants() {
+			if t.Blacklist == "" {
+				continue
+			}
+			regs, err := s.readBlacklist(t.Blacklist)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+			blacklists[t.Name] = regs
+		}
+	}
+
+	return func() {
+		s.tenants.mutex.Lock()
+		s.tenants.registry = registry
+		s.tenants.blacklists = blacklists
+		s.tenants.mutex.Unlock()
+		if registry != nil {
+			s.log.Info("Loaded %d tenants", len(registry.Tenants()))
+		}
+	}, nil
+}
+
+// Tenants returns the current tenants, nil if there are none
+func (s *Server) Tenants() *tenant.Registry {
+	s.tenants.mutex.RLock()
+	defer s.tenants.mutex.RUnlock()
+	return s.tenants.registry
+}
+
+// resolveTenant attributes r to the tenant of user, its groups or the
+// listener port it came in on
+func (s *Server) resolveTenant(r *http.Request, user string, groups []string) {
+	registry := s.Tenants()
+	if registry == nil {
+		return
+	}
+	port := 0
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	if t := registry.Resolve(user, groups, port); t != nil {
+		if record, ok := r.Context().Value(requestKey{}).(*RequestRecord); ok {
+			record.Tenant = t.Name
+		}
+	}
+}
+
+// requestTenant returns the tenant r belongs to, or ""
+func requestTenant(r *http.Request) string {
+	if record, ok := r.Context().Value(requestKey{}).(*RequestRecord); ok {
+		return record.Tenant
+	}
+	return ""
+}
+
+// statsName returns the host or user name r is counted under in the stats:
+// name in the namespace of r's tenant
+func statsName(r *http.Request, name string) string {
+	if name == "" {
+		return ""
+	}
+	return tenant.Scope(requestTenant(r), name)
+}
+
+// tenantRule returns the rule of r's tenant blacklist that blocks target,
+// or ""
+func (s *Server) tenantRule(r *http.Request, target string) string {
+	name := requestTenant(r)
+	if name == "" {
+		return ""
+	}
+	s.tenants.mutex.RLock()
+	defer s.tenants.mutex.RUnlock()
+	for _, reg := range s.tenants.blacklists[name] {
+		if reg.MatchString(target) {
+			return "tenant:" + name + ":" + reg.String()
+		}
+	}
+	return ""
+}
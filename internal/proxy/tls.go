@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-proxy/internal/config"
+	"go-proxy/internal/logger"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, so renewed certificates are picked up without a restart.
+const certCheckInterval = 30 * time.Second
+
+// NewTLSConfig builds the TLS configuration for the TLS proxy listener
+// ("secure web proxy": clients speak TLS to the proxy itself, hiding
+// credentials and CONNECT targets from on-path observers). When a client CA
+// is configured every client must present a certificate signed by it; the
+// certificate subject then identifies the proxy user.
+func NewTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	reloader := &certReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// Without this http.Server would offer h2 even if not enabled
+		NextProtos: []string{"http/1.1"},
+	}
+	if cfg.TLSHTTP2 {
+		// CONNECT is then served per stream, many tunnels per connection
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader serves the listener certificate and reloads it when the
+// certificate or key file changes on disk.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) > certCheckInterval {
+		c.checked = time.Now()
+		if c.latestModTime().After(c.modTime) {
+			if err := c.loadLocked(); err != nil {
+				// Keep serving the previous certificate
+				logger.Warn("Failed to reload TLS certificate: %v", err)
+			} else {
+				logger.Log("Reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	return c.loadLocked()
+}
+
+func (c *certReloader) loadLocked() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// ServeProxy handles both CONNECT and plain HTTP proxy requests, for
+// listeners that carry both kinds of traffic (the TLS proxy listener).
+func (s *Server) ServeProxy(w http.ResponseWriter, r *http.Request) {
+	markServed(r)
+	if r.Method == http.MethodConnect {
+		s.HandleHTTPS(w, r)
+		return
+	}
+	s.HandleHTTP(w, r)
+}
+
+// loadCertUserMap reads a file of "<subject> <user>" lines mapping client
+// certificate subjects (full DN or CN) to proxy users.
+func loadCertUserMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cert user map: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndexAny(line, " \t")
+		if idx == -1 {
+			logger.Warn("Invalid cert user map line: %q", line)
+			continue
+		}
+		users[strings.TrimSpace(line[:idx])] = line[idx+1:]
+	}
+	return users, scanner.Err()
+}
+
+// certUser maps the verified client certificate of r to a proxy user. It
+// returns "" for requests without a certificate and false when a user map
+// is configured but the certificate subject is not in it.
+func (s *Server) certUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", true
+	}
+	subject := r.TLS.PeerCertificates[0].Subject
+
+	s.identityMutex.RLock()
+	users := s.certUsers
+	s.identityMutex.RUnlock()
+
+	if users == nil {
+		return subject.CommonName, subject.CommonName != ""
+	}
+	if user, ok := users[subject.String()]; ok {
+		return user, true
+	}
+	if user, ok := users[subject.CommonName]; ok {
+		return user, true
+	}
+	return "", false
+}
+
+// HandlePAC serves a proxy auto-config file pointing browsers at the TLS
+// proxy listener, which is how most browsers are configured to use a
+// secure web proxy.
+func (s *Server) HandlePAC(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	proxyAddr := net.JoinHostPort(host, strconv.Itoa(s.cfg.TLSPort))
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n  return \"HTTPS %s\";\n}\n", proxyAddr)
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ActiveTunnels returns the number of CONNECT tunnels currently open
+func (s *Server) ActiveTunnels() int64 {
+	return s.activeTunnels.Load()
+}
+
+// WaitForTunnels blocks until all CONNECT tunnels have closed or ctx is done
+func (s *Server) WaitForTunnels(ctx context.Context) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.activeTunnels.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// HandleHTTPS handles CONNECT requests, tunnelling to the requested host
+func (s *Server) HandleHTTPS(w http.ResponseWriter, r *http.Request) {
+	w, r, finish := s.trackRequest(w, r)
+	defer finish()
+	if s.inMaintenance(r) {
+		s.writeMaintenance(w, r)
+		return
+	}
+
+	user, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	setRequestUser(r.Context(), user)
+	s.tagApp(r)
+
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetHost, targetPort, err := connectTarget(r.Host)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	host := net.JoinHostPort(targetHost, targetPort)
+	rule := s.blockingRule(r, user, targetHost, targetPort)
+	if rule != "" {
+		s.updateStats(statsName(r, host), true, 0, 1)
+		s.updateUserStats(statsName(r, user), true, 0, 1)
+		s.log.Info("BLOCKED HTTPS: %s", host)
+		s.recordBlocked(r, user, host, rule)
+		s.geo.RecordHostLocation(targetHost)
+		s.writeBlocked(w, r, rule)
+		return
+	}
+
+	egress := s.egressFor(r.Context(), user, r.RemoteAddr, targetHost)
+	dialHost := net.JoinHostPort(s.serviceHost(user, r.RemoteAddr, targetHost), targetPort)
+	var destConn net.Conn
+	up := s.upstreamFor(targetHost)
+	if up != nil {
+		destConn, err = s.dialUpstream(r.Context(), up, dialHost, egress)
+	} else {
+		destConn, err = s.dialContext(r.Context(), "tcp", dialHost, egress)
+	}
+	n := statsWeight(r, err != nil)
+	s.updateStats(statsName(r, host), false, 0, n)
+	s.updateUserStats(statsName(r, user), false, 0, n)
+	if err != nil {
+		if up != nil {
+			up.failures.Add(1)
+		}
+		recordFailure(r, classifyFailure(err))
+		s.writeError(w, r, gatewayStatus(err), err.Error())
+		return
+	}
+
+	s.recordOrigin(targetHost, destConn.RemoteAddr().String(), up != nil)
+	sent, received, err := s.tunnel(w, r, host, destConn)
+	if err != nil {
+		destConn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if up != nil {
+		up.bytes.Add(uint64(sent + received))
+	}
+	addRequestBytes(r.Context(), uint64(sent+received))
+	s.updateUserStats(statsName(r, user), false, uint64(sent+received)*n, 0)
+}
+
+// tunnel answers the CONNECT request r and relays between its client and
+// destConn, a connection to host, until either side closes. It returns the
+// bytes sent to and received from the client. HTTP/1 connections are
+// hijacked; over HTTP/2 the tunnel is the request's stream, so one client
+// connection carries many tunnels.
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request, host string, destConn net.Conn) (int64, int64, error) {
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	var client io.ReadWriteCloser
+	if r.ProtoMajor == 2 {
+		if err := controller.Flush(); err != nil {
+			return 0, 0, err
+		}
+		client = &streamConn{body: r.Body, w: w, controller: controller}
+	} else {
+		conn, _, err := controller.Hijack()
+		if err != nil {
+			return 0, 0, err
+		}
+		client = conn
+	}
+
+	s.emit(r, "connect", host, "")
+	s.activeTunnels.Add(1)
+	defer s.activeTunnels.Add(-1)
+
+	sent, received := s.relay(r, host, client, destConn)
+	return sent, received, nil
+}
+
+// relay copies between client and destConn, a connection to host, until
+// either side closes, classifying the tunnel by what the client sends. It
+// returns the bytes sent to and received from the client, as counted by the
+// kernel on destConn with -tunnel-accounting=kernel, which also go to the
+// stats of host.
+func (s *Server) relay(r *http.Request, host string, client io.ReadWriteCloser, destConn net.Conn) (int64, int64) {
+	var counted *kernelCountedConn
+	weight := requestWeight(r.Context())
+	if s.cfg.TunnelAccounting == "kernel" {
+		counted = &kernelCountedConn{Conn: destConn}
+		destConn = counted
+		weight = 0 // Counted below
+	}
+	sniff := &sniffer{ReadCloser: client, s: s, r: r, host: host}
+	t := s.registerTunnel(r, host)
+	defer s.unregisterTunnel(t)
+
+	// The handler goroutine is free now; use it for one direction
+	var received int64
+	done := make(chan struct{})
+	s.tunnelGoroutine(t, 1)
+	go func() {
+		defer s.tunnelGoroutine(t, -1)
+		received = s.transfer(statsName(r, host), destConn, s.meterUpload(r, host, sniff), weight)
+		close(done)
+	}()
+	s.tunnelGoroutine(t, 1)
+	sent := s.transfer(statsName(r, host), client, destConn, 0)
+	s.tunnelGoroutine(t, -1)
+	<-done
+	if counted != nil {
+		sent, received = counted.counts(sent, received)
+		s.updateStats(statsName(r, host), false, uint64(sent+received)*requestWeight(r.Context()), 0)
+	}
+
+	s.protocols.add(sniff.protocol(), sniff.denied, uint64(sent+received))
+	if sniff.protocol() == protoTLS && !sniff.denied {
+		s.watchCert(host)
+	}
+	return sent, received
+}
+
+// streamConn is the client side of a tunnel carried by an HTTP/2 stream
+type streamConn struct {
+	body       io.ReadCloser
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+// Write sends p to the client right away; tunnelled protocols are
+// interactive
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err == nil {
+		err = c.controller.Flush()
+	}
+	return n, err
+}
+
+// Close stops reading from the client; the stream itself ends when the
+// handler returns
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+// transfer copies src to dest until either closes. When the copy fails the
+// bytes copied count weight times in the stats of host.
+func (s *Server) transfer(host string, dest io.WriteCloser, src io.ReadCloser, weight uint64) int64 {
+	defer dest.Close()
+	defer src.Close()
+	var writenBVytes int64
+	var err error
+	if s.ring != nil {
+		writenBVytes, err = s.ring.copy(dest, src)
+	} else {
+		writenBVytes, err = io.Copy(dest, src)
+	}
+	if err != nil {
+		s.updateStats(host, false, uint64(writenBVytes)*weight, 0)
+	}
+	return writenBVytes
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is one proxy of the -upstreams pool
+type upstream struct {
+	url      *url.URL
+	name     string // URL without credentials, for logs and stats
+	healthy  atomic.Bool
+	requests atomic.Int64
+	failures atomic.Int64
+	bytes    atomic.Uint64
+	latency  atomic.Int64 // Round trip of the last health check, in microseconds
+}
+
+// upstreamPool picks the upstream proxy each request is sent through
+type upstreamPool struct {
+	upstreams []*upstream
+	strategy  string // round-robin, sticky or random
+	next      atomic.Uint64
+}
+
+// UpstreamStats reports the traffic and health of one upstream proxy
+type UpstreamStats struct {
+	URL       string  `json:"url"`
+	Healthy   bool    `json:"healthy"`
+	Requests  int64   `json:"requests"`
+	Failures  int64   `json:"failures"`
+	Bytes     uint64  `json:"bytes"`
+	LatencyMs float64 `json:"latency_ms"` // Last health check round trip
+}
+
+// upstreamKey is the context key of the upstream chosen for a request
+type upstreamKey struct{}
+
+// newUpstreamPool parses the comma separated proxy URLs of -upstreams.
+// Every upstream starts out healthy.
+func newUpstreamPool(value, strategy string) (*upstreamPool, error) {
+	pool := &upstreamPool{strategy: strategy}
+	for _, item := range splitList(value) {
+		u, err := url.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q: want http(s)://[user:pass@]host:port", item)
+		}
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			u.Host = net.JoinHostPort(u.Hostname(), port)
+		}
+		up := &upstream{url: u, name: u.Scheme + "://" + u.Host}
+		up.healthy.Store(true)
+		pool.upstreams = append(pool.upstreams, up)
+	}
+	if len(pool.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams in %q", value)
+	}
+	return pool, nil
+}
+
+// startUpstreams sends requests through the proxies in value and health
+// checks them every interval (0 disables health checks)
+func (s *Server) startUpstreams(value, strategy string, interval time.Duration) {
+	pool, err := newUpstreamPool(value, strategy)
+	if err != nil {
+		s.log.Info("Error loading upstreams: %v", err)
+		return
+	}
+	s.upstreams = pool
+	s.log.Info("Sending requests through %d upstreams (%s)", len(pool.upstreams), strategy)
+	if interval > 0 {
+		go s.checkUpstreams(interval)
+	}
+}
+
+// pick returns the upstream for a request to host. Unhealthy upstreams are
+// skipped unless none is healthy, in which case all of them are tried.
+func (p *upstreamPool) pick(host string) *upstream {
+	if p.strategy == "sticky" {
+		// Hash over the whole pool so hosts keep their upstream while
+		// others fail and recover
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		start := int(h.Sum32() % uint32(len(p.upstreams)))
+		for i := range p.upstreams {
+			if up := p.upstreams[(start+i)%len(p.upstreams)]; up.healthy.Load() {
+				return up
+			}
+		}
+		return p.upstreams[start]
+	}
+
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, up := range p.upstreams {
+		if up.healthy.Load() {
+			candidates = append(candidates, up)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+	if p.strategy == "random" {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	return candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// upstreamFor returns the upstream a request to host is sent through, or
+// nil to connect directly
+func (s *Server) upstreamFor(host string) *upstream {
+	if s.upstreams == nil {
+		return nil
+	}
+	up := s.upstreams.pick(host)
+	up.requests.Add(1)
+	return up
+}
+
+// upstreamProxy is the Proxy function of the forwarding transports: it
+// sends requests through the upstream chosen in HandleHTTP
+func upstreamProxy(r *http.Request) (*url.URL, error) {
+	if up, ok := r.Context().Value(upstreamKey{}).(*upstream); ok {
+		return up.url, nil
+	}
+	return nil, nil
+}
+
+// dialUpstream opens a tunnel to addr through the upstream proxy up,
+// reaching up itself via egress. The tunnel counts against the cap on
+// connections to the host of addr, not to the upstream, which every origin
+// it serves shares.
+func (s *Server) dialUpstream(ctx context.Context, up *upstream, addr, egress string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acquireOrigin(host); err != nil {
+		return nil, err
+	}
+	conn, err := s.connectUpstream(ctx, up, addr, egress)
+	if err != nil {
+		s.releaseOrigin(host)
+		return nil, err
+	}
+	return &originConn{Conn: conn, s: s, host: host}, nil
+}
+
+// connectUpstream sends CONNECT addr to the upstream proxy up. With
+// -upstream-proxy-protocol the connection starts with a PROXY protocol
+// header naming the client.
+func (s *Server) connectUpstream(ctx context.Context, up *upstream, addr, egress string) (net.Conn, error) {
+	conn, err := s.dialOrigin(ctx, "tcp", up.url.Host, egress)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if version := s.cfg.UpstreamProxyProto; version != "" {
+		client, local := requestAddrs(ctx)
+		if _, err := conn.Write(proxyHeader(version, client, local)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream %s: %w", up.name, err)
+		}
+	}
+	if up.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: up.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream %s: %w", up.name, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := up.url.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s: %w", up.name, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s: %w", up.name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s refused CONNECT %s: %s", up.name, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Origins that speak first may already have sent data
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// checkUpstreams dials every upstream each interval and marks those that
+// cannot be reached unhealthy until they can be again
+func (s *Server) checkUpstreams(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, up := range s.upstreams.upstreams {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			start := time.Now()
+			conn, err := s.dialContext(ctx, "tcp", up.url.Host, "")
+			cancel()
+			if err == nil {
+				conn.Close()
+				up.latency.Store(time.Since(start).Microseconds())
+			}
+
+			healthy := err == nil
+			if up.healthy.Swap(healthy) != healthy {
+				if healthy {
+					s.log.Info("Upstream %s is healthy again", up.name)
+				} else {
+					s.log.Warn("Upstream %s is unhealthy: %v", up.name, err)
+				}
+			}
+		}
+	}
+}
+
+// UpstreamStats returns the counters of each upstream proxy since startup
+func (s *Server) UpstreamStats() []UpstreamStats {
+	if s.upstreams == nil {
+		return []UpstreamStats{}
+	}
+	result := make([]UpstreamStats, 0, len(s.upstreams.upstreams))
+	for _, up := range s.upstreams.upstreams {
+		result = append(result, UpstreamStats{
+			URL:       up.name,
+			Healthy:   up.healthy.Load(),
+			Requests:  up.requests.Load(),
+			Failures:  up.failures.Load(),
+			Bytes:     up.bytes.Load(),
+			LatencyMs: float64(up.latency.Load()) / 1000,
+		})
+	}
+	return result
+}
+
+// HandleUpstreamStats serves UpstreamStats as JSON
+func (s *Server) HandleUpstreamStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.UpstreamStats())
+}
@@ -0,0 +1,378 @@
+//go:build linux && iouring
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// uringEntries is the size of the submission queue shared by all tunnels
+const uringEntries = 256
+
+// From linux/io_uring.h
+const (
+	uringOpSend        = 26
+	uringOpRecv        = 27
+	uringEnterGetEvent = 1
+	uringOffSQRing     = 0
+	uringOffCQRing     = 0x8000000
+	uringOffSQEs       = 0x10000000
+)
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	msgFlags    uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	pad         [2]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringRequest is a send or receive waiting for its completion
+type uringRequest struct {
+	op   uint8
+	fd   uintptr
+	buf  []byte
+	done chan int32
+}
+
+// uring copies tunnel data with send and receive operations batched into
+// one io_uring for all tunnels: under load many tunnels' operations go to
+// the kernel in a single io_uring_enter. Sockets stay non-blocking and in
+// Go's poller, so an operation that would block completes with EAGAIN and
+// is retried when the poller finds the socket ready, which keeps deadlines
+// and Close working as with plain reads and writes.
+type uring struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqes    []uringSQE
+	params  uringParams
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []uringCQE
+
+	submissions chan *uringRequest
+	slots       chan struct{} // Bounds requests in flight by the completion queue
+	requests    sync.Pool
+
+	mutex   sync.Mutex
+	pending map[uint64]*uringRequest
+	nextID  uint64
+
+	ops    atomic.Int64 // Sends and receives completed
+	enters atomic.Int64 // io_uring_enter calls submitting them
+}
+
+// newURing sets up the ring and starts the goroutines submitting to and
+// reaping from it
+func newURing() (*uring, error) {
+	u := &uring{pending: make(map[uint64]*uringRequest)}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&u.params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	u.fd = int(fd)
+	p := &u.params
+
+	var err error
+	u.sqRing, err = unix.Mmap(u.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		unix.Close(u.fd)
+		return nil, fmt.Errorf("map submission queue: %w", err)
+	}
+	u.cqRing, err = unix.Mmap(u.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		unix.Munmap(u.sqRing)
+		unix.Close(u.fd)
+		return nil, fmt.Errorf("map completion queue: %w", err)
+	}
+	sqes, err := unix.Mmap(u.fd, uringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		unix.Munmap(u.cqRing)
+		unix.Munmap(u.sqRing)
+		unix.Close(u.fd)
+		return nil, fmt.Errorf("map submission entries: %w", err)
+	}
+
+	u.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&sqes[0])), p.sqEntries)
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.ringMask]))
+	u.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.array])), p.sqEntries)
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.ringMask]))
+	u.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&u.cqRing[p.cqOff.cqes])), p.cqEntries)
+
+	u.submissions = make(chan *uringRequest, p.sqEntries)
+	u.slots = make(chan struct{}, p.cqEntries)
+	u.requests.New = func() any { return &uringRequest{done: make(chan int32, 1)} }
+	go u.submitLoop()
+	go u.reapLoop()
+	return u, nil
+}
+
+// enter calls io_uring_enter, retrying when interrupted
+func (u *uring) enter(submit, wait, flags uint32) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(submit), uintptr(wait), uintptr(flags), 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return int(n), errno
+		}
+		return int(n), nil
+	}
+}
+
+// submitLoop writes waiting requests to the submission queue and submits
+// them, as many at a time as have queued up
+func (u *uring) submitLoop() {
+	for req := range u.submissions {
+		batch := []*uringRequest{req}
+	collect:
+		for len(batch) < len(u.sqes) {
+			select {
+			case req := <-u.submissions:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+
+		tail := atomic.LoadUint32(u.sqTail)
+		ids := make([]uint64, len(batch))
+		u.mutex.Lock()
+		for i, req := range batch {
+			u.nextID++
+			ids[i] = u.nextID
+			u.pending[u.nextID] = req
+			index := (tail + uint32(i)) & u.sqMask
+			u.sqes[index] = uringSQE{
+				opcode:   req.op,
+				fd:       int32(req.fd),
+				addr:     uint64(uintptr(unsafe.Pointer(&req.buf[0]))),
+				len:      uint32(len(req.buf)),
+				msgFlags: unix.MSG_DONTWAIT | unix.MSG_NOSIGNAL,
+				userData: u.nextID,
+			}
+			u.sqArray[index] = index
+		}
+		u.mutex.Unlock()
+		atomic.StoreUint32(u.sqTail, tail+uint32(len(batch)))
+
+		for submitted := 0; submitted < len(batch); {
+			n, err := u.enter(uint32(len(batch)-submitted), 0, 0)
+			u.enters.Add(1)
+			if err == unix.EAGAIN || err == unix.EBUSY {
+				continue
+			}
+			if err != nil {
+				// Take back what the kernel did not read and fail it
+				atomic.StoreUint32(u.sqTail, tail+uint32(submitted))
+				u.mutex.Lock()
+				for i := submitted; i < len(batch); i++ {
+					delete(u.pending, ids[i])
+					batch[i].done <- -int32(err.(syscall.Errno))
+				}
+				u.mutex.Unlock()
+				break
+			}
+			submitted += n
+		}
+	}
+}
+
+// reapLoop hands completions to the requests waiting for them
+func (u *uring) reapLoop() {
+	for {
+		head, tail := atomic.LoadUint32(u.cqHead), atomic.LoadUint32(u.cqTail)
+		if head == tail {
+			u.enter(0, 1, uringEnterGetEvent)
+			continue
+		}
+		u.mutex.Lock()
+		for ; head != tail; head++ {
+			cqe := u.cqes[head&u.cqMask]
+			if req, ok := u.pending[cqe.userData]; ok {
+				delete(u.pending, cqe.userData)
+				req.done <- cqe.res
+			}
+		}
+		u.mutex.Unlock()
+		atomic.StoreUint32(u.cqHead, head)
+	}
+}
+
+// do runs one send or receive on fd and returns its result, a byte count
+// or a negated errno
+func (u *uring) do(op uint8, fd uintptr, buf []byte) int32 {
+	u.slots <- struct{}{}
+	req := u.requests.Get().(*uringRequest)
+	req.op, req.fd, req.buf = op, fd, buf
+	u.submissions <- req
+	res := <-req.done
+	req.buf = nil
+	u.requests.Put(req)
+	<-u.slots
+	u.ops.Add(1)
+	return res
+}
+
+// recv reads into buf from raw
+func (u *uring) recv(raw syscall.RawConn, buf []byte) (int, error) {
+	var res int32
+	err := raw.Read(func(fd uintptr) bool {
+		res = u.do(uringOpRecv, fd, buf)
+		return res != -int32(unix.EAGAIN)
+	})
+	switch {
+	case err != nil:
+		return 0, err
+	case res < 0:
+		return 0, os.NewSyscallError("recv", syscall.Errno(-res))
+	case res == 0:
+		return 0, io.EOF
+	}
+	return int(res), nil
+}
+
+// send writes all of buf to raw
+func (u *uring) send(raw syscall.RawConn, buf []byte) (int, error) {
+	sent := 0
+	var sendErr error
+	err := raw.Write(func(fd uintptr) bool {
+		for sent < len(buf) {
+			res := u.do(uringOpSend, fd, buf[sent:])
+			if res == -int32(unix.EAGAIN) {
+				return false
+			}
+			if res < 0 {
+				sendErr = os.NewSyscallError("send", syscall.Errno(-res))
+				return true
+			}
+			sent += int(res)
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	return sent, err
+}
+
+// copy copies src to dst like io.Copy, going through the ring for the
+// sides that are TCP connections
+func (u *uring) copy(dst io.Writer, src io.Reader) (int64, error) {
+	in, out := uringConn(src), uringConn(dst)
+	if in == nil && out == nil {
+		return io.Copy(dst, src)
+	}
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		var n int
+		var err error
+		if in != nil {
+			n, err = u.recv(in, buf)
+		} else {
+			n, err = src.Read(buf)
+		}
+		if n > 0 {
+			var m int
+			var writeErr error
+			if out != nil {
+				m, writeErr = u.send(out, buf[:n])
+			} else {
+				m, writeErr = dst.Write(buf[:n])
+			}
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// counts returns the operations completed and the io_uring_enter calls
+// that submitted them
+func (u *uring) counts() (int64, int64) {
+	return u.ops.Load(), u.enters.Load()
+}
+
+// uringConn returns the socket under v if v is a TCP connection, directly
+// or in a wrapper that passes data through unchanged, or nil
+func uringConn(v interface{}) syscall.RawConn {
+	for {
+		switch c := v.(type) {
+		case *net.TCPConn:
+			raw, err := c.SyscallConn()
+			if err != nil {
+				return nil
+			}
+			return raw
+		case *originConn:
+			v = c.Conn
+		case *kernelCountedConn:
+			v = c.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux || !iouring
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+)
+
+// uring is only built on Linux with -tags iouring
+type uring struct{}
+
+func newURing() (*uring, error) {
+	return nil, fmt.Errorf("io_uring support is not built in (rebuild on Linux with -tags iouring)")
+}
+
+func (*uring) copy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+func (*uring) counts() (int64, int64) {
+	return 0, 0
+}
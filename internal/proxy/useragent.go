@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mileusna/useragent"
+)
+
+// userAgent is what a User-Agent string tells about the device sending it
+type userAgent struct {
+	Browser        string `json:"browser"` // e.g. chrome, safari, curl; "" if unknown
+	BrowserVersion string `json:"browser_version,omitempty"`
+	OS             string `json:"os"` // windows, macos, ios, ipados, android, chromeos, linux; "" if unknown
+	OSVersion      string `json:"os_version,omitempty"`
+	// OSVersionFrozen is set when OSVersion is one browsers keep sending on
+	// newer releases, so the real version may be newer
+	OSVersionFrozen bool   `json:"os_version_frozen,omitempty"`
+	Device          string `json:"device"` // desktop, mobile, tablet, tv, console, bot or other
+}
+
+// uaBrowsers maps the parser's browser names to ours; others are lowercased
+var uaBrowsers = map[string]string{
+	useragent.HeadlessChrome:   "chrome",
+	useragent.MobileSafari:     "safari",
+	useragent.OperaMini:        "opera",
+	useragent.OperaTouch:       "opera",
+	useragent.InternetExplorer: "ie",
+	useragent.SamsungBrowser:   "samsung",
+	"YaBrowser":                "yandex",
+	"Go-http-client":           "go",
+	"python-requests":          "python",
+	"Python-urllib":            "python",
+}
+
+// uaSystems maps the parser's OS names to ours; others are lowercased
+var uaSystems = map[string]string{
+	useragent.MacOS:    "macos",
+	useragent.ChromeOS: "chromeos",
+}
+
+var (
+	uaVersion       = regexp.MustCompile(`^[0-9]+(?:\.[0-9]+)*$`)
+	uaIE            = regexp.MustCompile(`MSIE ([0-9.]+)|Trident/.*rv:([0-9.]+)`)
+	uaBot           = regexp.MustCompile(`(?i)bot\b|crawler|spider|slurp|facebookexternalhit|headless`)
+	uaTV            = regexp.MustCompile(`(?i)smart-?tv|android tv|tizen|web0s|webos|appletv|\bAFT[A-Z]|roku|bravia|hbbtv|crkey`)
+	uaConsole       = regexp.MustCompile(`PlayStation|Xbox|Nintendo`)
+	windowsVersions = map[string]string{
+		"10.0": "10", "6.3": "8.1", "6.2": "8", "6.1": "7", "6.0": "vista", "5.2": "xp", "5.1": "xp",
+	}
+)
+
+// parseUserAgent infers the browser, OS and device type from ua with the
+// useragent package, in the names -device-rules use
+func parseUserAgent(ua string) userAgent {
+	parsed := useragent.Parse(ua)
+	var agent userAgent
+
+	agent.Browser, agent.BrowserVersion = parsed.Name, parsed.Version
+	if m := uaIE.FindStringSubmatch(ua); m != nil {
+		// Internet Explorer 11 only identifies itself by its Trident engine
+		agent.Browser, agent.BrowserVersion = "ie", m[1]+m[2]
+	} else if name, ok := uaBrowsers[agent.Browser]; ok {
+		agent.Browser = name
+	} else {
+		agent.Browser = strings.ToLower(agent.Browser)
+	}
+
+	agent.OS, agent.OSVersion = parsed.OS, parsed.OSVersion
+	if name, ok := uaSystems[agent.OS]; ok {
+		agent.OS = name
+	} else {
+		agent.OS = strings.ToLower(agent.OS)
+	}
+	switch agent.OS {
+	case "windows":
+		agent.OSVersion = windowsVersions[agent.OSVersion]
+		// Windows 11 still sends Windows NT 10.0
+		agent.OSVersionFrozen = agent.OSVersion == "10"
+	case "ios":
+		if strings.Contains(ua, "iPad") {
+			agent.OS = "ipados"
+		}
+	case "macos":
+		// Browsers send 10.15.7 (Firefox 10.15) on every release since
+		// macOS 11
+		agent.OSVersionFrozen = agent.OSVersion == "10.15.7" || agent.OSVersion == "10.15"
+	case "android":
+		// Reduced User-Agents of Chrome send "Android 10; K" on any release
+		agent.OSVersionFrozen = agent.OSVersion == "10" && strings.Contains(ua, "Android 10; K)")
+	}
+	if !uaVersion.MatchString(agent.OSVersion) && agent.OSVersion != "xp" && agent.OSVersion != "vista" {
+		// Linux and ChromeOS name the CPU architecture instead
+		agent.OSVersion = ""
+	}
+
+	switch {
+	case parsed.Bot || uaBot.MatchString(ua):
+		agent.Device = "bot"
+	case uaConsole.MatchString(ua):
+		agent.Device = "console"
+	case uaTV.MatchString(ua):
+		agent.Device = "tv"
+	case agent.OS == "ipados" || parsed.Tablet || (agent.OS == "android" && !strings.Contains(ua, "Mobile")):
+		agent.Device = "tablet"
+	case parsed.Mobile:
+		agent.Device = "mobile"
+	case parsed.Desktop:
+		agent.Device = "desktop"
+	default:
+		agent.Device = "other"
+	}
+	return agent
+}
+
+// versionLess reports whether version is older than limit, comparing dot
+// separated numbers. Named versions, Windows xp and vista, are older than
+// any number.
+func versionLess(version, limit string) bool {
+	a, b := strings.Split(version, "."), strings.Split(limit, ".")
+	if _, err := strconv.Atoi(a[0]); err != nil {
+		return true
+	}
+	for i := 0; i < max(len(a), len(b)); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if i < len(b) {
+			y, _ = strconv.Atoi(b[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want userAgent
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			userAgent{"chrome", "126.0.0.0", "windows", "10", true, "desktop"}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.2592.68",
+			userAgent{"edge", "126.0.2592.68", "windows", "10", true, "desktop"}},
+		{"Mozilla/5.0 (Windows NT 6.1; Win64; x64; rv:115.0) Gecko/20100101 Firefox/115.0",
+			userAgent{"firefox", "115.0", "windows", "7", false, "desktop"}},
+		{"Mozilla/5.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)",
+			userAgent{"ie", "9.0", "windows", "7", false, "desktop"}},
+		{"Mozilla/5.0 (Windows NT 6.3; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			userAgent{"ie", "11.0", "windows", "8.1", false, "desktop"}},
+		{"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)",
+			userAgent{"ie", "6.0", "windows", "xp", false, "desktop"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+			userAgent{"safari", "17.5", "macos", "10.15.7", true, "desktop"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:127.0) Gecko/20100101 Firefox/127.0",
+			userAgent{"firefox", "127.0", "macos", "10.15", true, "desktop"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15",
+			userAgent{"safari", "13.1.2", "macos", "10.13.6", false, "desktop"}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			userAgent{"safari", "17.5", "ios", "17.5", false, "mobile"}},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/126.0.6478.54 Mobile/15E148 Safari/604.1",
+			userAgent{"chrome", "126.0.6478.54", "ipados", "16.6", false, "tablet"}},
+		{"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+			userAgent{"chrome", "126.0.0.0", "android", "10", true, "mobile"}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			userAgent{"chrome", "126.0.0.0", "android", "13", false, "tablet"}},
+		{"Mozilla/5.0 (Linux; Android 8.0.0; SM-G950F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/9.2 Chrome/67.0.3396.87 Mobile Safari/537.36",
+			userAgent{"samsung", "9.2", "android", "8.0.0", false, "mobile"}},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			userAgent{"chrome", "126.0.0.0", "chromeos", "", false, "desktop"}},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+			userAgent{"firefox", "127.0", "linux", "", false, "desktop"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			userAgent{"googlebot", "2.1", "", "", false, "bot"}},
+		{"Mozilla/5.0 (PlayStation; PlayStation 5/2.26) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Safari/605.1.15",
+			userAgent{"safari", "13.0", "", "", false, "console"}},
+		{"Mozilla/5.0 (Linux; Android 9; BRAVIA 4K GB ATV3 Build/PTT1.190515.001.S52) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/76.0.3809.132 Safari/537.36",
+			userAgent{"chrome", "76.0.3809.132", "android", "9", false, "tv"}},
+		{"curl/8.5.0", userAgent{"curl", "8.5.0", "", "", false, "other"}},
+		{"Go-http-client/1.1", userAgent{"go", "1.1", "", "", false, "other"}},
+		{"", userAgent{Device: "other"}},
+	}
+	for _, test := range tests {
+		if got := parseUserAgent(test.ua); got != test.want {
+			t.Errorf("parseUserAgent(%q)\n = %+v\nwant %+v", test.ua, got, test.want)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		version, limit string
+		want           bool
+	}{
+		{"9", "10", true},
+		{"10", "9", false},
+		{"10", "10", false},
+		{"10.0", "10", false},
+		{"10.13.6", "10.15", true},
+		{"10.15", "10.15.1", true},
+		{"17.5", "17", false},
+		{"8.0.0", "8", false},
+		{"126.0.0.0", "127", true},
+		{"xp", "7", true},
+		{"vista", "7", true},
+	}
+	for _, test := range tests {
+		if got := versionLess(test.version, test.limit); got != test.want {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", test.version, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestDeviceConditionFrozenVersion(t *testing.T) {
+	mac := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15"
+	oldMac := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15"
+	condition, err := parseDeviceCondition("os=macos<11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if condition.matches(mac, parseUserAgent(mac)) {
+		t.Error("os=macos<11 matched the frozen macOS 10.15.7 every current Mac sends")
+	}
+	if !condition.matches(oldMac, parseUserAgent(oldMac)) {
+		t.Error("os=macos<11 did not match macOS 10.13.6")
+	}
+}
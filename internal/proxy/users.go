@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"go-proxy/internal/auth"
+	"go-proxy/internal/stats"
+)
+
+// SetAuth enables proxy authentication with the given schemes. It must be
+// called before the server starts handling requests.
+func (s *Server) SetAuth(chain auth.Chain) {
+	s.auth = chain
+}
+
+// authorize resolves the proxy user of r and its tenant. It writes a 403 (or 407) response
+// and returns false if the client is not allowed to use the proxy.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := s.certUser(r)
+	if !ok {
+		s.log.Warn("Rejected client certificate from %s: subject not mapped to a user", r.RemoteAddr)
+		http.Error(w, "Client certificate not authorized", http.StatusForbidden)
+		return "", false
+	}
+
+	// A client certificate already identifies the user
+	if user != "" || len(s.auth) == 0 {
+		s.resolveTenant(r, user, nil)
+		return user, true
+	}
+
+	identity, err := s.auth.Authenticate(r)
+	if err != nil {
+		if !errors.Is(err, auth.ErrNoCredentials) {
+			s.log.Warn("Proxy authentication failed for %s: %v", r.RemoteAddr, err)
+			s.emitClient("auth", r.RemoteAddr, "", err.Error())
+		}
+		s.auth.Challenge(w)
+		return "", false
+	}
+
+	// Credentials are for the proxy only and must not reach the origin
+	r.Header.Del("Proxy-Authorization")
+	s.log.Debug("Authenticated %s as %s (%s)", r.RemoteAddr, identity.User, identity.Method)
+	s.resolveTenant(r, identity.User, identity.Groups)
+	return identity.User, true
+}
+
+// updateUserStats accumulates in-memory stats of requests and bytes for an
+// authenticated user
+func (s *Server) updateUserStats(user string, blocked bool, bytes uint64, requests uint64) {
+	if user == "" || (!blocked && bytes == 0 && requests == 0) {
+		return
+	}
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	userStats, exists := s.stats.UserStats[user]
+	if !exists {
+		userStats = &stats.UserStats{User: user}
+		s.stats.UserStats[user] = userStats
+	}
+
+	userStats.RequestCount += int64(requests)
+	if blocked {
+		userStats.BlockedAttempts += int64(requests)
+	}
+	userStats.BytesTransferred += bytes
+	userStats.LastSeen = time.Now()
+}
+
+// saveUserStats flushes accumulated user stats to Redis. Users whose stats
+// could not be saved keep them for the next flush.
+func (s *Server) saveUserStats() {
+	s.statsMutex.Lock()
+	users := s.stats.UserStats
+	s.stats.UserStats = make(map[string]*stats.UserStats)
+	s.statsMutex.Unlock()
+
+	for user, userStats := range users {
+		if err := s.store.RecordUserActivity(*userStats); err != nil {
+			s.log.Info("Error saving stats for user %s: %v", user, err)
+			s.self.flushErrors.Add(1)
+			s.restoreUserStats(userStats)
+		}
+	}
+}
+
+// restoreUserStats adds back the stats of a user that could not be saved
+func (s *Server) restoreUserStats(delta *stats.UserStats) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	userStats, exists := s.stats.UserStats[delta.User]
+	if !exists {
+		s.stats.UserStats[delta.User] = delta
+		return
+	}
+	userStats.RequestCount += delta.RequestCount
+	userStats.BlockedAttempts += delta.BlockedAttempts
+	userStats.BytesTransferred += delta.BytesTransferred
+	if delta.LastSeen.After(userStats.LastSeen) {
+		userStats.LastSeen = delta.LastSeen
+	}
+}
+
+// clientSet selects clients by network or user name
+type clientSet struct {
+	nets  []*net.IPNet
+	users map[string]bool
+}
+
+// parseClientSet parses a comma separated list of IPs, CIDRs and user names
+func parseClientSet(value string) clientSet {
+	clients := clientSet{users: make(map[string]bool)}
+	for _, item := range splitList(value) {
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			clients.nets = append(clients.nets, ipNet)
+		} else if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			clients.nets = append(clients.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			clients.users[item] = true
+		}
+	}
+	return clients
+}
+
+// match reports whether user at remoteAddr is in the set
+func (c clientSet) match(user, remoteAddr string) bool {
+	if user != "" && c.users[user] {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range c.nets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tunnel is a user-space VPN outbound connections can be dialed through
+type tunnel interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// wgConfig is a parsed wg-quick style WireGuard config
+type wgConfig struct {
+	addresses []netip.Addr // Tunnel addresses of this end
+	dns       []netip.Addr // Resolvers reached through the tunnel
+	mtu       int
+	ipc       string // Device and peer settings in the UAPI format
+}
+
+// loadWireGuardConfig reads the [Interface] and [Peer] sections of a
+// wg-quick config. Keys are converted to the hex form the device expects
+// and peer endpoints are resolved once, at startup.
+func loadWireGuardConfig(filename string) (*wgConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WireGuard config: %v", err)
+	}
+	defer file.Close()
+
+	cfg := &wgConfig{mtu: 1420}
+	var ipc strings.Builder
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			// Peer settings follow their public_key, which starts the peer
+			section = strings.ToLower(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s line %d: want <key> = <value>", filename, lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if err := cfg.set(&ipc, section, key, value); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	if len(cfg.addresses) == 0 {
+		return nil, fmt.Errorf("%s: [Interface] has no Address", filename)
+	}
+	cfg.ipc = ipc.String()
+	return cfg, nil
+}
+
+// set applies one key of a config section
+func (c *wgConfig) set(ipc *strings.Builder, section, key, value string) error {
+	switch section + "." + key {
+	case "interface.privatekey":
+		return writeKey(ipc, "private_key", value)
+	case "interface.listenport":
+		fmt.Fprintf(ipc, "listen_port=%s\n", value)
+	case "interface.address":
+		for _, item := range splitList(value) {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return fmt.Errorf("invalid Address %q", item)
+			}
+			c.addresses = append(c.addresses, prefix.Addr())
+		}
+	case "interface.dns":
+		for _, item := range splitList(value) {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return fmt.Errorf("invalid DNS %q", item)
+			}
+			c.dns = append(c.dns, addr)
+		}
+	case "interface.mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu < 576 {
+			return fmt.Errorf("invalid MTU %q", value)
+		}
+		c.mtu = mtu
+	case "peer.publickey":
+		return writeKey(ipc, "public_key", value)
+	case "peer.presharedkey":
+		return writeKey(ipc, "preshared_key", value)
+	case "peer.endpoint":
+		addr, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return fmt.Errorf("invalid Endpoint %q: %v", value, err)
+		}
+		fmt.Fprintf(ipc, "endpoint=%s\n", addr)
+	case "peer.allowedips":
+		for _, item := range splitList(value) {
+			if _, err := netip.ParsePrefix(item); err != nil {
+				return fmt.Errorf("invalid AllowedIPs %q", item)
+			}
+			fmt.Fprintf(ipc, "allowed_ip=%s\n", item)
+		}
+	case "peer.persistentkeepalive":
+		fmt.Fprintf(ipc, "persistent_keepalive_interval=%s\n", value)
+	default:
+		// wg-quick hooks (PostUp, Table, ...) configure the host; ignore them
+	}
+	return nil
+}
+
+// writeKey writes a base64 WireGuard key as a hex UAPI setting
+func writeKey(ipc *strings.Builder, name, value string) error {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid %s", name)
+	}
+	fmt.Fprintf(ipc, "%s=%s\n", name, hex.EncodeToString(key))
+	return nil
+}
+
+// startTunnels brings up the tunnels listed in -wireguard. A tunnel that
+// fails to start is logged and left out, so rules naming it fall back to
+// interface lookup and fail to dial rather than leaking traffic.
+func (s *Server) startTunnels(value string) {
+	s.tunnels = make(map[string]tunnel)
+	for _, item := range splitList(value) {
+		name, filename, ok := strings.Cut(item, "=")
+		if !ok || name == "" || filename == "" {
+			s.log.Info("Error starting WireGuard tunnel: want name=file, got %q", item)
+			continue
+		}
+		cfg, err := loadWireGuardConfig(filename)
+		if err != nil {
+			s.log.Info("Error starting WireGuard tunnel %s: %v", name, err)
+			continue
+		}
+		t, err := newWireGuardTunnel(name, cfg, s.log)
+		if err != nil {
+			s.log.Info("Error starting WireGuard tunnel %s: %v", name, err)
+			continue
+		}
+		s.tunnels[name] = t
+		s.log.Info("Started WireGuard tunnel %s (%s)", name, cfg.addresses[0])
+	}
+}
@@ -0,0 +1,65 @@
+//go:build wireguard
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+
+	"go-proxy/internal/logger"
+)
+
+// wireGuardTunnel dials through a wireguard-go device backed by a
+// user-space network stack, so no host interface or route is needed
+type wireGuardTunnel struct {
+	net       *netstack.Net
+	systemDNS bool // Resolve names on the host: the config lists no DNS
+}
+
+func newWireGuardTunnel(name string, cfg *wgConfig, log logger.Logger) (tunnel, error) {
+	tun, tnet, err := netstack.CreateNetTUN(cfg.addresses, cfg.dns, cfg.mtu)
+	if err != nil {
+		return nil, fmt.Errorf("create network stack: %w", err)
+	}
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) { log.Debug("wireguard "+name+": "+format, args...) },
+		Errorf:   func(format string, args ...any) { log.Warn("wireguard "+name+": "+format, args...) },
+	})
+	if err := dev.IpcSet(cfg.ipc); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("configure device: %w", err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("bring device up: %w", err)
+	}
+	return &wireGuardTunnel{net: tnet, systemDNS: len(cfg.dns) == 0}, nil
+}
+
+func (t *wireGuardTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !t.systemDNS {
+		return t.net.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	lastErr := fmt.Errorf("no address of %s reachable through the tunnel", host)
+	for _, ip := range ips {
+		c, err := t.net.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,13 @@
+//go:build !wireguard
+
+package proxy
+
+import (
+	"fmt"
+
+	"go-proxy/internal/logger"
+)
+
+func newWireGuardTunnel(name string, cfg *wgConfig, log logger.Logger) (tunnel, error) {
+	return nil, fmt.Errorf("WireGuard support is not built in (rebuild with -tags wireguard)")
+}
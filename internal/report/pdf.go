@@ -0,0 +1,232 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Page geometry in points (A4)
+const (
+	pdfWidth    = 595
+	pdfHeight   = 842
+	pdfMargin   = 50
+	pdfFontSize = 9
+	pdfLine     = 13 // Height of a table row
+)
+
+// helveticaWidths are the widths of the printable ASCII characters in
+// Helvetica, in thousandths of the font size, from space to tilde
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfColumn is a column of a table in the PDF rendering
+type pdfColumn struct {
+	title string
+	width float64
+	right bool // Right-aligned, for numbers
+}
+
+// pdfDocument lays out text top to bottom over as many pages as it takes,
+// using the standard Helvetica fonts so nothing needs embedding
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	y     float64 // Baseline of the next line on the current page
+}
+
+// PDF renders the report as a PDF document with the same sections as the
+// HTML rendering
+func (r *Report) PDF() ([]byte, error) {
+	doc := &pdfDocument{}
+	doc.newPage()
+
+	doc.heading(r.Title(), 16)
+	doc.heading("Totals", 12)
+	totals := []pdfColumn{{"", 120, false}, {"", 100, true}}
+	doc.row(totals, false, "Requests", strconv.FormatInt(r.Requests, 10))
+	doc.row(totals, false, "Blocked attempts", strconv.FormatInt(r.Blocked, 10))
+	doc.row(totals, false, "Bandwidth", formatBytes(r.Bytes))
+	doc.row(totals, false, "Hosts", strconv.Itoa(r.Hosts))
+
+	doc.heading("Top hosts", 12)
+	if len(r.TopHosts) == 0 {
+		doc.row([]pdfColumn{{"", 300, false}}, false, "No traffic.")
+	} else {
+		columns := []pdfColumn{{"Host", 255, false}, {"Requests", 80, true}, {"Connections", 80, true}, {"Bandwidth", 80, true}}
+		doc.header(columns)
+		for _, host := range r.TopHosts {
+			doc.row(columns, false, host.Host, strconv.FormatInt(host.RequestCount, 10),
+				strconv.FormatInt(host.Connections, 10), formatBytes(host.BytesTransferred))
+		}
+	}
+
+	doc.heading("Clients", 12)
+	if len(r.Clients) == 0 {
+		doc.row([]pdfColumn{{"", 300, false}}, false, "No client usage recorded.")
+	} else {
+		columns := []pdfColumn{{"Client", 155, false}, {"Requests", 70, true}, {"Blocked", 60, true}, {"Bandwidth", 70, true}, {"Last seen", 140, true}}
+		doc.header(columns)
+		for _, user := range r.Clients {
+			doc.row(columns, false, user.User, strconv.FormatInt(user.RequestCount, 10),
+				strconv.FormatInt(user.BlockedAttempts, 10), formatBytes(user.BytesTransferred),
+				user.LastSeen.Format("2006-01-02 15:04"))
+		}
+	}
+
+	doc.heading("Most blocked", 12)
+	if len(r.BlockedHosts) == 0 {
+		doc.row([]pdfColumn{{"", 300, false}}, false, "Nothing was blocked.")
+	} else {
+		columns := []pdfColumn{{"Host", 335, false}, {"Blocked attempts", 80, true}, {"On blacklist", 80, true}}
+		doc.header(columns)
+		for _, host := range r.BlockedHosts {
+			listed := "no"
+			if host.Blocked {
+				listed = "yes"
+			}
+			doc.row(columns, false, host.Host, strconv.FormatInt(host.BlockedAttempts, 10), listed)
+		}
+	}
+
+	return doc.bytes(), nil
+}
+
+// newPage starts a page
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfHeight - pdfMargin
+}
+
+// space moves down by height, starting a page if it does not fit
+func (d *pdfDocument) space(height float64) {
+	if d.y-height < pdfMargin {
+		d.newPage()
+	}
+	d.y -= height
+}
+
+// text writes s with its baseline at y, starting at x
+func (d *pdfDocument) text(x float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfEscape(s))
+}
+
+// heading writes a title of size, with space above it
+func (d *pdfDocument) heading(s string, size float64) {
+	d.space(size * 2)
+	d.text(pdfMargin, size, true, s)
+	d.space(size / 2)
+}
+
+// header writes the column titles of a table, underlined
+func (d *pdfDocument) header(columns []pdfColumn) {
+	titles := make([]string, len(columns))
+	for i, column := range columns {
+		titles[i] = column.title
+	}
+	d.row(columns, true, titles...)
+	fmt.Fprintf(d.pages[len(d.pages)-1], "0.5 w %d %.2f m %d %.2f l S\n", pdfMargin, d.y-3, pdfWidth-pdfMargin, d.y-3)
+}
+
+// row writes one line of a table, shortening cells wider than their column
+func (d *pdfDocument) row(columns []pdfColumn, bold bool, cells ...string) {
+	d.space(pdfLine)
+	x := float64(pdfMargin)
+	for i, column := range columns {
+		cell := fitText(cells[i], column.width-6, pdfFontSize)
+		if column.right {
+			d.text(x+column.width-textWidth(cell, pdfFontSize), pdfFontSize, bold, cell)
+		} else {
+			d.text(x, pdfFontSize, bold, cell)
+		}
+		x += column.width
+	}
+}
+
+// bytes assembles the pages into a PDF file
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	// Objects 1 to 4 are fixed; each page then takes a page and a content
+	// stream object
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape makes s safe inside a PDF string, replacing characters the
+// standard fonts cannot show
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < ' ' || c > '~':
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// textWidth returns the width of s in Helvetica at size
+func textWidth(s string, size float64) float64 {
+	var width int
+	for _, c := range s {
+		if c >= ' ' && c <= '~' {
+			width += helveticaWidths[c-' ']
+		} else {
+			width += helveticaWidths['?'-' ']
+		}
+	}
+	return float64(width) * size / 1000
+}
+
+// fitText shortens s with an ellipsis until it is at most width wide
+func fitText(s string, width, size float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
@@ -0,0 +1,192 @@
+// Package report compiles usage summaries from the stats store: the top
+// hosts, usage per client, the most blocked hosts and bandwidth totals of
+// a day or week. A Scheduler renders them as HTML and mails them, writes
+// them to a directory, or both, after each period ends.
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"time"
+
+	"go-proxy/internal/stats"
+	"go-proxy/internal/storage"
+)
+
+// Report summarizes the traffic of the days from From to To, inclusive
+type Report struct {
+	Period       string // daily, weekly or monthly
+	From         time.Time
+	To           time.Time
+	Requests     int64
+	Blocked      int64
+	Bytes        uint64
+	Hosts        int               // Distinct hosts
+	TopHosts     []stats.HostStats // Most bytes first
+	Clients      []stats.UserStats // Most bytes first
+	BlockedHosts []stats.HostStats // Most blocked attempts first
+}
+
+// Build compiles the report of the days from from to to, inclusive, with
+// at most top rows per table
+func Build(store storage.StatsStore, period string, from, to time.Time, top int) (*Report, error) {
+	report := &Report{Period: period, From: from, To: to}
+
+	_, records, err := store.GetDailyStats(from, to, "", "day")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host stats: %w", err)
+	}
+	hosts := make(map[string]*stats.HostStats)
+	for _, record := range records {
+		report.Requests += record.RequestCount
+		report.Blocked += record.BlockedAttempts
+		report.Bytes += record.BytesTransferred
+		host, ok := hosts[record.Host]
+		if !ok {
+			host = &stats.HostStats{Host: record.Host}
+			hosts[record.Host] = host
+		}
+		host.Connections += record.Connections
+		host.RequestCount += record.RequestCount
+		host.BlockedAttempts += record.BlockedAttempts
+		host.BytesTransferred += record.BytesTransferred
+		host.Blocked = host.Blocked || record.Blocked
+	}
+	report.Hosts = len(hosts)
+	for _, host := range hosts {
+		report.TopHosts = append(report.TopHosts, *host)
+		if host.BlockedAttempts > 0 || host.Blocked {
+			report.BlockedHosts = append(report.BlockedHosts, *host)
+		}
+	}
+	sort.Slice(report.TopHosts, func(i, j int) bool {
+		if report.TopHosts[i].BytesTransferred != report.TopHosts[j].BytesTransferred {
+			return report.TopHosts[i].BytesTransferred > report.TopHosts[j].BytesTransferred
+		}
+		return report.TopHosts[i].Host < report.TopHosts[j].Host
+	})
+	sort.Slice(report.BlockedHosts, func(i, j int) bool {
+		if report.BlockedHosts[i].BlockedAttempts != report.BlockedHosts[j].BlockedAttempts {
+			return report.BlockedHosts[i].BlockedAttempts > report.BlockedHosts[j].BlockedAttempts
+		}
+		return report.BlockedHosts[i].Host < report.BlockedHosts[j].Host
+	})
+
+	_, userRecords, err := store.GetUserStats(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user stats: %w", err)
+	}
+	users := make(map[string]*stats.UserStats)
+	for _, record := range userRecords {
+		user, ok := users[record.User]
+		if !ok {
+			user = &stats.UserStats{User: record.User}
+			users[record.User] = user
+		}
+		user.RequestCount += record.RequestCount
+		user.BlockedAttempts += record.BlockedAttempts
+		user.BytesTransferred += record.BytesTransferred
+		if record.LastSeen.After(user.LastSeen) {
+			user.LastSeen = record.LastSeen
+		}
+	}
+	for _, user := range users {
+		report.Clients = append(report.Clients, *user)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		if report.Clients[i].BytesTransferred != report.Clients[j].BytesTransferred {
+			return report.Clients[i].BytesTransferred > report.Clients[j].BytesTransferred
+		}
+		return report.Clients[i].User < report.Clients[j].User
+	})
+
+	if len(report.TopHosts) > top {
+		report.TopHosts = report.TopHosts[:top]
+	}
+	if len(report.BlockedHosts) > top {
+		report.BlockedHosts = report.BlockedHosts[:top]
+	}
+	if len(report.Clients) > top {
+		report.Clients = report.Clients[:top]
+	}
+	return report, nil
+}
+
+// Title names the report, e.g. "go-proxy daily report for 2024-03-22"
+func (r *Report) Title() string {
+	if r.From.Equal(r.To) {
+		return fmt.Sprintf("go-proxy %s report for %s", r.Period, r.From.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("go-proxy %s report for %s to %s", r.Period, r.From.Format("2006-01-02"), r.To.Format("2006-01-02"))
+}
+
+// HTML renders the report as a self-contained HTML page, usable as the
+// body of an email
+func (r *Report) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 GiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Arial, sans-serif; color: #222; }
+table { border-collapse: collapse; margin-bottom: 24px; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f0f0f0; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+
+<h2>Totals</h2>
+<table>
+<tr><th>Requests</th><td class="n">{{.Requests}}</td></tr>
+<tr><th>Blocked attempts</th><td class="n">{{.Blocked}}</td></tr>
+<tr><th>Bandwidth</th><td class="n">{{bytes .Bytes}}</td></tr>
+<tr><th>Hosts</th><td class="n">{{.Hosts}}</td></tr>
+</table>
+
+<h2>Top hosts</h2>
+{{if .TopHosts}}<table>
+<tr><th>Host</th><th>Requests</th><th>Connections</th><th>Bandwidth</th></tr>
+{{range .TopHosts}}<tr><td>{{.Host}}</td><td class="n">{{.RequestCount}}</td><td class="n">{{.Connections}}</td><td class="n">{{bytes .BytesTransferred}}</td></tr>
+{{end}}</table>{{else}}<p>No traffic.</p>{{end}}
+
+<h2>Clients</h2>
+{{if .Clients}}<table>
+<tr><th>Client</th><th>Requests</th><th>Blocked</th><th>Bandwidth</th><th>Last seen</th></tr>
+{{range .Clients}}<tr><td>{{.User}}</td><td class="n">{{.RequestCount}}</td><td class="n">{{.BlockedAttempts}}</td><td class="n">{{bytes .BytesTransferred}}</td><td>{{.LastSeen.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>{{else}}<p>No client usage recorded.</p>{{end}}
+
+<h2>Most blocked</h2>
+{{if .BlockedHosts}}<table>
+<tr><th>Host</th><th>Blocked attempts</th><th>On blacklist</th></tr>
+{{range .BlockedHosts}}<tr><td>{{.Host}}</td><td class="n">{{.BlockedAttempts}}</td><td>{{if .Blocked}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>{{else}}<p>Nothing was blocked.</p>{{end}}
+</body>
+</html>
+`))
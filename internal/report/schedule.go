@@ -0,0 +1,170 @@
+package report
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/storage"
+)
+
+// reportDelay leaves the last stats flush of a period time to land before
+// its report is built
+const reportDelay = 5 * time.Minute
+
+// Options configure scheduled reports. An empty or "off" Schedule
+// disables them.
+type Options struct {
+	Schedule     string   // daily or weekly
+	Dir          string   // Directory report files are written to ("" disables)
+	SMTPAddr     string   // host:port of the mail server ("" disables mail)
+	SMTPUser     string   // Username for SMTP AUTH ("" sends without)
+	SMTPPassword string   // Password for SMTP AUTH
+	From         string   // Sender address
+	To           []string // Recipient addresses
+	Top          int      // Rows per table
+}
+
+// Scheduler builds and delivers a report after every day or week
+type Scheduler struct {
+	opts  Options
+	store storage.StatsStore
+	log   logger.Logger
+	stop  chan struct{}
+}
+
+// New creates a scheduler. Start begins delivering reports.
+func New(opts Options, store storage.StatsStore, log logger.Logger) *Scheduler {
+	return &Scheduler{opts: opts, store: store, log: log, stop: make(chan struct{})}
+}
+
+// Enabled reports whether reports are scheduled
+func (s *Scheduler) Enabled() bool {
+	return s.opts.Schedule == "daily" || s.opts.Schedule == "weekly"
+}
+
+// Start delivers the report of each period shortly after it ends, in
+// local time, until Stop. Weeks start on Monday. It does nothing if
+// reports are disabled.
+func (s *Scheduler) Start() {
+	if !s.Enabled() {
+		return
+	}
+	go func() {
+		for {
+			from, to, due := s.next(time.Now())
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if err := s.Run(from, to); err != nil {
+				s.log.Error("Failed to deliver %s report: %v", s.opts.Schedule, err)
+			}
+		}
+	}()
+}
+
+// Stop ends scheduling
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+// next returns the first and last day of the next period to end after
+// now and when its report is due
+func (s *Scheduler) next(now time.Time) (time.Time, time.Time, time.Time) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start := today
+	days := 1
+	if s.opts.Schedule == "weekly" {
+		days = 7
+		start = today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	}
+	end := start.AddDate(0, 0, days)
+	if due := start.Add(reportDelay); now.Before(due) {
+		// The previous period's report is still to come
+		end = start
+		start = start.AddDate(0, 0, -days)
+	}
+	return start, end.AddDate(0, 0, -1), end.Add(reportDelay)
+}
+
+// Run builds the report of the days from from to to, inclusive, and
+// delivers it to the directory and mail recipients configured
+func (s *Scheduler) Run(from, to time.Time) error {
+	// Stats records are keyed by calendar date, which the store compares
+	// in UTC
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	report, err := Build(s.store, s.opts.Schedule, from, to, s.opts.Top)
+	if err != nil {
+		return err
+	}
+	body, err := report.HTML()
+	if err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+
+	if s.opts.Dir != "" {
+		name := filepath.Join(s.opts.Dir, fmt.Sprintf("report-%s-%s.html", s.opts.Schedule, from.Format("2006-01-02")))
+		if err := writeFile(name, body); err != nil {
+			return err
+		}
+		s.log.Info("Wrote %s", name)
+	}
+	if s.opts.SMTPAddr != "" {
+		if err := s.mail(report.Title(), body); err != nil {
+			return err
+		}
+		s.log.Info("Mailed %q to %s", report.Title(), strings.Join(s.opts.To, ", "))
+	}
+	return nil
+}
+
+// writeFile replaces name with data, so readers never see a partial
+// report
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// mail sends body as an HTML email to the recipients. net/smtp upgrades
+// the connection with STARTTLS when the server offers it.
+func (s *Scheduler) mail(subject string, body []byte) error {
+	var auth smtp.Auth
+	if s.opts.SMTPUser != "" {
+		host, _, err := net.SplitHostPort(s.opts.SMTPAddr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %w", s.opts.SMTPAddr, err)
+		}
+		auth = smtp.PlainAuth("", s.opts.SMTPUser, s.opts.SMTPPassword, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.opts.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.opts.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.Write(body)
+
+	if err := smtp.SendMail(s.opts.SMTPAddr, auth, s.opts.From, s.opts.To, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to mail report: %w", err)
+	}
+	return nil
+}
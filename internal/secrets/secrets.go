@@ -0,0 +1,70 @@
+// Package secrets resolves secret references such as Redis passwords from
+// files, HashiCorp Vault or AWS Secrets Manager so they never have to be
+// passed on the command line.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reference schemes understood by Resolve.
+const (
+	SchemeFile  = "file:"
+	SchemeVault = "vault:"
+	SchemeAWSSM = "awssm:"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// IsReference reports whether value points at an external secret instead of
+// being the secret itself.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, SchemeFile) ||
+		strings.HasPrefix(value, SchemeVault) ||
+		strings.HasPrefix(value, SchemeAWSSM)
+}
+
+// Resolve returns the secret referenced by ref. Supported forms are
+//
+//	file:/run/secrets/redis_password
+//	vault:secret/data/proxy#redis_password
+//	awssm:prod/proxy#redis_password
+//
+// Any other value is returned unchanged.
+func Resolve(ctx context.Context, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, SchemeFile):
+		return ReadFile(strings.TrimPrefix(ref, SchemeFile))
+	case strings.HasPrefix(ref, SchemeVault):
+		path, field := splitField(strings.TrimPrefix(ref, SchemeVault))
+		return readVault(ctx, path, field)
+	case strings.HasPrefix(ref, SchemeAWSSM):
+		id, field := splitField(strings.TrimPrefix(ref, SchemeAWSSM))
+		return readAWSSecret(ctx, id, field)
+	default:
+		return ref, nil
+	}
+}
+
+// ReadFile reads a secret from a file, Docker secrets style. Surrounding
+// whitespace, including the trailing newline most editors add, is trimmed.
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// splitField splits "path#field" into its parts.
+func splitField(ref string) (string, string) {
+	if idx := strings.LastIndex(ref, "#"); idx != -1 {
+		return ref[:idx], ref[idx+1:]
+	}
+	return ref, ""
+}
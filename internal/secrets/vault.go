@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// vaultResponse covers both KV v1 (data.field) and KV v2 (data.data.field).
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// readVault fetches field from the Vault secret at path using VAULT_ADDR and
+// VAULT_TOKEN (and optionally VAULT_NAMESPACE) from the environment.
+func readVault(ctx context.Context, path, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("vault: VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	if field == "" {
+		return "", fmt.Errorf("vault: reference %q has no #field", path)
+	}
+
+	url := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned status %d for %s", resp.StatusCode, path)
+	}
+
+	var body vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to parse vault response: %w", err)
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault: field %q not found in %s", field, path)
+	}
+	return value, nil
+}
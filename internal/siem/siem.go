@@ -0,0 +1,167 @@
+// Package siem writes proxy security events in the Common Event Format
+// (ArcSight) or the Log Event Extended Format (QRadar), one per line.
+package siem
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-proxy/internal/storage"
+)
+
+const (
+	vendor  = "go-proxy"
+	product = "go-proxy"
+	version = "1.0"
+)
+
+// severities maps the event types worth a SIEM's attention to a CEF
+// severity (0-10); other types are not written
+var severities = map[string]int{
+	"block": 5,
+	"error": 3,
+	"auth":  6,
+	"abuse": 7,
+	"alert": 8,
+}
+
+// names are the human readable event names
+var names = map[string]string{
+	"block": "Request blocked",
+	"error": "Proxy error",
+	"auth":  "Authentication failure",
+	"abuse": "Proxy abuse",
+	"alert": "Security alert",
+}
+
+// Writer formats events and writes them to a file or stdout
+type Writer struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	format func(storage.Event) string
+}
+
+// Open returns a Writer for format ("cef" or "leef") appending to path,
+// or writing to stdout if path is "" or "-"
+func Open(format, path string) (*Writer, error) {
+	w := &Writer{out: os.Stdout}
+	switch format {
+	case "cef":
+		w.format = CEF
+	case "leef":
+		w.format = LEEF
+	default:
+		return nil, fmt.Errorf("unknown SIEM format %q (want cef or leef)", format)
+	}
+	if path != "" && path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SIEM log: %v", err)
+		}
+		w.out = file
+	}
+	return w, nil
+}
+
+// Append writes event if its type is a security event
+func (w *Writer) Append(event storage.Event) error {
+	if _, ok := severities[event.Type]; !ok {
+		return nil
+	}
+	line := w.format(event)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := io.WriteString(w.out, line+"\n")
+	return err
+}
+
+// Close closes the log file
+func (w *Writer) Close() error {
+	if closer, ok := w.out.(io.Closer); ok && w.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CEF formats event as a CEF:0 line
+func CEF(event storage.Event) string {
+	header := []string{"CEF:0", vendor, product, version, event.Type, names[event.Type], strconv.Itoa(severities[event.Type])}
+	for i := 1; i < len(header); i++ {
+		header[i] = cefHeaderEscaper.Replace(header[i])
+	}
+
+	ip, port := splitClient(event.Client)
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(event.Time.UnixMilli(), 10))
+	add("src", ip)
+	add("spt", port)
+	add("suser", event.User)
+	add("dhost", event.Host)
+	if event.Type == "block" {
+		add("act", "blocked")
+		add("cs1Label", "rule")
+		add("cs1", event.Detail)
+	} else {
+		add("msg", event.Detail)
+	}
+	add("externalId", event.RequestID)
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// LEEF formats event as a LEEF:1.0 line with tab separated attributes
+func LEEF(event storage.Event) string {
+	header := []string{"LEEF:1.0", vendor, product, version, event.Type}
+	for i := 1; i < len(header); i++ {
+		header[i] = leefHeaderEscaper.Replace(header[i])
+	}
+
+	ip, port := splitClient(event.Client)
+	var attrs []string
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, key+"="+leefValueEscaper.Replace(value))
+		}
+	}
+	// devTimeFormat is a Java SimpleDateFormat pattern
+	add("devTime", event.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+	add("devTimeFormat", "yyyy-MM-dd'T'HH:mm:ss.SSSXXX")
+	add("sev", strconv.Itoa(severities[event.Type]))
+	add("cat", names[event.Type])
+	add("src", ip)
+	add("srcPort", port)
+	add("usrName", event.User)
+	add("dstHost", event.Host)
+	if event.Type == "block" {
+		add("action", "blocked")
+		add("rule", event.Detail)
+	} else {
+		add("msg", event.Detail)
+	}
+	add("requestId", event.RequestID)
+	return strings.Join(header, "|") + "|" + strings.Join(attrs, "\t")
+}
+
+var (
+	cefHeaderEscaper  = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`, "\n", " ", "\r", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+// splitClient splits a client address into IP and port, if it has one
+func splitClient(addr string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+	return addr, ""
+}
@@ -6,6 +6,7 @@ import "time"
 type HostStats struct {
 	Host             string    `json:"host"`
 	IPs              string    `json:"ips"`
+	Country          string    `json:"country,omitempty"` // Country code from geolocation, if known when written
 	Connections      int64     `json:"connections"`
 	RequestCount     int64     `json:"request_count"`
 	BlockedAttempts  int64     `json:"blocked_attempts"`
@@ -25,3 +25,12 @@ type ProxyStats struct {
 	IPAddresses      map[string]IPStats
 	mu               sync.RWMutex
 }
+
+// UserStats represents statistics attributed to an authenticated proxy user
+type UserStats struct {
+	User             string    `json:"user"`
+	RequestCount     int64     `json:"request_count"`
+	BlockedAttempts  int64     `json:"blocked_attempts"`
+	BytesTransferred uint64    `json:"bytes_transferred"`
+	LastSeen         time.Time `json:"last_seen"`
+}
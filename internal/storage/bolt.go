@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// statsBucket holds host and user records under the same keys RedisStore
+// uses (HOST:..., USER:...)
+var statsBucket = []byte("stats")
+
+// boltSweepInterval is how often expired records are deleted
+const boltSweepInterval = time.Hour
+
+// BoltStore keeps stats in a local bbolt database file, for single-box
+// deployments without Redis
+type BoltStore struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+// boltRecord wraps a record with its expiry, which bbolt has no notion of
+type boltRecord struct {
+	Expires int64           `json:"expires"` // Unix seconds
+	Data    json.RawMessage `json:"data"`
+}
+
+// Compile-time check that BoltStore satisfies StatsStore
+var _ StatsStore = (*BoltStore)(nil)
+
+// NewBoltStore opens (or creates) the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s: %w", path, err)
+	}
+
+	s := &BoltStore{db: db, stop: make(chan struct{})}
+	go s.sweepLoop()
+	return s, nil
+}
+
+// DB exposes the database so other components (the geo cache) can keep
+// their data in the same file
+func (s *BoltStore) DB() *bolt.DB {
+	return s.db
+}
+
+// Close stops the sweeper and closes the database
+func (s *BoltStore) Close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+// RecordHostActivity implements StatsStore
+func (s *BoltStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	if host == "" {
+		return fmt.Errorf("invalid host: empty")
+	}
+	host = cleanHost(host)
+	now := time.Now()
+	hourKey, dayKey := hostKeys(host, now)
+
+	// Resolve a fresh record outside the write transaction, since it does
+	// a DNS lookup and bbolt allows a single writer
+	var fresh *stats.HostStats
+	if !s.liveKeys(hourKey, dayKey) {
+		hs := newHostStats(host, blocked, bytesTransferred)
+		fresh = &hs
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		for _, period := range []struct {
+			key string
+			ttl time.Duration
+		}{{hourKey, hourlyTTL}, {dayKey, dailyTTL}} {
+			var hostStats stats.HostStats
+			found, err := getRecord(bucket, period.key, now, &hostStats)
+			if err != nil {
+				return err
+			}
+			if found {
+				addHostActivity(&hostStats, blocked, bytesTransferred)
+			} else if fresh != nil {
+				hostStats = *fresh
+			} else {
+				// Expired between the check and this transaction
+				hostStats = stats.HostStats{Host: host, IPs: "unknown"}
+				addHostActivity(&hostStats, blocked, bytesTransferred)
+			}
+			if err := putRecord(bucket, period.key, now.Add(period.ttl), hostStats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecordUserActivity implements StatsStore
+func (s *BoltStore) RecordUserActivity(delta stats.UserStats) error {
+	if delta.User == "" {
+		return fmt.Errorf("invalid user: empty")
+	}
+	now := time.Now()
+	hourKey, dayKey := userKeys(delta.User, now)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		for _, period := range []struct {
+			key string
+			ttl time.Duration
+		}{{hourKey, hourlyTTL}, {dayKey, dailyTTL}} {
+			userStats := stats.UserStats{User: delta.User}
+			if _, err := getRecord(bucket, period.key, now, &userStats); err != nil {
+				return err
+			}
+			addUserActivity(&userStats, delta)
+			if err := putRecord(bucket, period.key, now.Add(period.ttl), userStats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetDailyStats implements StatsStore
+func (s *BoltStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+	hourly := granularity == "hour"
+	return s.selectHosts(func(rk recordKey) bool {
+		return rk.hourly == hourly &&
+			strings.Contains(rk.name, hostFilter) &&
+			rk.inRange(fromDate, toDate)
+	})
+}
+
+// GetHourlyStats implements StatsStore
+func (s *BoltStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	day := date.Format("2006-01-02")
+	return s.selectHosts(func(rk recordKey) bool {
+		return rk.hourly &&
+			rk.date.Format("2006-01-02") == day &&
+			rk.hour >= fromHour && rk.hour <= toHour
+	})
+}
+
+// GetUserStats implements StatsStore
+func (s *BoltStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers(false, fromDate, toDate)
+}
+
+// GetUserHourlyStats implements StatsStore
+func (s *BoltStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers(true, fromDate, toDate)
+}
+
+// selectUsers returns the live hourly or daily user records in the date
+// range
+func (s *BoltStore) selectUsers(hourly bool, fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	var keys []string
+	records := make(map[string]stats.UserStats)
+	now := time.Now()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte("USER:")
+		c := tx.Bucket(statsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rk, ok := parseRecordKey(string(k))
+			if !ok || rk.hourly != hourly || !rk.inRange(fromDate, toDate) {
+				continue
+			}
+			var userStats stats.UserStats
+			if !decodeRecord(v, now, &userStats) {
+				continue
+			}
+			keys = append(keys, string(k))
+			records[string(k)] = userStats
+		}
+		return nil
+	})
+	return keys, records, err
+}
+
+// selectHosts returns the live host records whose key matches
+func (s *BoltStore) selectHosts(match func(recordKey) bool) ([]string, map[string]stats.HostStats, error) {
+	var keys []string
+	records := make(map[string]stats.HostStats)
+	now := time.Now()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte("HOST:")
+		c := tx.Bucket(statsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rk, ok := parseRecordKey(string(k))
+			if !ok || !match(rk) {
+				continue
+			}
+			var hostStats stats.HostStats
+			if !decodeRecord(v, now, &hostStats) {
+				continue
+			}
+			keys = append(keys, string(k))
+			records[string(k)] = hostStats
+		}
+		return nil
+	})
+	return keys, records, err
+}
+
+// liveKeys reports whether every key holds an unexpired record
+func (s *BoltStore) liveKeys(keys ...string) bool {
+	live := true
+	now := time.Now()
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		for _, key := range keys {
+			var record boltRecord
+			v := bucket.Get([]byte(key))
+			if v == nil || json.Unmarshal(v, &record) != nil || record.Expires < now.Unix() {
+				live = false
+				return nil
+			}
+		}
+		return nil
+	})
+	return live
+}
+
+// sweepLoop deletes expired records periodically
+func (s *BoltStore) sweepLoop() {
+	ticker := time.NewTicker(boltSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.sweep(); err != nil {
+				logger.Warn("Failed to delete expired stats: %v", err)
+			}
+		}
+	}
+}
+
+func (s *BoltStore) sweep() error {
+	now := time.Now().Unix()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(statsBucket).Cursor()
+		for k, v := c.First(); k != nil; {
+			var record boltRecord
+			if json.Unmarshal(v, &record) != nil || record.Expires < now {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				// Delete moves the cursor to the next item
+				k, v = c.Seek(k)
+				continue
+			}
+			k, v = c.Next()
+		}
+		return nil
+	})
+}
+
+// getRecord decodes the live record at key into v, reporting whether one
+// was found
+func getRecord(bucket *bolt.Bucket, key string, now time.Time, v interface{}) (bool, error) {
+	raw := bucket.Get([]byte(key))
+	if raw == nil {
+		return false, nil
+	}
+	var record boltRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return false, fmt.Errorf("failed to unmarshal record %s: %w", key, err)
+	}
+	if record.Expires < now.Unix() {
+		return false, nil
+	}
+	if err := json.Unmarshal(record.Data, v); err != nil {
+		return false, fmt.Errorf("failed to unmarshal record %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// putRecord stores v at key until expires
+func putRecord(bucket *bolt.Bucket, key string, expires time.Time, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record %s: %w", key, err)
+	}
+	raw, err := json.Marshal(boltRecord{Expires: expires.Unix(), Data: data})
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), raw)
+}
+
+// decodeRecord decodes a raw record into v unless it is expired or invalid
+func decodeRecord(raw []byte, now time.Time, v interface{}) bool {
+	var record boltRecord
+	if json.Unmarshal(raw, &record) != nil || record.Expires < now.Unix() {
+		return false
+	}
+	return json.Unmarshal(record.Data, v) == nil
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// bufferRetryInterval is how often a buffered store probes a failed
+// backend by replaying its queue
+const bufferRetryInterval = 10 * time.Second
+
+// BufferedStore shields the proxy from backend outages. When a write fails
+// the store switches to buffering: writes are aggregated in memory per
+// record (so their hour and day are kept) and replayed as merges once the
+// backend accepts them again. Reads always go to the backend.
+type BufferedStore struct {
+	StatsStore
+	importer   Importer
+	maxRecords int
+
+	mutex   sync.Mutex
+	down    bool
+	hosts   map[string]stats.HostStats // Pending host records by key
+	users   map[string]stats.UserStats // Pending user records by key
+	dropped int64                      // Writes lost because the buffer was full
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBufferedStore wraps backend with a write-behind buffer of at most
+// maxRecords pending records
+func NewBufferedStore(backend StatsStore, maxRecords int) (*BufferedStore, error) {
+	importer, ok := backend.(Importer)
+	if !ok {
+		return nil, fmt.Errorf("%T can't replay buffered stats: %w", backend, ErrImportUnsupported)
+	}
+
+	b := &BufferedStore{
+		StatsStore: backend,
+		importer:   importer,
+		maxRecords: maxRecords,
+		hosts:      make(map[string]stats.HostStats),
+		users:      make(map[string]stats.UserStats),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go b.retryLoop()
+	return b, nil
+}
+
+// RecordHostActivity implements StatsStore
+func (b *BufferedStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	if host == "" {
+		return fmt.Errorf("invalid host: empty")
+	}
+	if !b.isDown() {
+		err := b.StatsStore.RecordHostActivity(host, blocked, bytesTransferred)
+		if err == nil {
+			return nil
+		}
+		b.markDown(err)
+	}
+
+	host = cleanHost(host)
+	now := time.Now()
+	hourKey, dayKey := hostKeys(host, now)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, key := range []string{hourKey, dayKey} {
+		hostStats, ok := b.hosts[key]
+		if ok {
+			addHostActivity(&hostStats, blocked, bytesTransferred)
+		} else if b.fullLocked() {
+			b.dropped++
+			continue
+		} else {
+			// Resolved when the backend creates the record
+			hostStats = stats.HostStats{
+				Host:             host,
+				IPs:              "unknown",
+				Connections:      1,
+				RequestCount:     1,
+				BytesTransferred: bytesTransferred,
+				Blocked:          blocked,
+				LastSeen:         now,
+			}
+		}
+		b.hosts[key] = hostStats
+	}
+	return nil
+}
+
+// RecordUserActivity implements StatsStore
+func (b *BufferedStore) RecordUserActivity(delta stats.UserStats) error {
+	if delta.User == "" {
+		return fmt.Errorf("invalid user: empty")
+	}
+	if !b.isDown() {
+		err := b.StatsStore.RecordUserActivity(delta)
+		if err == nil {
+			return nil
+		}
+		b.markDown(err)
+	}
+
+	hourKey, dayKey := userKeys(delta.User, time.Now())
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, key := range []string{hourKey, dayKey} {
+		userStats, ok := b.users[key]
+		if !ok {
+			if b.fullLocked() {
+				b.dropped++
+				continue
+			}
+			userStats.User = delta.User
+		}
+		addUserActivity(&userStats, delta)
+		b.users[key] = userStats
+	}
+	return nil
+}
+
+// ImportHost implements Importer
+func (b *BufferedStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	return b.importer.ImportHost(key, hostStats, merge)
+}
+
+// ImportUser implements Importer
+func (b *BufferedStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	return b.importer.ImportUser(key, userStats, merge)
+}
+
+// DisplayAllHostStats forwards to the backend when it supports it
+func (b *BufferedStore) DisplayAllHostStats() {
+	if display, ok := b.StatsStore.(interface{ DisplayAllHostStats() }); ok {
+		display.DisplayAllHostStats()
+	}
+}
+
+// Pending returns the number of buffered records and of writes dropped
+// because the buffer was full
+func (b *BufferedStore) Pending() (int, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.hosts) + len(b.users), b.dropped
+}
+
+// Close replays what it can and closes the backend
+func (b *BufferedStore) Close() error {
+	close(b.stop)
+	<-b.done
+	if b.isDown() {
+		b.replay()
+	}
+	if pending, _ := b.Pending(); pending > 0 {
+		logger.Warn("Discarding %d buffered stats records on shutdown", pending)
+	}
+	if closer, ok := b.StatsStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (b *BufferedStore) isDown() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.down
+}
+
+func (b *BufferedStore) markDown(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.down {
+		logger.Warn("Stats backend unavailable, buffering writes in memory: %v", err)
+		b.down = true
+	}
+}
+
+// fullLocked reports whether a new record would exceed the buffer.
+// Callers must hold mutex.
+func (b *BufferedStore) fullLocked() bool {
+	return len(b.hosts)+len(b.users) >= b.maxRecords
+}
+
+func (b *BufferedStore) retryLoop() {
+	defer close(b.done)
+	ticker := time.NewTicker(bufferRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if b.isDown() {
+				b.replay()
+			}
+		}
+	}
+}
+
+// replay writes the buffered records to the backend. If the first write
+// fails the backend is still down and everything is kept; a later failure
+// is a bad record rather than an outage, so that record is dropped.
+func (b *BufferedStore) replay() {
+	b.mutex.Lock()
+	hosts, users := b.hosts, b.users
+	b.hosts = make(map[string]stats.HostStats)
+	b.users = make(map[string]stats.UserStats)
+	b.mutex.Unlock()
+
+	replayed := 0
+	for key, hostStats := range hosts {
+		err := b.importer.ImportHost(key, hostStats, true)
+		if err != nil && replayed == 0 {
+			b.requeue(hosts, users)
+			return
+		}
+		if err != nil {
+			logger.Warn("Dropping buffered stats record %s: %v", key, err)
+		}
+		delete(hosts, key)
+		replayed++
+	}
+	for key, userStats := range users {
+		err := b.importer.ImportUser(key, userStats, true)
+		if err != nil && replayed == 0 {
+			b.requeue(hosts, users)
+			return
+		}
+		if err != nil {
+			logger.Warn("Dropping buffered stats record %s: %v", key, err)
+		}
+		delete(users, key)
+		replayed++
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// Records buffered during the replay go out on the next attempt
+	if len(b.hosts)+len(b.users) == 0 {
+		b.down = false
+		logger.Info("Stats backend recovered: replayed %d buffered records (%d writes dropped while full)", replayed, b.dropped)
+		b.dropped = 0
+	}
+}
+
+// requeue merges records that could not be replayed back into the buffer
+func (b *BufferedStore) requeue(hosts map[string]stats.HostStats, users map[string]stats.UserStats) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, hostStats := range hosts {
+		if pending, ok := b.hosts[key]; ok {
+			mergeHostStats(&hostStats, pending)
+		}
+		b.hosts[key] = hostStats
+	}
+	for key, userStats := range users {
+		if pending, ok := b.users[key]; ok {
+			mergeUserStats(&userStats, pending)
+		}
+		b.users[key] = userStats
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go-proxy/internal/stats"
+)
+
+// dumpVersion is bumped when the Dump layout changes incompatibly
+const dumpVersion = 1
+
+// ErrImportUnsupported is returned by Import for stores that can't load
+// whole records
+var ErrImportUnsupported = errors.New("storage backend does not support import")
+
+// Dump is the portable form of a range of stats, used for backups and for
+// moving stats between backends or instances. Records are keyed like the
+// Redis keys (HOST:example.com:DAY:2024-03-22).
+type Dump struct {
+	Version  int                        `json:"version"`
+	Exported time.Time                  `json:"exported"`
+	From     string                     `json:"from"`
+	To       string                     `json:"to"`
+	Hosts    map[string]stats.HostStats `json:"hosts"`
+	Users    map[string]stats.UserStats `json:"users"`
+}
+
+// Importer is implemented by stores that can load whole records, as
+// opposed to the incremental Record* calls the proxy makes
+type Importer interface {
+	// ImportHost stores a host record under key, adding it to an existing
+	// record when merge is set and replacing it otherwise
+	ImportHost(key string, hostStats stats.HostStats, merge bool) error
+	// ImportUser does the same for a user record
+	ImportUser(key string, userStats stats.UserStats, merge bool) error
+}
+
+// Export collects the daily and hourly host records and the daily user
+// records between from and to (inclusive dates)
+func Export(store StatsStore, from, to time.Time) (*Dump, error) {
+	dump := &Dump{
+		Version:  dumpVersion,
+		Exported: time.Now(),
+		From:     from.Format("2006-01-02"),
+		To:       to.Format("2006-01-02"),
+		Hosts:    make(map[string]stats.HostStats),
+	}
+
+	for _, granularity := range []string{"day", "hour"} {
+		_, records, err := store.GetDailyStats(from, to, "", granularity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s host stats: %w", granularity, err)
+		}
+		for key, hostStats := range records {
+			dump.Hosts[key] = hostStats
+		}
+	}
+
+	_, users, err := store.GetUserStats(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export user stats: %w", err)
+	}
+	dump.Users = users
+	return dump, nil
+}
+
+// Import loads every record of dump into store, merging with existing
+// records when merge is set. It returns the number of records written.
+func Import(store StatsStore, dump *Dump, merge bool) (int, error) {
+	importer, ok := store.(Importer)
+	if !ok {
+		return 0, ErrImportUnsupported
+	}
+	if dump.Version != dumpVersion {
+		return 0, fmt.Errorf("unsupported dump version %d", dump.Version)
+	}
+
+	imported := 0
+	for key, hostStats := range dump.Hosts {
+		if rk, ok := parseRecordKey(key); !ok || rk.kind != "HOST" {
+			return imported, fmt.Errorf("invalid host record key %q", key)
+		}
+		if err := importer.ImportHost(key, hostStats, merge); err != nil {
+			return imported, fmt.Errorf("failed to import %s: %w", key, err)
+		}
+		imported++
+	}
+	for key, userStats := range dump.Users {
+		if rk, ok := parseRecordKey(key); !ok || rk.kind != "USER" {
+			return imported, fmt.Errorf("invalid user record key %q", key)
+		}
+		if err := importer.ImportUser(key, userStats, merge); err != nil {
+			return imported, fmt.Errorf("failed to import %s: %w", key, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// WriteDump writes dump as gzipped JSON
+func WriteDump(w io.Writer, dump *Dump) error {
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(dump); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadDump reads a dump written by WriteDump; plain JSON is accepted too
+func ReadDump(r io.Reader) (*Dump, error) {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	var dump Dump
+	if err := json.NewDecoder(src).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("invalid stats dump: %w", err)
+	}
+	return &dump, nil
+}
+
+// recordTTL returns the retention of the record behind key
+func recordTTL(key string) time.Duration {
+	if rk, ok := parseRecordKey(key); ok && rk.hourly {
+		return hourlyTTL
+	}
+	return dailyTTL
+}
+
+// mergeHostStats adds the counters of src to dst
+func mergeHostStats(dst *stats.HostStats, src stats.HostStats) {
+	dst.Connections += src.Connections
+	dst.RequestCount += src.RequestCount
+	dst.BlockedAttempts += src.BlockedAttempts
+	dst.BytesTransferred += src.BytesTransferred
+	dst.Blocked = dst.Blocked || src.Blocked
+	if src.LastSeen.After(dst.LastSeen) {
+		dst.LastSeen = src.LastSeen
+	}
+	if dst.IPs == "" || dst.IPs == "unknown" {
+		dst.IPs = src.IPs
+	}
+}
+
+// mergeUserStats adds the counters of src to dst
+func mergeUserStats(dst *stats.UserStats, src stats.UserStats) {
+	dst.RequestCount += src.RequestCount
+	dst.BlockedAttempts += src.BlockedAttempts
+	dst.BytesTransferred += src.BytesTransferred
+	if src.LastSeen.After(dst.LastSeen) {
+		dst.LastSeen = src.LastSeen
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+
+	"go-proxy/internal/stats"
+)
+
+// Compile-time checks that every backend can load dumps
+var (
+	_ Importer = (*RedisStore)(nil)
+	_ Importer = (*MemoryStore)(nil)
+	_ Importer = (*BoltStore)(nil)
+	_ Importer = (*PostgresStore)(nil)
+)
+
+// ImportHost implements Importer
+func (s *RedisStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	if merge {
+		var existing stats.HostStats
+		found, err := s.getJSON(key, &existing)
+		if err != nil {
+			return err
+		}
+		if found {
+			mergeHostStats(&existing, hostStats)
+			hostStats = existing
+		}
+	}
+	return s.setJSON(key, hostStats)
+}
+
+// ImportUser implements Importer
+func (s *RedisStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	if merge {
+		var existing stats.UserStats
+		found, err := s.getJSON(key, &existing)
+		if err != nil {
+			return err
+		}
+		if found {
+			mergeUserStats(&existing, userStats)
+			userStats = existing
+		}
+	}
+	return s.setJSON(key, userStats)
+}
+
+func (s *RedisStore) getJSON(key string, v interface{}) (bool, error) {
+	val, err := s.get(key)
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(val), v); err != nil {
+		return false, fmt.Errorf("failed to unmarshal stats for key %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *RedisStore) setJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stats for key %s: %w", key, err)
+	}
+	return s.set(key, data, recordTTL(key))
+}
+
+// ImportHost implements Importer
+func (m *MemoryStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.hosts[key]
+	if merge && ok && now.Before(entry.expires) {
+		mergeHostStats(&entry.stats, hostStats)
+	} else {
+		entry.stats = hostStats
+	}
+	entry.expires = now.Add(recordTTL(key))
+	m.hosts[key] = entry
+	return nil
+}
+
+// ImportUser implements Importer
+func (m *MemoryStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := m.users[key]
+	if merge && ok && now.Before(entry.expires) {
+		mergeUserStats(&entry.stats, userStats)
+	} else {
+		entry.stats = userStats
+	}
+	entry.expires = now.Add(recordTTL(key))
+	m.users[key] = entry
+	return nil
+}
+
+// ImportHost implements Importer
+func (s *BoltStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if merge {
+			var existing stats.HostStats
+			found, err := getRecord(bucket, key, now, &existing)
+			if err != nil {
+				return err
+			}
+			if found {
+				mergeHostStats(&existing, hostStats)
+				hostStats = existing
+			}
+		}
+		return putRecord(bucket, key, now.Add(recordTTL(key)), hostStats)
+	})
+}
+
+// ImportUser implements Importer
+func (s *BoltStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if merge {
+			var existing stats.UserStats
+			found, err := getRecord(bucket, key, now, &existing)
+			if err != nil {
+				return err
+			}
+			if found {
+				mergeUserStats(&existing, userStats)
+				userStats = existing
+			}
+		}
+		return putRecord(bucket, key, now.Add(recordTTL(key)), userStats)
+	})
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// lazyRetryInterval is how often a LazyStore retries connecting
+const lazyRetryInterval = 5 * time.Second
+
+// ErrUnavailable is returned while there is no stats backend to talk to,
+// either because it hasn't been reached yet or because stats are disabled
+var ErrUnavailable = errors.New("stats backend unavailable")
+
+// LazyStore connects to its backend in the background so the proxy can
+// serve traffic before the backend is reachable (e.g. when Redis sits
+// behind the proxy host). Until then every call fails with ErrUnavailable;
+// wrap it in a BufferedStore to keep the writes.
+type LazyStore struct {
+	name string
+	open func() (StatsStore, error)
+
+	mutex sync.RWMutex
+	store StatsStore
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Compile-time checks that the stand-in stores satisfy StatsStore
+var (
+	_ StatsStore = (*LazyStore)(nil)
+	_ Importer   = (*LazyStore)(nil)
+	_ StatsStore = NoStore{}
+)
+
+// NewLazyStore starts connecting with open, retrying until it succeeds.
+// name is used in log messages.
+func NewLazyStore(name string, open func() (StatsStore, error)) *LazyStore {
+	l := &LazyStore{
+		name: name,
+		open: open,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.connectLoop()
+	return l
+}
+
+// RecordHostActivity implements StatsStore
+func (l *LazyStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	store, err := l.backend()
+	if err != nil {
+		return err
+	}
+	return store.RecordHostActivity(host, blocked, bytesTransferred)
+}
+
+// RecordUserActivity implements StatsStore
+func (l *LazyStore) RecordUserActivity(delta stats.UserStats) error {
+	store, err := l.backend()
+	if err != nil {
+		return err
+	}
+	return store.RecordUserActivity(delta)
+}
+
+// GetDailyStats implements StatsStore
+func (l *LazyStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+	store, err := l.backend()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetDailyStats(fromDate, toDate, hostFilter, granularity)
+}
+
+// GetHourlyStats implements StatsStore
+func (l *LazyStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	store, err := l.backend()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetHourlyStats(date, fromHour, toHour)
+}
+
+// GetUserStats implements StatsStore
+func (l *LazyStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	store, err := l.backend()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetUserStats(fromDate, toDate)
+}
+
+// GetUserHourlyStats implements StatsStore
+func (l *LazyStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	store, err := l.backend()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetUserHourlyStats(fromDate, toDate)
+}
+
+// ImportHost implements Importer
+func (l *LazyStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	importer, err := l.importer()
+	if err != nil {
+		return err
+	}
+	return importer.ImportHost(key, hostStats, merge)
+}
+
+// ImportUser implements Importer
+func (l *LazyStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	importer, err := l.importer()
+	if err != nil {
+		return err
+	}
+	return importer.ImportUser(key, userStats, merge)
+}
+
+// DisplayAllHostStats forwards to the backend once connected
+func (l *LazyStore) DisplayAllHostStats() {
+	store, err := l.backend()
+	if err != nil {
+		return
+	}
+	if display, ok := store.(interface{ DisplayAllHostStats() }); ok {
+		display.DisplayAllHostStats()
+	}
+}
+
+// Close stops connecting and closes the backend if it was reached
+func (l *LazyStore) Close() error {
+	close(l.stop)
+	<-l.done
+	store, err := l.backend()
+	if err != nil {
+		return nil
+	}
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (l *LazyStore) backend() (StatsStore, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.store == nil {
+		return nil, ErrUnavailable
+	}
+	return l.store, nil
+}
+
+func (l *LazyStore) importer() (Importer, error) {
+	store, err := l.backend()
+	if err != nil {
+		return nil, err
+	}
+	importer, ok := store.(Importer)
+	if !ok {
+		return nil, ErrImportUnsupported
+	}
+	return importer, nil
+}
+
+func (l *LazyStore) connectLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(lazyRetryInterval)
+	defer ticker.Stop()
+
+	for attempt := 1; ; attempt++ {
+		store, err := l.open()
+		if err == nil {
+			l.mutex.Lock()
+			l.store = store
+			l.mutex.Unlock()
+			logger.Info("Connected to stats backend %s after %d attempt(s)", l.name, attempt)
+			return
+		}
+		if attempt == 1 {
+			logger.Warn("Stats backend %s unavailable, retrying every %v: %v", l.name, lazyRetryInterval, err)
+		} else {
+			logger.Debug("Stats backend %s still unavailable: %v", l.name, err)
+		}
+
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NoStore is the stats backend of -storage=none: writes are discarded and
+// queries fail with ErrUnavailable
+type NoStore struct{}
+
+// RecordHostActivity implements StatsStore
+func (NoStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	return nil
+}
+
+// RecordUserActivity implements StatsStore
+func (NoStore) RecordUserActivity(delta stats.UserStats) error {
+	return nil
+}
+
+// GetDailyStats implements StatsStore
+func (NoStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+	return nil, nil, ErrUnavailable
+}
+
+// GetHourlyStats implements StatsStore
+func (NoStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	return nil, nil, ErrUnavailable
+}
+
+// GetUserStats implements StatsStore
+func (NoStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return nil, nil, ErrUnavailable
+}
+
+// GetUserHourlyStats implements StatsStore
+func (NoStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return nil, nil, ErrUnavailable
+}
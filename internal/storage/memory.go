@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go-proxy/internal/stats"
+)
+
+// memorySweepInterval is how often expired records are dropped
+const memorySweepInterval = time.Minute
+
+// MemoryStore keeps stats in process memory with the same keys and
+// retention as RedisStore. Everything is lost on restart, so it is meant
+// for development and tests.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	hosts     map[string]memoryHost
+	users     map[string]memoryUser
+	lastSweep time.Time
+}
+
+type memoryHost struct {
+	stats   stats.HostStats
+	expires time.Time
+}
+
+type memoryUser struct {
+	stats   stats.UserStats
+	expires time.Time
+}
+
+// Compile-time check that MemoryStore satisfies StatsStore
+var _ StatsStore = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		hosts:     make(map[string]memoryHost),
+		users:     make(map[string]memoryUser),
+		lastSweep: time.Now(),
+	}
+}
+
+// RecordHostActivity implements StatsStore
+func (m *MemoryStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	if host == "" {
+		return fmt.Errorf("invalid host: empty")
+	}
+	host = cleanHost(host)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	m.sweepLocked(now)
+
+	hourKey, dayKey := hostKeys(host, now)
+	for _, period := range []struct {
+		key string
+		ttl time.Duration
+	}{{hourKey, hourlyTTL}, {dayKey, dailyTTL}} {
+		entry, ok := m.hosts[period.key]
+		if ok && now.Before(entry.expires) {
+			addHostActivity(&entry.stats, blocked, bytesTransferred)
+		} else {
+			entry.stats = newHostStats(host, blocked, bytesTransferred)
+		}
+		entry.expires = now.Add(period.ttl)
+		m.hosts[period.key] = entry
+	}
+	return nil
+}
+
+// RecordUserActivity implements StatsStore
+func (m *MemoryStore) RecordUserActivity(delta stats.UserStats) error {
+	if delta.User == "" {
+		return fmt.Errorf("invalid user: empty")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	hourKey, dayKey := userKeys(delta.User, now)
+	for _, period := range []struct {
+		key string
+		ttl time.Duration
+	}{{hourKey, hourlyTTL}, {dayKey, dailyTTL}} {
+		entry, ok := m.users[period.key]
+		if !ok || now.After(entry.expires) {
+			entry.stats = stats.UserStats{User: delta.User}
+		}
+		addUserActivity(&entry.stats, delta)
+		entry.expires = now.Add(period.ttl)
+		m.users[period.key] = entry
+	}
+	return nil
+}
+
+// GetDailyStats implements StatsStore
+func (m *MemoryStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+	hourly := granularity == "hour"
+	return m.selectHosts(func(rk recordKey) bool {
+		return rk.hourly == hourly &&
+			strings.Contains(rk.name, hostFilter) &&
+			rk.inRange(fromDate, toDate)
+	})
+}
+
+// GetHourlyStats implements StatsStore
+func (m *MemoryStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	day := date.Format("2006-01-02")
+	return m.selectHosts(func(rk recordKey) bool {
+		return rk.hourly &&
+			rk.date.Format("2006-01-02") == day &&
+			rk.hour >= fromHour && rk.hour <= toHour
+	})
+}
+
+// GetUserStats implements StatsStore
+func (m *MemoryStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return m.selectUsers(false, fromDate, toDate)
+}
+
+// GetUserHourlyStats implements StatsStore
+func (m *MemoryStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return m.selectUsers(true, fromDate, toDate)
+}
+
+// selectUsers returns the live hourly or daily user records in the date
+// range
+func (m *MemoryStore) selectUsers(hourly bool, fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	var keys []string
+	records := make(map[string]stats.UserStats)
+	for key, entry := range m.users {
+		rk, ok := parseRecordKey(key)
+		if !ok || rk.hourly != hourly || !rk.inRange(fromDate, toDate) || now.After(entry.expires) {
+			continue
+		}
+		keys = append(keys, key)
+		records[key] = entry.stats
+	}
+	return keys, records, nil
+}
+
+// selectHosts returns the live host records whose key matches
+func (m *MemoryStore) selectHosts(match func(recordKey) bool) ([]string, map[string]stats.HostStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	var keys []string
+	records := make(map[string]stats.HostStats)
+	for key, entry := range m.hosts {
+		rk, ok := parseRecordKey(key)
+		if !ok || now.After(entry.expires) || !match(rk) {
+			continue
+		}
+		keys = append(keys, key)
+		records[key] = entry.stats
+	}
+	return keys, records, nil
+}
+
+// sweepLocked drops expired records at most once per sweep interval.
+// Callers must hold mutex.
+func (m *MemoryStore) sweepLocked(now time.Time) {
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, entry := range m.hosts {
+		if now.After(entry.expires) {
+			delete(m.hosts, key)
+		}
+	}
+	for key, entry := range m.users {
+		if now.After(entry.expires) {
+			delete(m.users, key)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// schemaKey holds the version of the last migration applied to the stats
+// records in Redis
+const schemaKey = "SCHEMA:version"
+
+// migrateBatch is the SCAN page size and progress interval of a migration
+const migrateBatch = 1000
+
+// Migration upgrades the stats records in Redis one key at a time. Apply
+// gets the physical (possibly prefixed) key and must be idempotent, and
+// must not write when dryRun is set; it reports whether the key needed (or
+// got) an upgrade.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(s *RedisStore, key string, rk recordKey, dryRun bool) (bool, error)
+}
+
+// Migrations lists every schema upgrade in version order
+var Migrations = []Migration{
+	{1, "Apply the retention policy to records with a missing or longer TTL", migrateRetention},
+	{2, "Fill in host, user and IP fields missing from old records", migrateFields},
+	{3, "Fill in the country of host records from the geolocation cache", migrateCountry},
+}
+
+// MigrationProgress reports how far a migration has got
+type MigrationProgress struct {
+	Version  int
+	Scanned  int // Keys examined
+	Upgraded int // Keys that needed an upgrade
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for
+// a database that has never been migrated
+func (s *RedisStore) SchemaVersion() (int, error) {
+	val, err := s.get(schemaKey)
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// Migrate applies the migrations newer than the stored schema version to
+// every HOST:* and USER:* key, recording the new version after each one.
+// With dryRun nothing is written and the counts show what would change.
+// progress, if set, is called periodically and after each migration.
+func (s *RedisStore) Migrate(dryRun bool, progress func(MigrationProgress)) ([]MigrationProgress, error) {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	var results []MigrationProgress
+	for _, m := range Migrations {
+		if m.Version <= current {
+			continue
+		}
+		logger.Info("Applying stats schema migration %d: %s (dry run: %t)", m.Version, m.Description, dryRun)
+
+		p := MigrationProgress{Version: m.Version}
+		for _, pattern := range []string{"HOST:*", "USER:*"} {
+			err := s.scan(pattern, migrateBatch, func(physical string) error {
+				p.Scanned++
+				if rk, ok := parseRecordKey(s.logical(physical)); ok {
+					upgraded, err := m.Apply(s, physical, rk, dryRun)
+					if err != nil {
+						return fmt.Errorf("migration %d failed on %s: %w", m.Version, physical, err)
+					}
+					if upgraded {
+						p.Upgraded++
+					}
+				}
+				if p.Scanned%migrateBatch == 0 && progress != nil {
+					progress(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return append(results, p), err
+			}
+		}
+
+		if progress != nil {
+			progress(p)
+		}
+		results = append(results, p)
+		if !dryRun {
+			if err := s.set(schemaKey, m.Version, 0); err != nil {
+				return results, fmt.Errorf("failed to record schema version %d: %w", m.Version, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+// migrateRetention sets the expiry of a record to the end of its period
+// plus the retention of its granularity, and deletes records already past
+// it. Records written before the TTLs existed have none.
+func migrateRetention(s *RedisStore, key string, rk recordKey, dryRun bool) (bool, error) {
+	end := rk.date.AddDate(0, 0, 1)
+	retention := dailyTTL
+	if rk.hourly {
+		end = rk.date.Add(time.Duration(rk.hour+1) * time.Hour)
+		retention = hourlyTTL
+	}
+	// Period dates are local wall-clock times
+	end = time.Date(end.Year(), end.Month(), end.Day(), end.Hour(), 0, 0, 0, time.Local)
+	remaining := time.Until(end.Add(retention))
+
+	ttl, err := s.rdb.TTL(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	// -2 means the key expired since the scan
+	if ttl == -2 || (ttl > 0 && ttl <= remaining+time.Hour) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	if remaining <= 0 {
+		return true, s.rdb.Del(ctx, key).Err()
+	}
+	return true, s.rdb.Expire(ctx, key, remaining).Err()
+}
+
+// migrateFields rewrites records that lack the name fields, which older
+// versions left empty, keeping their TTL
+func migrateFields(s *RedisStore, key string, rk recordKey, dryRun bool) (bool, error) {
+	raw, err := s.rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var record interface{}
+	switch rk.kind {
+	case "HOST":
+		var hostStats stats.HostStats
+		if err := json.Unmarshal(raw, &hostStats); err != nil {
+			return false, err
+		}
+		if hostStats.Host != "" && hostStats.IPs != "" {
+			return false, nil
+		}
+		if hostStats.Host == "" {
+			hostStats.Host = rk.name
+		}
+		if hostStats.IPs == "" {
+			hostStats.IPs = "unknown"
+		}
+		record = hostStats
+	case "USER":
+		var userStats stats.UserStats
+		if err := json.Unmarshal(raw, &userStats); err != nil {
+			return false, err
+		}
+		if userStats.User != "" {
+			return false, nil
+		}
+		userStats.User = rk.name
+		record = userStats
+	default:
+		return false, nil
+	}
+
+	if dryRun {
+		return true, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	return true, s.rdb.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true}).Err()
+}
+
+// migrateCountry copies the country code of the host's geolocation record,
+// if there is one, into host records written before records carried it,
+// keeping their TTL
+func migrateCountry(s *RedisStore, key string, rk recordKey, dryRun bool) (bool, error) {
+	if rk.kind != "HOST" {
+		return false, nil
+	}
+	raw, err := s.rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var hostStats stats.HostStats
+	if err := json.Unmarshal(raw, &hostStats); err != nil {
+		return false, err
+	}
+	if hostStats.Country != "" {
+		return false, nil
+	}
+
+	// Geolocation records are kept by the geo package as JSON under
+	// geo:<host>, prefixed or not
+	geoRaw, err := s.get("geo:" + rk.name)
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var location struct {
+		CountryCode string `json:"country_code"`
+	}
+	if json.Unmarshal([]byte(geoRaw), &location) != nil || location.CountryCode == "" {
+		return false, nil
+	}
+
+	if dryRun {
+		return true, nil
+	}
+	hostStats.Country = strings.ToUpper(location.CountryCode)
+	data, err := json.Marshal(hostStats)
+	if err != nil {
+		return false, err
+	}
+	return true, s.rdb.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true}).Err()
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// copyBatch is the SCAN page size used when reading Redis records
+const copyBatch = 500
+
+// importHostSQL stores a whole host record for a period; $10 selects
+// whether an existing row is added to (merge) or replaced
+const importHostSQL = `
+INSERT INTO host_rollups AS r
+	(host_id, granularity, period_start, connections, requests, blocked_attempts, bytes, blocked, last_seen)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (host_id, granularity, period_start) DO UPDATE SET
+	connections      = EXCLUDED.connections + CASE WHEN $10 THEN r.connections ELSE 0 END,
+	requests         = EXCLUDED.requests + CASE WHEN $10 THEN r.requests ELSE 0 END,
+	blocked_attempts = EXCLUDED.blocked_attempts + CASE WHEN $10 THEN r.blocked_attempts ELSE 0 END,
+	bytes            = EXCLUDED.bytes + CASE WHEN $10 THEN r.bytes ELSE 0 END,
+	blocked          = EXCLUDED.blocked OR ($10 AND r.blocked),
+	last_seen        = CASE WHEN $10 THEN GREATEST(r.last_seen, EXCLUDED.last_seen) ELSE EXCLUDED.last_seen END`
+
+// importClientSQL does the same for a client record; $8 selects merging
+const importClientSQL = `
+INSERT INTO client_rollups AS r
+	(client_id, granularity, period_start, requests, blocked_attempts, bytes, last_seen)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (client_id, granularity, period_start) DO UPDATE SET
+	requests         = EXCLUDED.requests + CASE WHEN $8 THEN r.requests ELSE 0 END,
+	blocked_attempts = EXCLUDED.blocked_attempts + CASE WHEN $8 THEN r.blocked_attempts ELSE 0 END,
+	bytes            = EXCLUDED.bytes + CASE WHEN $8 THEN r.bytes ELSE 0 END,
+	last_seen        = CASE WHEN $8 THEN GREATEST(r.last_seen, EXCLUDED.last_seen) ELSE EXCLUDED.last_seen END`
+
+// CopyToPostgres copies every host and user record in Redis into dst.
+// Rows for the same period are overwritten, so the copy can be rerun
+// safely, e.g. once more right before switching the proxy over. progress,
+// if set, is called with the running count after each batch.
+func (s *RedisStore) CopyToPostgres(dst *PostgresStore, progress func(copied int)) (int, error) {
+	copied := 0
+	for _, pattern := range []string{"HOST:*", "USER:*"} {
+		err := s.scan(pattern, copyBatch, func(physical string) error {
+			key := s.logical(physical)
+			rk, ok := parseRecordKey(key)
+			if !ok {
+				logger.Debug("Skipping malformed key %s", physical)
+				return nil
+			}
+			val, err := s.rdb.Get(ctx, physical).Bytes()
+			if err != nil {
+				// Expired since the scan
+				return nil
+			}
+			if err := copyRecord(dst, key, rk.kind, val); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", physical, err)
+			}
+			copied++
+			if copied%copyBatch == 0 && progress != nil {
+				progress(copied)
+			}
+			return nil
+		})
+		if err != nil {
+			return copied, err
+		}
+	}
+	if progress != nil {
+		progress(copied)
+	}
+	return copied, nil
+}
+
+// copyRecord decodes a raw Redis record and stores it in dst
+func copyRecord(dst *PostgresStore, key, kind string, raw []byte) error {
+	if kind == "USER" {
+		var userStats stats.UserStats
+		if err := json.Unmarshal(raw, &userStats); err != nil {
+			return err
+		}
+		return dst.ImportUser(key, userStats, false)
+	}
+	var hostStats stats.HostStats
+	if err := json.Unmarshal(raw, &hostStats); err != nil {
+		return err
+	}
+	return dst.ImportHost(key, hostStats, false)
+}
+
+// ImportHost implements Importer
+func (s *PostgresStore) ImportHost(key string, hostStats stats.HostStats, merge bool) error {
+	rk, ok := parseRecordKey(key)
+	if !ok {
+		return fmt.Errorf("invalid record key %q", key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	hostID, err := s.hostID(ctx, rk.name, hostStats.IPs)
+	if err != nil {
+		return err
+	}
+	granularity, period := rk.period()
+	_, err = s.db.ExecContext(ctx, importHostSQL, hostID, granularity, period,
+		hostStats.Connections, hostStats.RequestCount, hostStats.BlockedAttempts,
+		int64(hostStats.BytesTransferred), hostStats.Blocked, hostStats.LastSeen, merge)
+	return err
+}
+
+// ImportUser implements Importer
+func (s *PostgresStore) ImportUser(key string, userStats stats.UserStats, merge bool) error {
+	rk, ok := parseRecordKey(key)
+	if !ok {
+		return fmt.Errorf("invalid record key %q", key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	clientID, err := s.clientID(ctx, rk.name)
+	if err != nil {
+		return err
+	}
+	granularity, period := rk.period()
+	_, err = s.db.ExecContext(ctx, importClientSQL, clientID, granularity, period,
+		userStats.RequestCount, userStats.BlockedAttempts,
+		int64(userStats.BytesTransferred), userStats.LastSeen, merge)
+	return err
+}
+
+// period returns the rollup granularity and wall-clock start of a record
+func (rk recordKey) period() (string, time.Time) {
+	if rk.hourly {
+		return "hour", rk.date.Add(time.Duration(rk.hour) * time.Hour)
+	}
+	return "day", rk.date
+}
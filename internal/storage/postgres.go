@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq" // Registers the "postgres" driver
+
+	"go-proxy/internal/stats"
+)
+
+// pgTimeout bounds every statement, so a stuck database can't block a
+// stats flush forever
+const pgTimeout = 10 * time.Second
+
+// pgSchema is a normalized layout for SQL analytics: one row per host and
+// client, and per-period rollups for each. Periods are local wall-clock
+// times, matching the dates in the Redis keys. Rows are never expired;
+// prune them with SQL if needed.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS hosts (
+	id         BIGSERIAL PRIMARY KEY,
+	name       TEXT NOT NULL UNIQUE,
+	ips        TEXT NOT NULL DEFAULT 'unknown',
+	first_seen TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS clients (
+	id         BIGSERIAL PRIMARY KEY,
+	name       TEXT NOT NULL UNIQUE,
+	first_seen TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS host_rollups (
+	host_id          BIGINT NOT NULL REFERENCES hosts (id),
+	granularity      TEXT NOT NULL CHECK (granularity IN ('hour', 'day')),
+	period_start     TIMESTAMP NOT NULL,
+	connections      BIGINT NOT NULL,
+	requests         BIGINT NOT NULL,
+	blocked_attempts BIGINT NOT NULL,
+	bytes            BIGINT NOT NULL,
+	blocked          BOOLEAN NOT NULL,
+	last_seen        TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (host_id, granularity, period_start)
+);
+CREATE INDEX IF NOT EXISTS host_rollups_period ON host_rollups (granularity, period_start);
+
+CREATE TABLE IF NOT EXISTS client_rollups (
+	client_id        BIGINT NOT NULL REFERENCES clients (id),
+	granularity      TEXT NOT NULL CHECK (granularity IN ('hour', 'day')),
+	period_start     TIMESTAMP NOT NULL,
+	requests         BIGINT NOT NULL,
+	blocked_attempts BIGINT NOT NULL,
+	bytes            BIGINT NOT NULL,
+	last_seen        TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (client_id, granularity, period_start)
+);
+CREATE INDEX IF NOT EXISTS client_rollups_period ON client_rollups (granularity, period_start);
+`
+
+// recordHostSQL adds one flush to the hourly and daily rollups of a host,
+// with the same counting rules as addHostActivity
+const recordHostSQL = `
+INSERT INTO host_rollups AS r
+	(host_id, granularity, period_start, connections, requests, blocked_attempts, bytes, blocked, last_seen)
+VALUES ($1, 'hour', $2, 1, 1, 0, $4, $5, $6), ($1, 'day', $3, 1, 1, 0, $4, $5, $6)
+ON CONFLICT (host_id, granularity, period_start) DO UPDATE SET
+	connections      = r.connections + 1,
+	requests         = r.requests + 1,
+	blocked_attempts = r.blocked_attempts + CASE WHEN EXCLUDED.blocked THEN 1 ELSE 0 END,
+	bytes            = r.bytes + EXCLUDED.bytes,
+	blocked          = r.blocked OR EXCLUDED.blocked,
+	last_seen        = EXCLUDED.last_seen`
+
+// recordClientSQL adds accumulated counters to a client's rollups
+const recordClientSQL = `
+INSERT INTO client_rollups AS r
+	(client_id, granularity, period_start, requests, blocked_attempts, bytes, last_seen)
+VALUES ($1, 'hour', $2, $4, $5, $6, $7), ($1, 'day', $3, $4, $5, $6, $7)
+ON CONFLICT (client_id, granularity, period_start) DO UPDATE SET
+	requests         = r.requests + EXCLUDED.requests,
+	blocked_attempts = r.blocked_attempts + EXCLUDED.blocked_attempts,
+	bytes            = r.bytes + EXCLUDED.bytes,
+	last_seen        = EXCLUDED.last_seen`
+
+const selectHostsSQL = `
+SELECT h.name, h.ips, r.period_start, r.connections, r.requests, r.blocked_attempts, r.bytes, r.blocked, r.last_seen
+FROM host_rollups r JOIN hosts h ON h.id = r.host_id
+WHERE r.granularity = $1 AND r.period_start >= $2 AND r.period_start < $3 AND strpos(h.name, $4) > 0
+ORDER BY r.period_start, h.name`
+
+const selectClientsSQL = `
+SELECT c.name, r.period_start, r.requests, r.blocked_attempts, r.bytes, r.last_seen
+FROM client_rollups r JOIN clients c ON c.id = r.client_id
+WHERE r.granularity = $1 AND r.period_start >= $2 AND r.period_start < $3
+ORDER BY r.period_start, c.name`
+
+// PostgresStore keeps stats in PostgreSQL for long-term analytics
+type PostgresStore struct {
+	db  *sql.DB
+	ids sync.Map // "host:<name>" / "client:<name>" -> row ID
+}
+
+// Compile-time check that PostgresStore satisfies StatsStore
+var _ StatsStore = (*PostgresStore)(nil)
+
+// NewPostgresStore connects to the database at dsn (a postgres:// URL or
+// key=value string) and creates the schema if needed
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Postgres DSN: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, pgSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create Postgres schema: %w", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// Close releases the connection pool
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// RecordHostActivity implements StatsStore
+func (s *PostgresStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	if host == "" {
+		return fmt.Errorf("invalid host: empty")
+	}
+	host = cleanHost(host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	hostID, err := s.hostID(ctx, host, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	hour, day := periodStarts(now)
+	if _, err := s.db.ExecContext(ctx, recordHostSQL,
+		hostID, hour, day, int64(bytesTransferred), blocked, now); err != nil {
+		return fmt.Errorf("failed to record activity for %s: %w", host, err)
+	}
+	return nil
+}
+
+// RecordUserActivity implements StatsStore
+func (s *PostgresStore) RecordUserActivity(delta stats.UserStats) error {
+	if delta.User == "" {
+		return fmt.Errorf("invalid user: empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	clientID, err := s.clientID(ctx, delta.User)
+	if err != nil {
+		return err
+	}
+	hour, day := periodStarts(time.Now())
+	if _, err := s.db.ExecContext(ctx, recordClientSQL,
+		clientID, hour, day, delta.RequestCount, delta.BlockedAttempts,
+		int64(delta.BytesTransferred), delta.LastSeen); err != nil {
+		return fmt.Errorf("failed to record activity for user %s: %w", delta.User, err)
+	}
+	return nil
+}
+
+// GetDailyStats implements StatsStore
+func (s *PostgresStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+	if granularity != "hour" {
+		granularity = "day"
+	}
+	return s.selectHosts(granularity, wallDay(fromDate), wallDay(toDate).AddDate(0, 0, 1), hostFilter)
+}
+
+// GetHourlyStats implements StatsStore
+func (s *PostgresStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	day := wallDay(date)
+	return s.selectHosts("hour",
+		day.Add(time.Duration(fromHour)*time.Hour),
+		day.Add(time.Duration(toHour+1)*time.Hour), "")
+}
+
+// GetUserStats implements StatsStore
+func (s *PostgresStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers("day", fromDate, toDate)
+}
+
+// GetUserHourlyStats implements StatsStore
+func (s *PostgresStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers("hour", fromDate, toDate)
+}
+
+// selectUsers returns client rollups of granularity in the date range,
+// keyed like the Redis records
+func (s *PostgresStore) selectUsers(granularity string, fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, selectClientsSQL, granularity, wallDay(fromDate), wallDay(toDate).AddDate(0, 0, 1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query user stats: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	records := make(map[string]stats.UserStats)
+	for rows.Next() {
+		var userStats stats.UserStats
+		var period time.Time
+		if err := rows.Scan(&userStats.User, &period, &userStats.RequestCount,
+			&userStats.BlockedAttempts, &userStats.BytesTransferred, &userStats.LastSeen); err != nil {
+			return nil, nil, err
+		}
+		hourKey, key := userKeys(userStats.User, period)
+		if granularity == "hour" {
+			key = hourKey
+		}
+		keys = append(keys, key)
+		records[key] = userStats
+	}
+	return keys, records, rows.Err()
+}
+
+// selectHosts returns host rollups of granularity with a period start in
+// [from, to), keyed like the Redis records
+func (s *PostgresStore) selectHosts(granularity string, from, to time.Time, hostFilter string) ([]string, map[string]stats.HostStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, selectHostsSQL, granularity, from, to, hostFilter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query host stats: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	records := make(map[string]stats.HostStats)
+	for rows.Next() {
+		var hostStats stats.HostStats
+		var period time.Time
+		if err := rows.Scan(&hostStats.Host, &hostStats.IPs, &period, &hostStats.Connections,
+			&hostStats.RequestCount, &hostStats.BlockedAttempts, &hostStats.BytesTransferred,
+			&hostStats.Blocked, &hostStats.LastSeen); err != nil {
+			return nil, nil, err
+		}
+		hourKey, dayKey := hostKeys(hostStats.Host, period)
+		key := dayKey
+		if granularity == "hour" {
+			key = hourKey
+		}
+		keys = append(keys, key)
+		records[key] = hostStats
+	}
+	return keys, records, rows.Err()
+}
+
+// hostID returns the row ID of host, creating the row on first sight. New
+// hosts get ips, or their resolved addresses when ips is empty.
+func (s *PostgresStore) hostID(ctx context.Context, host, ips string) (int64, error) {
+	if id, ok := s.ids.Load("host:" + host); ok {
+		return id.(int64), nil
+	}
+
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM hosts WHERE name = $1`, host).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		if ips == "" {
+			ips = newHostStats(host, false, 0).IPs
+		}
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO hosts (name, ips) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id`, host, ips).Scan(&id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up host %s: %w", host, err)
+	}
+	s.ids.Store("host:"+host, id)
+	return id, nil
+}
+
+// clientID returns the row ID of a proxy user, creating the row if needed
+func (s *PostgresStore) clientID(ctx context.Context, user string) (int64, error) {
+	if id, ok := s.ids.Load("client:" + user); ok {
+		return id.(int64), nil
+	}
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO clients (name) VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id`, user).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to look up user %s: %w", user, err)
+	}
+	s.ids.Store("client:"+user, id)
+	return id, nil
+}
+
+// periodStarts returns the wall-clock starts of the hour and day of t
+func periodStarts(t time.Time) (time.Time, time.Time) {
+	day := wallDay(t)
+	return day.Add(time.Duration(t.Hour()) * time.Hour), day
+}
+
+// wallDay returns midnight of t's date, as a zone-less wall-clock time the
+// way TIMESTAMP columns store it
+func wallDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
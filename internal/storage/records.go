@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+)
+
+// Retention of the per-period records, shared by every StatsStore
+const (
+	hourlyTTL = 15 * 24 * time.Hour // 15 days
+	dailyTTL  = 90 * 24 * time.Hour // 3 months
+)
+
+// maxPooledBuffer is the largest encoding buffer kept for reuse
+const maxPooledBuffer = 64 << 10
+
+// periodNames is the formatted hour and day of the hour starting at start
+type periodNames struct {
+	loc        *time.Location
+	start, end int64 // Unix seconds
+	hour, day  string
+}
+
+// currentPeriod caches the period names of the last hour keys were built
+// for, so that every write in an hour does not format the time again
+var currentPeriod atomic.Pointer[periodNames]
+
+// jsonBuffers are reused for encoding records
+var jsonBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// periodOf returns the hour (2024-03-22-15) and day (2024-03-22) of now
+func periodOf(now time.Time) (string, string) {
+	sec := now.Unix()
+	if p := currentPeriod.Load(); p != nil && p.loc == now.Location() && sec >= p.start && sec < p.end {
+		return p.hour, p.day
+	}
+	year, month, day := now.Date()
+	start := time.Date(year, month, day, now.Hour(), 0, 0, 0, now.Location())
+	p := &periodNames{
+		loc:   now.Location(),
+		start: start.Unix(),
+		end:   start.Add(time.Hour).Unix(),
+		hour:  now.Format("2006-01-02-15"),
+		day:   now.Format("2006-01-02"),
+	}
+	currentPeriod.Store(p)
+	return p.hour, p.day
+}
+
+// hostKeys returns the hourly and daily record keys of host at now
+// (HOST:example.com:HOUR:2024-03-22-15, HOST:example.com:DAY:2024-03-22)
+func hostKeys(host string, now time.Time) (string, string) {
+	hour, day := periodOf(now)
+	return "HOST:" + host + ":HOUR:" + hour, "HOST:" + host + ":DAY:" + day
+}
+
+// userKeys returns the hourly and daily record keys of user at now
+func userKeys(user string, now time.Time) (string, string) {
+	hour, day := periodOf(now)
+	return "USER:" + user + ":HOUR:" + hour, "USER:" + user + ":DAY:" + day
+}
+
+// encodeRecord encodes record as JSON into a pooled buffer, to be handed
+// back with releaseBuffer once written
+func encodeRecord(record interface{}) (*bytes.Buffer, error) {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(record); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	buf.Truncate(buf.Len() - 1) // The newline Encode appends
+	return buf, nil
+}
+
+// releaseBuffer returns a buffer from encodeRecord to the pool
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		jsonBuffers.Put(buf)
+	}
+}
+
+// hostCountry returns the known country code of a host, see SetHostCountry
+var hostCountry atomic.Value // func(string) string
+
+// SetHostCountry makes new and updated host records carry the country code
+// fn returns, so stats queries need no separate geolocation lookup. fn must
+// not block; "" leaves the country to a later write.
+func SetHostCountry(fn func(host string) string) {
+	hostCountry.Store(fn)
+}
+
+// countryOf returns the country code of host, or "" if unknown. Hosts in
+// a tenant namespace (tenant/host) are looked up by their own name.
+func countryOf(host string) string {
+	if fn, ok := hostCountry.Load().(func(string) string); ok {
+		return fn(host[strings.LastIndex(host, "/")+1:])
+	}
+	return ""
+}
+
+// cleanHost strips the port from a host
+func cleanHost(host string) string {
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	return host
+}
+
+// newHostStats creates the record for the first activity of a host in a
+// period, resolving its IP addresses
+func newHostStats(host string, blocked bool, bytesTransferred uint64) stats.HostStats {
+	ips, err := net.LookupHost(host)
+	ipList := "unknown"
+	if err == nil && len(ips) > 0 {
+		ipList = strings.Join(ips, ",")
+	} else {
+		logger.Debug("Could not resolve IPs for host %s", host)
+	}
+
+	return stats.HostStats{
+		Host:             host,
+		IPs:              ipList,
+		Country:          countryOf(host),
+		Connections:      1,
+		RequestCount:     1,
+		BlockedAttempts:  0,
+		BytesTransferred: bytesTransferred,
+		Blocked:          blocked,
+		LastSeen:         time.Now(),
+	}
+}
+
+// addHostActivity merges one flush of activity into an existing record
+func addHostActivity(hostStats *stats.HostStats, blocked bool, bytesTransferred uint64) {
+	hostStats.Connections++
+	hostStats.RequestCount++
+	hostStats.BytesTransferred += bytesTransferred
+	hostStats.LastSeen = time.Now()
+	if hostStats.Country == "" {
+		// The first write may come before the location is known
+		hostStats.Country = countryOf(hostStats.Host)
+	}
+	if blocked {
+		hostStats.BlockedAttempts++
+		hostStats.Blocked = true
+	}
+}
+
+// addUserActivity merges accumulated user counters into a record
+func addUserActivity(userStats *stats.UserStats, delta stats.UserStats) {
+	userStats.RequestCount += delta.RequestCount
+	userStats.BlockedAttempts += delta.BlockedAttempts
+	userStats.BytesTransferred += delta.BytesTransferred
+	userStats.LastSeen = delta.LastSeen
+}
+
+// recordKey is a parsed HOST: or USER: record key
+type recordKey struct {
+	kind   string // HOST or USER
+	name   string // Host or user name
+	hourly bool
+	date   time.Time // Day of the record (UTC midnight)
+	hour   int       // Hour of hourly records
+}
+
+// parseRecordKey splits a record key, reporting false for malformed keys
+func parseRecordKey(key string) (recordKey, bool) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 4 {
+		return recordKey{}, false
+	}
+
+	rk := recordKey{kind: parts[0], name: parts[1], hourly: parts[2] == "HOUR"}
+	period := parts[3]
+	if rk.hourly {
+		idx := strings.LastIndex(period, "-")
+		if idx == -1 {
+			return recordKey{}, false
+		}
+		hour, err := strconv.Atoi(period[idx+1:])
+		if err != nil {
+			return recordKey{}, false
+		}
+		rk.hour = hour
+		period = period[:idx]
+	}
+
+	date, err := time.Parse("2006-01-02", period)
+	if err != nil {
+		return recordKey{}, false
+	}
+	rk.date = date
+	return rk, true
+}
+
+// RecordHour returns the day (UTC midnight) and hour of an hourly record
+// key such as USER:alice:HOUR:2024-03-22-15. Names may contain colons, as
+// IPv6 addresses do.
+func RecordHour(key string) (time.Time, int, bool) {
+	period := key[strings.LastIndex(key, ":")+1:]
+	idx := strings.LastIndex(period, "-")
+	if idx == -1 {
+		return time.Time{}, 0, false
+	}
+	hour, err := strconv.Atoi(period[idx+1:])
+	if err != nil || hour < 0 || hour > 23 {
+		return time.Time{}, 0, false
+	}
+	date, err := time.Parse("2006-01-02", period[:idx])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return date, hour, true
+}
+
+// inRange reports whether the record's day lies within [from, to]
+func (rk recordKey) inRange(from, to time.Time) bool {
+	return !rk.date.Before(from) && !rk.date.After(to)
+}
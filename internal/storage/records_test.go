@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"go-proxy/internal/stats"
+)
+
+func BenchmarkHostKeys(b *testing.B) {
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hostKeys("example.com", now)
+	}
+}
+
+func BenchmarkEncodeRecord(b *testing.B) {
+	record := stats.HostStats{Host: "example.com", IPs: "192.0.2.1", Connections: 1, BytesTransferred: 1500, LastSeen: time.Now()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := encodeRecord(record)
+		if err != nil {
+			b.Fatal(err)
+		}
+		releaseBuffer(buf)
+	}
+}
+
+func BenchmarkRecordHostActivity(b *testing.B) {
+	store := NewMemoryStore()
+	// Addresses rather than names: the first record of a host resolves it
+	hosts := make([]string, 64)
+	for i := range hosts {
+		hosts[i] = "192.0.2." + strconv.Itoa(i)
+		store.RecordHostActivity(hosts[i], false, 0)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.RecordHostActivity(hosts[i%len(hosts)], false, 1500); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecordUserActivity(b *testing.B) {
+	store := NewMemoryStore()
+	delta := stats.UserStats{User: "alice", RequestCount: 1, BytesTransferred: 1500}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.RecordUserActivity(delta); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
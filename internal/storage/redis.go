@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,23 +15,46 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	rdb *redis.Client
-	ctx = context.Background()
-)
+var ctx = context.Background()
+
+// RedisStore keeps host and user stats in Redis
+type RedisStore struct {
+	rdb    *redis.Client
+	prefix string // Prepended to every key, see rediskeys.go
+}
 
-func InitRedis(addr, password string) error {
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       0,
-	})
+// NewRedisStore connects to Redis and verifies the connection
+func NewRedisStore(opts RedisOptions) (*RedisStore, error) {
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisStore{
+		rdb: redis.NewClient(&redis.Options{
+			Addr:      opts.Addr,
+			Username:  opts.Username,
+			Password:  opts.Password,
+			DB:        opts.DB,
+			TLSConfig: tlsConfig,
+		}),
+		prefix: opts.Prefix,
+	}
+	s.rdb.AddHook(latencyHook{})
 
-	return checkConnection()
+	if err := s.checkConnection(); err != nil {
+		s.rdb.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close releases the Redis connection pool
+func (s *RedisStore) Close() error {
+	return s.rdb.Close()
 }
 
-func checkConnection() error {
-	pong, err := rdb.Ping(ctx).Result()
+func (s *RedisStore) checkConnection() error {
+	pong, err := s.rdb.Ping(ctx).Result()
 	if err != nil {
 		return fmt.Errorf("failed to connect to Redis: %v", err)
 	}
@@ -40,119 +62,79 @@ func checkConnection() error {
 	return nil
 }
 
-func RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
-	// Log the incoming request
-	fmt.Printf("\n=== Recording Host Activity ===\n")
-	fmt.Printf("Host: %s\nBlocked: %v\nBytes Transferred: %d\n", host, blocked, bytesTransferred)
+func (s *RedisStore) RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error {
+	if logger.Enabled(logger.LevelDebug) {
+		logger.Debug("Recording host activity: host=%s blocked=%v bytes=%d", host, blocked, bytesTransferred)
+	}
 
 	if host == "" {
-		fmt.Printf("❌ Error: Invalid host (empty)\n")
 		return fmt.Errorf("invalid host: empty")
 	}
 
 	// Clean the host - remove any port number if present
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
-		fmt.Printf("📝 Cleaned host (removed port): %s\n", host)
-	}
+	host = cleanHost(host)
 
 	// Create timeframe-based keys
-	now := time.Now()
-	hourKey := fmt.Sprintf("HOST:%s:HOUR:%s", host, now.Format("2006-01-02-15"))
-	dayKey := fmt.Sprintf("HOST:%s:DAY:%s", host, now.Format("2006-01-02"))
-
-	fmt.Printf("🔑 Hour Key: %s\n", hourKey)
-	fmt.Printf("🔑 Day Key: %s\n", dayKey)
+	hourKey, dayKey := hostKeys(host, time.Now())
 
 	// Handle hourly stats - TTL: 15 days
-	if err := updateHostStats(hourKey, host, blocked, bytesTransferred, 15*24*time.Hour); err != nil {
-		fmt.Printf("❌ Error updating hourly stats: %v\n", err)
+	if err := s.updateHostStats(hourKey, host, blocked, bytesTransferred, hourlyTTL); err != nil {
+		logger.Error("Error updating hourly stats for %s: %v", host, err)
 		return err
 	}
 
 	// Handle daily stats - TTL: 3 months (90 days)
-	if err := updateHostStats(dayKey, host, blocked, bytesTransferred, 90*24*time.Hour); err != nil {
-		fmt.Printf("❌ Error updating daily stats: %v\n", err)
+	if err := s.updateHostStats(dayKey, host, blocked, bytesTransferred, dailyTTL); err != nil {
+		logger.Error("Error updating daily stats for %s: %v", host, err)
 		return err
 	}
 
 	return nil
 }
 
-func updateHostStats(key, host string, blocked bool, bytesTransferred uint64, expiration time.Duration) error {
+func (s *RedisStore) updateHostStats(key, host string, blocked bool, bytesTransferred uint64, expiration time.Duration) error {
 	var hostStats stats.HostStats
-	val, err := rdb.Get(ctx, key).Result()
+	val, err := s.get(key)
 	if err != nil && err != redis.Nil {
-		fmt.Printf("❌ Redis error getting stats for key %s: %v\n", key, err)
 		return err
 	}
 
 	if err == redis.Nil {
-		fmt.Printf("🆕 New stats entry for key: %s\n", key)
-		// For new hosts, try to resolve IP addresses
-		ips, err := net.LookupHost(host)
-		ipList := "unknown"
-		if err == nil && len(ips) > 0 {
-			ipList = strings.Join(ips, ",")
-			fmt.Printf("📍 Resolved IPs: %s\n", ipList)
-		} else {
-			fmt.Printf("⚠️ Could not resolve IPs for host\n")
-		}
-
-		hostStats = stats.HostStats{
-			Host:             host,
-			IPs:              ipList,
-			Connections:      1,
-			RequestCount:     1,
-			BlockedAttempts:  0,
-			BytesTransferred: bytesTransferred,
-			Blocked:          blocked,
-			LastSeen:         time.Now(),
-		}
+		logger.Debug("New stats entry for key: %s", key)
+		hostStats = newHostStats(host, blocked, bytesTransferred)
 	} else {
-		fmt.Printf("🔄 Updating existing stats for key: %s\n", key)
 		if err := json.Unmarshal([]byte(val), &hostStats); err != nil {
-			fmt.Printf("❌ Error unmarshaling stats: %v\n", err)
-			return err
-		}
-
-		hostStats.Connections++
-		hostStats.RequestCount++
-		hostStats.BytesTransferred += bytesTransferred
-		hostStats.LastSeen = time.Now()
-		if blocked {
-			hostStats.BlockedAttempts++
-			hostStats.Blocked = true
+			return fmt.Errorf("failed to unmarshal stats for key %s: %w", key, err)
 		}
+		addHostActivity(&hostStats, blocked, bytesTransferred)
 	}
 
-	data, err := json.Marshal(hostStats)
+	buf, err := encodeRecord(hostStats)
 	if err != nil {
-		fmt.Printf("❌ Error marshaling stats: %v\n", err)
-		return err
+		return fmt.Errorf("failed to marshal stats for key %s: %w", key, err)
 	}
-
-	err = rdb.Set(ctx, key, data, expiration).Err()
+	err = s.set(key, buf.Bytes(), expiration)
+	releaseBuffer(buf)
 	if err != nil {
-		fmt.Printf("❌ Error saving to Redis: %v\n", err)
 		return err
 	}
 
-	fmt.Printf("✅ Successfully updated stats for key: %s\n", key)
-	fmt.Printf("⏰ Expiration: %v\n", expiration)
+	if logger.Enabled(logger.LevelDebug) {
+		logger.Debug("Updated stats for key %s (expires in %v)", key, expiration)
+	}
 	return nil
 }
 
-func GetIPHistory(ip string) ([]stats.IPStats, error) {
+func (s *RedisStore) GetIPHistory(ip string) ([]stats.IPStats, error) {
 	timeframesKey := fmt.Sprintf("IP:%s:timeframes", ip)
-	keys, err := rdb.SMembers(ctx, timeframesKey).Result()
+	keys, err := s.rdb.SMembers(ctx, s.key(timeframesKey)).Result()
 	if err != nil {
 		return nil, err
 	}
 
 	var history []stats.IPStats
 	for _, key := range keys {
-		val, err := rdb.Get(ctx, key).Result()
+		val, err := s.get(key)
 		if err != nil {
 			continue
 		}
@@ -167,18 +149,17 @@ func GetIPHistory(ip string) ([]stats.IPStats, error) {
 	return history, nil
 }
 
-func GetTimeframeData(start, end time.Time) ([]string, map[string]stats.HostStats, error) {
-	fmt.Printf("\n=== Querying Timeframe Data ===\n")
-	fmt.Printf("Start: %v\nEnd: %v\n", start, end)
+func (s *RedisStore) GetTimeframeData(start, end time.Time) ([]string, map[string]stats.HostStats, error) {
+	logger.Debug("Querying timeframe data: %v to %v", start, end)
 
 	// Get all keys matching both hour and day patterns
 	patterns := []string{"HOST:*:HOUR:*", "HOST:*:DAY:*"}
 	var allKeys []string
 
 	for _, pattern := range patterns {
-		keys, err := rdb.Keys(ctx, pattern).Result()
+		keys, err := s.keys(pattern)
 		if err != nil {
-			fmt.Printf("❌ Error getting keys for pattern %s: %v\n", pattern, err)
+			logger.Error("Error getting keys for pattern %s: %v", pattern, err)
 			continue
 		}
 		allKeys = append(allKeys, keys...)
@@ -187,13 +168,13 @@ func GetTimeframeData(start, end time.Time) ([]string, map[string]stats.HostStat
 	var filteredKeys []string
 	records := make(map[string]stats.HostStats)
 
-	fmt.Printf("🔍 Found %d total keys to examine\n", len(allKeys))
+	logger.Debug("Found %d total keys to examine", len(allKeys))
 
 	for _, key := range allKeys {
 		// Extract timestamp from key
 		parts := strings.Split(key, ":")
 		if len(parts) < 4 {
-			fmt.Printf("⚠️ Invalid key format: %s\n", key)
+			logger.Debug("Invalid key format: %s", key)
 			continue
 		}
 
@@ -207,7 +188,7 @@ func GetTimeframeData(start, end time.Time) ([]string, map[string]stats.HostStat
 		}
 
 		if err != nil {
-			fmt.Printf("❌ Error parsing time from key %s: %v\n", key)
+			logger.Debug("Error parsing time from key %s: %v", key, err)
 			continue
 		}
 
@@ -216,96 +197,86 @@ func GetTimeframeData(start, end time.Time) ([]string, map[string]stats.HostStat
 			continue
 		}
 
-		val, err := rdb.Get(ctx, key).Result()
+		val, err := s.get(key)
 		if err != nil {
-			fmt.Printf("❌ Error reading key %s: %v\n", key, err)
+			logger.Warn("Error reading key %s: %v", key, err)
 			continue
 		}
 
 		var stats stats.HostStats
 		if err := json.Unmarshal([]byte(val), &stats); err != nil {
-			fmt.Printf("❌ Error parsing stats for key %s: %v\n", key, err)
+			logger.Warn("Error parsing stats for key %s: %v", key, err)
 			continue
 		}
 
 		filteredKeys = append(filteredKeys, key)
 		records[key] = stats
 
-		fmt.Printf("✅ Added record for key: %s\n", key)
-		fmt.Printf("   Host: %s, Requests: %d, Bytes: %d\n",
-			stats.Host, stats.RequestCount, stats.BytesTransferred)
+		logger.Debug("Added record for key %s: requests=%d bytes=%d",
+			key, stats.RequestCount, stats.BytesTransferred)
 	}
 
-	fmt.Printf("📊 Found %d matching records\n", len(filteredKeys))
-	fmt.Printf("=== End Query ===\n\n")
+	logger.Debug("Found %d matching records", len(filteredKeys))
 
 	return filteredKeys, records, nil
 }
 
-func CheckRedisConnection() error {
-	result, err := rdb.Ping(ctx).Result()
+func (s *RedisStore) CheckRedisConnection() error {
+	result, err := s.rdb.Ping(ctx).Result()
 	if err != nil {
 		return fmt.Errorf("Redis connection error: %v", err)
 	}
-	fmt.Printf("Redis connection test: %s\n", result)
+	logger.Debug("Redis connection test: %s", result)
 	return nil
 }
 
-// Update DisplayAllHostStats to handle both hourly and daily stats
-func DisplayAllHostStats() {
-	fmt.Printf("\n=== Current Redis Host Statistics ===\n")
+// DisplayAllHostStats dumps every hourly and daily record at debug level.
+// It is a no-op unless debug logging is enabled since it reads every key.
+func (s *RedisStore) DisplayAllHostStats() {
+	if !logger.Enabled(logger.LevelDebug) {
+		return
+	}
 
 	// Get all keys matching our pattern
 	patterns := []string{"HOST:*:HOUR:*", "HOST:*:DAY:*"}
 
 	for _, pattern := range patterns {
-		fmt.Printf("\n📊 Checking pattern: %s\n", pattern)
-		keys, err := rdb.Keys(ctx, pattern).Result()
+		keys, err := s.keys(pattern)
 		if err != nil {
-			fmt.Printf("❌ Error getting keys for pattern %s: %v\n", pattern, err)
+			logger.Error("Error getting keys for pattern %s: %v", pattern, err)
 			continue
 		}
 
-		fmt.Printf("📑 Found %d records\n", len(keys))
+		logger.Debug("Host statistics for %s: %d records", pattern, len(keys))
 
 		// Sort keys for consistent display
 		sort.Strings(keys)
 
 		for _, key := range keys {
-			val, err := rdb.Get(ctx, key).Result()
+			val, err := s.get(key)
 			if err != nil {
-				fmt.Printf("❌ Error reading key %s: %v\n", key, err)
+				logger.Warn("Error reading key %s: %v", key, err)
 				continue
 			}
 
 			var stats stats.HostStats
 			if err := json.Unmarshal([]byte(val), &stats); err != nil {
-				fmt.Printf("❌ Error parsing stats for key %s: %v\n", key, err)
+				logger.Warn("Error parsing stats for key %s: %v", key, err)
 				continue
 			}
 
 			// Calculate time since last seen
 			timeSince := time.Since(stats.LastSeen).Round(time.Second)
 
-			fmt.Printf("\n🔑 Key: %s\n", key)
-			fmt.Printf("📊 Statistics:\n")
-			fmt.Printf("   Host: %s\n", stats.Host)
-			fmt.Printf("   IPs: %s\n", stats.IPs)
-			fmt.Printf("   Connections: %d\n", stats.Connections)
-			fmt.Printf("   Requests: %d\n", stats.RequestCount)
-			fmt.Printf("   Bytes Transferred: %d\n", stats.BytesTransferred)
-			fmt.Printf("   Blocked Attempts: %d\n", stats.BlockedAttempts)
-			fmt.Printf("   Blocked Status: %v\n", stats.Blocked)
-			fmt.Printf("   Last Seen: %v (%v ago)\n", stats.LastSeen, timeSince)
-			fmt.Printf("-------------------\n")
+			logger.Debug("%s: host=%s ips=%s connections=%d requests=%d bytes=%d blocked_attempts=%d blocked=%v last_seen=%v (%v ago)",
+				key, stats.Host, stats.IPs, stats.Connections, stats.RequestCount, stats.BytesTransferred,
+				stats.BlockedAttempts, stats.Blocked, stats.LastSeen, timeSince)
 		}
 	}
-
-	fmt.Printf("=== End Statistics ===\n\n")
 }
 
 // GetDailyStats retrieves host statistics for a date range with specified granularity
-func GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
+func (s *RedisStore) GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error) {
 	// Default to day granularity if not specified
 	if granularity == "" {
 		granularity = "day"
@@ -330,19 +301,19 @@ func GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity st
 	var filteredKeys []string
 	records := make(map[string]stats.HostStats)
 
-	keys, err := rdb.Keys(ctx, pattern).Result()
+	keys, err := s.keys(pattern)
 	if err != nil {
-		fmt.Printf("❌ Error getting keys: %v\n", err)
+		logger.Error("Error getting keys: %v", err)
 		return nil, nil, err
 	}
 
-	fmt.Printf("🔍 Found %d total keys to examine with pattern: %s\n", len(keys), pattern)
+	logger.Debug("Found %d total keys to examine with pattern: %s", len(keys), pattern)
 
 	for _, key := range keys {
 		// Extract date from key based on granularity
 		parts := strings.Split(key, ":")
 		if len(parts) != 4 {
-			fmt.Printf("⚠️ Invalid key format: %s\n", key)
+			logger.Debug("Invalid key format: %s", key)
 			continue
 		}
 
@@ -351,7 +322,7 @@ func GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity st
 			// Format: HOST:example.com:HOUR:2024-03-22-15
 			hourParts := strings.Split(parts[3], "-")
 			if len(hourParts) != 4 {
-				fmt.Printf("⚠️ Invalid hour format: %s\n", parts[3])
+				logger.Debug("Invalid hour format: %s", parts[3])
 				continue
 			}
 			dateStr := fmt.Sprintf("%s-%s-%s", hourParts[0], hourParts[1], hourParts[2])
@@ -362,7 +333,7 @@ func GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity st
 		}
 
 		if err != nil {
-			fmt.Printf("❌ Error parsing date from key %s: %v\n", key, err)
+			logger.Debug("Error parsing date from key %s: %v", key, err)
 			continue
 		}
 
@@ -371,68 +342,65 @@ func GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity st
 			continue
 		}
 
-		val, err := rdb.Get(ctx, key).Result()
+		val, err := s.get(key)
 		if err != nil {
-			fmt.Printf("❌ Error reading key %s: %v\n", key, err)
+			logger.Warn("Error reading key %s: %v", key, err)
 			continue
 		}
 
 		var stats stats.HostStats
 		if err := json.Unmarshal([]byte(val), &stats); err != nil {
-			fmt.Printf("❌ Error parsing stats for key %s: %v\n", key, err)
+			logger.Warn("Error parsing stats for key %s: %v", key, err)
 			continue
 		}
 
 		filteredKeys = append(filteredKeys, key)
 		records[key] = stats
 
-		fmt.Printf("✅ Added record for key: %s\n", key)
-		fmt.Printf("   Host: %s, Requests: %d, Bytes: %d\n",
-			stats.Host, stats.RequestCount, stats.BytesTransferred)
+		logger.Debug("Added record for key %s: requests=%d bytes=%d",
+			key, stats.RequestCount, stats.BytesTransferred)
 	}
 
-	fmt.Printf("📊 Found %d matching records\n", len(filteredKeys))
-	fmt.Printf("=== End Query ===\n\n")
+	logger.Debug("Found %d matching records", len(filteredKeys))
 
 	return filteredKeys, records, nil
 }
 
 // GetHourlyStats retrieves host statistics for specific hours in a day
-func GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
-	fmt.Printf("\n=== Querying Hourly Stats ===\n")
-	fmt.Printf("Date: %v\nHours: %02d:00-%02d:00\n",
+func (s *RedisStore) GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error) {
+	logger.Debug("Querying hourly stats: %v %02d:00-%02d:00",
 		date.Format("2006-01-02"), fromHour, toHour)
 
 	pattern := fmt.Sprintf("HOST:*:HOUR:%s-*", date.Format("2006-01-02"))
 	var filteredKeys []string
 	records := make(map[string]stats.HostStats)
 
-	keys, err := rdb.Keys(ctx, pattern).Result()
+	keys, err := s.keys(pattern)
 	if err != nil {
-		fmt.Printf("❌ Error getting keys: %v\n", err)
+		logger.Error("Error getting keys: %v", err)
 		return nil, nil, err
 	}
 
-	fmt.Printf("🔍 Found %d total keys to examine\n", len(keys))
+	logger.Debug("Found %d total keys to examine", len(keys))
 
 	for _, key := range keys {
 		// Extract hour from key (format: HOST:example.com:HOUR:2024-03-22-15)
 		parts := strings.Split(key, ":")
 		if len(parts) != 4 {
-			fmt.Printf("⚠️ Invalid key format: %s\n", key)
+			logger.Debug("Invalid key format: %s", key)
 			continue
 		}
 
 		// Split the date-hour part
 		dateHourParts := strings.Split(parts[3], "-")
 		if len(dateHourParts) != 4 {
-			fmt.Printf("⚠️ Invalid date-hour format: %s\n", parts[3])
+			logger.Debug("Invalid date-hour format: %s", parts[3])
 			continue
 		}
 
 		hour, err := strconv.Atoi(dateHourParts[3])
 		if err != nil {
-			fmt.Printf("❌ Error parsing hour from key %s: %v\n", key, err)
+			logger.Debug("Error parsing hour from key %s: %v", key, err)
 			continue
 		}
 
@@ -441,28 +409,26 @@ func GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]
 			continue
 		}
 
-		val, err := rdb.Get(ctx, key).Result()
+		val, err := s.get(key)
 		if err != nil {
-			fmt.Printf("❌ Error reading key %s: %v\n", key, err)
+			logger.Warn("Error reading key %s: %v", key, err)
 			continue
 		}
 
 		var stats stats.HostStats
 		if err := json.Unmarshal([]byte(val), &stats); err != nil {
-			fmt.Printf("❌ Error parsing stats for key %s: %v\n", key, err)
+			logger.Warn("Error parsing stats for key %s: %v", key, err)
 			continue
 		}
 
 		filteredKeys = append(filteredKeys, key)
 		records[key] = stats
 
-		fmt.Printf("✅ Added record for key: %s\n", key)
-		fmt.Printf("   Host: %s, Hour: %02d:00, Requests: %d, Bytes: %d\n",
-			stats.Host, hour, stats.RequestCount, stats.BytesTransferred)
+		logger.Debug("Added record for key %s: hour=%02d:00 requests=%d bytes=%d",
+			key, hour, stats.RequestCount, stats.BytesTransferred)
 	}
 
-	fmt.Printf("📊 Found %d matching records\n", len(filteredKeys))
-	fmt.Printf("=== End Query ===\n\n")
+	logger.Debug("Found %d matching records", len(filteredKeys))
 
 	return filteredKeys, records, nil
 }
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// clusterChannel is the logical name of the pub/sub channel proxy
+// instances share
+const clusterChannel = "CLUSTER:rules"
+
+// RedisBus broadcasts messages to every proxy instance using the same
+// Redis (and prefix)
+type RedisBus struct {
+	rdb     *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+// NewRedisBus connects to Redis for cluster messages
+func NewRedisBus(opts RedisOptions) (*RedisBus, error) {
+	rdb, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBus{rdb: rdb, channel: opts.Prefix + clusterChannel}, nil
+}
+
+// Publish sends payload to every subscribed instance, this one included
+func (b *RedisBus) Publish(payload []byte) error {
+	return b.rdb.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe calls handler with every message published from now on, one
+// at a time. The subscription survives reconnects; messages published
+// while disconnected are lost.
+func (b *RedisBus) Subscribe(handler func(payload []byte)) {
+	b.pubsub = b.rdb.Subscribe(ctx, b.channel)
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+}
+
+// Close ends the subscription and releases the connection pool
+func (b *RedisBus) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.rdb.Close()
+}
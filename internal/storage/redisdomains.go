@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// domainsKey is the logical key of the sorted set of destination domains
+// scored by when they were first seen, in Unix seconds
+const domainsKey = "DOMAINS:first_seen"
+
+// RedisDomains remembers when each destination domain was first seen,
+// shared by the instances using the same Redis server and prefix
+type RedisDomains struct {
+	rdb *redis.Client
+	key string
+}
+
+// NewRedisDomains connects to Redis for the first-seen times of domains
+func NewRedisDomains(opts RedisOptions) (*RedisDomains, error) {
+	rdb, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisDomains{rdb: rdb, key: opts.Prefix + domainsKey}, nil
+}
+
+// FirstSeen returns when domain was first seen, recording now if it has
+// not been seen before, and whether it was new
+func (d *RedisDomains) FirstSeen(domain string, now time.Time) (time.Time, bool, error) {
+	added, err := d.rdb.ZAddNX(ctx, d.key, redis.Z{Score: float64(now.Unix()), Member: domain}).Result()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if added == 1 {
+		return now, true, nil
+	}
+	score, err := d.rdb.ZScore(ctx, d.key, domain).Result()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(int64(score), 0), false, nil
+}
+
+// Since returns the domains first seen at or after since
+func (d *RedisDomains) Since(since time.Time) (map[string]time.Time, error) {
+	members, err := d.rdb.ZRangeByScoreWithScores(ctx, d.key, &redis.ZRangeBy{
+		Min: strconv.FormatInt(since.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]time.Time, len(members))
+	for _, member := range members {
+		domains[member.Member.(string)] = time.Unix(int64(member.Score), 0)
+	}
+	return domains, nil
+}
+
+// Close releases the connection pool
+func (d *RedisDomains) Close() error {
+	return d.rdb.Close()
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// eventStreamKey is the logical key of the event stream
+const eventStreamKey = "EVENTS"
+
+// Event is a significant proxy event, such as a blocked request
+type Event struct {
+	ID        string    `json:"id"` // Stream entry ID, the cursor to read on from
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"` // connect, block, error, auth, abuse or alert
+	Client    string    `json:"client,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Detail    string    `json:"detail,omitempty"` // Blocking rule, error message or alert
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// RedisEventLog keeps proxy events in a capped Redis stream, so consumers
+// can follow them from a cursor across proxy restarts
+type RedisEventLog struct {
+	rdb    *redis.Client
+	key    string
+	maxLen int64
+}
+
+// NewRedisEventLog connects to Redis for an event stream holding about the
+// last maxLen events
+func NewRedisEventLog(opts RedisOptions, maxLen int64) (*RedisEventLog, error) {
+	rdb, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisEventLog{rdb: rdb, key: opts.Prefix + eventStreamKey, maxLen: maxLen}, nil
+}
+
+// Close releases the Redis connection pool
+func (l *RedisEventLog) Close() error {
+	return l.rdb.Close()
+}
+
+// Append adds event to the stream, trimming the oldest beyond the cap.
+// Redis assigns the ID.
+func (l *RedisEventLog) Append(event Event) error {
+	return l.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: l.key,
+		MaxLen: l.maxLen,
+		Approx: true, // Trimming whole nodes is much cheaper
+		Values: map[string]interface{}{
+			"time":       event.Time.UnixMilli(),
+			"type":       event.Type,
+			"client":     event.Client,
+			"user":       event.User,
+			"host":       event.Host,
+			"detail":     event.Detail,
+			"request_id": event.RequestID,
+		},
+	}).Err()
+}
+
+// Read returns up to limit events after cursor, oldest first; an empty
+// cursor starts at the oldest event kept. With wait > 0 it blocks up to
+// wait for an event if there is none yet.
+func (l *RedisEventLog) Read(rctx context.Context, cursor string, limit int64, wait time.Duration) ([]Event, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	block := time.Duration(-1) // Don't block
+	if wait > 0 {
+		block = wait
+	}
+	streams, err := l.rdb.XRead(rctx, &redis.XReadArgs{
+		Streams: []string{l.key, cursor},
+		Count:   limit,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return []Event{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			events = append(events, parseEvent(message))
+		}
+	}
+	return events, nil
+}
+
+// parseEvent converts a stream entry written by Append
+func parseEvent(message redis.XMessage) Event {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+	event := Event{
+		ID:        message.ID,
+		Type:      field("type"),
+		Client:    field("client"),
+		User:      field("user"),
+		Host:      field("host"),
+		Detail:    field("detail"),
+		RequestID: field("request_id"),
+	}
+	if millis, err := strconv.ParseInt(field("time"), 10, 64); err == nil {
+		event.Time = time.UnixMilli(millis)
+	}
+	return event
+}
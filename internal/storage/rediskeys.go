@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Keys are stored under RedisOptions.Prefix. Records written before a
+// prefix was configured stay readable: reads fall back to the bare key,
+// scans cover both, and the bare key is dropped once the record is
+// rewritten under the prefix.
+
+// key returns the physical key of a logical key such as HOST:...
+func (s *RedisStore) key(logical string) string {
+	return s.prefix + logical
+}
+
+// logical strips the prefix from a physical key
+func (s *RedisStore) logical(physical string) string {
+	return strings.TrimPrefix(physical, s.prefix)
+}
+
+// get reads a logical key, falling back to the unprefixed key
+func (s *RedisStore) get(logical string) (string, error) {
+	val, err := s.rdb.Get(ctx, s.key(logical)).Result()
+	if err == redis.Nil && s.prefix != "" {
+		return s.rdb.Get(ctx, logical).Result()
+	}
+	return val, err
+}
+
+// set writes a logical key and removes its unprefixed predecessor
+func (s *RedisStore) set(logical string, value interface{}, expiration time.Duration) error {
+	if s.prefix == "" {
+		return s.rdb.Set(ctx, logical, value, expiration).Err()
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key(logical), value, expiration)
+		pipe.Del(ctx, logical)
+		return nil
+	})
+	return err
+}
+
+// keys returns the logical keys matching pattern, prefixed or not
+func (s *RedisStore) keys(pattern string) ([]string, error) {
+	physical, err := s.rdb.Keys(ctx, s.key(pattern)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if s.prefix == "" {
+		return physical, nil
+	}
+
+	seen := make(map[string]bool, len(physical))
+	logical := make([]string, 0, len(physical))
+	for _, key := range physical {
+		key = s.logical(key)
+		seen[key] = true
+		logical = append(logical, key)
+	}
+	legacy, err := s.rdb.Keys(ctx, pattern).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range legacy {
+		if !seen[key] {
+			logical = append(logical, key)
+		}
+	}
+	return logical, nil
+}
+
+// scan calls fn with every physical key matching pattern, prefixed or not,
+// without blocking Redis the way KEYS does
+func (s *RedisStore) scan(pattern string, count int64, fn func(physical string) error) error {
+	patterns := []string{s.key(pattern)}
+	if s.prefix != "" {
+		patterns = append(patterns, pattern)
+	}
+	for _, p := range patterns {
+		iter := s.rdb.Scan(ctx, 0, p, count).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// leaseKeyPrefix is the logical key prefix of job leases
+const leaseKeyPrefix = "LEASE:"
+
+// holdLease takes the lease in KEYS[1] for ARGV[1] if it is free, or
+// renews it if ARGV[1] holds it already, for ARGV[2] milliseconds
+var holdLease = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseLease deletes the lease in KEYS[1] if ARGV[1] holds it
+var releaseLease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisLeases elects, per job, the one instance among those sharing a
+// Redis server and prefix that runs it. A lease lapses when its holder
+// stops renewing it, and the next instance asking takes it over.
+type RedisLeases struct {
+	rdb    *redis.Client
+	prefix string
+	id     string // This instance
+}
+
+// NewRedisLeases connects to Redis for job leases
+func NewRedisLeases(opts RedisOptions) (*RedisLeases, error) {
+	rdb, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &RedisLeases{rdb: rdb, prefix: opts.Prefix + leaseKeyPrefix, id: hex.EncodeToString(id)}, nil
+}
+
+// Hold reports whether this instance holds the lease on job, taking it if
+// it is free. A held lease is renewed for ttl, which should outlast the
+// interval at which the job asks.
+func (l *RedisLeases) Hold(job string, ttl time.Duration) (bool, error) {
+	held, err := holdLease.Run(ctx, l.rdb, []string{l.prefix + job}, l.id, ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+// Release gives up the lease on job if this instance holds it
+func (l *RedisLeases) Release(job string) error {
+	return releaseLease.Run(ctx, l.rdb, []string{l.prefix + job}, l.id).Err()
+}
+
+// Close releases the connection pool
+func (l *RedisLeases) Close() error {
+	return l.rdb.Close()
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStats summarises the commands sent to Redis since startup by every
+// client of the package
+type RedisStats struct {
+	Commands     int64   `json:"commands"` // Pipelines count once
+	Errors       int64   `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+}
+
+// redisMetrics counts commands and their latency
+var redisMetrics struct {
+	commands atomic.Int64
+	errors   atomic.Int64
+	nanos    atomic.Int64
+	maxNanos atomic.Int64
+}
+
+// RedisCommandStats returns the Redis command counters
+func RedisCommandStats() RedisStats {
+	stats := RedisStats{
+		Commands:     redisMetrics.commands.Load(),
+		Errors:       redisMetrics.errors.Load(),
+		MaxLatencyMs: float64(redisMetrics.maxNanos.Load()) / 1e6,
+	}
+	if stats.Commands > 0 {
+		stats.AvgLatencyMs = float64(redisMetrics.nanos.Load()) / float64(stats.Commands) / 1e6
+	}
+	return stats
+}
+
+// observeRedis counts a command, or pipeline, that took d
+func observeRedis(d time.Duration, err error) {
+	redisMetrics.commands.Add(1)
+	redisMetrics.nanos.Add(int64(d))
+	if err != nil && err != redis.Nil {
+		redisMetrics.errors.Add(1)
+	}
+	for {
+		longest := redisMetrics.maxNanos.Load()
+		if int64(d) <= longest || redisMetrics.maxNanos.CompareAndSwap(longest, int64(d)) {
+			return
+		}
+	}
+}
+
+// latencyHook times every command a client sends
+type latencyHook struct{}
+
+func (latencyHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (latencyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(time.Since(start), err)
+		return err
+	}
+}
+
+func (latencyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis(time.Since(start), err)
+		return err
+	}
+}
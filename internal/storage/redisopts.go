@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisOptions describes how to reach Redis. It is shared by the stats
+// store, the geolocation cache and the command line tools.
+type RedisOptions struct {
+	Addr     string
+	Username string // ACL user; empty uses the default user
+	Password string
+	DB       int    // Database index
+	Prefix   string // Namespace for every key, e.g. "proxy:"
+	TLS      bool   // Connect over TLS (implied by the file options)
+	CAFile   string // CA bundle to verify the server (default: system roots)
+	CertFile string // Client certificate for mutual TLS
+	KeyFile  string // Key of CertFile
+}
+
+// RegisterFlags adds the Redis connection flags to fs, for the tools that
+// don't load the full proxy configuration
+func (o *RedisOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Addr, "redis-addr", "localhost:6379", "Redis address")
+	fs.StringVar(&o.Username, "redis-username", "", "Redis ACL username")
+	fs.StringVar(&o.Password, "redis-password", "", "Redis password")
+	fs.IntVar(&o.DB, "redis-db", 0, "Redis database index")
+	fs.StringVar(&o.Prefix, "redis-prefix", "", "Prefix for every Redis key, e.g. \"proxy:\"")
+	fs.BoolVar(&o.TLS, "redis-tls", false, "Connect to Redis over TLS")
+	fs.StringVar(&o.CAFile, "redis-tls-ca", "", "CA bundle for verifying the Redis server")
+	fs.StringVar(&o.CertFile, "redis-tls-cert", "", "Client certificate for Redis mutual TLS")
+	fs.StringVar(&o.KeyFile, "redis-tls-key", "", "Client key for Redis mutual TLS")
+}
+
+// TLSConfig returns the client TLS configuration, or nil when TLS is off
+func (o RedisOptions) TLSConfig() (*tls.Config, error) {
+	if !o.TLS && o.CAFile == "" && o.CertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newRedisClient connects to Redis and checks the connection
+func newRedisClient(opts RedisOptions) (*redis.Client, error) {
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr:      opts.Addr,
+		Username:  opts.Username,
+		Password:  opts.Password,
+		DB:        opts.DB,
+		TLSConfig: tlsConfig,
+	})
+	rdb.AddHook(latencyHook{})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	return rdb, nil
+}
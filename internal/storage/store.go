@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"time"
+
+	"go-proxy/internal/stats"
+)
+
+// StatsStore persists host and user statistics. The proxy writes to it and
+// the API reads from it; RedisStore is the production implementation.
+type StatsStore interface {
+	// RecordHostActivity adds one flush worth of traffic for host
+	RecordHostActivity(host string, blocked bool, bytesTransferred uint64) error
+	// RecordUserActivity adds accumulated counters for a user
+	RecordUserActivity(delta stats.UserStats) error
+	// GetDailyStats returns host records keyed by record ID, for whole days
+	// (granularity "day") or hours ("hour") in the date range
+	GetDailyStats(fromDate, toDate time.Time, hostFilter string, granularity string) ([]string, map[string]stats.HostStats, error)
+	// GetHourlyStats returns host records for an hour range of one day
+	GetHourlyStats(date time.Time, fromHour, toHour int) ([]string, map[string]stats.HostStats, error)
+	// GetUserStats returns daily user records in the date range
+	GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error)
+	// GetUserHourlyStats returns hourly user records in the date range
+	GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error)
+}
+
+// Compile-time check that RedisStore satisfies StatsStore
+var _ StatsStore = (*RedisStore)(nil)
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-proxy/internal/logger"
+	"go-proxy/internal/stats"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RecordUserActivity adds the accumulated counters of a user to the hourly
+// (15 day TTL) and daily (90 day TTL) user records.
+func (s *RedisStore) RecordUserActivity(delta stats.UserStats) error {
+	if delta.User == "" {
+		return fmt.Errorf("invalid user: empty")
+	}
+
+	hourKey, dayKey := userKeys(delta.User, time.Now())
+
+	if err := s.updateUserStats(hourKey, delta, hourlyTTL); err != nil {
+		return err
+	}
+	return s.updateUserStats(dayKey, delta, dailyTTL)
+}
+
+func (s *RedisStore) updateUserStats(key string, delta stats.UserStats, expiration time.Duration) error {
+	userStats := stats.UserStats{User: delta.User}
+
+	val, err := s.get(key)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(val), &userStats); err != nil {
+			return fmt.Errorf("failed to unmarshal user stats for key %s: %w", key, err)
+		}
+	}
+
+	addUserActivity(&userStats, delta)
+
+	buf, err := encodeRecord(userStats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user stats for key %s: %w", key, err)
+	}
+	err = s.set(key, buf.Bytes(), expiration)
+	releaseBuffer(buf)
+	if err != nil {
+		return err
+	}
+
+	if logger.Enabled(logger.LevelDebug) {
+		logger.Debug("Updated user stats for key %s", key)
+	}
+	return nil
+}
+
+// GetUserStats retrieves daily per-user statistics for a date range
+func (s *RedisStore) GetUserStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers("DAY", fromDate, toDate)
+}
+
+// GetUserHourlyStats retrieves hourly per-user statistics for a date range
+func (s *RedisStore) GetUserHourlyStats(fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	return s.selectUsers("HOUR", fromDate, toDate)
+}
+
+// selectUsers reads the user records of period (DAY or HOUR) in the date
+// range
+func (s *RedisStore) selectUsers(period string, fromDate, toDate time.Time) ([]string, map[string]stats.UserStats, error) {
+	keys, err := s.keys("USER:*:" + period + ":*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var filteredKeys []string
+	records := make(map[string]stats.UserStats)
+	for _, key := range keys {
+		// Format: USER:alice:DAY:2024-03-22 or USER:alice:HOUR:2024-03-22-15
+		idx := strings.LastIndex(key, ":")
+		keyDate, err := time.Parse("2006-01-02", key[idx+1:min(idx+11, len(key))])
+		if err != nil {
+			logger.Debug("Invalid user key format: %s", key)
+			continue
+		}
+		if keyDate.Before(fromDate) || keyDate.After(toDate) {
+			continue
+		}
+
+		val, err := s.get(key)
+		if err != nil {
+			logger.Warn("Error reading key %s: %v", key, err)
+			continue
+		}
+
+		var userStats stats.UserStats
+		if err := json.Unmarshal([]byte(val), &userStats); err != nil {
+			logger.Warn("Error parsing stats for key %s: %v", key, err)
+			continue
+		}
+
+		filteredKeys = append(filteredKeys, key)
+		records[key] = userStats
+	}
+
+	return filteredKeys, records, nil
+}
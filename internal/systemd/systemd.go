@@ -0,0 +1,126 @@
+// Package systemd implements socket activation (LISTEN_FDS) and the
+// sd_notify readiness/watchdog protocol without linking libsystemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation, keyed
+// by their FileDescriptorName= (or "fd3", "fd4", ... when unnamed), plus the
+// names in the order systemd passed them. It returns no listeners when the
+// process was not socket activated.
+func Listeners() (map[string]net.Listener, []string, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil, nil
+	}
+
+	var fdNames []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		fdNames = strings.Split(v, ":")
+	}
+
+	listeners := make(map[string]net.Listener, count)
+	order := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(fdNames) && fdNames[i] != "" && fdNames[i] != "unknown" {
+			name = fdNames[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close() // FileListener dups the descriptor
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket activation fd %d (%s): %w", fd, name, err)
+		}
+		listeners[name] = l
+		order = append(order, name)
+	}
+
+	return listeners, order, nil
+}
+
+// Notify sends state (e.g. "READY=1") to the service manager. It reports
+// false without error when not running under systemd with Type=notify.
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+
+	// Abstract namespace sockets are passed with a leading '@'
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("sd_notify dial failed: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("sd_notify write failed: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval configured with WatchdogSec=, or
+// zero when the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog pings the systemd watchdog at half the configured interval
+// for as long as healthy returns true. It does nothing when the watchdog is
+// disabled. Close the returned channel to stop pinging.
+func StartWatchdog(healthy func() bool) chan struct{} {
+	stop := make(chan struct{})
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return stop
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if healthy == nil || healthy() {
+					Notify("WATCHDOG=1")
+				}
+			}
+		}
+	}()
+	return stop
+}
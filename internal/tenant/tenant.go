@@ -0,0 +1,148 @@
+// Package tenant splits one proxy deployment between several teams or
+// customers. A request belongs to the tenant of its user, of one of the
+// user's groups or of the listener port it arrived on; each tenant has its
+// own blacklist, its own namespace in the stats and an API token that only
+// sees that namespace.
+package tenant
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Separator joins a tenant name and a host or user name in stats records
+const Separator = "/"
+
+// Tenant is one entry of the tenants file
+type Tenant struct {
+	Name      string   `json:"name"`
+	Users     []string `json:"users,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Ports     []int    `json:"ports,omitempty"`     // Local listener ports
+	Blacklist string   `json:"blacklist,omitempty"` // File of patterns blocked for this tenant only
+	APIToken  string   `json:"api_token,omitempty"` // Bearer token scoped to this tenant's stats
+}
+
+// Registry maps requests to tenants
+type Registry struct {
+	tenants []*Tenant
+	users   map[string]*Tenant
+	groups  map[string]*Tenant
+	ports   map[int]*Tenant
+}
+
+// Load reads a JSON array of tenants from path
+func Load(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var tenants []*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", path, err)
+	}
+	return New(tenants)
+}
+
+// New indexes tenants. A user, group or port may belong to one tenant only.
+func New(tenants []*Tenant) (*Registry, error) {
+	r := &Registry{
+		tenants: tenants,
+		users:   make(map[string]*Tenant),
+		groups:  make(map[string]*Tenant),
+		ports:   make(map[int]*Tenant),
+	}
+	names := make(map[string]bool)
+	for _, t := range tenants {
+		if t.Name == "" || strings.ContainsAny(t.Name, Separator+": ") {
+			return nil, fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		for _, user := range t.Users {
+			if other, ok := r.users[user]; ok {
+				return nil, fmt.Errorf("user %s is in tenants %s and %s", user, other.Name, t.Name)
+			}
+			r.users[user] = t
+		}
+		for _, group := range t.Groups {
+			if other, ok := r.groups[group]; ok {
+				return nil, fmt.Errorf("group %s is in tenants %s and %s", group, other.Name, t.Name)
+			}
+			r.groups[group] = t
+		}
+		for _, port := range t.Ports {
+			if other, ok := r.ports[port]; ok {
+				return nil, fmt.Errorf("port %d is in tenants %s and %s", port, other.Name, t.Name)
+			}
+			r.ports[port] = t
+		}
+	}
+	return r, nil
+}
+
+// Tenants returns every tenant in file order
+func (r *Registry) Tenants() []*Tenant {
+	return r.tenants
+}
+
+// Resolve returns the tenant of a request by user, then groups, then the
+// local port it arrived on (0 if unknown), or nil if it has none
+func (r *Registry) Resolve(user string, groups []string, port int) *Tenant {
+	if t, ok := r.users[user]; ok && user != "" {
+		return t
+	}
+	for _, group := range groups {
+		if t, ok := r.groups[group]; ok {
+			return t
+		}
+	}
+	return r.ports[port]
+}
+
+// ByToken returns the tenant whose API token is token, or nil
+func (r *Registry) ByToken(token string) *Tenant {
+	for _, t := range r.tenants {
+		if t.APIToken != "" && subtle.ConstantTimeCompare([]byte(t.APIToken), []byte(token)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// Scope returns name in the stats namespace of tenant ("" is the shared
+// namespace)
+func Scope(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + Separator + name
+}
+
+// Unscope splits a stats name into its tenant and the name within it
+func Unscope(scoped string) (string, string) {
+	if tenant, name, ok := strings.Cut(scoped, Separator); ok {
+		return tenant, name
+	}
+	return "", scoped
+}
+
+// contextKey is the context key of the tenant an API request is scoped to
+type contextKey struct{}
+
+// WithTenant returns ctx scoped to tenant
+func WithTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the tenant ctx is scoped to, or nil if unscoped
+func FromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(contextKey{}).(*Tenant)
+	return t
+}
@@ -0,0 +1,161 @@
+// Package upgrade hands listening sockets over to a freshly started copy of
+// the binary so the proxy can be replaced without refusing connections.
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// envInheritFDs names the listeners passed to the child, in fd order from 3
+	envInheritFDs = "GO_PROXY_INHERIT_FDS"
+	// envReadyFD is the pipe the child writes to once it is serving
+	envReadyFD = "GO_PROXY_READY_FD"
+)
+
+const firstFD = 3
+
+// upgraded is set once Inherited finds listeners passed by a parent
+var upgraded bool
+
+// filer is implemented by *net.TCPListener and *net.UnixListener
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherited returns the listeners passed by a parent process during an
+// upgrade, keyed by name. It returns nil when the process was not started
+// by an upgrade.
+func Inherited() (map[string]net.Listener, error) {
+	value := os.Getenv(envInheritFDs)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envInheritFDs)
+	upgraded = true
+
+	listeners := make(map[string]net.Listener)
+	for i, name := range strings.Split(value, ":") {
+		file := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// Upgraded reports whether Inherited found this process was started by an
+// upgrade
+func Upgraded() bool {
+	return upgraded
+}
+
+// Ready tells the parent of an upgrade that this process is serving. It is
+// a no-op when the process was not started by an upgrade.
+func Ready() error {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+
+	pipe := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer pipe.Close()
+	_, err = pipe.Write([]byte{1})
+	return err
+}
+
+// Spawn starts a new instance of the current executable with the same
+// arguments and environment, passing it the given listeners, and waits up
+// to timeout for it to call Ready. names and listeners must be the same
+// length. On success the caller should stop accepting and drain its own
+// connections; on failure the child has been killed and the caller keeps
+// serving.
+func Spawn(names []string, listeners []net.Listener, timeout time.Duration) (*os.Process, error) {
+	if len(names) != len(listeners) {
+		return nil, fmt.Errorf("upgrade: %d names for %d listeners", len(names), len(listeners))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: cannot locate executable: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return nil, fmt.Errorf("upgrade: listener %s cannot be passed on", names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: listener %s: %w", names[i], err)
+		}
+		files = append(files, f)
+	}
+
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		// Never let the child mistake our systemd sockets for its own
+		if strings.HasPrefix(kv, "LISTEN_") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env = append(env,
+		envInheritFDs+"="+strings.Join(names, ":"),
+		envReadyFD+"="+strconv.Itoa(firstFD+len(listeners)))
+
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	}
+	process, err := os.StartProcess(executable, os.Args, attr)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: failed to start %s: %w", executable, err)
+	}
+	readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(readyR, buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return process, nil
+		}
+		// EOF: the child exited (or closed the pipe) before becoming ready
+		process.Kill()
+		process.Wait()
+		return nil, fmt.Errorf("upgrade: new process failed to start: %w", err)
+	case <-time.After(timeout):
+		process.Kill()
+		process.Wait()
+		return nil, fmt.Errorf("upgrade: new process not ready after %v", timeout)
+	}
+}
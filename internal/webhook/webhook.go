@@ -0,0 +1,64 @@
+// Package webhook posts proxy alerts to an HTTP endpoint as JSON:
+//
+//	{"text": "go-proxy alert: exfiltration: ...", "time": "...", "type": "alert", "client": "...", ...}
+//
+// The text field makes the payload usable as a Slack or Mattermost
+// incoming webhook as is.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go-proxy/internal/storage"
+)
+
+// Sender posts alert events to a webhook URL
+type Sender struct {
+	url    string
+	client *http.Client
+}
+
+// payload is the body of a webhook request
+type payload struct {
+	Text string `json:"text"`
+	storage.Event
+}
+
+// Open returns a Sender posting to rawURL
+func Open(rawURL string) (*Sender, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	return &Sender{url: rawURL, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Append posts event if it is an alert
+func (s *Sender) Append(event storage.Event) error {
+	if event.Type != "alert" {
+		return nil
+	}
+	body, err := json.Marshal(payload{Text: "go-proxy alert: " + event.Detail, Event: event})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post alert: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close implements io.Closer; a Sender holds no resources
+func (s *Sender) Close() error {
+	return nil
+}
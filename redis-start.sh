@@ -19,4 +19,4 @@ docker compose ps
 
 # Show how to connect
 echo -e "\nTo connect to Redis:"
-echo "redis-cli -h localhost -p 6379 -a \$REDIS_PASSWORD" 
\ No newline at end of file
+echo "redis-cli -h localhost -p 6379 -a \$PROXY_REDIS_PASSWORD" 
\ No newline at end of file